@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	sstable "stinky-db/db/SSTable"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type options struct {
+	footer  bool
+	index   bool
+	records bool
+	hex     bool
+	stats   bool
+	verify  bool
+}
+
+// dumper prints what it is asked to about tables and counts the problems it
+// finds in them
+type dumper struct {
+	out      io.Writer
+	opts     options
+	problems int
+}
+
+type sizeStats struct {
+	min   int
+	max   int
+	total int
+}
+
+func (s *sizeStats) add(size int, first bool) {
+	if first {
+		s.min = size
+		s.max = size
+	}
+	s.min = min(s.min, size)
+	s.max = max(s.max, size)
+	s.total += size
+}
+
+func (s sizeStats) String() string {
+	return fmt.Sprintf("min %d, max %d, total %d", s.min, s.max, s.total)
+}
+
+type tableStats struct {
+	records    int
+	keys       int
+	tombstones int
+	minSeq     uint64
+	maxSeq     uint64
+	keySizes   sizeStats
+	valueSizes sizeStats
+}
+
+func (d *dumper) problem(format string, args ...any) {
+	d.problems += 1
+	fmt.Fprintf(d.out, "PROBLEM: "+format+"\n", args...)
+}
+
+// escape makes keys and values safe to print, with -hex every byte outside
+// of printable ASCII is written as \xNN
+func (d *dumper) escape(s string) string {
+	if d.opts.hex {
+		buf := strings.Builder{}
+		for i := 0; i < len(s); i += 1 {
+			c := s[i]
+			switch {
+			case c == '\\':
+				buf.WriteString(`\\`)
+			case c >= 0x20 && c < 0x7f:
+				buf.WriteByte(c)
+			default:
+				fmt.Fprintf(&buf, `\x%02x`, c)
+			}
+		}
+		return buf.String()
+	}
+
+	if !utf8.ValidString(s) || strings.IndexFunc(s, func(c rune) bool { return !unicode.IsPrint(c) }) >= 0 {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+func (d *dumper) dump(path string) {
+	fmt.Fprintf(d.out, "== %s\n", path)
+
+	table, err := sstable.GenerateFromDisk(path)
+	if err != nil {
+		d.problem("could not open table: %v", err)
+		return
+	}
+
+	if d.opts.footer {
+		d.printFooter(&table)
+	}
+
+	if d.opts.index {
+		d.printIndex(&table)
+	}
+
+	if !d.opts.records && !d.opts.stats && !d.opts.verify {
+		return
+	}
+
+	stats := d.readRecords(&table)
+
+	if d.opts.stats {
+		d.printStats(&table, stats)
+	}
+}
+
+func (d *dumper) printFooter(table *sstable.Table) {
+	fileIdx := table.FileIndex
+	size := int64(-1)
+	if info, err := os.Stat(table.FilePath); err == nil {
+		size = info.Size()
+	}
+
+	fmt.Fprintln(d.out, "footer:")
+	fmt.Fprintf(d.out, "  version      %d\n", fileIdx.Version)
+	fmt.Fprintf(d.out, "  checksummed  %t\n", table.Checksummed())
+	fmt.Fprintf(d.out, "  file size    %d\n", size)
+	fmt.Fprintf(d.out, "  data         offset %d, len %d\n", fileIdx.DataStart, fileIdx.DataLen)
+	fmt.Fprintf(d.out, "  index        offset %d, len %d\n", fileIdx.IndexStart, fileIdx.IndexLen)
+	fmt.Fprintf(d.out, "  meta         offset %d, len %d\n", fileIdx.MetaStart, fileIdx.MetaLen)
+	fmt.Fprintf(d.out, "  bloom        offset %d, len %d\n", fileIdx.BloomStart, fileIdx.BloomLen)
+	fmt.Fprintf(d.out, "  start key    %s\n", d.escape(fileIdx.MinMax.StartKey))
+	fmt.Fprintf(d.out, "  end key      %s\n", d.escape(fileIdx.MinMax.EndKey))
+}
+
+func (d *dumper) printIndex(table *sstable.Table) {
+	if len(table.Blocks) > 0 {
+		fmt.Fprintf(d.out, "index: %d blocks\n", len(table.Blocks))
+		for i, handle := range table.Blocks {
+			fmt.Fprintf(d.out, "  block %d  offset %d, len %d, last key %s\n", i, handle.Offset, handle.Len, d.escape(handle.LastKey))
+		}
+		return
+	}
+
+	// tables in the JSON format have a sparse index of some of their keys instead of blocks
+	keys := make([]string, 0, len(table.SparseIndex))
+	for key := range table.SparseIndex {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return table.SparseIndex[a].Start - table.SparseIndex[b].Start
+	})
+
+	fmt.Fprintf(d.out, "sparse index: %d keys\n", len(keys))
+	for _, key := range keys {
+		entry := table.SparseIndex[key]
+		fmt.Fprintf(d.out, "  %s  offset %d, len %d\n", d.escape(key), entry.Start, entry.Len)
+	}
+}
+
+// readRecords goes through every block, printing and checking the records
+// as asked. Records have to be ordered by key and then by sequence number
+// newest first, two records of one key with the same sequence number are
+// duplicates
+func (d *dumper) readRecords(table *sstable.Table) tableStats {
+	stats := tableStats{}
+	var prev *sstable.Data
+	first, last := "", ""
+	unreadable := false
+
+	if d.opts.records {
+		fmt.Fprintln(d.out, "records:")
+	}
+
+	for i := 0; i < table.NumBlocks(); i += 1 {
+		records, err := table.ReadBlock(i)
+		if err != nil {
+			// prev stays the last record read, the next block still continues
+			// its key and has to come after it
+			d.problem("block %d: %v", i, err)
+			unreadable = true
+			continue
+		}
+
+		if d.opts.verify && len(table.Blocks) > 0 {
+			if len(records) == 0 {
+				d.problem("block %d is empty", i)
+			} else if records[len(records)-1].Key != table.Blocks[i].LastKey {
+				d.problem("block %d ends in %s but the index says %s",
+					i, d.escape(records[len(records)-1].Key), d.escape(table.Blocks[i].LastKey))
+			}
+		}
+
+		for j := range records {
+			keyVal := records[j]
+			if d.opts.records {
+				d.printRecord(keyVal)
+			}
+
+			if stats.records == 0 {
+				first = keyVal.Key
+				stats.minSeq = keyVal.Seq
+			}
+			last = keyVal.Key
+
+			if prev == nil || prev.Key != keyVal.Key {
+				stats.keys += 1
+			}
+			if keyVal.Delete {
+				stats.tombstones += 1
+			}
+			stats.minSeq = min(stats.minSeq, keyVal.Seq)
+			stats.maxSeq = max(stats.maxSeq, keyVal.Seq)
+			stats.keySizes.add(len(keyVal.Key), stats.records == 0)
+			stats.valueSizes.add(len(keyVal.Value), stats.records == 0)
+			stats.records += 1
+
+			if d.opts.verify {
+				d.verifyRecord(table, prev, keyVal, i)
+			}
+			prev = &records[j]
+		}
+	}
+
+	// the key range can only be checked once every record has been read
+	if d.opts.verify && stats.records > 0 && !unreadable {
+		minMax := table.FileIndex.MinMax
+		if first != minMax.StartKey || last != minMax.EndKey {
+			d.problem("records span %s .. %s but the footer says %s .. %s",
+				d.escape(first), d.escape(last), d.escape(minMax.StartKey), d.escape(minMax.EndKey))
+		}
+	}
+
+	return stats
+}
+
+func (d *dumper) verifyRecord(table *sstable.Table, prev *sstable.Data, keyVal sstable.Data, block int) {
+	if table.Bloom != nil && !table.Bloom.MayContain(keyVal.Key) {
+		d.problem("block %d: the bloom filter does not contain %s", block, d.escape(keyVal.Key))
+	}
+
+	if prev == nil {
+		return
+	}
+
+	switch {
+	case prev.Key > keyVal.Key:
+		d.problem("block %d: %s comes after %s", block, d.escape(keyVal.Key), d.escape(prev.Key))
+	case prev.Key == keyVal.Key && prev.Seq == keyVal.Seq:
+		d.problem("block %d: %s is in the table twice at sequence %d", block, d.escape(keyVal.Key), keyVal.Seq)
+	case prev.Key == keyVal.Key && prev.Seq < keyVal.Seq:
+		d.problem("block %d: version %d of %s comes after the older version %d", block, keyVal.Seq, d.escape(keyVal.Key), prev.Seq)
+	}
+}
+
+func (d *dumper) printRecord(keyVal sstable.Data) {
+	if keyVal.Delete {
+		fmt.Fprintf(d.out, "  %s @%d deleted\n", d.escape(keyVal.Key), keyVal.Seq)
+		return
+	}
+
+	fmt.Fprintf(d.out, "  %s @%d = %s\n", d.escape(keyVal.Key), keyVal.Seq, d.escape(keyVal.Value))
+}
+
+// printCompression lists how many blocks each codec stored and the ratio
+// they got, damaged blocks are reported by readRecords already
+func (d *dumper) printCompression(table *sstable.Table) {
+	stats, err := table.CompressionStats()
+	if err != nil || len(stats.Blocks) == 0 {
+		return
+	}
+
+	codecs := make([]sstable.Codec, 0, len(stats.Blocks))
+	for codec := range stats.Blocks {
+		codecs = append(codecs, codec)
+	}
+	slices.Sort(codecs)
+
+	counts := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		counts = append(counts, fmt.Sprintf("%s %d", codec, stats.Blocks[codec]))
+	}
+
+	fmt.Fprintf(d.out, "  compression  %s; %d -> %d bytes, ratio %.2f\n",
+		strings.Join(counts, ", "), stats.RawBytes, stats.StoredBytes, stats.Ratio())
+}
+
+func (d *dumper) printStats(table *sstable.Table, stats tableStats) {
+	fmt.Fprintln(d.out, "stats:")
+	fmt.Fprintf(d.out, "  records      %d\n", stats.records)
+	fmt.Fprintf(d.out, "  keys         %d\n", stats.keys)
+	fmt.Fprintf(d.out, "  old versions %d\n", stats.records-stats.keys)
+	fmt.Fprintf(d.out, "  tombstones   %d\n", stats.tombstones)
+	fmt.Fprintf(d.out, "  sequence     %d .. %d\n", stats.minSeq, stats.maxSeq)
+	fmt.Fprintf(d.out, "  key bytes    %s\n", stats.keySizes)
+	fmt.Fprintf(d.out, "  value bytes  %s\n", stats.valueSizes)
+	fmt.Fprintf(d.out, "  blocks       %d\n", table.NumBlocks())
+	d.printCompression(table)
+	fmt.Fprintf(d.out, "  key range    %s .. %s\n", d.escape(table.FileIndex.MinMax.StartKey), d.escape(table.FileIndex.MinMax.EndKey))
+	if table.Bloom != nil {
+		fmt.Fprintf(d.out, "  bloom        %d bytes, %.4f estimated false positive rate\n",
+			table.FileIndex.BloomLen, table.Bloom.EstimatedFalsePositiveRate())
+	}
+}
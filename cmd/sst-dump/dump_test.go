@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	sstable "stinky-db/db/SSTable"
+	"strings"
+	"testing"
+)
+
+func writeTable(t *testing.T, data []sstable.Data) string {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	table := sstable.GenerateFromSorted(data, path)
+
+	err := table.WriteToFile()
+	if err != nil {
+		t.Fatalf("could not write table: %+v\n", err)
+	}
+
+	return path
+}
+
+func dumpTable(path string, opts options) (string, int) {
+	out := bytes.Buffer{}
+	d := &dumper{out: &out, opts: opts}
+	d.dump(path)
+
+	return out.String(), d.problems
+}
+
+func TestDumpsValidTable(t *testing.T) {
+	data := []sstable.Data{}
+	for i := 0; i < 500; i += 1 {
+		key := fmt.Sprintf("key_%03d", i)
+		data = append(data, sstable.Data{Key: key, Value: "new", Seq: uint64(1000 + i)})
+		if i%10 == 0 {
+			// older versions of a key are legitimate as long as they come after newer ones
+			data = append(data, sstable.Data{Key: key, Seq: uint64(i), Delete: true})
+		}
+	}
+	data = append(data, sstable.Data{Key: "key_\xff\x00", Value: "bin", Seq: 1})
+	path := writeTable(t, data)
+
+	out, problems := dumpTable(path, options{footer: true, index: true, records: true, hex: true, stats: true, verify: true})
+	if problems != 0 {
+		t.Fatalf("expected no problems, got %d\n%s", problems, out)
+	}
+
+	for _, expected := range []string{
+		"  version      5\n",
+		"  key_000 @1000 = new\n",
+		"  key_000 @0 deleted\n",
+		`  key_\xff\x00 @1 = bin` + "\n",
+		"  records      551\n",
+		"  keys         501\n",
+		"  tombstones   50\n",
+		"  compression  none ",
+		"  block 0  offset 0,",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected the dump to contain %q", expected)
+		}
+	}
+}
+
+func TestFindsProblems(t *testing.T) {
+	unordered := writeTable(t, []sstable.Data{
+		{Key: "b", Value: "1", Seq: 1},
+		{Key: "a", Value: "2", Seq: 2},
+		{Key: "c", Value: "3", Seq: 3},
+		{Key: "c", Value: "4", Seq: 3},
+		{Key: "d", Value: "5", Seq: 4},
+		{Key: "d", Value: "6", Seq: 5},
+	})
+
+	out, problems := dumpTable(unordered, options{verify: true})
+	if problems != 3 {
+		t.Errorf("expected 3 problems, got %d\n%s", problems, out)
+	}
+	for _, expected := range []string{"a comes after b", "c is in the table twice", "version 5 of d comes after the older version 4"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected the dump to report %q\n%s", expected, out)
+		}
+	}
+
+	data := []sstable.Data{}
+	for i := 0; i < 1000; i += 1 {
+		data = append(data, sstable.Data{Key: fmt.Sprintf("key_%04d", i), Value: "val", Seq: uint64(i + 1)})
+	}
+	corrupt := writeTable(t, data)
+
+	buf, err := os.ReadFile(corrupt)
+	if err != nil {
+		t.Fatalf("could not read table: %+v\n", err)
+	}
+	// the first data block starts at offset 0
+	buf[10] ^= 0xff
+	err = os.WriteFile(corrupt, buf, 0o644)
+	if err != nil {
+		t.Fatalf("could not write table: %+v\n", err)
+	}
+
+	out, problems = dumpTable(corrupt, options{verify: true})
+	if problems != 1 || !strings.Contains(out, "block 0: ") || !strings.Contains(out, "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch in block 0 only, got %d\n%s", problems, out)
+	}
+
+	_, problems = dumpTable(filepath.Join(t.TempDir(), "missing.sst"), options{verify: true})
+	if problems != 1 {
+		t.Errorf("expected a table that can not be opened to be a problem")
+	}
+}
+
+func TestBadBlockDoesNotSplitAKey(t *testing.T) {
+	// the versions of k fill several blocks, the one in the middle is damaged
+	data := []sstable.Data{{Key: "a", Value: "val", Seq: 1}}
+	for seq := 3000; seq > 1; seq -= 1 {
+		data = append(data, sstable.Data{Key: "k", Value: "val", Seq: uint64(seq)})
+	}
+	data = append(data, sstable.Data{Key: "z", Value: "val", Seq: 1})
+	path := writeTable(t, data)
+
+	table, err := sstable.GenerateFromDisk(path)
+	if err != nil {
+		t.Fatalf("could not open table: %+v\n", err)
+	}
+	if len(table.Blocks) < 3 || table.Blocks[0].LastKey != "k" || table.Blocks[1].LastKey != "k" {
+		t.Fatalf("expected k to span the first blocks, got %+v", table.Blocks)
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read table: %+v\n", err)
+	}
+	buf[table.Blocks[1].Offset+3] ^= 0xff
+	err = os.WriteFile(path, buf, 0o644)
+	if err != nil {
+		t.Fatalf("could not write table: %+v\n", err)
+	}
+
+	out, problems := dumpTable(path, options{stats: true, verify: true})
+	if problems != 1 || !strings.Contains(out, "block 1: ") {
+		t.Errorf("expected only block 1 to be a problem, got %d\n%s", problems, out)
+	}
+	if !strings.Contains(out, "  keys         3\n") {
+		t.Errorf("expected the versions of k after the bad block to count as the same key\n%s", out)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	opts := options{}
+	flag.BoolVar(&opts.footer, "footer", false, "print the file index kept in the footer")
+	flag.BoolVar(&opts.index, "index", false, "print the block index, or the sparse index of JSON tables")
+	flag.BoolVar(&opts.records, "records", false, "print every record")
+	flag.BoolVar(&opts.hex, "hex", false, "escape every byte of keys and values outside of printable ASCII as \\xNN")
+	flag.BoolVar(&opts.stats, "stats", false, "print record counts, key range and sizes")
+	flag.BoolVar(&opts.verify, "verify", false, "check checksums, record order and duplicate keys")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] table.sst...\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "with no flags the footer and stats are printed and the tables verified")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if !opts.footer && !opts.index && !opts.records && !opts.stats && !opts.verify {
+		opts.footer, opts.stats, opts.verify = true, true, true
+	}
+
+	d := &dumper{out: os.Stdout, opts: opts}
+	for _, path := range flag.Args() {
+		d.dump(path)
+	}
+
+	if d.problems > 0 {
+		fmt.Fprintf(os.Stderr, "%d problems found\n", d.problems)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	stinky "stinky-db/db"
+	lsmtree "stinky-db/db/LSMTree"
+	"strconv"
+	"strings"
+)
+
+// backend is what the shell runs its commands against, either a data dir
+// opened in process or a stinky-server reached over its HTTP API
+type backend interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	Delete(key string) error
+	// Scan calls fn for the live keys in [start, end) in order, at most limit
+	// of them unless limit is 0
+	Scan(start, end string, limit int, fn func(key, value string) error) error
+	Levels() ([]lsmtree.LevelInfo, error)
+	Compact() error
+	Flush() error
+	Close() error
+}
+
+type localBackend struct {
+	store *stinky.DB
+}
+
+func openLocal(dir string) (*localBackend, error) {
+	store, err := stinky.Open(dir, stinky.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &localBackend{store: store}, nil
+}
+
+func (b *localBackend) Get(key string) (string, error) {
+	return b.store.Get(key)
+}
+
+func (b *localBackend) Put(key, value string) error {
+	return b.store.Put(key, value)
+}
+
+func (b *localBackend) Delete(key string) error {
+	return b.store.Delete(key)
+}
+
+func (b *localBackend) Scan(start, end string, limit int, fn func(key, value string) error) error {
+	it, err := b.store.Scan(start, end)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for count := 0; (limit == 0 || count < limit) && it.Next(); count += 1 {
+		err = fn(it.Key(), it.Value())
+		if err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
+
+func (b *localBackend) Levels() ([]lsmtree.LevelInfo, error) {
+	return b.store.Levels(), nil
+}
+
+func (b *localBackend) Compact() error {
+	return b.store.Compact()
+}
+
+func (b *localBackend) Flush() error {
+	return b.store.Flush()
+}
+
+func (b *localBackend) Close() error {
+	return b.store.Close()
+}
+
+type remoteBackend struct {
+	base   string
+	client *http.Client
+}
+
+func newRemote(base string) *remoteBackend {
+	return &remoteBackend{base: strings.TrimSuffix(base, "/"), client: &http.Client{}}
+}
+
+func (b *remoteBackend) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		return nil, responseError(res)
+	}
+
+	return res, nil
+}
+
+// responseError turns the {"error"} body of a failed request back into an error
+func responseError(res *http.Response) error {
+	if res.StatusCode == http.StatusNotFound {
+		return stinky.ErrNotFound
+	}
+
+	body := struct {
+		Error string `json:"error"`
+	}{}
+	err := json.NewDecoder(res.Body).Decode(&body)
+	if err != nil || body.Error == "" {
+		return fmt.Errorf("server answered %s", res.Status)
+	}
+
+	return fmt.Errorf("server answered %s: %s", res.Status, body.Error)
+}
+
+// call runs a request whose response has no body worth reading
+func (b *remoteBackend) call(method, path string, body io.Reader) error {
+	res, err := b.do(method, path, body)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (b *remoteBackend) Get(key string) (string, error) {
+	res, err := b.do(http.MethodGet, "/kv/"+url.PathEscape(key), nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	val, err := io.ReadAll(res.Body)
+	return string(val), err
+}
+
+func (b *remoteBackend) Put(key, value string) error {
+	return b.call(http.MethodPut, "/kv/"+url.PathEscape(key), strings.NewReader(value))
+}
+
+func (b *remoteBackend) Delete(key string) error {
+	return b.call(http.MethodDelete, "/kv/"+url.PathEscape(key), nil)
+}
+
+func (b *remoteBackend) Scan(start, end string, limit int, fn func(key, value string) error) error {
+	query := url.Values{}
+	query.Set("start", start)
+	query.Set("end", end)
+	query.Set("limit", strconv.Itoa(limit))
+
+	res, err := b.do(http.MethodGet, "/scan?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	lines := bufio.NewScanner(res.Body)
+	lines.Buffer(nil, 1<<30)
+	for lines.Scan() {
+		record := struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			Error string `json:"error"`
+		}{}
+		err = json.Unmarshal(lines.Bytes(), &record)
+		if err != nil {
+			return err
+		}
+
+		if record.Error != "" {
+			return errors.New(record.Error)
+		}
+
+		err = fn(record.Key, record.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return lines.Err()
+}
+
+func (b *remoteBackend) Levels() ([]lsmtree.LevelInfo, error) {
+	res, err := b.do(http.MethodGet, "/levels", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	levels := []lsmtree.LevelInfo{}
+	err = json.NewDecoder(res.Body).Decode(&levels)
+
+	return levels, err
+}
+
+func (b *remoteBackend) Compact() error {
+	return b.call(http.MethodPost, "/compact", nil)
+}
+
+func (b *remoteBackend) Flush() error {
+	return b.call(http.MethodPost, "/flush", nil)
+}
+
+func (b *remoteBackend) Close() error {
+	b.client.CloseIdleConnections()
+	return nil
+}
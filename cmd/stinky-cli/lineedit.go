@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+const max_history = 1_000
+
+var (
+	ErrInterrupted = errors.New("interrupted")
+)
+
+// lineEditor reads lines from a terminal in raw mode so it can offer the
+// history on the arrow keys and complete commands on tab
+type lineEditor struct {
+	in      *bufio.Reader
+	fd      int
+	out     io.Writer
+	history []string
+	// historyFile keeps the history between sessions, it is not saved when empty
+	historyFile string
+	complete    func(prefix string) []string
+}
+
+func newLineEditor(in *os.File, out io.Writer, historyFile string, complete func(prefix string) []string) *lineEditor {
+	e := &lineEditor{
+		in:          bufio.NewReader(in),
+		fd:          int(in.Fd()),
+		out:         out,
+		historyFile: historyFile,
+		complete:    complete,
+	}
+	e.loadHistory()
+
+	return e
+}
+
+func (e *lineEditor) loadHistory() {
+	if e.historyFile == "" {
+		return
+	}
+
+	buf, err := os.ReadFile(e.historyFile)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+	e.history = e.history[max(0, len(e.history)-max_history):]
+}
+
+func (e *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+
+	e.history = append(e.history, line)
+	if len(e.history) > max_history {
+		e.history = e.history[1:]
+	}
+
+	if e.historyFile == "" {
+		return
+	}
+
+	file, err := os.OpenFile(e.historyFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	fmt.Fprintln(file, line)
+}
+
+// readLine returns io.EOF on ctrl-d at an empty line and ErrInterrupted on ctrl-c
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	state := editState{prompt: prompt, histPos: len(e.history)}
+	e.refresh(&state)
+
+	for {
+		c, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch c {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			line := string(state.buf)
+			e.addHistory(line)
+			return line, nil
+		case 3: // ctrl-c
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", ErrInterrupted
+		case 4: // ctrl-d
+			if len(state.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			state.deleteAt(state.pos)
+		case 127, 8: // backspace
+			if state.pos > 0 {
+				state.pos -= 1
+				state.deleteAt(state.pos)
+			}
+		case 1: // ctrl-a
+			state.pos = 0
+		case 5: // ctrl-e
+			state.pos = len(state.buf)
+		case 11: // ctrl-k
+			state.buf = state.buf[:state.pos]
+		case 21: // ctrl-u
+			state.buf = state.buf[state.pos:]
+			state.pos = 0
+		case '\t':
+			e.completeWord(&state)
+		case 27:
+			e.escape(&state)
+		default:
+			if c >= ' ' {
+				state.buf = slices.Insert(state.buf, state.pos, c)
+				state.pos += 1
+			}
+		}
+
+		e.refresh(&state)
+	}
+}
+
+type editState struct {
+	prompt  string
+	buf     []rune
+	pos     int
+	histPos int
+	// saved is the line that was being typed before the history was browsed
+	saved []rune
+}
+
+func (s *editState) deleteAt(pos int) {
+	if pos < len(s.buf) {
+		s.buf = slices.Delete(s.buf, pos, pos+1)
+	}
+}
+
+// escape handles the arrow, home, end and delete key sequences
+func (e *lineEditor) escape(state *editState) {
+	c, _, err := e.in.ReadRune()
+	if err != nil || (c != '[' && c != 'O') {
+		return
+	}
+
+	c, _, err = e.in.ReadRune()
+	if err != nil {
+		return
+	}
+
+	switch c {
+	case 'A':
+		e.browseHistory(state, -1)
+	case 'B':
+		e.browseHistory(state, 1)
+	case 'C':
+		state.pos = min(state.pos+1, len(state.buf))
+	case 'D':
+		state.pos = max(state.pos-1, 0)
+	case 'H':
+		state.pos = 0
+	case 'F':
+		state.pos = len(state.buf)
+	case '3':
+		// delete is sent as ESC [ 3 ~
+		next, _, err := e.in.ReadRune()
+		if err == nil && next == '~' {
+			state.deleteAt(state.pos)
+		}
+	}
+}
+
+func (e *lineEditor) browseHistory(state *editState, step int) {
+	pos := state.histPos + step
+	if pos < 0 || pos > len(e.history) {
+		return
+	}
+
+	if state.histPos == len(e.history) {
+		state.saved = slices.Clone(state.buf)
+	}
+	state.histPos = pos
+
+	if pos == len(e.history) {
+		state.buf = slices.Clone(state.saved)
+	} else {
+		state.buf = []rune(e.history[pos])
+	}
+	state.pos = len(state.buf)
+}
+
+// completeWord completes the command at the start of the line. One match is
+// filled in, several are extended to their common prefix or listed when
+// that adds nothing
+func (e *lineEditor) completeWord(state *editState) {
+	before := string(state.buf[:state.pos])
+	// only the first word of a command is completed
+	start := strings.LastIndexAny(before, ";") + 1
+	word := strings.TrimLeft(before[start:], " ")
+	if strings.ContainsAny(word, " \t") {
+		return
+	}
+
+	matches := e.complete(word)
+	if len(matches) == 0 {
+		return
+	}
+
+	completion := matches[0]
+	if len(matches) == 1 {
+		completion += " "
+	} else {
+		for _, match := range matches[1:] {
+			completion = commonPrefix(completion, match)
+		}
+	}
+
+	if completion == word {
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(matches, "  "))
+		return
+	}
+
+	insert := []rune(completion[len(word):])
+	state.buf = slices.Insert(state.buf, state.pos, insert...)
+	state.pos += len(insert)
+}
+
+func commonPrefix(a, b string) string {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n += 1
+	}
+
+	return a[:n]
+}
+
+// refresh redraws the prompt and line and puts the cursor back in place
+func (e *lineEditor) refresh(state *editState) {
+	line := string(state.buf)
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", state.prompt, line)
+	if back := len(state.buf) - state.pos; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
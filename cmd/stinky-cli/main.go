@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	dir := flag.String("dir", "", "data directory to open")
+	server := flag.String("server", "", "HTTP address of a stinky-server to connect to instead, e.g. http://127.0.0.1:8080")
+	script := flag.String("c", "", "commands to run instead of starting the shell, separated by ;")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s -dir <dir> repair\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "repair rebuilds a data dir that can not be opened from the records still readable in it")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.Arg(0) == "repair" {
+		if *dir == "" || flag.NArg() != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(runRepair(*dir, os.Stdout))
+	}
+
+	if (*dir == "") == (*server == "") {
+		fmt.Fprintln(os.Stderr, "pass either -dir or -server")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var b backend
+	if *dir != "" {
+		local, err := openLocal(*dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "opening %s: %+v\n", *dir, err)
+			os.Exit(1)
+		}
+		b = local
+	} else {
+		b = newRemote(*server)
+	}
+
+	sh := &shell{backend: b, out: os.Stdout}
+	code := 0
+	switch {
+	case *script != "":
+		code = runScript(sh, *script)
+	case isTerminal(int(os.Stdin.Fd())):
+		code = runInteractive(sh)
+	default:
+		code = runLines(sh, os.Stdin)
+	}
+
+	err := b.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "closing: %+v\n", err)
+		code = 1
+	}
+
+	os.Exit(code)
+}
+
+func runScript(sh *shell, script string) int {
+	err := sh.run(script)
+	if err != nil && !errors.Is(err, ErrQuit) {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// runLines runs commands piped in one per line, it keeps going past failed
+// commands but exits non-zero if there were any
+func runLines(sh *shell, in io.Reader) int {
+	code := 0
+	lines := bufio.NewScanner(in)
+	for lines.Scan() {
+		err := sh.run(lines.Text())
+		if errors.Is(err, ErrQuit) {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			code = 1
+		}
+	}
+
+	return code
+}
+
+func runInteractive(sh *shell) int {
+	historyFile := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyFile = filepath.Join(home, ".stinky_history")
+	}
+
+	editor := newLineEditor(os.Stdin, os.Stdout, historyFile, func(prefix string) []string {
+		matches := []string{}
+		for _, name := range commandNames() {
+			if strings.HasPrefix(name, strings.ToLower(prefix)) {
+				matches = append(matches, name)
+			}
+		}
+		return matches
+	})
+
+	fmt.Println("type help for the commands, tab completes them")
+	for {
+		line, err := editor.readLine("stinky> ")
+		if errors.Is(err, ErrInterrupted) {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading input: %+v\n", err)
+			return 1
+		}
+
+		err = sh.run(line)
+		if errors.Is(err, ErrQuit) {
+			return 0
+		}
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	}
+}
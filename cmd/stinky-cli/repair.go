@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	stinky "stinky-db/db"
+)
+
+// runRepair repairs the data dir, which no one may have open, and prints
+// what was recovered and what was lost
+func runRepair(dir string, out io.Writer) int {
+	report, err := stinky.Repair(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "repairing %s: %+v\n", dir, err)
+		return 1
+	}
+
+	printReport(out, report)
+	return 0
+}
+
+func printReport(out io.Writer, report stinky.RepairReport) {
+	fmt.Fprintf(out, "tables:   %d intact, %d damaged, %d records recovered\n",
+		report.TablesRead, len(report.DamagedTables), report.TableRecords)
+	fmt.Fprintf(out, "wal:      %d segments intact, %d damaged, %d records recovered\n",
+		report.SegmentsRead, len(report.DamagedSegments), report.WALRecords)
+	fmt.Fprintf(out, "written:  %d tables\n", len(report.TablesWritten))
+
+	if len(report.Lost) == 0 {
+		fmt.Fprintln(out, "nothing was lost")
+		return
+	}
+
+	names := make([]string, 0, len(report.Lost))
+	for name := range report.Lost {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	fmt.Fprintf(out, "lost, damaged files were moved into %s:\n", report.LostDir)
+	for _, name := range names {
+		for _, lost := range report.Lost[name] {
+			fmt.Fprintf(out, "  %s: %s\n", name, lost)
+		}
+	}
+}
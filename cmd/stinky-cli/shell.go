@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	stinky "stinky-db/db"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrUsage          = errors.New("wrong number of arguments")
+	ErrQuit           = errors.New("quit")
+)
+
+type command struct {
+	usage   string
+	help    string
+	minArgs int
+	maxArgs int
+	run     func(sh *shell, args []string) error
+}
+
+var commands = map[string]command{
+	"get": {usage: "get <key>", help: "prints the value of a key", minArgs: 1, maxArgs: 1, run: (*shell).get},
+	"put": {usage: "put <key> <value>", help: "sets a key", minArgs: 2, maxArgs: 2, run: (*shell).put},
+	"del": {usage: "del <key>...", help: "deletes keys", minArgs: 1, maxArgs: -1, run: (*shell).del},
+	"scan": {usage: "scan [start [end [limit]]]", help: "prints the keys in [start, end) and their values",
+		minArgs: 0, maxArgs: 3, run: (*shell).scan},
+	"count": {usage: "count [start [end]]", help: "counts the keys in [start, end)", minArgs: 0, maxArgs: 2, run: (*shell).count},
+	"levels": {usage: "levels", help: "lists the tables of every level with their sizes and key ranges",
+		minArgs: 0, maxArgs: 0, run: (*shell).levels},
+	"compact": {usage: "compact", help: "merges every table into the deepest layer", minArgs: 0, maxArgs: 0, run: (*shell).compact},
+	"flush":   {usage: "flush", help: "writes the memtables into level 0", minArgs: 0, maxArgs: 0, run: (*shell).flush},
+}
+
+// builtins are handled by the shell itself rather than the command table
+var builtins = []string{"help", "exit", "quit"}
+
+type shell struct {
+	backend backend
+	out     io.Writer
+}
+
+// commandNames lists every command in the order completion offers them
+func commandNames() []string {
+	names := slices.Clone(builtins)
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// run executes every command on the line, it stops at the first one that fails
+func (sh *shell) run(line string) error {
+	cmds, err := parse(line)
+	if err != nil {
+		return err
+	}
+
+	for _, args := range cmds {
+		err = sh.exec(args)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sh *shell) exec(args []string) error {
+	name := strings.ToLower(args[0])
+	switch name {
+	case "exit", "quit":
+		return ErrQuit
+	case "help":
+		sh.help()
+		return nil
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("%w %q, try help", ErrUnknownCommand, args[0])
+	}
+
+	args = args[1:]
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		return fmt.Errorf("%w, usage: %s", ErrUsage, cmd.usage)
+	}
+
+	return cmd.run(sh, args)
+}
+
+func (sh *shell) help() {
+	for _, name := range commandNames() {
+		cmd, ok := commands[name]
+		if ok {
+			fmt.Fprintf(sh.out, "  %-28s %s\n", cmd.usage, cmd.help)
+		}
+	}
+	fmt.Fprintf(sh.out, "  %-28s %s\n", "help", "prints this")
+	fmt.Fprintf(sh.out, "  %-28s %s\n", "exit", "leaves the shell")
+	fmt.Fprintln(sh.out, "Separate commands with ; and quote arguments with spaces in them")
+}
+
+func (sh *shell) get(args []string) error {
+	val, err := sh.backend.Get(args[0])
+	if errors.Is(err, stinky.ErrNotFound) {
+		fmt.Fprintln(sh.out, "(not found)")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(sh.out, display(val))
+	return nil
+}
+
+func (sh *shell) put(args []string) error {
+	err := sh.backend.Put(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(sh.out, "OK")
+	return nil
+}
+
+func (sh *shell) del(args []string) error {
+	for _, key := range args {
+		err := sh.backend.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(sh.out, "OK")
+	return nil
+}
+
+func (sh *shell) scan(args []string) error {
+	start, end, limit := "", "", 0
+	if len(args) > 0 {
+		start = args[0]
+	}
+	if len(args) > 1 {
+		end = args[1]
+	}
+	if len(args) > 2 {
+		var err error
+		limit, err = strconv.Atoi(args[2])
+		if err != nil || limit < 0 {
+			return fmt.Errorf("limit %q is not a non-negative number", args[2])
+		}
+	}
+
+	return sh.backend.Scan(start, end, limit, func(key, value string) error {
+		_, err := fmt.Fprintf(sh.out, "%s\t%s\n", display(key), display(value))
+		return err
+	})
+}
+
+func (sh *shell) count(args []string) error {
+	start, end := "", ""
+	if len(args) > 0 {
+		start = args[0]
+	}
+	if len(args) > 1 {
+		end = args[1]
+	}
+
+	count := 0
+	err := sh.backend.Scan(start, end, 0, func(key, value string) error {
+		count += 1
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(sh.out, count)
+	return nil
+}
+
+func (sh *shell) levels(args []string) error {
+	levels, err := sh.backend.Levels()
+	if err != nil {
+		return err
+	}
+
+	for _, level := range levels {
+		size := int64(0)
+		for _, table := range level.Tables {
+			size += table.Size
+		}
+		tables := "tables"
+		if len(level.Tables) == 1 {
+			tables = "table"
+		}
+		fmt.Fprintf(sh.out, "level %d: %d %s, %s\n", level.Level, len(level.Tables), tables, formatSize(size))
+
+		for _, table := range level.Tables {
+			fmt.Fprintf(sh.out, "  %s  %9s  %s .. %s\n",
+				table.Name, formatSize(table.Size), display(table.MinMax.StartKey), display(table.MinMax.EndKey))
+		}
+	}
+
+	return nil
+}
+
+func (sh *shell) compact(args []string) error {
+	err := sh.backend.Compact()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(sh.out, "OK")
+	return nil
+}
+
+func (sh *shell) flush(args []string) error {
+	err := sh.backend.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(sh.out, "OK")
+	return nil
+}
+
+// parse splits a line into commands on ; and each command into arguments on
+// spaces. Single and double quotes group words, inside double quotes and
+// outside of quotes a backslash escapes the next character
+func parse(line string) ([][]string, error) {
+	cmds := [][]string{}
+	args := []string{}
+	word := strings.Builder{}
+	inWord := false
+	quote := rune(0)
+	escaped := false
+
+	endWord := func() {
+		if inWord {
+			args = append(args, word.String())
+		}
+		word.Reset()
+		inWord = false
+	}
+	endCommand := func() {
+		endWord()
+		if len(args) > 0 {
+			cmds = append(cmds, args)
+		}
+		args = []string{}
+	}
+
+	for _, c := range line {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ';':
+			endCommand()
+		case unicode.IsSpace(c):
+			endWord()
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if escaped {
+		return nil, errors.New("line ends in a backslash")
+	}
+	endCommand()
+
+	return cmds, nil
+}
+
+// display quotes strings that would not print cleanly
+func display(s string) string {
+	if !utf8.ValidString(s) || strings.IndexFunc(s, func(c rune) bool { return !unicode.IsPrint(c) }) >= 0 {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+func formatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit += 1
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
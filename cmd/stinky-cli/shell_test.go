@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	stinky "stinky-db/db"
+	api "stinky-db/db/API"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cmds, err := parse(`put "a b" 'c\d'; get a\ b ;; scan "" x`)
+	if err != nil {
+		t.Fatalf("could not parse: %+v\n", err)
+	}
+
+	expected := [][]string{{"put", "a b", `c\d`}, {"get", "a b"}, {"scan", "", "x"}}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("expected %q, got %q", expected, cmds)
+	}
+
+	if display("a\tb") != `"a\tb"` || display("a b") != "a b" {
+		t.Errorf("expected only unprintable strings to be quoted")
+	}
+
+	for _, line := range []string{`get "a`, `get a\`} {
+		_, err = parse(line)
+		if err == nil {
+			t.Errorf("expected %q to fail to parse", line)
+		}
+	}
+}
+
+// runShell runs the script against both a local data dir and a server
+// serving one and checks they print the same
+func runShell(t *testing.T, script string) string {
+	local, err := openLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer local.Close()
+
+	store, err := stinky.Open(t.TempDir(), stinky.Options{})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer store.Close()
+
+	server := httptest.NewServer(api.NewHandler(store))
+	defer server.Close()
+
+	outputs := []string{}
+	for _, b := range []backend{local, newRemote(server.URL)} {
+		out := bytes.Buffer{}
+		sh := &shell{backend: b, out: &out}
+		err = sh.run(script)
+		if err != nil {
+			t.Fatalf("could not run %q: %+v\n", script, err)
+		}
+		outputs = append(outputs, out.String())
+	}
+
+	if outputs[0] != outputs[1] {
+		t.Errorf("expected local and remote output to match, got\n%s\nand\n%s", outputs[0], outputs[1])
+	}
+
+	return outputs[0]
+}
+
+func TestCommands(t *testing.T) {
+	script := []string{}
+	for i := 0; i < 20; i += 1 {
+		script = append(script, fmt.Sprintf("put key/%02d val_%d", i, i))
+	}
+	script = append(script, "del key/03 key/04", "get key/01", "get key/03", `put "odd key" "a b"`, "get 'odd key'",
+		"count key/ key/10", "scan key/10 '' 3", "flush", "compact")
+
+	out := runShell(t, strings.Join(script, "; "))
+
+	expected := strings.Repeat("OK\n", 21) + "val_1\n(not found)\nOK\na b\n8\n" +
+		"key/10\tval_10\nkey/11\tval_11\nkey/12\tval_12\n" + "OK\nOK\n"
+	if out != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out)
+	}
+}
+
+func TestLevelsAfterCompaction(t *testing.T) {
+	out := runShell(t, "put a 1; put b 2; flush; compact; levels")
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 7 || lines[4] != "level 0: 0 tables, 0 B" || !strings.HasPrefix(lines[5], "level 1: 1 table, ") {
+		t.Fatalf("unexpected levels output\n%s", out)
+	}
+
+	if !strings.HasSuffix(lines[6], "a .. b") {
+		t.Errorf("expected the table to span a .. b, got %s", lines[6])
+	}
+}
+
+func TestShellErrors(t *testing.T) {
+	sh := &shell{backend: nil, out: &bytes.Buffer{}}
+
+	err := sh.run("frobnicate")
+	if !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("expected unknown command, got %+v", err)
+	}
+
+	err = sh.run("get")
+	if !errors.Is(err, ErrUsage) {
+		t.Errorf("expected usage error, got %+v", err)
+	}
+
+	err = sh.run("exit; get a")
+	if !errors.Is(err, ErrQuit) {
+		t.Errorf("expected quit, got %+v", err)
+	}
+}
+
+func TestRepairReport(t *testing.T) {
+	dir := t.TempDir()
+	store, err := stinky.Open(dir, stinky.Options{})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	err = store.Put("a", "1")
+	if err != nil {
+		t.Fatalf("could not put: %+v\n", err)
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatalf("could not close db: %+v\n", err)
+	}
+
+	out := bytes.Buffer{}
+	if runRepair(dir, &out) != 0 {
+		t.Fatalf("could not repair")
+	}
+
+	expected := "tables:   1 intact, 0 damaged, 1 records recovered\n" +
+		"wal:      0 segments intact, 0 damaged, 0 records recovered\n" +
+		"written:  1 tables\nnothing was lost\n"
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"errors"
+)
+
+// line editing needs termios, without it lines are read as they come
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
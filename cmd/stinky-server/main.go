@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	stinky "stinky-db/db"
+	api "stinky-db/db/API"
+	resp "stinky-db/db/RESP"
+	sstable "stinky-db/db/SSTable"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	dir := flag.String("dir", "./stinky", "directory the database is stored in")
+	addr := flag.String("addr", "127.0.0.1:6379", "address to serve the redis protocol on")
+	httpAddr := flag.String("http", "", "address to serve the HTTP API on, it is off when empty")
+	maxClients := flag.Int("max-clients", resp.DEFAULT_MAX_CLIENTS, "how many connections are served at once")
+	blockCacheSize := flag.Int64("block-cache-size", sstable.DEFAULT_BLOCK_CACHE_SIZE, "bytes of decoded SSTable blocks kept in memory")
+	mmap := flag.Bool("mmap", false, "read SSTables through memory mappings of their files")
+	compression := flag.String("compression", "", "comma separated codecs of the SSTable data blocks per level, none, snappy or flate")
+	flag.Parse()
+
+	codecs := []sstable.Codec{}
+	for _, name := range strings.Split(*compression, ",") {
+		if name == "" {
+			continue
+		}
+
+		codec, err := sstable.ParseCodec(strings.TrimSpace(name))
+		if err != nil {
+			log.Fatalf("-compression: %+v\n", err)
+		}
+		codecs = append(codecs, codec)
+	}
+
+	sstable.SharedBlockCache.SetCapacity(*blockCacheSize)
+
+	store, err := stinky.Open(*dir, stinky.Options{Mmap: *mmap, Compression: codecs})
+	if err != nil {
+		log.Fatalf("opening %s: %+v\n", *dir, err)
+	}
+
+	server := resp.NewServer(store, resp.Options{MaxClients: *maxClients})
+
+	httpServer := &http.Server{Addr: *httpAddr, Handler: api.NewHandler(store)}
+	if *httpAddr != "" {
+		go func() {
+			log.Printf("serving the HTTP API on %s\n", *httpAddr)
+			err := httpServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("serving HTTP: %+v\n", err)
+				server.Close()
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Close()
+	}()
+
+	log.Printf("serving %s on %s\n", *dir, *addr)
+	err = server.ListenAndServe(*addr)
+	httpServer.Shutdown(context.Background())
+	if err != nil && !errors.Is(err, resp.ErrServerClosed) {
+		store.Close()
+		log.Fatalf("serving: %+v\n", err)
+	}
+
+	err = store.Close()
+	if err != nil {
+		log.Fatalf("closing %s: %+v\n", *dir, err)
+	}
+}
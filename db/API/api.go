@@ -0,0 +1,331 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	stinky "stinky-db/db"
+	"strconv"
+)
+
+const (
+	// max_batch_size bounds the body of a POST /batch
+	max_batch_size = 64 << 20
+	// scan_flush_every is how many scanned records are buffered before they
+	// are flushed to the client
+	scan_flush_every = 128
+)
+
+// Handler serves the store over HTTP
+//
+//	GET    /kv/{key}                  the raw value, 404 when it is missing
+//	PUT    /kv/{key}                  stores the raw body as the value
+//	DELETE /kv/{key}                  deletes the key
+//	GET    /scan?start=&end=&limit=   streams {"key","value"} lines in key order
+//	POST   /batch                     applies a JSON list of ops atomically
+//	GET    /health                    200 while the store takes writes, 503 otherwise
+//	GET    /stats                     the store's stats as JSON
+//	GET    /levels                    the live tables of every level as JSON
+//	POST   /flush                     writes the memtables into level 0
+//	POST   /compact                   merges every table into the deepest layer
+//
+// Errors are answered with a {"error": "..."} body
+type Handler struct {
+	store *stinky.DB
+	mux   *http.ServeMux
+}
+
+// BatchOp is one write of a POST /batch, Op is either put or delete
+type BatchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// Record is one line of a GET /scan response
+type Record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type statsResponse struct {
+	Sequence  uint64         `json:"sequence"`
+	Bloom     bloomStats     `json:"bloom"`
+	ReadCache readCacheStats `json:"read_cache"`
+}
+
+type bloomStats struct {
+	Checks            uint64  `json:"checks"`
+	Negatives         uint64  `json:"negatives"`
+	FalsePositives    uint64  `json:"false_positives"`
+	FalsePositiveRate float64 `json:"false_positive_rate"`
+}
+
+type readCacheStats struct {
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Evictions uint64  `json:"evictions"`
+	Len       int     `json:"len"`
+	Bytes     int64   `json:"bytes"`
+	HitRate   float64 `json:"hit_rate"`
+}
+
+func NewHandler(store *stinky.DB) *Handler {
+	h := &Handler{store: store, mux: http.NewServeMux()}
+
+	h.mux.HandleFunc("GET /kv/{key...}", h.get)
+	h.mux.HandleFunc("PUT /kv/{key...}", h.put)
+	h.mux.HandleFunc("DELETE /kv/{key...}", h.delete)
+	h.mux.HandleFunc("GET /scan", h.scan)
+	h.mux.HandleFunc("POST /batch", h.batch)
+	h.mux.HandleFunc("GET /health", h.health)
+	h.mux.HandleFunc("GET /stats", h.stats)
+	h.mux.HandleFunc("GET /levels", h.levels)
+	h.mux.HandleFunc("POST /flush", h.flush)
+	h.mux.HandleFunc("POST /compact", h.compact)
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// writeStoreError picks the status code for an error returned by the store
+func writeStoreError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	maxBytesErr := &http.MaxBytesError{}
+	switch {
+	case errors.Is(err, stinky.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, stinky.ErrEntryTooLarge), errors.As(err, &maxBytesErr):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, stinky.ErrClosed):
+		status = http.StatusServiceUnavailable
+	}
+
+	writeError(w, status, err)
+}
+
+func keyOf(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.PathValue("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("key is empty"))
+		return "", false
+	}
+
+	return key, true
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyOf(w, r)
+	if !ok {
+		return
+	}
+
+	val, err := h.store.Get(key)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(val)))
+	io.WriteString(w, val)
+}
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyOf(w, r)
+	if !ok {
+		return
+	}
+
+	// anything as big as the memtable is rejected by the store anyway, so the body is not read past it
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.store.MaxEntrySize()))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	err = h.store.Put(key, string(body))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) delete(w http.ResponseWriter, r *http.Request) {
+	key, ok := keyOf(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.store.Delete(key)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scan streams one JSON record per line. The status is sent before the
+// first record, an error after that is reported as a final {"error"} line
+func (h *Handler) scan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 0
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit has to be a non-negative number"))
+			return
+		}
+	}
+
+	it, err := h.store.Scan(query.Get("start"), query.Get("end"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer it.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+	for count := 0; (limit == 0 || count < limit) && it.Next(); count += 1 {
+		err = encoder.Encode(Record{Key: it.Key(), Value: it.Value()})
+		if err != nil {
+			// the client went away
+			return
+		}
+
+		if (count+1)%scan_flush_every == 0 {
+			controller.Flush()
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		encoder.Encode(errorResponse{Error: err.Error()})
+	}
+}
+
+func (h *Handler) batch(w http.ResponseWriter, r *http.Request) {
+	ops := []BatchOp{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, max_batch_size)).Decode(&ops)
+	maxBytesErr := &http.MaxBytesError{}
+	if errors.As(err, &maxBytesErr) {
+		writeStoreError(w, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	batch := stinky.NewWriteBatch()
+	for i, op := range ops {
+		if op.Key == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("op %d has an empty key", i))
+			return
+		}
+
+		switch op.Op {
+		case "put":
+			batch.Put(op.Key, op.Value)
+		case "delete":
+			batch.Delete(op.Key)
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Errorf("op %d is neither put nor delete", i))
+			return
+		}
+	}
+
+	err = h.store.Write(batch)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) health(w http.ResponseWriter, r *http.Request) {
+	err := h.store.Err()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	stats := h.store.Stats()
+	writeJSON(w, http.StatusOK, statsResponse{
+		Sequence: stats.Sequence,
+		Bloom: bloomStats{
+			Checks:            stats.Bloom.Checks,
+			Negatives:         stats.Bloom.Negatives,
+			FalsePositives:    stats.Bloom.FalsePositives,
+			FalsePositiveRate: stats.Bloom.FalsePositiveRate,
+		},
+		ReadCache: readCacheStats{
+			Hits:      stats.ReadCache.Hits,
+			Misses:    stats.ReadCache.Misses,
+			Evictions: stats.ReadCache.Evictions,
+			Len:       stats.ReadCache.Len,
+			Bytes:     stats.ReadCache.Bytes,
+			HitRate:   stats.ReadCache.HitRate,
+		},
+	})
+}
+
+func (h *Handler) levels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.store.Levels())
+}
+
+func (h *Handler) flush(w http.ResponseWriter, r *http.Request) {
+	err := h.store.Flush()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) compact(w http.ResponseWriter, r *http.Request) {
+	err := h.store.Compact()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
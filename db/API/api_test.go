@@ -0,0 +1,189 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	stinky "stinky-db/db"
+	"strings"
+	"testing"
+)
+
+func startServer(t *testing.T, opts stinky.Options) (*httptest.Server, *stinky.DB) {
+	store, err := stinky.Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+
+	server := httptest.NewServer(NewHandler(store))
+	t.Cleanup(func() {
+		server.Close()
+		store.Close()
+	})
+
+	return server, store
+}
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("could not build request: %+v\n", err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not %s %s: %+v\n", method, url, err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("could not read response: %+v\n", err)
+	}
+
+	return res.StatusCode, string(resBody)
+}
+
+func TestKeyRoutes(t *testing.T) {
+	server, _ := startServer(t, stinky.Options{MemTableSize: 1024})
+
+	status, _ := do(t, http.MethodPut, server.URL+"/kv/users/1", "alice")
+	if status != http.StatusNoContent {
+		t.Errorf("expected 204 on put, got %d", status)
+	}
+
+	status, body := do(t, http.MethodGet, server.URL+"/kv/users/1", "")
+	if status != http.StatusOK || body != "alice" {
+		t.Errorf("expected alice, got %d %q", status, body)
+	}
+
+	status, _ = do(t, http.MethodDelete, server.URL+"/kv/users/1", "")
+	if status != http.StatusNoContent {
+		t.Errorf("expected 204 on delete, got %d", status)
+	}
+
+	status, body = do(t, http.MethodGet, server.URL+"/kv/users/1", "")
+	if status != http.StatusNotFound || !strings.Contains(body, `"error"`) {
+		t.Errorf("expected a 404 with an error body, got %d %q", status, body)
+	}
+
+	status, _ = do(t, http.MethodPut, server.URL+"/kv/big", strings.Repeat("x", 2048))
+	if status != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a value bigger than the memtable, got %d", status)
+	}
+
+	status, _ = do(t, http.MethodPut, server.URL+"/kv/big", strings.Repeat("x", 1022))
+	if status != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for an entry as big as the memtable, got %d", status)
+	}
+
+	status, _ = do(t, http.MethodPost, server.URL+"/kv/a", "")
+	if status != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", status)
+	}
+
+	status, _ = do(t, http.MethodGet, server.URL+"/kv/", "")
+	if status != http.StatusBadRequest {
+		t.Errorf("expected 400 for an empty key, got %d", status)
+	}
+}
+
+func TestBatchAndScan(t *testing.T) {
+	server, store := startServer(t, stinky.Options{CacheSize: 8, MemTableSize: 512})
+
+	ops := []BatchOp{}
+	for i := 0; i < 300; i += 1 {
+		ops = append(ops, BatchOp{Op: "put", Key: fmt.Sprintf("key_%03d", i), Value: fmt.Sprint(i)})
+	}
+	ops = append(ops, BatchOp{Op: "delete", Key: "key_005"})
+
+	// the batch is bigger than the memtable but every entry fits
+	buf, _ := json.Marshal(ops[:50])
+	status, body := do(t, http.MethodPost, server.URL+"/batch", string(buf))
+	if status != http.StatusNoContent {
+		t.Fatalf("expected 204 on batch, got %d %s", status, body)
+	}
+
+	buf, _ = json.Marshal(ops[50:])
+	status, body = do(t, http.MethodPost, server.URL+"/batch", string(buf))
+	if status != http.StatusNoContent {
+		t.Fatalf("expected 204 on batch, got %d %s", status, body)
+	}
+
+	status, _ = do(t, http.MethodPost, server.URL+"/batch", `[{"op":"put","key":"x","value":"1"},{"op":"incr","key":"y"}]`)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown op, got %d", status)
+	}
+
+	_, err := store.Get("x")
+	if err == nil {
+		t.Errorf("expected a rejected batch to write nothing")
+	}
+
+	res, err := http.Get(server.URL + "/scan?start=key_003&end=key_250&limit=200")
+	if err != nil {
+		t.Fatalf("could not scan: %+v\n", err)
+	}
+	defer res.Body.Close()
+
+	if res.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("expected ndjson, got %s", res.Header.Get("Content-Type"))
+	}
+
+	keys := []string{}
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		record := Record{}
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			t.Fatalf("could not decode %q: %+v\n", scanner.Text(), err)
+		}
+		keys = append(keys, record.Key)
+	}
+
+	expected := []string{"key_003", "key_004"}
+	for i := 6; len(expected) < 200; i += 1 {
+		expected = append(expected, fmt.Sprintf("key_%03d", i))
+	}
+	if !slices.Equal(keys, expected) {
+		t.Errorf("expected %d keys from key_003 without key_005, got %v", len(expected), keys)
+	}
+
+	status, _ = do(t, http.MethodGet, server.URL+"/scan?limit=-1", "")
+	if status != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad limit, got %d", status)
+	}
+}
+
+func TestHealthAndStats(t *testing.T) {
+	server, store := startServer(t, stinky.Options{})
+
+	status, body := do(t, http.MethodGet, server.URL+"/health", "")
+	if status != http.StatusOK || !strings.Contains(body, `"ok"`) {
+		t.Errorf("expected a healthy store, got %d %s", status, body)
+	}
+
+	store.Put("a", "1")
+	store.Put("b", "2")
+
+	status, body = do(t, http.MethodGet, server.URL+"/stats", "")
+	stats := statsResponse{}
+	err := json.Unmarshal([]byte(body), &stats)
+	if status != http.StatusOK || err != nil {
+		t.Fatalf("could not get stats: %d %s\n", status, body)
+	}
+
+	if stats.Sequence != 2 {
+		t.Errorf("expected sequence 2, got %d", stats.Sequence)
+	}
+
+	store.Close()
+	status, _ = do(t, http.MethodGet, server.URL+"/health", "")
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 once the store is closed, got %d", status)
+	}
+}
@@ -0,0 +1,151 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync/atomic"
+)
+
+const (
+	DEFAULT_BITS_PER_KEY = 10
+	header_size          = 5
+	max_hashes           = 30
+)
+
+var (
+	ErrInvalidFilter = errors.New("invalid bloom filter")
+)
+
+// Filter is a bloom filter that derives its k probe positions from two
+// halves of a single 64 bit hash (double hashing)
+type Filter struct {
+	bits      []byte
+	numBits   uint64
+	numHashes uint8
+	numKeys   uint32
+}
+
+func New(numKeys int, bitsPerKey int) *Filter {
+	if bitsPerKey <= 0 {
+		bitsPerKey = DEFAULT_BITS_PER_KEY
+	}
+
+	// k = ln(2) * bits per key minimises the false positive rate
+	numHashes := int(math.Round(float64(bitsPerKey) * math.Ln2))
+	numHashes = max(1, min(numHashes, max_hashes))
+
+	numBits := max(numKeys*bitsPerKey, 64)
+	numBytes := (numBits + 7) / 8
+
+	return &Filter{
+		bits:      make([]byte, numBytes),
+		numBits:   uint64(numBytes * 8),
+		numHashes: uint8(numHashes),
+	}
+}
+
+func hash(key string) (uint32, uint32) {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	sum := hasher.Sum64()
+
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (f *Filter) Add(key string) {
+	h1, h2 := hash(key)
+	for i := uint32(0); i < uint32(f.numHashes); i += 1 {
+		bit := uint64(h1+i*h2) % f.numBits
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+	f.numKeys += 1
+}
+
+// MayContain never returns false for a key that was added
+func (f *Filter) MayContain(key string) bool {
+	h1, h2 := hash(key)
+	for i := uint32(0); i < uint32(f.numHashes); i += 1 {
+		bit := uint64(h1+i*h2) % f.numBits
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// EstimatedFalsePositiveRate is the expected rate for the number of keys added so far
+func (f *Filter) EstimatedFalsePositiveRate() float64 {
+	k := float64(f.numHashes)
+	return math.Pow(1-math.Exp(-k*float64(f.numKeys)/float64(f.numBits)), k)
+}
+
+// Encode lays the filter out as the number of hashes, the number of keys and the bit array
+func (f *Filter) Encode() []byte {
+	buf := make([]byte, header_size, header_size+len(f.bits))
+	buf[0] = f.numHashes
+	binary.LittleEndian.PutUint32(buf[1:5], f.numKeys)
+
+	return append(buf, f.bits...)
+}
+
+func Decode(data []byte) (*Filter, error) {
+	if len(data) <= header_size || data[0] == 0 || data[0] > max_hashes {
+		return nil, ErrInvalidFilter
+	}
+
+	bits := make([]byte, len(data)-header_size)
+	copy(bits, data[header_size:])
+
+	return &Filter{
+		bits:      bits,
+		numBits:   uint64(len(bits) * 8),
+		numHashes: data[0],
+		numKeys:   binary.LittleEndian.Uint32(data[1:5]),
+	}, nil
+}
+
+// Stats counts how the filters in front of the tables performed, they are
+// safe to update from concurrent readers
+type Stats struct {
+	checks         atomic.Uint64
+	negatives      atomic.Uint64
+	falsePositives atomic.Uint64
+}
+
+type StatsSnapshot struct {
+	Checks         uint64
+	Negatives      uint64
+	FalsePositives uint64
+	// FalsePositiveRate is the share of lookups for absent keys the filters let through
+	FalsePositiveRate float64
+}
+
+func (s *Stats) Record(mayContain bool) {
+	s.checks.Add(1)
+	if !mayContain {
+		s.negatives.Add(1)
+	}
+}
+
+// RecordFalsePositive is called when a filter let a lookup through but the table did not have the key
+func (s *Stats) RecordFalsePositive() {
+	s.falsePositives.Add(1)
+}
+
+func (s *Stats) Snapshot() StatsSnapshot {
+	snapshot := StatsSnapshot{
+		Checks:         s.checks.Load(),
+		Negatives:      s.negatives.Load(),
+		FalsePositives: s.falsePositives.Load(),
+	}
+
+	absent := snapshot.Negatives + snapshot.FalsePositives
+	if absent > 0 {
+		snapshot.FalsePositiveRate = float64(snapshot.FalsePositives) / float64(absent)
+	}
+
+	return snapshot
+}
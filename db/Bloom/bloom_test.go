@@ -0,0 +1,89 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNoFalseNegatives(t *testing.T) {
+	filter := New(1000, 10)
+	for i := 0; i < 1000; i += 1 {
+		filter.Add(fmt.Sprintf("key_%d", i))
+	}
+
+	for i := 0; i < 1000; i += 1 {
+		if !filter.MayContain(fmt.Sprintf("key_%d", i)) {
+			t.Fatalf("filter lost key_%d", i)
+		}
+	}
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	filter := New(10_000, 10)
+	for i := 0; i < 10_000; i += 1 {
+		filter.Add(fmt.Sprintf("key_%d", i))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10_000; i += 1 {
+		if filter.MayContain(fmt.Sprintf("missing_%d", i)) {
+			falsePositives += 1
+		}
+	}
+
+	// 10 bits per key should land around 1%
+	rate := float64(falsePositives) / 10_000
+	if rate > 0.03 {
+		t.Errorf("false positive rate too high: %f", rate)
+	}
+
+	estimated := filter.EstimatedFalsePositiveRate()
+	if estimated <= 0 || estimated > 0.02 {
+		t.Errorf("unexpected estimated false positive rate: %f", estimated)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	filter := New(100, 8)
+	for i := 0; i < 100; i += 1 {
+		filter.Add(fmt.Sprintf("key_%d", i))
+	}
+
+	decoded, err := Decode(filter.Encode())
+	if err != nil {
+		t.Fatalf("could not decode filter: %+v", err)
+	}
+
+	for i := 0; i < 100; i += 1 {
+		if !decoded.MayContain(fmt.Sprintf("key_%d", i)) {
+			t.Fatalf("decoded filter lost key_%d", i)
+		}
+	}
+
+	if decoded.EstimatedFalsePositiveRate() != filter.EstimatedFalsePositiveRate() {
+		t.Errorf("decoded filter does not match the original")
+	}
+
+	_, err = Decode([]byte{1, 2})
+	if err != ErrInvalidFilter {
+		t.Errorf("expected invalid filter error, got %+v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	stats := Stats{}
+	stats.Record(false)
+	stats.Record(false)
+	stats.Record(false)
+	stats.Record(true)
+	stats.RecordFalsePositive()
+
+	snapshot := stats.Snapshot()
+	if snapshot.Checks != 4 || snapshot.Negatives != 3 || snapshot.FalsePositives != 1 {
+		t.Errorf("unexpected stats: %+v", snapshot)
+	}
+
+	if snapshot.FalsePositiveRate != 0.25 {
+		t.Errorf("expected false positive rate 0.25, got %f", snapshot.FalsePositiveRate)
+	}
+}
@@ -0,0 +1,127 @@
+package cache
+
+import "container/list"
+
+// arc is an adaptive replacement cache weighted by entry size. t1 holds
+// entries used once and t2 entries used more than once, b1 and b2 remember
+// the keys recently evicted from them without their values. A hit on a
+// remembered key moves target, the share of the capacity given to t1,
+// towards the list that would have kept it
+type arc struct {
+	capacity int64
+	target   int64
+	items    map[string]*list.Element
+	t1, t2   *segment
+	b1, b2   *segment
+}
+
+func newARC(capacity int64) *arc {
+	return &arc{
+		capacity: capacity,
+		items:    map[string]*list.Element{},
+		t1:       newSegment(),
+		t2:       newSegment(),
+		b1:       newSegment(),
+		b2:       newSegment(),
+	}
+}
+
+func (c *arc) isGhost(elem *list.Element) bool {
+	segment := elem.Value.(*readEntry).segment
+	return segment == c.b1 || segment == c.b2
+}
+
+func (c *arc) get(key string) (string, bool) {
+	elem, ok := c.items[key]
+	if !ok || c.isGhost(elem) {
+		return "", false
+	}
+
+	c.promote(key, elem)
+	return c.items[key].Value.(*readEntry).value, true
+}
+
+// promote moves the entry to the front of t2
+func (c *arc) promote(key string, elem *list.Element) {
+	entry := elem.Value.(*readEntry)
+	if entry.segment == c.t2 {
+		c.t2.entries.MoveToFront(elem)
+		return
+	}
+
+	entry.segment.remove(elem)
+	c.items[key] = c.t2.pushFront(entry)
+}
+
+func (c *arc) set(key, value string, size int64) int {
+	dest := c.t1
+	fromB2 := false
+	if elem, ok := c.items[key]; ok {
+		old := elem.Value.(*readEntry)
+		switch old.segment {
+		case c.b1:
+			c.target = min(c.capacity, c.target+max(c.b2.size/max(c.b1.size, 1), 1)*size)
+		case c.b2:
+			c.target = max(0, c.target-max(c.b1.size/max(c.b2.size, 1), 1)*size)
+			fromB2 = true
+		}
+
+		old.segment.remove(elem)
+		delete(c.items, key)
+		dest = c.t2
+	}
+
+	evicted := 0
+	for c.len() > 0 && c.t1.size+c.t2.size+size > c.capacity {
+		c.replace(fromB2)
+		evicted += 1
+	}
+
+	c.items[key] = dest.pushFront(&readEntry{key: key, value: value, size: size})
+	c.trimGhosts()
+
+	return evicted
+}
+
+// replace evicts the least recently used entry of t1 or t2 into its ghost list
+func (c *arc) replace(fromB2 bool) {
+	from, to := c.t2, c.b2
+	if c.t1.len() > 0 && (c.t2.len() == 0 || c.t1.size > c.target || (fromB2 && c.t1.size == c.target)) {
+		from, to = c.t1, c.b1
+	}
+
+	entry := from.remove(from.back())
+	entry.value = ""
+	c.items[entry.key] = to.pushFront(entry)
+}
+
+// trimGhosts keeps t1 and b1 within the capacity and all four lists within twice of it
+func (c *arc) trimGhosts() {
+	for c.b1.len() > 0 && c.t1.size+c.b1.size > c.capacity {
+		c.dropGhost(c.b1)
+	}
+
+	for c.b2.len() > 0 && c.t1.size+c.t2.size+c.b1.size+c.b2.size > 2*c.capacity {
+		c.dropGhost(c.b2)
+	}
+}
+
+func (c *arc) dropGhost(ghosts *segment) {
+	entry := ghosts.remove(ghosts.back())
+	delete(c.items, entry.key)
+}
+
+func (c *arc) remove(key string) {
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*readEntry).segment.remove(elem)
+		delete(c.items, key)
+	}
+}
+
+func (c *arc) len() int {
+	return c.t1.len() + c.t2.len()
+}
+
+func (c *arc) bytes() int64 {
+	return c.t1.size + c.t2.size
+}
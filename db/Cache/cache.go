@@ -1,63 +1,154 @@
 package cache
 
-import "sync"
+import (
+	"math"
+	"slices"
+	"sync"
+)
 
 type CacheActions interface {
 	Get(key string) (string, bool)
 	Set(key, value string)
+	Delete(key string)
 	Keys() []string
 	Values() []string
 }
 
+type Entry struct {
+	Value     string
+	Seq       uint64
+	Tombstone bool
+}
+
+// Cache buffers writes before they go into the memtable, every key holds
+// its versions oldest first. Reads of the tables on disk go through a
+// ReadCache instead
 type Cache struct {
-	values map[string]string
+	values map[string][]Entry
 	mu     sync.Mutex
 	len    int
 	maxLen int
 }
 
 func NewCache(maxLen int) *Cache {
-	return &Cache{values: make(map[string]string), mu: sync.Mutex{}, maxLen: maxLen}
+	return &Cache{values: make(map[string][]Entry), mu: sync.Mutex{}, maxLen: maxLen}
 }
 
+// Get only returns live values, use Lookup to tell a deleted key from a missing one
 func (c *Cache) Get(key string) (string, bool) {
-	val, ok := c.values[key]
-	return val, ok
+	entry, ok := c.Lookup(key)
+	if entry.Tombstone {
+		return "", false
+	}
+	return entry.Value, ok
+}
+
+func (c *Cache) Lookup(key string) (Entry, bool) {
+	return c.LookupAt(key, math.MaxUint64)
+}
+
+// LookupAt finds the newest version of the key written at or before seq
+func (c *Cache) LookupAt(key string, seq uint64) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	versions := c.values[key]
+	for i := len(versions) - 1; i >= 0; i -= 1 {
+		if versions[i].Seq <= seq {
+			return versions[i], true
+		}
+	}
+
+	return Entry{}, false
 }
 
 func (c *Cache) Set(key, value string) {
+	c.set(key, Entry{Value: value}, 0)
+}
+
+// SetWithSeq adds the version written at seq, pinned is the sequence number
+// of the newest live snapshot and the previous version is only kept when
+// it is not newer than that
+func (c *Cache) SetWithSeq(key, value string, seq, pinned uint64) {
+	c.set(key, Entry{Value: value, Seq: seq}, pinned)
+}
+
+func (c *Cache) Delete(key string) {
+	c.set(key, Entry{Tombstone: true}, 0)
+}
+
+func (c *Cache) DeleteWithSeq(key string, seq, pinned uint64) {
+	c.set(key, Entry{Seq: seq, Tombstone: true}, pinned)
+}
+
+func (c *Cache) set(key string, entry Entry, pinned uint64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.values[key] = value
+
+	versions := c.values[key]
+	last := len(versions) - 1
+	if last >= 0 && (versions[last].Seq == entry.Seq || versions[last].Seq > pinned) {
+		versions[last] = entry
+		return
+	}
+
+	c.values[key] = append(versions, entry)
+	c.len += 1
 }
 
 func (c *Cache) Keys() []string {
-	keys := make([]string, 0, c.len)
-	for key := range c.values {
-		keys = append(keys, key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.values))
+	for key, versions := range c.values {
+		if !versions[len(versions)-1].Tombstone {
+			keys = append(keys, key)
+		}
 	}
 
 	return keys
 }
 
 func (c *Cache) Values() []string {
-	vals := make([]string, 0, c.len)
-	for _, val := range c.values {
-		vals = append(vals, val)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vals := make([]string, 0, len(c.values))
+	for _, versions := range c.values {
+		if newest := versions[len(versions)-1]; !newest.Tombstone {
+			vals = append(vals, newest.Value)
+		}
 	}
 
 	return vals
 }
 
+// Snapshot copies the versions of every key, tombstones included
+func (c *Cache) Snapshot() map[string][]Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := make(map[string][]Entry, len(c.values))
+	for key, versions := range c.values {
+		snapshot[key] = slices.Clone(versions)
+	}
+
+	return snapshot
+}
+
 func (c *Cache) IsAtMaxSize() bool {
-	return c.len == c.maxLen
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.len >= c.maxLen
 }
 
-func (c *Cache) Swap() map[string]string {
+func (c *Cache) Swap() map[string][]Entry {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	currCache := c.values
-	c.values = make(map[string]string)
+	c.values = make(map[string][]Entry)
 	c.len = 0
 	return currCache
 }
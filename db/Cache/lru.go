@@ -0,0 +1,105 @@
+package cache
+
+import "container/list"
+
+type readEntry struct {
+	key   string
+	value string
+	size  int64
+	// segment is the list of the policy the entry is in
+	segment *segment
+}
+
+// segment is a list of entries ordered from most to least recently used
+// that keeps track of their size
+type segment struct {
+	entries *list.List
+	size    int64
+}
+
+func newSegment() *segment {
+	return &segment{entries: list.New()}
+}
+
+func (s *segment) pushFront(entry *readEntry) *list.Element {
+	entry.segment = s
+	s.size += entry.size
+
+	return s.entries.PushFront(entry)
+}
+
+func (s *segment) remove(elem *list.Element) *readEntry {
+	entry := s.entries.Remove(elem).(*readEntry)
+	s.size -= entry.size
+
+	return entry
+}
+
+// resize changes the value of the entry in place
+func (s *segment) resize(elem *list.Element, value string, size int64) {
+	entry := elem.Value.(*readEntry)
+	s.size += size - entry.size
+	entry.value = value
+	entry.size = size
+}
+
+func (s *segment) back() *list.Element {
+	return s.entries.Back()
+}
+
+func (s *segment) len() int {
+	return s.entries.Len()
+}
+
+type lru struct {
+	capacity int64
+	items    map[string]*list.Element
+	order    *segment
+}
+
+func newLRU(capacity int64) *lru {
+	return &lru{capacity: capacity, items: map[string]*list.Element{}, order: newSegment()}
+}
+
+func (c *lru) get(key string) (string, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+
+	c.order.entries.MoveToFront(elem)
+	return elem.Value.(*readEntry).value, true
+}
+
+func (c *lru) set(key, value string, size int64) int {
+	if elem, ok := c.items[key]; ok {
+		c.order.resize(elem, value, size)
+		c.order.entries.MoveToFront(elem)
+	} else {
+		c.items[key] = c.order.pushFront(&readEntry{key: key, value: value, size: size})
+	}
+
+	evicted := 0
+	for c.order.size > c.capacity {
+		entry := c.order.remove(c.order.back())
+		delete(c.items, entry.key)
+		evicted += 1
+	}
+
+	return evicted
+}
+
+func (c *lru) remove(key string) {
+	if elem, ok := c.items[key]; ok {
+		c.order.remove(elem)
+		delete(c.items, key)
+	}
+}
+
+func (c *lru) len() int {
+	return c.order.len()
+}
+
+func (c *lru) bytes() int64 {
+	return c.order.size
+}
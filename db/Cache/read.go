@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+type Policy int
+
+const (
+	// PolicyLRU evicts the entry that was used the longest time ago
+	PolicyLRU Policy = iota
+	// PolicyARC balances recently and frequently used entries and adapts the
+	// split between them to the workload
+	PolicyARC
+	// PolicyTinyLFU admits entries into the cache only when they are used
+	// more often than the entry they would replace, which keeps scans from
+	// flushing out hot keys
+	PolicyTinyLFU
+)
+
+const (
+	DEFAULT_READ_SHARDS = 16
+	// entry_overhead is roughly what an entry costs on top of its key and value
+	entry_overhead = 64
+)
+
+type ReadOptions struct {
+	// MaxBytes is how many bytes of keys and values the cache holds
+	MaxBytes int64
+	// Shards splits the cache into independently locked parts, it is rounded
+	// up to a power of two
+	Shards int
+	Policy Policy
+}
+
+type ReadStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Len and Bytes are the number of entries held and their size
+	Len   int
+	Bytes int64
+	// HitRate is the share of lookups that were served from the cache
+	HitRate float64
+}
+
+// policy decides which entries of a shard are kept, it is only called with
+// the lock of the shard held
+type policy interface {
+	get(key string) (string, bool)
+	// set adds or replaces the key and returns how many entries were evicted
+	set(key, value string, size int64) int
+	remove(key string)
+	len() int
+	bytes() int64
+}
+
+type readShard struct {
+	mu     sync.Mutex
+	policy policy
+}
+
+// ReadCache holds values read from the tables on disk. It is bounded by the
+// size of its keys and values and is safe to use from concurrent readers
+type ReadCache struct {
+	shards   []readShard
+	mask     uint64
+	maxEntry int64
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+func NewReadCache(opts ReadOptions) *ReadCache {
+	if opts.Shards <= 0 {
+		opts.Shards = DEFAULT_READ_SHARDS
+	}
+
+	numShards := 1
+	for numShards < opts.Shards {
+		numShards <<= 1
+	}
+
+	capacity := max(opts.MaxBytes/int64(numShards), 1)
+	c := &ReadCache{
+		shards:   make([]readShard, numShards),
+		mask:     uint64(numShards - 1),
+		maxEntry: capacity,
+	}
+
+	for i := range c.shards {
+		switch opts.Policy {
+		case PolicyARC:
+			c.shards[i].policy = newARC(capacity)
+		case PolicyTinyLFU:
+			c.shards[i].policy = newTinyLFU(capacity)
+		default:
+			c.shards[i].policy = newLRU(capacity)
+		}
+	}
+
+	return c
+}
+
+func (c *ReadCache) shard(key string) *readShard {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+
+	return &c.shards[hasher.Sum64()&c.mask]
+}
+
+func entrySize(key, value string) int64 {
+	return int64(len(key)+len(value)) + entry_overhead
+}
+
+func (c *ReadCache) Get(key string) (string, bool) {
+	shard := c.shard(key)
+	shard.mu.Lock()
+	value, ok := shard.policy.get(key)
+	shard.mu.Unlock()
+
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+
+	return value, ok
+}
+
+// Set caches the value of the key, values bigger than a shard are not cached
+func (c *ReadCache) Set(key, value string) {
+	size := entrySize(key, value)
+	shard := c.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if size > c.maxEntry {
+		shard.policy.remove(key)
+		return
+	}
+
+	evicted := shard.policy.set(key, value, size)
+	if evicted > 0 {
+		c.evictions.Add(uint64(evicted))
+	}
+}
+
+// Invalidate drops the key, it has to be called whenever the key is written
+// or deleted so readers do not get a stale value
+func (c *ReadCache) Invalidate(key string) {
+	shard := c.shard(key)
+	shard.mu.Lock()
+	shard.policy.remove(key)
+	shard.mu.Unlock()
+}
+
+func (c *ReadCache) Stats() ReadStats {
+	stats := ReadStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mu.Lock()
+		stats.Len += shard.policy.len()
+		stats.Bytes += shard.policy.bytes()
+		shard.mu.Unlock()
+	}
+
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(lookups)
+	}
+
+	return stats
+}
@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+var policies = []struct {
+	name   string
+	policy Policy
+}{
+	{name: "lru", policy: PolicyLRU},
+	{name: "arc", policy: PolicyARC},
+	{name: "tinylfu", policy: PolicyTinyLFU},
+}
+
+func TestReadCacheGetSetInvalidate(t *testing.T) {
+	for _, tc := range policies {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewReadCache(ReadOptions{MaxBytes: 1 << 20, Policy: tc.policy})
+
+			_, ok := c.Get("a")
+			if ok {
+				t.Fatalf("expected a miss on an empty cache")
+			}
+
+			c.Set("a", "val")
+			val, ok := c.Get("a")
+			if !ok || val != "val" {
+				t.Fatalf("expected val, got %s %v", val, ok)
+			}
+
+			c.Set("a", "newer")
+			val, ok = c.Get("a")
+			if !ok || val != "newer" {
+				t.Fatalf("expected newer, got %s %v", val, ok)
+			}
+
+			c.Invalidate("a")
+			_, ok = c.Get("a")
+			if ok {
+				t.Fatalf("expected a to be gone after the invalidation")
+			}
+
+			stats := c.Stats()
+			if stats.Hits != 2 || stats.Misses != 2 {
+				t.Errorf("expected 2 hits and 2 misses, got %+v", stats)
+			}
+			if stats.Len != 0 || stats.Bytes != 0 {
+				t.Errorf("expected an empty cache, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestReadCacheStaysWithinItsSize(t *testing.T) {
+	const maxBytes = 16 << 10
+	for _, tc := range policies {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewReadCache(ReadOptions{MaxBytes: maxBytes, Shards: 4, Policy: tc.policy})
+
+			for i := 0; i < 5_000; i += 1 {
+				key := fmt.Sprintf("key_%d", i)
+				c.Set(key, "some value that takes up space")
+				c.Get(key)
+			}
+
+			stats := c.Stats()
+			if stats.Bytes > maxBytes {
+				t.Errorf("expected at most %d bytes, got %d", maxBytes, stats.Bytes)
+			}
+			if stats.Evictions == 0 {
+				t.Errorf("expected evictions, got %+v", stats)
+			}
+			if stats.Len == 0 {
+				t.Errorf("expected the cache to still hold entries, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestReadCacheSkipsEntriesBiggerThanAShard(t *testing.T) {
+	c := NewReadCache(ReadOptions{MaxBytes: 1 << 10, Shards: 4})
+
+	c.Set("big", string(make([]byte, 1<<10)))
+	_, ok := c.Get("big")
+	if ok {
+		t.Errorf("expected an entry bigger than its shard not to be cached")
+	}
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRU(3 * entrySize("a", "1"))
+	c.set("a", "1", entrySize("a", "1"))
+	c.set("b", "2", entrySize("b", "2"))
+	c.set("c", "3", entrySize("c", "3"))
+	c.get("a")
+
+	evicted := c.set("d", "4", entrySize("d", "4"))
+	if evicted != 1 {
+		t.Fatalf("expected one eviction, got %d", evicted)
+	}
+
+	if _, ok := c.get("b"); ok {
+		t.Errorf("expected b to have been evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+}
+
+func TestARCKeepsFrequentKeysThroughAScan(t *testing.T) {
+	size := entrySize("hot_0", "val")
+	c := newARC(20 * size)
+
+	for round := 0; round < 3; round += 1 {
+		for i := 0; i < 10; i += 1 {
+			key := fmt.Sprintf("hot_%d", i)
+			if _, ok := c.get(key); !ok {
+				c.set(key, "val", size)
+			}
+		}
+	}
+
+	for i := 0; i < 100; i += 1 {
+		c.set(fmt.Sprintf("cold_%d", i), "val", size)
+	}
+
+	for i := 0; i < 10; i += 1 {
+		if _, ok := c.get(fmt.Sprintf("hot_%d", i)); !ok {
+			t.Errorf("expected hot_%d to survive the scan", i)
+		}
+	}
+}
+
+func TestTinyLFUKeepsFrequentKeysThroughAScan(t *testing.T) {
+	size := entrySize("hot_0", "val")
+	c := newTinyLFU(100 * size)
+
+	for round := 0; round < 5; round += 1 {
+		for i := 0; i < 50; i += 1 {
+			key := fmt.Sprintf("hot_%d", i)
+			if _, ok := c.get(key); !ok {
+				c.set(key, "val", size)
+			}
+		}
+	}
+
+	for i := 0; i < 1_000; i += 1 {
+		key := fmt.Sprintf("cold_%d", i)
+		c.get(key)
+		c.set(key, "val", size)
+	}
+
+	kept := 0
+	for i := 0; i < 50; i += 1 {
+		if _, ok := c.get(fmt.Sprintf("hot_%d", i)); ok {
+			kept += 1
+		}
+	}
+
+	if kept < 45 {
+		t.Errorf("expected the hot keys to survive the scan, only %d of 50 did", kept)
+	}
+}
+
+func TestReadCacheConcurrentUse(t *testing.T) {
+	for _, tc := range policies {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewReadCache(ReadOptions{MaxBytes: 32 << 10, Policy: tc.policy})
+
+			wg := sync.WaitGroup{}
+			for worker := 0; worker < 8; worker += 1 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 2_000; i += 1 {
+						key := fmt.Sprintf("key_%d", (i*7+worker)%500)
+						if _, ok := c.Get(key); !ok {
+							c.Set(key, key)
+						}
+						if i%10 == 0 {
+							c.Invalidate(key)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			stats := c.Stats()
+			if stats.Hits+stats.Misses != 8*2_000 {
+				t.Errorf("expected every lookup to be counted, got %+v", stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"container/list"
+	"hash/fnv"
+)
+
+const (
+	// window_share and protected_share are the percentage of the capacity
+	// given to the admission window and to the protected part of the main cache
+	window_share    = 1
+	protected_share = 80
+	sketch_depth    = 4
+	// average_entry_size sizes the frequency sketch from the capacity in bytes
+	average_entry_size = 128
+	// reset_factor is how many additions per counter the sketch takes
+	// before all its counts are halved, so old popularity fades
+	reset_factor = 10
+)
+
+// sketch is a count-min sketch that estimates how often a key was seen
+type sketch struct {
+	rows      [sketch_depth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newSketch(capacity int64) *sketch {
+	width := 64
+	for int64(width) < capacity/average_entry_size {
+		width <<= 1
+	}
+
+	s := &sketch{mask: uint64(width - 1), resetAt: width * reset_factor}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+
+	return s
+}
+
+// indexes derives a counter of every row from two halves of a single hash
+func (s *sketch) indexes(key string) [sketch_depth]uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	sum := hasher.Sum64()
+	h1, h2 := sum, (sum>>32)|1
+
+	var indexes [sketch_depth]uint64
+	for i := range indexes {
+		indexes[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+
+	return indexes
+}
+
+func (s *sketch) increment(key string) {
+	for row, i := range s.indexes(key) {
+		if s.rows[row][i] < 15 {
+			s.rows[row][i] += 1
+		}
+	}
+
+	s.additions += 1
+	if s.additions >= s.resetAt {
+		for _, counters := range s.rows {
+			for i := range counters {
+				counters[i] /= 2
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *sketch) estimate(key string) uint8 {
+	estimate := uint8(15)
+	for row, i := range s.indexes(key) {
+		estimate = min(estimate, s.rows[row][i])
+	}
+
+	return estimate
+}
+
+// tinyLFU is a W-TinyLFU cache. New entries go into a small LRU window,
+// entries pushed out of it only make it into the main cache when the
+// sketch has seen them more often than the entry the main cache would
+// evict for them. The main cache is split into a probation part for
+// entries hit once since they were admitted and a protected part for the rest
+type tinyLFU struct {
+	windowCap    int64
+	protectedCap int64
+	mainCap      int64
+	items        map[string]*list.Element
+	window       *segment
+	probation    *segment
+	protected    *segment
+	sketch       *sketch
+}
+
+func newTinyLFU(capacity int64) *tinyLFU {
+	windowCap := max(capacity*window_share/100, 1)
+	mainCap := max(capacity-windowCap, 1)
+
+	return &tinyLFU{
+		windowCap:    windowCap,
+		protectedCap: mainCap * protected_share / 100,
+		mainCap:      mainCap,
+		items:        map[string]*list.Element{},
+		window:       newSegment(),
+		probation:    newSegment(),
+		protected:    newSegment(),
+		sketch:       newSketch(capacity),
+	}
+}
+
+func (c *tinyLFU) get(key string) (string, bool) {
+	c.sketch.increment(key)
+
+	elem, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+
+	c.touch(key, elem)
+	return c.items[key].Value.(*readEntry).value, true
+}
+
+// touch moves a hit entry to the front of its part, entries on probation
+// become protected
+func (c *tinyLFU) touch(key string, elem *list.Element) {
+	entry := elem.Value.(*readEntry)
+	if entry.segment != c.probation {
+		entry.segment.entries.MoveToFront(elem)
+		return
+	}
+
+	c.probation.remove(elem)
+	c.items[key] = c.protected.pushFront(entry)
+
+	for c.protected.size > c.protectedCap && c.protected.len() > 1 {
+		demoted := c.protected.remove(c.protected.back())
+		c.items[demoted.key] = c.probation.pushFront(demoted)
+	}
+}
+
+func (c *tinyLFU) set(key, value string, size int64) int {
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*readEntry).segment.resize(elem, value, size)
+		c.touch(key, elem)
+	} else {
+		c.sketch.increment(key)
+		c.items[key] = c.window.pushFront(&readEntry{key: key, value: value, size: size})
+	}
+
+	evicted := 0
+	for c.window.size > c.windowCap && c.window.len() > 0 {
+		candidate := c.window.remove(c.window.back())
+		if !c.admit(candidate) {
+			delete(c.items, candidate.key)
+			evicted += 1
+			continue
+		}
+
+		for c.probation.size+c.protected.size+candidate.size > c.mainCap {
+			c.evictMain()
+			evicted += 1
+		}
+		c.items[candidate.key] = c.probation.pushFront(candidate)
+	}
+
+	// a value that grew in place can push the main cache over its capacity
+	for c.probation.size+c.protected.size > c.mainCap {
+		c.evictMain()
+		evicted += 1
+	}
+
+	return evicted
+}
+
+// admit decides if the candidate pushed out of the window is worth the
+// entries of the main cache it would take the place of
+func (c *tinyLFU) admit(candidate *readEntry) bool {
+	if candidate.size > c.mainCap {
+		return false
+	}
+
+	if c.probation.size+c.protected.size+candidate.size <= c.mainCap {
+		return true
+	}
+
+	victim := c.probation.back()
+	if victim == nil {
+		victim = c.protected.back()
+	}
+
+	return c.sketch.estimate(candidate.key) > c.sketch.estimate(victim.Value.(*readEntry).key)
+}
+
+// evictMain drops the least recently used entry on probation, or the
+// least recently used protected one when nothing is on probation
+func (c *tinyLFU) evictMain() {
+	from := c.probation
+	if from.len() == 0 {
+		from = c.protected
+	}
+
+	entry := from.remove(from.back())
+	delete(c.items, entry.key)
+}
+
+func (c *tinyLFU) remove(key string) {
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*readEntry).segment.remove(elem)
+		delete(c.items, key)
+	}
+}
+
+func (c *tinyLFU) len() int {
+	return c.window.len() + c.probation.len() + c.protected.len()
+}
+
+func (c *tinyLFU) bytes() int64 {
+	return c.window.size + c.probation.size + c.protected.size
+}
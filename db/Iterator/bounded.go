@@ -0,0 +1,105 @@
+package iterator
+
+// BoundedIterator only shows the keys of another iterator in [start, end),
+// an empty end leaves the range open at the top
+type BoundedIterator struct {
+	it         Iterator
+	start      string
+	end        string
+	positioned bool
+}
+
+func NewBoundedIterator(it Iterator, start, end string) *BoundedIterator {
+	return &BoundedIterator{it: it, start: start, end: end}
+}
+
+// PrefixEnd returns the smallest key bigger than every key with the prefix,
+// an empty string when there is none
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i -= 1 {
+		if end[i] < 0xff {
+			end[i] += 1
+			return string(end[:i+1])
+		}
+	}
+
+	return ""
+}
+
+func (b *BoundedIterator) inBounds() bool {
+	if !b.it.Valid() {
+		return false
+	}
+
+	key := b.it.Key()
+	return key >= b.start && (b.end == "" || key < b.end)
+}
+
+func (b *BoundedIterator) Seek(key string) bool {
+	b.positioned = true
+	b.it.Seek(max(key, b.start))
+	return b.inBounds()
+}
+
+func (b *BoundedIterator) First() bool {
+	return b.Seek(b.start)
+}
+
+func (b *BoundedIterator) Last() bool {
+	b.positioned = true
+	if b.end == "" {
+		b.it.Last()
+		return b.inBounds()
+	}
+
+	// Prev from the first key at or after end, or from past the last key
+	b.it.Seek(b.end)
+	b.it.Prev()
+	return b.inBounds()
+}
+
+func (b *BoundedIterator) Next() bool {
+	if !b.positioned {
+		return b.First()
+	}
+
+	// having run off the start of the range the next key can still be before it
+	if b.it.Next() && b.it.Key() < b.start {
+		return b.First()
+	}
+
+	return b.inBounds()
+}
+
+func (b *BoundedIterator) Prev() bool {
+	if !b.positioned {
+		return false
+	}
+
+	if b.it.Prev() && b.end != "" && b.it.Key() >= b.end {
+		return b.Last()
+	}
+
+	return b.inBounds()
+}
+
+func (b *BoundedIterator) Valid() bool {
+	return b.inBounds()
+}
+
+func (b *BoundedIterator) Key() string {
+	return b.it.Key()
+}
+
+func (b *BoundedIterator) Value() string {
+	return b.it.Value()
+}
+
+func (b *BoundedIterator) Err() error {
+	return b.it.Err()
+}
+
+func (b *BoundedIterator) Close() error {
+	return b.it.Close()
+}
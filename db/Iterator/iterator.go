@@ -0,0 +1,117 @@
+package iterator
+
+import (
+	"sort"
+	"strings"
+)
+
+// Iterator walks keys in ascending order. A new iterator sits before the
+// first key so Next moves it onto the first one. Seek, First, Last, Next and
+// Prev report whether the iterator is on a key afterwards, once it has run
+// off either end Prev or Next bring it back onto the last or first key
+type Iterator interface {
+	// Seek moves to the first key that is not smaller than key
+	Seek(key string) bool
+	First() bool
+	Last() bool
+	Next() bool
+	Prev() bool
+	Valid() bool
+	Key() string
+	Value() string
+	Err() error
+	Close() error
+}
+
+// InternalIterator also yields the tombstones written for deleted keys, the
+// merging iterator needs them to hide older values. It can hold several
+// versions of a key, they come newest first
+type InternalIterator interface {
+	Iterator
+	Tombstone() bool
+	Seq() uint64
+}
+
+type Entry struct {
+	Key       string
+	Value     string
+	Seq       uint64
+	Tombstone bool
+}
+
+// SliceIterator iterates over entries sorted by key
+type SliceIterator struct {
+	entries []Entry
+	// pos is -1 before the first entry and len(entries) after the last one
+	pos int
+}
+
+func NewSliceIterator(entries []Entry) *SliceIterator {
+	return &SliceIterator{entries: entries, pos: -1}
+}
+
+// SortEntries sorts entries by key and the versions of a key newest first,
+// for building a SliceIterator out of a map
+func SortEntries(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key == entries[j].Key {
+			return entries[i].Seq > entries[j].Seq
+		}
+		return entries[i].Key < entries[j].Key
+	})
+}
+
+func (it *SliceIterator) Seek(key string) bool {
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return strings.Compare(it.entries[i].Key, key) != -1
+	})
+	return it.Valid()
+}
+
+func (it *SliceIterator) First() bool {
+	it.pos = 0
+	return it.Valid()
+}
+
+func (it *SliceIterator) Last() bool {
+	it.pos = len(it.entries) - 1
+	return it.Valid()
+}
+
+func (it *SliceIterator) Next() bool {
+	it.pos = min(it.pos+1, len(it.entries))
+	return it.Valid()
+}
+
+func (it *SliceIterator) Prev() bool {
+	it.pos = max(it.pos-1, -1)
+	return it.Valid()
+}
+
+func (it *SliceIterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *SliceIterator) Key() string {
+	return it.entries[it.pos].Key
+}
+
+func (it *SliceIterator) Value() string {
+	return it.entries[it.pos].Value
+}
+
+func (it *SliceIterator) Tombstone() bool {
+	return it.entries[it.pos].Tombstone
+}
+
+func (it *SliceIterator) Seq() uint64 {
+	return it.entries[it.pos].Seq
+}
+
+func (it *SliceIterator) Err() error {
+	return nil
+}
+
+func (it *SliceIterator) Close() error {
+	return nil
+}
@@ -0,0 +1,188 @@
+package iterator
+
+import (
+	"slices"
+	"testing"
+)
+
+func entries(pairs ...string) []Entry {
+	result := []Entry{}
+	for i := 0; i < len(pairs); i += 2 {
+		if pairs[i+1] == "<deleted>" {
+			result = append(result, Entry{Key: pairs[i], Tombstone: true})
+			continue
+		}
+		result = append(result, Entry{Key: pairs[i], Value: pairs[i+1]})
+	}
+
+	return result
+}
+
+func collect(it Iterator) []string {
+	pairs := []string{}
+	for it.Next() {
+		pairs = append(pairs, it.Key()+"="+it.Value())
+	}
+
+	return pairs
+}
+
+func collectBackwards(it Iterator) []string {
+	pairs := []string{}
+	for ok := it.Last(); ok; ok = it.Prev() {
+		pairs = append(pairs, it.Key()+"="+it.Value())
+	}
+
+	return pairs
+}
+
+func newTestMerge() *MergingIterator {
+	return NewMergingIterator([]InternalIterator{
+		NewSliceIterator(entries("b", "new", "d", "<deleted>")),
+		NewSliceIterator(entries("a", "1", "b", "old", "c", "<deleted>", "e", "5")),
+		NewSliceIterator(entries("c", "3", "d", "4", "f", "6")),
+	})
+}
+
+func TestMergingIteratorNewestWins(t *testing.T) {
+	expected := []string{"a=1", "b=new", "e=5", "f=6"}
+
+	got := collect(newTestMerge())
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	slices.Reverse(expected)
+	got = collectBackwards(newTestMerge())
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v backwards, got %v", expected, got)
+	}
+}
+
+func TestMergingIteratorChangesDirection(t *testing.T) {
+	it := newTestMerge()
+
+	if !it.Seek("c") || it.Key() != "e" {
+		t.Fatalf("expected seek to skip the deleted c and d")
+	}
+
+	if !it.Prev() || it.Key() != "b" || it.Value() != "new" {
+		t.Fatalf("expected prev to go back to b=new")
+	}
+
+	if !it.Next() || it.Key() != "e" {
+		t.Fatalf("expected next to go forward to e again")
+	}
+
+	if !it.Next() || it.Key() != "f" || it.Next() {
+		t.Fatalf("expected f to be the last key")
+	}
+
+	if !it.Prev() || it.Key() != "f" {
+		t.Errorf("expected prev past the end to come back to f")
+	}
+}
+
+func TestBoundedIterator(t *testing.T) {
+	it := NewBoundedIterator(newTestMerge(), "b", "f")
+	expected := []string{"b=new", "e=5"}
+
+	got := collect(it)
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	slices.Reverse(expected)
+	got = collectBackwards(it)
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected %v backwards, got %v", expected, got)
+	}
+
+	if it.Seek("a") && it.Key() != "b" {
+		t.Errorf("expected a seek before the range to land on b, got %s", it.Key())
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"":         "",
+		"abc":      "abd",
+		"ab\xff":   "ac",
+		"\xff\xff": "",
+	}
+
+	for prefix, want := range cases {
+		if got := PrefixEnd(prefix); got != want {
+			t.Errorf("expected prefix end of %q to be %q, got %q", prefix, want, got)
+		}
+	}
+}
+
+func newTestVersions(seq uint64) *SnapshotIterator {
+	versions := []Entry{
+		{Key: "a", Value: "a3", Seq: 3},
+		{Key: "a", Value: "a1", Seq: 1},
+		{Key: "b", Value: "b9", Seq: 9},
+		{Key: "c", Seq: 6, Tombstone: true},
+		{Key: "c", Value: "c4", Seq: 4},
+		{Key: "c", Value: "c2", Seq: 2},
+		{Key: "d", Value: "d5", Seq: 5},
+	}
+
+	return NewSnapshotIterator(NewSliceIterator(versions), seq)
+}
+
+func TestSnapshotIteratorShowsVisibleVersions(t *testing.T) {
+	cases := map[uint64][]string{
+		0:  {},
+		2:  {"a=a1", "c=c2"},
+		4:  {"a=a3", "c=c4"},
+		5:  {"a=a3", "c=c4", "d=d5"},
+		10: {"a=a3", "b=b9", "c=", "d=d5"},
+	}
+
+	for seq, expected := range cases {
+		got := collect(newTestVersions(seq))
+		if !slices.Equal(got, expected) {
+			t.Errorf("expected %v at %d, got %v", expected, seq, got)
+		}
+
+		expected = slices.Clone(expected)
+		slices.Reverse(expected)
+		got = collectBackwards(newTestVersions(seq))
+		if !slices.Equal(got, expected) {
+			t.Errorf("expected %v backwards at %d, got %v", expected, seq, got)
+		}
+	}
+
+	it := newTestVersions(4)
+	if !it.Seek("b") || it.Key() != "c" || it.Value() != "c4" {
+		t.Fatalf("expected seek to land on c=c4")
+	}
+	if !it.Prev() || it.Key() != "a" || it.Value() != "a3" {
+		t.Errorf("expected prev to land on a=a3")
+	}
+	if !it.Next() || it.Key() != "c" || it.Value() != "c4" {
+		t.Errorf("expected next to land on c=c4 again")
+	}
+	if it.Next() {
+		t.Errorf("expected nothing after c at 4, got %s", it.Key())
+	}
+}
+
+func TestMergingSnapshotsOfSeveralSources(t *testing.T) {
+	newer := []Entry{{Key: "a", Value: "a7", Seq: 7}, {Key: "b", Seq: 8, Tombstone: true}}
+	older := []Entry{{Key: "a", Value: "a2", Seq: 2}, {Key: "b", Value: "b3", Seq: 3}}
+
+	for seq, expected := range map[uint64][]string{5: {"a=a2", "b=b3"}, 8: {"a=a7"}} {
+		it := NewMergingIterator([]InternalIterator{
+			NewSnapshotIterator(NewSliceIterator(newer), seq),
+			NewSnapshotIterator(NewSliceIterator(older), seq),
+		})
+
+		got := collect(it)
+		if !slices.Equal(got, expected) {
+			t.Errorf("expected %v at %d, got %v", expected, seq, got)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package iterator
+
+import "errors"
+
+type direction int
+
+const (
+	forward direction = iota
+	backward
+)
+
+// MergingIterator merges iterators given newest first. When several of them
+// hold a key the newest one wins and keys whose newest entry is a tombstone
+// are skipped
+type MergingIterator struct {
+	children []InternalIterator
+	// current is the child the merged iterator is on, when it is nil the
+	// iterator ran off the end going forward or off the start going backward
+	current InternalIterator
+	dir     direction
+}
+
+func NewMergingIterator(children []InternalIterator) *MergingIterator {
+	return &MergingIterator{children: children, dir: backward}
+}
+
+func (it *MergingIterator) Seek(key string) bool {
+	for _, child := range it.children {
+		child.Seek(key)
+	}
+	it.dir = forward
+	it.findSmallest()
+
+	return it.skipTombstones()
+}
+
+func (it *MergingIterator) First() bool {
+	for _, child := range it.children {
+		child.First()
+	}
+	it.dir = forward
+	it.findSmallest()
+
+	return it.skipTombstones()
+}
+
+func (it *MergingIterator) Last() bool {
+	for _, child := range it.children {
+		child.Last()
+	}
+	it.dir = backward
+	it.findLargest()
+
+	return it.skipTombstones()
+}
+
+func (it *MergingIterator) Next() bool {
+	if it.current == nil {
+		if it.dir == backward {
+			return it.First()
+		}
+		return false
+	}
+
+	it.next()
+	return it.skipTombstones()
+}
+
+func (it *MergingIterator) Prev() bool {
+	if it.current == nil {
+		if it.dir == forward {
+			return it.Last()
+		}
+		return false
+	}
+
+	it.prev()
+	return it.skipTombstones()
+}
+
+func (it *MergingIterator) next() {
+	key := it.current.Key()
+
+	// coming from the other direction the children sit before the key, move
+	// them onto the first key after it
+	if it.dir == backward {
+		for _, child := range it.children {
+			if child.Seek(key) && child.Key() == key {
+				child.Next()
+			}
+		}
+		it.dir = forward
+		it.findSmallest()
+		return
+	}
+
+	for _, child := range it.children {
+		if child.Valid() && child.Key() == key {
+			child.Next()
+		}
+	}
+	it.findSmallest()
+}
+
+func (it *MergingIterator) prev() {
+	key := it.current.Key()
+
+	if it.dir == forward {
+		for _, child := range it.children {
+			// Seek leaves the child on the first key not smaller than key or
+			// past the end, either way Prev lands on the last key before it
+			child.Seek(key)
+			child.Prev()
+		}
+		it.dir = backward
+		it.findLargest()
+		return
+	}
+
+	for _, child := range it.children {
+		if child.Valid() && child.Key() == key {
+			child.Prev()
+		}
+	}
+	it.findLargest()
+}
+
+// skipTombstones moves on in the current direction while the newest entry
+// of the key the iterator is on is a tombstone
+func (it *MergingIterator) skipTombstones() bool {
+	for it.current != nil && it.current.Tombstone() {
+		if it.dir == forward {
+			it.next()
+		} else {
+			it.prev()
+		}
+	}
+
+	return it.current != nil
+}
+
+// findSmallest picks the child on the smallest key, the first child wins ties
+// as it is the newest
+func (it *MergingIterator) findSmallest() {
+	it.current = nil
+	for _, child := range it.children {
+		if child.Valid() && (it.current == nil || child.Key() < it.current.Key()) {
+			it.current = child
+		}
+	}
+}
+
+func (it *MergingIterator) findLargest() {
+	it.current = nil
+	for _, child := range it.children {
+		if child.Valid() && (it.current == nil || child.Key() > it.current.Key()) {
+			it.current = child
+		}
+	}
+}
+
+func (it *MergingIterator) Valid() bool {
+	return it.current != nil
+}
+
+func (it *MergingIterator) Key() string {
+	return it.current.Key()
+}
+
+func (it *MergingIterator) Value() string {
+	return it.current.Value()
+}
+
+func (it *MergingIterator) Err() error {
+	errs := []error{}
+	for _, child := range it.children {
+		errs = append(errs, child.Err())
+	}
+
+	return errors.Join(errs...)
+}
+
+func (it *MergingIterator) Close() error {
+	errs := []error{}
+	for _, child := range it.children {
+		errs = append(errs, child.Close())
+	}
+
+	return errors.Join(errs...)
+}
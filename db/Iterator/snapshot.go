@@ -0,0 +1,147 @@
+package iterator
+
+// SnapshotIterator shows the versions another iterator holds as they were at
+// a sequence number, for every key only the newest version written at or
+// before it is yielded and keys with no such version are skipped
+type SnapshotIterator struct {
+	it  InternalIterator
+	seq uint64
+	// entry is the version the iterator is on. Going forward it is the entry
+	// the wrapped iterator is on, going backward the wrapped iterator is
+	// already before every version of the key
+	entry Entry
+	valid bool
+	dir   direction
+}
+
+func NewSnapshotIterator(it InternalIterator, seq uint64) *SnapshotIterator {
+	return &SnapshotIterator{it: it, seq: seq, dir: backward}
+}
+
+func (s *SnapshotIterator) Seek(key string) bool {
+	s.it.Seek(key)
+	s.dir = forward
+	return s.findNext()
+}
+
+func (s *SnapshotIterator) First() bool {
+	s.it.First()
+	s.dir = forward
+	return s.findNext()
+}
+
+func (s *SnapshotIterator) Last() bool {
+	s.it.Last()
+	s.dir = backward
+	return s.findPrev()
+}
+
+func (s *SnapshotIterator) Next() bool {
+	if !s.valid {
+		if s.dir == backward {
+			return s.First()
+		}
+		return false
+	}
+
+	// coming from the other direction the wrapped iterator sits before the key
+	if s.dir == backward {
+		s.it.Seek(s.entry.Key)
+		s.dir = forward
+	}
+
+	for s.it.Valid() && s.it.Key() == s.entry.Key {
+		s.it.Next()
+	}
+
+	return s.findNext()
+}
+
+func (s *SnapshotIterator) Prev() bool {
+	if !s.valid {
+		if s.dir == forward {
+			return s.Last()
+		}
+		return false
+	}
+
+	if s.dir == forward {
+		// Seek lands on the newest version of the key or past the end,
+		// either way Prev lands on the last entry before the key
+		s.it.Seek(s.entry.Key)
+		s.it.Prev()
+		s.dir = backward
+	}
+
+	return s.findPrev()
+}
+
+// findNext moves forward onto the first version that is visible at seq
+func (s *SnapshotIterator) findNext() bool {
+	for s.it.Valid() && s.it.Seq() > s.seq {
+		s.it.Next()
+	}
+
+	s.valid = s.it.Valid()
+	if s.valid {
+		s.entry = s.current()
+	}
+
+	return s.valid
+}
+
+// findPrev moves backward over the versions of a key at a time, going
+// backward they come oldest first so the last visible one is kept
+func (s *SnapshotIterator) findPrev() bool {
+	for s.it.Valid() {
+		key := s.it.Key()
+		found := false
+		for s.it.Valid() && s.it.Key() == key {
+			if s.it.Seq() <= s.seq {
+				s.entry = s.current()
+				found = true
+			}
+			s.it.Prev()
+		}
+
+		if found {
+			s.valid = true
+			return true
+		}
+	}
+
+	s.valid = false
+	return false
+}
+
+func (s *SnapshotIterator) current() Entry {
+	return Entry{Key: s.it.Key(), Value: s.it.Value(), Seq: s.it.Seq(), Tombstone: s.it.Tombstone()}
+}
+
+func (s *SnapshotIterator) Valid() bool {
+	return s.valid
+}
+
+func (s *SnapshotIterator) Key() string {
+	return s.entry.Key
+}
+
+func (s *SnapshotIterator) Value() string {
+	return s.entry.Value
+}
+
+func (s *SnapshotIterator) Tombstone() bool {
+	return s.entry.Tombstone
+}
+
+func (s *SnapshotIterator) Seq() uint64 {
+	return s.entry.Seq
+}
+
+func (s *SnapshotIterator) Err() error {
+	return s.it.Err()
+}
+
+func (s *SnapshotIterator) Close() error {
+	return s.it.Close()
+}
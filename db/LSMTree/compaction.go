@@ -0,0 +1,433 @@
+package lsmtree
+
+import (
+	"cmp"
+	"path/filepath"
+	"slices"
+	manifest "stinky-db/db/Manifest"
+	sstable "stinky-db/db/SSTable"
+	"strconv"
+	"strings"
+)
+
+// record_overhead approximates what a record costs on disk on top of its key and value
+const record_overhead = 64
+
+// compactionJob merges inputs out of layer into the overlapping tables of
+// the layer below it, level 0 is layer 0
+type compactionJob struct {
+	layer          int
+	inputs         []LSMTreeNode
+	overlapping    []LSMTreeNode
+	dropTombstones bool
+}
+
+func (lsm *LSMTree) compactionWorker() {
+	defer lsm.wg.Done()
+
+	for {
+		lsm.mu.Lock()
+		for len(lsm.queue) == 0 && !lsm.closed {
+			lsm.cond.Wait()
+		}
+
+		if lsm.closed {
+			lsm.mu.Unlock()
+			return
+		}
+
+		job := lsm.queue[0]
+		lsm.queue = lsm.queue[1:]
+		lsm.mu.Unlock()
+
+		err := lsm.runCompaction(job)
+
+		lsm.mu.Lock()
+		lsm.busy[job.layer] = false
+		lsm.busy[job.layer+1] = false
+		lsm.pending -= 1
+		if err != nil && lsm.bgErr == nil {
+			lsm.bgErr = err
+		}
+		lsm.maybeScheduleCompactions()
+		lsm.cond.Broadcast()
+		lsm.mu.Unlock()
+	}
+}
+
+// maybeScheduleCompactions must be called with lsm.mu held. It queues a
+// job for level 0 once it is full and for every layer that is over its size
+// budget, as long as no other job is working on the same layers
+func (lsm *LSMTree) maybeScheduleCompactions() {
+	if lsm.closed || lsm.bgErr != nil {
+		return
+	}
+
+	if len(lsm.Level_0) >= lsm.Options.Level0MaxTables && !lsm.busy[0] && !lsm.busy[1] {
+		inputs := slices.Clone(lsm.Level_0)
+		start, end := keyRange(inputs)
+		lsm.enqueue(compactionJob{
+			layer:          0,
+			inputs:         inputs,
+			overlapping:    lsm.overlapping("1", start, end),
+			dropTombstones: lsm.isBottomLayer("1"),
+		})
+	}
+
+	for _, name := range lsm.layerNames() {
+		layer, _ := strconv.Atoi(name)
+		if lsm.busy[layer] || lsm.busy[layer+1] || layerSize(lsm.Layers[name]) <= lsm.layerMaxBytes(layer) {
+			continue
+		}
+
+		nextName := strconv.Itoa(layer + 1)
+		input := lsm.pickTable(name)
+		minMax := input.Table.FileIndex.MinMax
+		lsm.compactPointers[name] = minMax.EndKey
+
+		lsm.enqueue(compactionJob{
+			layer:          layer,
+			inputs:         []LSMTreeNode{input},
+			overlapping:    lsm.overlapping(nextName, minMax.StartKey, minMax.EndKey),
+			dropTombstones: lsm.isBottomLayer(nextName),
+		})
+	}
+}
+
+// CompactAll merges every level into the one below it, top down, until all
+// tables are in the deepest layer. Each level is merged in one go so this is
+// meant for maintenance rather than for running next to heavy traffic
+func (lsm *LSMTree) CompactAll() error {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+
+	for layer := 0; layer < lsm.bottomLayer(); layer += 1 {
+		for (lsm.busy[layer] || lsm.busy[layer+1]) && lsm.bgErr == nil && !lsm.closed {
+			lsm.cond.Wait()
+		}
+		if lsm.closed {
+			return ClosedErr
+		}
+		if lsm.bgErr != nil {
+			return lsm.bgErr
+		}
+
+		inputs := slices.Clone(lsm.Level_0)
+		if layer > 0 {
+			inputs = slices.Clone(lsm.Layers[strconv.Itoa(layer)])
+		}
+		if len(inputs) == 0 {
+			continue
+		}
+
+		nextName := strconv.Itoa(layer + 1)
+		start, end := keyRange(inputs)
+		lsm.enqueue(compactionJob{
+			layer:          layer,
+			inputs:         inputs,
+			overlapping:    lsm.overlapping(nextName, start, end),
+			dropTombstones: lsm.isBottomLayer(nextName),
+		})
+
+		for lsm.busy[layer] && lsm.bgErr == nil && !lsm.closed {
+			lsm.cond.Wait()
+		}
+	}
+
+	if lsm.closed {
+		return ClosedErr
+	}
+
+	return lsm.bgErr
+}
+
+// bottomLayer is the deepest layer holding tables, at least layer 1
+func (lsm *LSMTree) bottomLayer() int {
+	bottom := 1
+	for name, nodes := range lsm.Layers {
+		layer, _ := strconv.Atoi(name)
+		if len(nodes) > 0 {
+			bottom = max(bottom, layer)
+		}
+	}
+
+	return bottom
+}
+
+func (lsm *LSMTree) enqueue(job compactionJob) {
+	lsm.busy[job.layer] = true
+	lsm.busy[job.layer+1] = true
+	lsm.pending += 1
+	lsm.queue = append(lsm.queue, job)
+	lsm.cond.Broadcast()
+}
+
+func (lsm *LSMTree) runCompaction(job compactionJob) error {
+	from := strconv.Itoa(job.layer)
+	to := strconv.Itoa(job.layer + 1)
+
+	if job.layer > 0 && len(job.inputs) == 1 && len(job.overlapping) == 0 {
+		return lsm.moveTable(job.layer, job.inputs[0])
+	}
+
+	// the next layer holds older data than the inputs, level 0 inputs are ordered oldest first already
+	outputs, err := lsm.mergeTables(slices.Concat(job.overlapping, job.inputs), job.layer+1, job.dropTombstones)
+	if err != nil {
+		return err
+	}
+
+	// the inputs stay live until the edit swapping them for the outputs is in the manifest
+	edit := manifest.VersionEdit{}
+	for _, node := range job.inputs {
+		edit.Removed = append(edit.Removed, manifest.DeletedFile{Level: job.layer, Num: node.FileNum})
+	}
+	for _, node := range job.overlapping {
+		edit.Removed = append(edit.Removed, manifest.DeletedFile{Level: job.layer + 1, Num: node.FileNum})
+	}
+	for _, node := range outputs {
+		edit.Added = append(edit.Added, fileMeta(job.layer+1, node))
+	}
+
+	err = lsm.versions.LogAndApply(edit)
+	if err != nil {
+		lsm.removeTableFiles(outputs)
+		return err
+	}
+
+	lsm.mu.Lock()
+	if job.layer == 0 {
+		lsm.Level_0 = removeNodes(lsm.Level_0, job.inputs)
+	} else {
+		lsm.removeFromLayer(from, job.inputs)
+	}
+	lsm.installOutputs(to, job.overlapping, outputs)
+	lsm.mu.Unlock()
+
+	return lsm.removeTableFiles(slices.Concat(job.inputs, job.overlapping))
+}
+
+func (lsm *LSMTree) layerMaxBytes(layer int) int64 {
+	budget := lsm.Options.Layer1MaxBytes
+	for i := 1; i < layer; i += 1 {
+		budget *= int64(compaction_ratio)
+	}
+
+	return budget
+}
+
+func layerSize(nodes []LSMTreeNode) int64 {
+	size := int64(0)
+	for _, node := range nodes {
+		size += node.Table.Size
+	}
+
+	return size
+}
+
+func keyRange(nodes []LSMTreeNode) (string, string) {
+	start := nodes[0].Table.FileIndex.MinMax.StartKey
+	end := nodes[0].Table.FileIndex.MinMax.EndKey
+	for _, node := range nodes[1:] {
+		start = min(start, node.Table.FileIndex.MinMax.StartKey)
+		end = max(end, node.Table.FileIndex.MinMax.EndKey)
+	}
+
+	return start, end
+}
+
+// overlapping returns the tables of a layer whose key range intersects [start, end]
+func (lsm *LSMTree) overlapping(layer string, start, end string) []LSMTreeNode {
+	nodes := []LSMTreeNode{}
+	for _, node := range lsm.Layers[layer] {
+		minMax := node.Table.FileIndex.MinMax
+		if strings.Compare(minMax.EndKey, start) == -1 || strings.Compare(minMax.StartKey, end) == 1 {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+// pickTable chooses the table of a layer that starts after the last key
+// compacted out of it, wrapping around to the first table
+func (lsm *LSMTree) pickTable(layer string) LSMTreeNode {
+	nodes := lsm.Layers[layer]
+	pointer, ok := lsm.compactPointers[layer]
+	if ok {
+		for _, node := range nodes {
+			if strings.Compare(node.Table.FileIndex.MinMax.StartKey, pointer) == 1 {
+				return node
+			}
+		}
+	}
+
+	return nodes[0]
+}
+
+// moveTable hands a table to the next layer without rewriting it, there is
+// nothing in the next layer it has to be merged with. The table keeps the
+// codec of the layer it was written for
+func (lsm *LSMTree) moveTable(layer int, node LSMTreeNode) error {
+	err := lsm.versions.LogAndApply(manifest.VersionEdit{
+		Removed: []manifest.DeletedFile{{Level: layer, Num: node.FileNum}},
+		Added:   []manifest.FileMeta{fileMeta(layer+1, node)},
+	})
+	if err != nil {
+		return err
+	}
+
+	from := strconv.Itoa(layer)
+	to := strconv.Itoa(layer + 1)
+
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+
+	lsm.removeFromLayer(from, []LSMTreeNode{node})
+	lsm.installOutputs(to, nil, []LSMTreeNode{node})
+
+	return nil
+}
+
+// mergeTables merges the sources, given oldest first, and writes the result
+// into size bounded tables for the level
+func (lsm *LSMTree) mergeTables(sources []LSMTreeNode, level int, dropTombstones bool) ([]LSMTreeNode, error) {
+	runs := make([][]sstable.Data, 0, len(sources))
+	for _, node := range sources {
+		data, err := node.Table.GetAllElements()
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, data)
+	}
+
+	merged := mergeRuns(runs, lsm.Snapshots())
+	if dropTombstones {
+		merged = sstable.DropTombstones(merged)
+	}
+
+	outputs := []LSMTreeNode{}
+	for _, data := range splitTables(merged, lsm.Options.TargetFileSize) {
+		fileNum, path := lsm.newTablePath()
+		node, err := lsm.writeTable(data, level, fileNum, path)
+		if err != nil {
+			lsm.removeTableFiles(outputs)
+			return nil, err
+		}
+		outputs = append(outputs, node)
+	}
+
+	return outputs, nil
+}
+
+// splitTables cuts sorted records into runs of about targetSize bytes
+func splitTables(data []sstable.Data, targetSize int64) [][]sstable.Data {
+	tables := [][]sstable.Data{}
+	start := 0
+	size := int64(0)
+	for i, keyVal := range data {
+		size += int64(len(keyVal.Key) + len(keyVal.Value) + record_overhead)
+		if i != len(data)-1 && (size < targetSize || data[i+1].Key == keyVal.Key) {
+			// the versions of a key stay in one table so tables in a layer never overlap
+			continue
+		}
+
+		tables = append(tables, data[start:i+1])
+		start = i + 1
+		size = 0
+	}
+
+	return tables
+}
+
+// mergeRuns merges sorted runs given oldest first into the versions of each
+// key newest first. Only the newest version of a key and the versions one of
+// the snapshots still reads are kept, the newest run wins between records
+// that have no sequence number
+func mergeRuns(runs [][]sstable.Data, snapshots []uint64) []sstable.Data {
+	newestFirst := slices.Clone(runs)
+	slices.Reverse(newestFirst)
+	all := slices.Concat(newestFirst...)
+	slices.SortStableFunc(all, func(a, b sstable.Data) int {
+		if a.Key != b.Key {
+			return strings.Compare(a.Key, b.Key)
+		}
+		return cmp.Compare(b.Seq, a.Seq)
+	})
+
+	merged := make([]sstable.Data, 0, len(all))
+	for i, keyVal := range all {
+		if i > 0 && all[i-1].Key == keyVal.Key && !readBySnapshot(keyVal.Seq, all[i-1].Seq, snapshots) {
+			continue
+		}
+		merged = append(merged, keyVal)
+	}
+
+	return merged
+}
+
+// writeTable writes the table of a level into the compaction dir and only
+// moves it into the data dir once it is complete
+func (lsm *LSMTree) writeTable(data []sstable.Data, level int, fileNum uint64, path string) (LSMTreeNode, error) {
+	table := sstable.GenerateFromSorted(data, filepath.Join(lsm.CompactionDir, filepath.Base(path)))
+	table.FS = lsm.fs
+	table.BlockCache = lsm.Options.BlockCache
+	table.TableCache = lsm.tableCache
+	table.Options = lsm.tableOptions(level)
+
+	err := table.WriteToFile()
+	if err != nil {
+		return LSMTreeNode{}, err
+	}
+
+	err = lsm.fs.Rename(table.FilePath, path)
+	if err != nil {
+		return LSMTreeNode{}, err
+	}
+
+	err = lsm.fs.Sync(lsm.DataDir)
+	if err != nil {
+		return LSMTreeNode{}, err
+	}
+	table.FilePath = path
+
+	node := NewNode(&table)
+	node.FileNum = fileNum
+
+	return node, nil
+}
+
+func (lsm *LSMTree) removeFromLayer(layer string, nodes []LSMTreeNode) {
+	lsm.installOutputs(layer, nodes, nil)
+}
+
+func (lsm *LSMTree) installOutputs(layer string, replaced []LSMTreeNode, outputs []LSMTreeNode) {
+	nodes := removeNodes(lsm.Layers[layer], replaced)
+	nodes = append(nodes, outputs...)
+	sortByStartKey(nodes)
+
+	if len(nodes) == 0 {
+		delete(lsm.Layers, layer)
+		return
+	}
+	lsm.Layers[layer] = nodes
+}
+
+func removeNodes(nodes []LSMTreeNode, toRemove []LSMTreeNode) []LSMTreeNode {
+	return slices.DeleteFunc(slices.Clone(nodes), func(node LSMTreeNode) bool {
+		return slices.ContainsFunc(toRemove, func(removed LSMTreeNode) bool {
+			return removed.Table == node.Table
+		})
+	})
+}
+
+func (lsm *LSMTree) removeTableFiles(nodes []LSMTreeNode) error {
+	for _, node := range nodes {
+		err := node.Table.Remove()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,28 +1,112 @@
 package lsmtree
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"math"
+	"path/filepath"
 	"slices"
+	bloom "stinky-db/db/Bloom"
+	iterator "stinky-db/db/Iterator"
+	manifest "stinky-db/db/Manifest"
 	memtable "stinky-db/db/MemTable"
 	sstable "stinky-db/db/SSTable"
+	vfs "stinky-db/db/VFS"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type LSMTreeNode struct {
 	Table       *sstable.Table
-	BloomFilter any // for now
+	BloomFilter *bloom.Filter
+	// FileNum identifies the table in the manifest
+	FileNum uint64
 }
 
+// LevelInfo describes the tables of one level, level 0 comes first and
+// layer n is level n
+type LevelInfo struct {
+	Level  int         `json:"level"`
+	Tables []TableInfo `json:"tables"`
+}
+
+type TableInfo struct {
+	FileNum    uint64                  `json:"file_num"`
+	Name       string                  `json:"name"`
+	Size       int64                   `json:"size"`
+	MinMax     sstable.MinMax          `json:"min_max"`
+	BlockCache sstable.BlockCacheStats `json:"block_cache"`
+}
+
+type Options struct {
+	// BloomBitsPerKey sizes the bloom filters of new tables, see sstable.WriteOptions
+	BloomBitsPerKey int
+	// Level0MaxTables is how many tables level 0 collects before they are compacted into layer 1
+	Level0MaxTables int
+	// TargetFileSize is roughly how many bytes of records compaction writes into a single table
+	TargetFileSize int64
+	// Layer1MaxBytes is the size budget of layer 1, every deeper layer gets
+	// compaction_ratio times the budget of the one above it
+	Layer1MaxBytes int64
+	// Level0SlowdownTables is the level 0 size from which writers should be slowed down
+	Level0SlowdownTables int
+	// Level0StopTables is the level 0 size at which InsertMemtable blocks until compaction catches up
+	Level0StopTables int
+	// CompactionWorkers is how many compactions can run in the background at once
+	CompactionWorkers int
+	// FS holds the tables and the manifest, nil is vfs.Default
+	FS vfs.FS
+	// BlockCache holds the decoded blocks of the tables, nil is sstable.SharedBlockCache
+	BlockCache *sstable.BlockCache
+	// MaxOpenTables is how many table files are kept open between reads
+	MaxOpenTables int
+	// Mmap reads the tables out of memory mappings of their files, see sstable.TableCacheOptions
+	Mmap bool
+	// Compression holds the codec of the data blocks of every level, level
+	// i uses Compression[i] and levels past the end use the last entry.
+	// Without any entries blocks are stored uncompressed
+	Compression []sstable.Codec
+}
+
+var (
+	ClosedErr = errors.New("lsm tree is closed")
+)
+
 type LSMTree struct {
 	Level_0       []LSMTreeNode
 	Layers        map[string][]LSMTreeNode
 	DataDir       string
 	CompactionDir string
+	Options       Options
+	BloomStats    *bloom.Stats
+	fs            vfs.FS
+	// tableCache keeps the files of the live tables open
+	tableCache *sstable.TableCache
+	// versions logs every change to the set of live tables into the manifest
+	versions *manifest.VersionSet
+	// compactPointers remember the last key compacted out of each layer so
+	// the next compaction of that layer picks up the table after it
+	compactPointers map[string]string
+	snapshots       snapshotList
+
+	// mu guards the layers, readers hold it for reading while they go
+	// through the tables so compaction can not swap them out underneath
+	mu sync.RWMutex
+	// cond is signalled whenever jobs finish or level 0 changes
+	cond    *sync.Cond
+	queue   []compactionJob
+	pending int
+	// busy marks the layers a queued or running compaction reads from or writes into
+	busy   map[int]bool
+	bgErr  error
+	closed bool
+	wg     sync.WaitGroup
 }
 
 var (
 	layer_prefix        = "layer_"
+	table_ext           = ".sst"
 	compaction_ratio    = 10 // each new layer has x10 more sstables
 	compaction_dir      = "./compaction"
 	test_compaction_dir = "./test-compaction"
@@ -30,137 +114,555 @@ var (
 	test_data_dir       = "./test-data"
 	test_data_gen_dir   = "./test-data-gen"
 	lvl_0_max_len       = 4
+	lvl_0_slowdown_len  = 8
+	lvl_0_stop_len      = 12
+	compaction_workers  = 2
+	target_file_size    = int64(2 << 20)
+	layer_1_max_bytes   = int64(10 << 20)
 )
 
+func (o Options) codec(level int) sstable.Codec {
+	if len(o.Compression) == 0 {
+		return sstable.CodecNone
+	}
+
+	return o.Compression[min(level, len(o.Compression)-1)]
+}
+
+func (o Options) withDefaults() Options {
+	if o.Level0MaxTables <= 0 {
+		o.Level0MaxTables = lvl_0_max_len
+	}
+
+	if o.TargetFileSize <= 0 {
+		o.TargetFileSize = target_file_size
+	}
+
+	if o.Layer1MaxBytes <= 0 {
+		o.Layer1MaxBytes = layer_1_max_bytes
+	}
+
+	if o.Level0SlowdownTables <= 0 {
+		o.Level0SlowdownTables = max(lvl_0_slowdown_len, o.Level0MaxTables*2)
+	}
+
+	if o.Level0StopTables <= o.Level0SlowdownTables {
+		o.Level0StopTables = max(lvl_0_stop_len, o.Level0SlowdownTables+o.Level0MaxTables)
+	}
+
+	if o.CompactionWorkers <= 0 {
+		o.CompactionWorkers = compaction_workers
+	}
+
+	if o.FS == nil {
+		o.FS = vfs.Default
+	}
+
+	if o.MaxOpenTables <= 0 {
+		o.MaxOpenTables = sstable.DEFAULT_MAX_OPEN_TABLES
+	}
+
+	return o
+}
+
 func NewNode(ss *sstable.Table) LSMTreeNode {
 	return LSMTreeNode{
-		Table: ss,
+		Table:       ss,
+		BloomFilter: ss.Bloom,
 	}
 }
 
-func NewTree(dataDir, compactionDir string) (LSMTree, error) {
-	var lsmtree LSMTree
+func NewTree(dataDir, compactionDir string) (*LSMTree, error) {
+	return NewTreeWithOptions(dataDir, compactionDir, Options{})
+}
+
+// NewTreeWithOptions loads the tables the manifest in dataDir lists and
+// starts the background compaction workers, Close stops them again. A data
+// dir without a manifest is moved over to one from the tables it holds
+func NewTreeWithOptions(dataDir, compactionDir string, opts Options) (*LSMTree, error) {
+	lsmtree := &LSMTree{}
+	opts = opts.withDefaults()
+	fs := opts.FS
 
-	files, err := os.ReadDir(dataDir)
-	if err != nil {
-		return lsmtree, nil
+	for _, dir := range []string{dataDir, compactionDir} {
+		if err := fs.MkdirAll(dir); err != nil {
+			return lsmtree, err
+		}
 	}
 
-	sortedFileNames := []string{}
-	for _, file := range files {
-		sortedFileNames = append(sortedFileNames, file.Name())
+	versions, err := openVersions(fs, dataDir)
+	if err != nil {
+		return lsmtree, err
 	}
-	slices.Sort(sortedFileNames)
 
+	tableCache := sstable.NewTableCacheWithOptions(sstable.TableCacheOptions{
+		MaxOpenTables: opts.MaxOpenTables,
+		Mmap:          opts.Mmap,
+	})
+
+	version := versions.Current()
 	tables := map[string][]LSMTreeNode{}
 	layer0 := []LSMTreeNode{}
-	for _, fileName := range sortedFileNames {
-		ss, err := sstable.GenerateFromDisk(dataDir + "/" + fileName)
-		if err != nil {
-			return lsmtree, err
-		}
-
-		node := LSMTreeNode{Table: &ss}
+	for _, level := range version.LevelNums() {
+		for _, meta := range version.Levels[level] {
+			ss, err := sstable.GenerateFromFS(fs, filepath.Join(dataDir, meta.Name))
+			if err != nil {
+				versions.Close()
+				return lsmtree, err
+			}
+			ss.BlockCache = opts.BlockCache
+			ss.TableCache = tableCache
 
-		if strings.Contains(fileName, layer_prefix+"0") {
-			layer0 = append(layer0, node)
-		} else {
-			layerPrefix := strings.
-				Split(strings.
-					Split(fileName, layer_prefix)[1], "_")[0]
+			node := NewNode(&ss)
+			node.FileNum = meta.Num
 
-			tables[layerPrefix] = append(tables[layerPrefix], node)
+			// level 0 tables overlap so they stay in the order the manifest added them in
+			if level == 0 {
+				layer0 = append(layer0, node)
+			} else {
+				name := strconv.Itoa(level)
+				tables[name] = append(tables[name], node)
+			}
 		}
 	}
 
+	for _, nodes := range tables {
+		sortByStartKey(nodes)
+	}
+
+	err = removeStrayFiles(fs, dataDir, compactionDir, version.LiveFiles())
+	if err != nil {
+		versions.Close()
+		return lsmtree, err
+	}
+
 	lsmtree.DataDir = dataDir
 	lsmtree.Layers = tables
 	lsmtree.Level_0 = layer0
 	lsmtree.CompactionDir = compactionDir
+	lsmtree.Options = opts
+	lsmtree.BloomStats = &bloom.Stats{}
+	lsmtree.fs = fs
+	lsmtree.tableCache = tableCache
+	lsmtree.versions = versions
+	lsmtree.compactPointers = map[string]string{}
+	lsmtree.busy = map[int]bool{}
+	lsmtree.cond = sync.NewCond(&lsmtree.mu)
+
+	for i := 0; i < lsmtree.Options.CompactionWorkers; i += 1 {
+		lsmtree.wg.Add(1)
+		go lsmtree.compactionWorker()
+	}
 
 	return lsmtree, nil
 }
 
-func (lsm *LSMTree) getLayer0NameNum() int {
-	if len(lsm.Level_0) == 0 {
-		return 1
+func openVersions(fs vfs.FS, dataDir string) (*manifest.VersionSet, error) {
+	exists, err := manifest.Exists(fs, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		return manifest.Open(fs, dataDir)
+	}
+
+	version, err := legacyVersion(fs, dataDir)
+	if err != nil {
+		return nil, err
 	}
 
-	return len(lsm.Level_0) + 1
+	return manifest.Create(fs, dataDir, version)
 }
 
-func (lsm *LSMTree) InsertMemtable(mem *memtable.RBTree) error {
-	if len(lsm.Level_0) != lvl_0_max_len {
-		ss, err := sstable.GenerateFromTree(mem, fmt.Sprintf("%s/%s0_%d", lsm.DataDir, layer_prefix, lsm.getLayer0NameNum()))
+// legacyVersion builds a version out of tables named like layer_1_12 which
+// were written before the data dir had a manifest
+func legacyVersion(fs vfs.FS, dataDir string) (manifest.Version, error) {
+	version := manifest.NewVersion()
+
+	names, err := fs.List(dataDir)
+	if err != nil {
+		return version, err
+	}
+
+	type legacyTable struct {
+		layer   int
+		fileNum int
+		meta    manifest.FileMeta
+	}
+
+	legacy := []legacyTable{}
+	for _, name := range names {
+		layer, fileNum, ok := parseTableName(name)
+		if !ok {
+			continue
+		}
+
+		ss, err := sstable.GenerateFromFS(fs, filepath.Join(dataDir, name))
 		if err != nil {
-			return err
+			return version, err
 		}
-		lsm.Level_0 = append(lsm.Level_0, NewNode(&ss))
-		return nil
+
+		layerNum, _ := strconv.Atoi(layer)
+		node := NewNode(&ss)
+		legacy = append(legacy, legacyTable{layer: layerNum, fileNum: fileNum, meta: fileMeta(layerNum, node)})
 	}
-	err := lsm.compact()
+
+	// the old file numbers give the order level 0 was flushed in
+	slices.SortFunc(legacy, func(a, b legacyTable) int {
+		if a.layer != b.layer {
+			return a.layer - b.layer
+		}
+		return a.fileNum - b.fileNum
+	})
+
+	for _, table := range legacy {
+		table.meta.Num = version.NextFileNum
+		version.NextFileNum += 1
+		version.Levels[table.layer] = append(version.Levels[table.layer], table.meta)
+	}
+
+	return version, nil
+}
+
+// parseTableName splits a name like layer_1_12 into its layer and file number
+func parseTableName(name string) (string, int, bool) {
+	if !strings.HasPrefix(name, layer_prefix) {
+		return "", 0, false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(name, layer_prefix), "_")
+	if len(parts) != 2 {
+		return "", 0, false
+	}
+
+	if _, err := strconv.Atoi(parts[0]); err != nil {
+		return "", 0, false
+	}
+
+	fileNum, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, false
+	}
+
+	return parts[0], fileNum, true
+}
+
+func isTableFile(name string) bool {
+	_, _, legacy := parseTableName(name)
+	return legacy || strings.HasSuffix(name, table_ext)
+}
+
+// removeStrayFiles removes the tables no committed version lists, flushes and
+// compactions that crashed before logging their edit leave them behind
+func removeStrayFiles(fs vfs.FS, dataDir, compactionDir string, live map[string]bool) error {
+	names, err := fs.List(dataDir)
 	if err != nil {
 		return err
 	}
 
-	newLvl0 := []LSMTreeNode{}
-	lsm.Level_0 = newLvl0
+	for _, name := range names {
+		if live[name] || !isTableFile(name) {
+			continue
+		}
 
-	ss, err := sstable.GenerateFromTree(mem, fmt.Sprintf("%s/%s0_%d", lsm.DataDir, layer_prefix, lsm.getLayer0NameNum()))
+		err = fs.Remove(filepath.Join(dataDir, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	names, err = fs.List(compactionDir)
 	if err != nil {
 		return err
 	}
 
-	lsm.Level_0 = append(lsm.Level_0, NewNode(&ss))
+	for _, name := range names {
+		if !isTableFile(name) {
+			continue
+		}
+
+		err = fs.Remove(filepath.Join(compactionDir, name))
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (lsm *LSMTree) compactLayer0() (*sstable.Table, error) {
-	mergedData := []sstable.Data{}
-	for _, ss := range lsm.Level_0 {
-		err := ss.Table.ReadIntoMem()
+func sortByStartKey(nodes []LSMTreeNode) {
+	slices.SortFunc(nodes, func(a, b LSMTreeNode) int {
+		return strings.Compare(a.Table.FileIndex.MinMax.StartKey, b.Table.FileIndex.MinMax.StartKey)
+	})
+}
+
+// Get looks the key up in level 0 from the newest table to the oldest and
+// then through the deeper layers in order, returning the first value found
+func (lsm *LSMTree) Get(key string) (string, error) {
+	return lsm.GetAt(key, math.MaxUint64)
+}
+
+// GetAt returns the newest version of the key written at or before seq
+func (lsm *LSMTree) GetAt(key string, seq uint64) (string, error) {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
+	for i := len(lsm.Level_0) - 1; i >= 0; i -= 1 {
+		val, err := lsm.getFromNode(lsm.Level_0[i], key, seq)
+		if !errors.Is(err, sstable.KeyNotFoundErr) {
+			return val, err
+		}
+	}
+
+	for _, layer := range lsm.layerNames() {
+		for _, node := range lsm.Layers[layer] {
+			val, err := lsm.getFromNode(node, key, seq)
+			if !errors.Is(err, sstable.KeyNotFoundErr) {
+				return val, err
+			}
+		}
+	}
+
+	return "", sstable.KeyNotFoundErr
+}
+
+// getFromNode only opens the table when its bloom filter can not rule the key out
+func (lsm *LSMTree) getFromNode(node LSMTreeNode, key string, seq uint64) (string, error) {
+	if !node.Table.InRange(key) {
+		return "", sstable.KeyNotFoundErr
+	}
+
+	if node.BloomFilter == nil {
+		return node.Table.GetAt(key, seq)
+	}
+
+	mayContain := node.BloomFilter.MayContain(key)
+	lsm.BloomStats.Record(mayContain)
+	if !mayContain {
+		return "", sstable.KeyNotFoundErr
+	}
+
+	val, err := node.Table.GetAt(key, seq)
+	if errors.Is(err, sstable.KeyNotFoundErr) {
+		lsm.BloomStats.RecordFalsePositive()
+	}
+
+	return val, err
+}
+
+// NewIterators returns an iterator for every table, newest data first, the
+// tables stay readable through them even once compaction has replaced them
+func (lsm *LSMTree) NewIterators() ([]iterator.InternalIterator, error) {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
+	nodes := slices.Clone(lsm.Level_0)
+	slices.Reverse(nodes)
+	for _, layer := range lsm.layerNames() {
+		nodes = append(nodes, lsm.Layers[layer]...)
+	}
+
+	iters := make([]iterator.InternalIterator, 0, len(nodes))
+	for _, node := range nodes {
+		it, err := node.Table.NewIterator()
 		if err != nil {
+			for _, opened := range iters {
+				opened.Close()
+			}
 			return nil, err
 		}
+		iters = append(iters, it)
+	}
+
+	return iters, nil
+}
+
+func (lsm *LSMTree) tableOptions(level int) sstable.WriteOptions {
+	return sstable.WriteOptions{BloomBitsPerKey: lsm.Options.BloomBitsPerKey, Codec: lsm.Options.codec(level)}
+}
 
-		mergedData = slices.Concat(mergedData, ss.Table.Data)
+func (lsm *LSMTree) layerNames() []string {
+	names := make([]string, 0, len(lsm.Layers))
+	for name := range lsm.Layers {
+		names = append(names, name)
 	}
 
-	mergedSS := sstable.GenerateFromData(mergedData, lsm.CompactionDir+"/layer_0")
+	slices.SortFunc(names, func(a, b string) int {
+		aNum, _ := strconv.Atoi(a)
+		bNum, _ := strconv.Atoi(b)
+		return aNum - bNum
+	})
+
+	return names
+}
+
+// isBottomLayer reports whether no layer deeper than the given one holds any
+// tables, tombstones written into the bottom layer have nothing left to shadow
+func (lsm *LSMTree) isBottomLayer(layer string) bool {
+	layerNum, _ := strconv.Atoi(layer)
+	for name, nodes := range lsm.Layers {
+		num, _ := strconv.Atoi(name)
+		if num > layerNum && len(nodes) > 0 {
+			return false
+		}
+	}
 
-	return &mergedSS, nil
+	return true
 }
 
-func (lsm *LSMTree) compact() error {
-	compacted0, err := lsm.compactLayer0()
+// newTablePath picks the file number and path of a new table, the level a
+// table is in is only recorded in the manifest
+func (lsm *LSMTree) newTablePath() (uint64, string) {
+	fileNum := lsm.versions.NewFileNum()
+	return fileNum, filepath.Join(lsm.DataDir, fmt.Sprintf("%06d%s", fileNum, table_ext))
+}
+
+func fileMeta(level int, node LSMTreeNode) manifest.FileMeta {
+	minMax := node.Table.FileIndex.MinMax
+	return manifest.FileMeta{
+		Num:      node.FileNum,
+		Name:     filepath.Base(node.Table.FilePath),
+		Level:    level,
+		StartKey: minMax.StartKey,
+		EndKey:   minMax.EndKey,
+		Size:     node.Table.Size,
+	}
+}
+
+// InsertMemtable writes the memtable into level 0 and schedules a background
+// compaction once level 0 is full. It blocks while level 0 is at
+// Level0StopTables so flushes can not outrun compaction
+func (lsm *LSMTree) InsertMemtable(mem *memtable.RBTree) error {
+	lsm.mu.Lock()
+	for len(lsm.Level_0) >= lsm.Options.Level0StopTables && lsm.bgErr == nil && !lsm.closed {
+		lsm.maybeScheduleCompactions()
+		lsm.cond.Wait()
+	}
+	err := lsm.bgErr
+	if lsm.closed {
+		err = ClosedErr
+	}
+	lsm.mu.Unlock()
+
 	if err != nil {
 		return err
 	}
 
-	files, err := os.ReadDir(lsm.DataDir)
+	fileNum, path := lsm.newTablePath()
+	ss := sstable.GenerateFromSorted(sstable.TreeData(mem), path)
+	ss.FS = lsm.fs
+	ss.BlockCache = lsm.Options.BlockCache
+	ss.TableCache = lsm.tableCache
+	ss.Options = lsm.tableOptions(0)
+	err = ss.WriteToFile()
 	if err != nil {
 		return err
 	}
 
-	for _, file := range files {
-		if strings.Contains(file.Name(), layer_prefix+"0") {
-			err = os.Remove(lsm.DataDir + "/" + file.Name())
-			if err != nil {
-				return err
-			}
-		}
+	node := NewNode(&ss)
+	node.FileNum = fileNum
+	err = lsm.versions.LogAndApply(manifest.VersionEdit{
+		Added:        []manifest.FileMeta{fileMeta(0, node)},
+		LastSequence: mem.LastSeq,
+	})
+	if err != nil {
+		lsm.fs.Remove(path)
+		return err
 	}
 
-	if len(lsm.Layers["1"]) == 0 {
-		compacted0.FilePath = fmt.Sprintf("%s/%s1_1", lsm.DataDir, layer_prefix)
-		err = compacted0.WriteToFile()
-		if err != nil {
-			return err
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+
+	lsm.Level_0 = append(lsm.Level_0, node)
+	lsm.maybeScheduleCompactions()
+	lsm.cond.Broadcast()
+
+	return nil
+}
+
+// LastSequence is the highest sequence number written into a table
+func (lsm *LSMTree) LastSequence() uint64 {
+	return lsm.versions.Current().LastSequence
+}
+
+// Levels lists the live tables of level 0, oldest first, and of every layer
+// ordered by their keys
+func (lsm *LSMTree) Levels() []LevelInfo {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
+	levels := []LevelInfo{{Level: 0, Tables: tableInfos(lsm.Level_0)}}
+	for _, name := range lsm.layerNames() {
+		layer, _ := strconv.Atoi(name)
+		levels = append(levels, LevelInfo{Level: layer, Tables: tableInfos(lsm.Layers[name])})
+	}
+
+	return levels
+}
+
+func tableInfos(nodes []LSMTreeNode) []TableInfo {
+	tables := make([]TableInfo, 0, len(nodes))
+	for _, node := range nodes {
+		tables = append(tables, TableInfo{
+			FileNum:    node.FileNum,
+			Name:       filepath.Base(node.Table.FilePath),
+			Size:       node.Table.Size,
+			MinMax:     node.Table.FileIndex.MinMax,
+			BlockCache: node.Table.BlockCacheStats(),
+		})
+	}
+
+	return tables
+}
+
+// OpenTables is how many table files are held open
+func (lsm *LSMTree) OpenTables() int {
+	return lsm.tableCache.Len()
+}
+
+func (lsm *LSMTree) Level0Len() int {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
+	return len(lsm.Level_0)
+}
+
+// WaitForCompactions blocks until no compaction is queued or running and no
+// layer needs one, it returns the error a background compaction failed with
+func (lsm *LSMTree) WaitForCompactions() error {
+	lsm.mu.Lock()
+	defer lsm.mu.Unlock()
+
+	for lsm.bgErr == nil && !lsm.closed {
+		lsm.maybeScheduleCompactions()
+		if lsm.pending == 0 {
+			break
 		}
-		lsm.Layers["1"] = append(lsm.Layers["1"], NewNode(compacted0))
+		lsm.cond.Wait()
+	}
+
+	return lsm.bgErr
+}
+
+// Close waits for running compactions to finish and stops the workers
+func (lsm *LSMTree) Close() error {
+	lsm.mu.Lock()
+	if lsm.closed {
+		lsm.mu.Unlock()
 		return nil
 	}
+	lsm.closed = true
+	lsm.cond.Broadcast()
+	lsm.mu.Unlock()
 
-	return nil
+	lsm.wg.Wait()
+	lsm.tableCache.Close()
+
+	err := lsm.versions.Close()
+	if lsm.bgErr != nil {
+		return lsm.bgErr
+	}
+
+	return err
 }
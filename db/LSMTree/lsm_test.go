@@ -1,46 +1,36 @@
 package lsmtree
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"slices"
 	memtable "stinky-db/db/MemTable"
+	sstable "stinky-db/db/SSTable"
+	vfs "stinky-db/db/VFS"
+	"strconv"
+	"strings"
 	"testing"
 )
 
-func clearDataAndCompactionDir(t *testing.T) {
-	files, err := os.ReadDir(test_data_dir)
-	if err != nil {
-		t.Fatalf("clear dir files error: %+v\n", err)
-	}
-
-	for _, file := range files {
-		err = os.Remove(test_data_dir + "/" + file.Name())
-		if err != nil {
-			t.Fatalf("could not delete file: %+v\n", err)
-		}
-	}
-
-	files, err = os.ReadDir(test_compaction_dir)
-	if err != nil {
-		t.Fatalf("clear dir files error: %+v\n", err)
-	}
-
-	for _, file := range files {
-		err = os.Remove(test_compaction_dir + "/" + file.Name())
-		if err != nil {
-			t.Fatalf("could not delete file: %+v\n", err)
-		}
-	}
+// memOptions keeps the tree in memory, tests then neither share the test data
+// dir nor have to clean it up
+func memOptions(opts Options) Options {
+	opts.FS = vfs.NewMem()
+	return opts
 }
 
 func TestCanInsertToLevel0(t *testing.T) {
-	defer clearDataAndCompactionDir(t)
+	t.Parallel()
+	opts := memOptions(Options{})
 
-	lsm, err := NewTree(test_data_dir, test_compaction_dir)
+	lsm, err := NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
 	if err != nil {
 		t.Errorf("could not make a lsm tree: %+v\n", err)
 	}
+	defer lsm.Close()
 
 	mem := memtable.NewRBTree(0)
 	mem.Insert("a", "val")
@@ -53,11 +43,37 @@ func TestCanInsertToLevel0(t *testing.T) {
 	}
 }
 
+// copyDir copies the files of a fixture dir so opening it can not add a manifest to the fixture
+func copyDir(t *testing.T, src string) string {
+	t.Helper()
+
+	dst := t.TempDir()
+	files, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatalf("could not read dir: %+v\n", err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(src + "/" + file.Name())
+		if err != nil {
+			t.Fatalf("could not read file: %+v\n", err)
+		}
+
+		err = os.WriteFile(dst+"/"+file.Name(), data, 0o644)
+		if err != nil {
+			t.Fatalf("could not write file: %+v\n", err)
+		}
+	}
+
+	return dst
+}
+
 func TestGenerateTreeFromWrittenFiles(t *testing.T) {
-	lsm, err := NewTree(test_data_gen_dir, test_compaction_dir)
+	lsm, err := NewTree(copyDir(t, test_data_gen_dir), test_compaction_dir)
 	if err != nil {
 		t.Fatalf("could not generate tree from gen dir: %+v\n", err)
 	}
+	defer lsm.Close()
 
 	if len(lsm.Level_0) != 1 {
 		t.Fatalf("level 0 should only have a single SSTable, got %d\n", len(lsm.Level_0))
@@ -65,12 +81,14 @@ func TestGenerateTreeFromWrittenFiles(t *testing.T) {
 }
 
 func TestCompactLevel0(t *testing.T) {
-	defer clearDataAndCompactionDir(t)
+	t.Parallel()
+	opts := memOptions(Options{})
 
-	lsm, err := NewTree(test_data_dir, test_compaction_dir)
+	lsm, err := NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
 	if err != nil {
 		t.Fatalf("could not make an lsm tree: %+v\n", err)
 	}
+	defer lsm.Close()
 
 	memTables := []*memtable.RBTree{}
 	for i := 0; i < 4; i += 1 {
@@ -100,6 +118,11 @@ func TestCompactLevel0(t *testing.T) {
 		t.Fatalf("could not insert a mem when lsm full: %+v\n", err)
 	}
 
+	err = lsm.WaitForCompactions()
+	if err != nil {
+		t.Fatalf("compaction failed: %+v\n", err)
+	}
+
 	if len(lsm.Level_0) != 1 {
 		t.Fatalf("layer 0 should only have a single item after compaction, got %d\n", len(lsm.Level_0))
 	}
@@ -114,10 +137,11 @@ func TestCompactLevel0(t *testing.T) {
 		t.Fatalf("could not get data for node in 1: %+v\n", err)
 	}
 
+	// the memtables were inserted in reverse so the one holding _0 is the newest
 	expectedValues := []string{
-		"val_3",
-		"val2_3",
-		"val3_3",
+		"val_0",
+		"val2_0",
+		"val3_0",
 	}
 
 	if len(data) != len(expectedValues) {
@@ -130,3 +154,472 @@ func TestCompactLevel0(t *testing.T) {
 		}
 	}
 }
+
+func TestCompactionEvictsCachedBlocks(t *testing.T) {
+	t.Parallel()
+	cache := sstable.NewBlockCache(1 << 20)
+	opts := memOptions(Options{BlockCache: cache})
+
+	lsm, err := NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
+	if err != nil {
+		t.Fatalf("could not make an lsm tree: %+v\n", err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 2; i += 1 {
+		mem := memtable.NewRBTree(0)
+		mem.Insert("a", fmt.Sprintf("val_%d", i))
+		mem.Insert(fmt.Sprintf("key_%d", i), "val")
+
+		err = lsm.InsertMemtable(mem)
+		if err != nil {
+			t.Fatalf("could not insert mem: %+v\n", err)
+		}
+	}
+
+	for _, key := range []string{"a", "key_0", "key_1"} {
+		_, err = lsm.Get(key)
+		if err != nil {
+			t.Fatalf("could not get %s: %+v\n", key, err)
+		}
+	}
+
+	if cache.Size() == 0 {
+		t.Fatalf("expected the reads to fill the block cache")
+	}
+
+	err = lsm.CompactAll()
+	if err != nil {
+		t.Fatalf("could not compact: %+v\n", err)
+	}
+
+	if cache.Size() != 0 {
+		t.Errorf("expected the blocks of the compacted tables to be evicted, %d bytes are left", cache.Size())
+	}
+
+	val, err := lsm.Get("a")
+	if err != nil || val != "val_1" {
+		t.Fatalf("expected val_1, got %s %+v", val, err)
+	}
+
+	levels := lsm.Levels()
+	table := levels[len(levels)-1].Tables[0]
+	if table.BlockCache.Misses != 1 || table.BlockCache.Blocks != 1 {
+		t.Errorf("expected the read to cache the block of the new table, got %+v", table.BlockCache)
+	}
+}
+
+func TestCompressionIsChosenPerLevel(t *testing.T) {
+	t.Parallel()
+	opts := memOptions(Options{Compression: []sstable.Codec{sstable.CodecNone, sstable.CodecSnappy, sstable.CodecFlate}})
+
+	lsm, err := NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
+	if err != nil {
+		t.Fatalf("could not make an lsm tree: %+v\n", err)
+	}
+	defer lsm.Close()
+
+	mem := memtable.NewRBTree(0)
+	for i := 0; i < 2000; i += 1 {
+		mem.Insert(fmt.Sprintf("key_%04d", i), fmt.Sprintf("val_%d", i%10))
+	}
+
+	err = lsm.InsertMemtable(mem)
+	if err != nil {
+		t.Fatalf("could not insert mem: %+v\n", err)
+	}
+
+	codecs := func(table *sstable.Table) map[sstable.Codec]int {
+		stats, err := table.CompressionStats()
+		if err != nil {
+			t.Fatalf("could not read compression stats: %+v\n", err)
+		}
+		return stats.Blocks
+	}
+
+	flushed := codecs(lsm.Level_0[0].Table)
+	if len(flushed) != 1 || flushed[sstable.CodecNone] == 0 {
+		t.Errorf("expected level 0 to be stored uncompressed, got %+v", flushed)
+	}
+
+	err = lsm.CompactAll()
+	if err != nil {
+		t.Fatalf("could not compact: %+v\n", err)
+	}
+
+	if len(lsm.Layers) == 0 {
+		t.Fatalf("expected compaction to write a layer")
+	}
+
+	for name, layer := range lsm.Layers {
+		level, _ := strconv.Atoi(name)
+		want := opts.codec(level)
+		for _, node := range layer {
+			blocks := codecs(node.Table)
+			if len(blocks) != 1 || blocks[want] == 0 {
+				t.Errorf("expected level %d to use %s, got %+v", level, want, blocks)
+			}
+		}
+	}
+
+	val, err := lsm.Get("key_1234")
+	if err != nil || val != "val_4" {
+		t.Errorf("expected val_4, got %s %+v", val, err)
+	}
+}
+
+func TestCompactionDropsTombstonesInBottomLayer(t *testing.T) {
+	t.Parallel()
+	opts := memOptions(Options{})
+
+	lsm, err := NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
+	if err != nil {
+		t.Fatalf("could not make an lsm tree: %+v\n", err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 5; i += 1 {
+		mem := memtable.NewRBTree(0)
+		mem.Insert(fmt.Sprintf("key_%d", i), "val")
+		if i == 3 {
+			mem.Delete("key_9")
+		}
+
+		err = lsm.InsertMemtable(mem)
+		if err != nil {
+			t.Fatalf("could not insert mem: %+v\n", err)
+		}
+	}
+
+	err = lsm.WaitForCompactions()
+	if err != nil {
+		t.Fatalf("compaction failed: %+v\n", err)
+	}
+
+	data, err := lsm.Layers["1"][0].Table.GetAllElements()
+	if err != nil {
+		t.Fatalf("could not get data for node in 1: %+v\n", err)
+	}
+
+	for _, keyval := range data {
+		if keyval.Delete {
+			t.Errorf("expected tombstones to be dropped from the bottom layer, got %+v", keyval)
+		}
+	}
+
+	if len(data) != 4 {
+		t.Errorf("expected 4 live keys in layer 1, got %d", len(data))
+	}
+}
+
+func TestBloomFiltersSkipTables(t *testing.T) {
+	t.Parallel()
+	opts := memOptions(Options{})
+
+	lsm, err := NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
+	if err != nil {
+		t.Fatalf("could not make an lsm tree: %+v\n", err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 3; i += 1 {
+		mem := memtable.NewRBTree(0)
+		for j := 0; j < 100; j += 1 {
+			mem.Insert(fmt.Sprintf("key_%03d", j*3+i), "val")
+		}
+
+		err = lsm.InsertMemtable(mem)
+		if err != nil {
+			t.Fatalf("could not insert mem: %+v\n", err)
+		}
+	}
+
+	for _, node := range lsm.Level_0 {
+		if node.BloomFilter == nil {
+			t.Fatalf("expected every level 0 node to have a bloom filter")
+		}
+	}
+
+	for i := 0; i < 300; i += 1 {
+		val, err := lsm.Get(fmt.Sprintf("key_%03d", i))
+		if err != nil || val != "val" {
+			t.Fatalf("expected val for key_%03d, got %s %+v", i, val, err)
+		}
+	}
+
+	stats := lsm.BloomStats.Snapshot()
+	if stats.Negatives == 0 {
+		t.Errorf("expected bloom filters to rule out tables, got %+v", stats)
+	}
+
+	if stats.FalsePositiveRate > 0.1 {
+		t.Errorf("false positive rate too high: %+v", stats)
+	}
+}
+
+func checkLayerInvariants(t *testing.T, lsm *LSMTree) {
+	t.Helper()
+
+	for _, name := range lsm.layerNames() {
+		nodes := lsm.Layers[name]
+		for i := 1; i < len(nodes); i += 1 {
+			prev := nodes[i-1].Table.FileIndex.MinMax
+			curr := nodes[i].Table.FileIndex.MinMax
+			if strings.Compare(prev.EndKey, curr.StartKey) != -1 {
+				t.Fatalf("tables in layer %s overlap: %+v and %+v", name, prev, curr)
+			}
+		}
+
+		layer, _ := strconv.Atoi(name)
+		if layerSize(nodes) > lsm.layerMaxBytes(layer) {
+			t.Fatalf("layer %s is over its budget after compaction", name)
+		}
+	}
+}
+
+func TestLeveledCompactionOverManyFlushes(t *testing.T) {
+	t.Parallel()
+	opts := memOptions(Options{TargetFileSize: 1024, Layer1MaxBytes: 2048})
+	lsm, err := NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
+	if err != nil {
+		t.Fatalf("could not make an lsm tree: %+v\n", err)
+	}
+	defer lsm.Close()
+
+	random := rand.New(rand.NewSource(1))
+	expected := map[string]string{}
+	for cycle := 0; cycle < 80; cycle += 1 {
+		mem := memtable.NewRBTree(0)
+		for i := 0; i < 20; i += 1 {
+			key := fmt.Sprintf("key_%04d", random.Intn(1000))
+			if random.Intn(10) == 0 {
+				mem.Delete(key)
+				delete(expected, key)
+				continue
+			}
+
+			val := fmt.Sprintf("val_%d_%d", cycle, i)
+			mem.Insert(key, val)
+			expected[key] = val
+		}
+
+		err = lsm.InsertMemtable(mem)
+		if err != nil {
+			t.Fatalf("could not insert mem %d: %+v\n", cycle, err)
+		}
+
+		if cycle%10 == 9 {
+			err = lsm.WaitForCompactions()
+			if err != nil {
+				t.Fatalf("compaction failed: %+v\n", err)
+			}
+			checkLayerInvariants(t, lsm)
+		}
+	}
+
+	if len(lsm.Layers) < 2 {
+		t.Fatalf("expected compaction to cascade into deeper layers, got %d layers", len(lsm.Layers))
+	}
+
+	checkReads := func(lsm *LSMTree) {
+		for i := 0; i < 1000; i += 1 {
+			key := fmt.Sprintf("key_%04d", i)
+			val, err := lsm.Get(key)
+			want, ok := expected[key]
+			if !ok {
+				if !errors.Is(err, sstable.KeyNotFoundErr) && !errors.Is(err, sstable.KeyDeletedErr) {
+					t.Fatalf("expected %s to be missing, got %s %+v", key, val, err)
+				}
+				continue
+			}
+
+			if err != nil || val != want {
+				t.Fatalf("expected %s for %s, got %s %+v", want, key, val, err)
+			}
+		}
+	}
+	checkReads(lsm)
+	err = lsm.Close()
+	if err != nil {
+		t.Fatalf("could not close lsm tree: %+v\n", err)
+	}
+
+	reopened, err := NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
+	if err != nil {
+		t.Fatalf("could not reopen lsm tree: %+v\n", err)
+	}
+
+	if len(reopened.Level_0) != len(lsm.Level_0) || len(reopened.Layers) != len(lsm.Layers) {
+		t.Fatalf("reopened tree does not match, got %d level 0 tables and %d layers", len(reopened.Level_0), len(reopened.Layers))
+	}
+	defer reopened.Close()
+	checkReads(reopened)
+}
+
+func TestRecoveryOnlyOpensTablesInManifest(t *testing.T) {
+	t.Parallel()
+	opts := memOptions(Options{})
+
+	lsm, err := NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
+	if err != nil {
+		t.Fatalf("could not make an lsm tree: %+v\n", err)
+	}
+
+	for i := 0; i < 2; i += 1 {
+		mem := memtable.NewRBTree(0)
+		mem.Insert("a", fmt.Sprintf("val_%d", i))
+		err = lsm.InsertMemtable(mem)
+		if err != nil {
+			t.Fatalf("could not insert mem: %+v\n", err)
+		}
+	}
+
+	err = lsm.Close()
+	if err != nil {
+		t.Fatalf("could not close lsm tree: %+v\n", err)
+	}
+
+	// a table written by a flush that crashed before logging its edit
+	stray := sstable.GenerateFromSorted([]sstable.Data{{Key: "a", Value: "stray"}}, filepath.Join(test_data_dir, "009999.sst"))
+	stray.FS = opts.FS
+	err = stray.WriteToFile()
+	if err != nil {
+		t.Fatalf("could not write stray table: %+v\n", err)
+	}
+
+	lsm, err = NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
+	if err != nil {
+		t.Fatalf("could not reopen lsm tree: %+v\n", err)
+	}
+	defer lsm.Close()
+
+	if len(lsm.Level_0) != 2 {
+		t.Fatalf("expected the 2 tables in the manifest, got %d", len(lsm.Level_0))
+	}
+
+	val, err := lsm.Get("a")
+	if err != nil || val != "val_1" {
+		t.Errorf("expected val_1, got %s %+v", val, err)
+	}
+
+	exists, err := vfs.Exists(opts.FS, filepath.Join(test_data_dir, "009999.sst"))
+	if err != nil || exists {
+		t.Errorf("expected the stray table to be removed, got %t %+v", exists, err)
+	}
+}
+
+func TestMovesLegacyTablesIntoManifest(t *testing.T) {
+	dir := copyDir(t, test_data_gen_dir)
+	lsm, err := NewTree(dir, test_compaction_dir)
+	if err != nil {
+		t.Fatalf("could not generate tree from gen dir: %+v\n", err)
+	}
+
+	mem := memtable.NewRBTree(0)
+	mem.Insert("zzz", "val")
+	err = lsm.InsertMemtable(mem)
+	if err != nil {
+		t.Fatalf("could not insert mem: %+v\n", err)
+	}
+	lsm.Close()
+
+	lsm, err = NewTree(dir, test_compaction_dir)
+	if err != nil {
+		t.Fatalf("could not reopen tree: %+v\n", err)
+	}
+	defer lsm.Close()
+
+	if len(lsm.Level_0) != 2 {
+		t.Fatalf("expected the legacy table and the new one in level 0, got %d", len(lsm.Level_0))
+	}
+
+	if !strings.HasPrefix(filepath.Base(lsm.Level_0[0].Table.FilePath), layer_prefix) {
+		t.Errorf("expected the legacy table to keep its name and stay oldest, got %s", lsm.Level_0[0].Table.FilePath)
+	}
+}
+
+func TestMergeRunsKeepsHighestSequence(t *testing.T) {
+	runs := [][]sstable.Data{
+		{{Key: "a", Value: "old", Seq: 1}, {Key: "b", Value: "newest", Seq: 9}},
+		{{Key: "a", Value: "new", Seq: 5}, {Key: "b", Value: "stale", Seq: 3}},
+		{{Key: "c", Value: "first"}},
+		{{Key: "c", Value: "second"}},
+	}
+
+	expected := []sstable.Data{
+		{Key: "a", Value: "new", Seq: 5},
+		{Key: "b", Value: "newest", Seq: 9},
+		{Key: "c", Value: "second"},
+	}
+
+	merged := mergeRuns(runs, nil)
+	if !slices.Equal(merged, expected) {
+		t.Errorf("expected %+v, got %+v", expected, merged)
+	}
+}
+
+func TestMergeRunsKeepsVersionsSnapshotsRead(t *testing.T) {
+	runs := [][]sstable.Data{
+		{{Key: "a", Value: "a2", Seq: 2}, {Key: "b", Value: "b1", Seq: 1}},
+		{{Key: "a", Value: "a5", Seq: 5}, {Key: "b", Seq: 4, Delete: true}},
+		{{Key: "a", Value: "a9", Seq: 9}, {Key: "b", Value: "b8", Seq: 8}},
+	}
+
+	// the snapshot at 4 reads a2 and the tombstone of b, the one at 6 reads a5
+	expected := []sstable.Data{
+		{Key: "a", Value: "a9", Seq: 9},
+		{Key: "a", Value: "a5", Seq: 5},
+		{Key: "a", Value: "a2", Seq: 2},
+		{Key: "b", Value: "b8", Seq: 8},
+		{Key: "b", Seq: 4, Delete: true},
+	}
+
+	merged := mergeRuns(runs, []uint64{4, 6})
+	if !slices.Equal(merged, expected) {
+		t.Errorf("expected %+v, got %+v", expected, merged)
+	}
+
+	// a snapshot at 5 reads a5 and the tombstone, which hides nothing once b1 is gone
+	expected = []sstable.Data{expected[0], expected[1], expected[3], expected[4]}
+	merged = mergeRuns(runs, []uint64{5})
+	if !slices.Equal(merged, expected) {
+		t.Errorf("expected %+v, got %+v", expected, merged)
+	}
+
+	if dropped := sstable.DropTombstones(merged); !slices.Equal(dropped, expected[:3]) {
+		t.Errorf("expected the oldest tombstone to be dropped, got %+v", dropped)
+	}
+}
+
+func TestFlushRecordsLastSequence(t *testing.T) {
+	t.Parallel()
+	opts := memOptions(Options{})
+
+	lsm, err := NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
+	if err != nil {
+		t.Fatalf("could not make an lsm tree: %+v\n", err)
+	}
+
+	mem := memtable.NewRBTree(0)
+	mem.InsertWithSeq("a", "val", 41, 0)
+	mem.DeleteWithSeq("b", 42, 0)
+	err = lsm.InsertMemtable(mem)
+	if err != nil {
+		t.Fatalf("could not insert mem: %+v\n", err)
+	}
+
+	err = lsm.Close()
+	if err != nil {
+		t.Fatalf("could not close lsm tree: %+v\n", err)
+	}
+
+	lsm, err = NewTreeWithOptions(test_data_dir, test_compaction_dir, opts)
+	if err != nil {
+		t.Fatalf("could not reopen lsm tree: %+v\n", err)
+	}
+	defer lsm.Close()
+
+	if lsm.LastSequence() != 42 {
+		t.Errorf("expected last sequence 42, got %d", lsm.LastSequence())
+	}
+}
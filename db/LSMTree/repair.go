@@ -0,0 +1,286 @@
+package lsmtree
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	manifest "stinky-db/db/Manifest"
+	sstable "stinky-db/db/SSTable"
+	vfs "stinky-db/db/VFS"
+	"strconv"
+	"strings"
+)
+
+// TableSalvage holds every record that could be read out of the tables of a
+// data dir, Rebuild writes them into fresh tables
+type TableSalvage struct {
+	// Intact names the tables every record was read from, Damaged the ones
+	// records were lost from, Lost describes what was lost per file
+	Intact  []string
+	Damaged []string
+	Lost    map[string][]string
+	// ManifestErr is why the manifest could not be read, every table in the
+	// data dir is salvaged then
+	ManifestErr  error
+	Records      int
+	LastSequence uint64
+
+	fs         vfs.FS
+	dataDir    string
+	runs       []salvagedRun
+	maxFileNum uint64
+}
+
+type salvagedRun struct {
+	level   int
+	fileNum uint64
+	data    []sstable.Data
+}
+
+// SalvageTables reads what it can out of the tables the manifest of dataDir
+// in fs lists. Tables it does not list are left over from flushes and
+// compactions that never committed and are skipped, unless the manifest
+// itself can not be read. Nothing is written
+func SalvageTables(fs vfs.FS, dataDir string) (*TableSalvage, error) {
+	salvage := &TableSalvage{Lost: map[string][]string{}, fs: fs, dataDir: dataDir}
+
+	names, err := fs.List(dataDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return salvage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := manifest.Exists(fs, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var listed map[string]manifest.FileMeta
+	if exists {
+		version, err := manifest.Load(fs, dataDir)
+		if err != nil {
+			salvage.ManifestErr = err
+		} else {
+			salvage.LastSequence = version.LastSequence
+			salvage.maxFileNum = version.NextFileNum
+			listed = map[string]manifest.FileMeta{}
+			for _, metas := range version.Levels {
+				for _, meta := range metas {
+					listed[meta.Name] = meta
+				}
+			}
+		}
+	}
+
+	found := map[string]bool{}
+	for _, name := range names {
+		if num, ok := manifest.ParseManifestName(name); ok {
+			salvage.maxFileNum = max(salvage.maxFileNum, num)
+		}
+		if !isTableFile(name) {
+			continue
+		}
+		found[name] = true
+
+		level, fileNum := tableLevelAndNum(name)
+		salvage.maxFileNum = max(salvage.maxFileNum, fileNum)
+		if listed != nil {
+			meta, ok := listed[name]
+			if !ok {
+				continue
+			}
+			level, fileNum = meta.Level, meta.Num
+		}
+
+		data, lost, err := sstable.Salvage(fs, filepath.Join(dataDir, name))
+		if err != nil {
+			lost = append(lost, err.Error())
+		}
+		if len(lost) > 0 {
+			salvage.Damaged = append(salvage.Damaged, name)
+			salvage.Lost[name] = lost
+		} else {
+			salvage.Intact = append(salvage.Intact, name)
+		}
+
+		for _, keyVal := range data {
+			salvage.LastSequence = max(salvage.LastSequence, keyVal.Seq)
+		}
+		salvage.Records += len(data)
+		salvage.runs = append(salvage.runs, salvagedRun{level: level, fileNum: fileNum, data: data})
+	}
+
+	for name := range listed {
+		if !found[name] {
+			salvage.Lost[name] = []string{"the manifest lists the table but the file is missing"}
+		}
+	}
+
+	return salvage, nil
+}
+
+// tableLevelAndNum reads the level and file number out of a table name,
+// tables named by their file number alone are assumed to be in level 0
+func tableLevelAndNum(name string) (int, uint64) {
+	if layer, fileNum, ok := parseTableName(name); ok {
+		level, _ := strconv.Atoi(layer)
+		return level, uint64(fileNum)
+	}
+
+	fileNum, err := strconv.ParseUint(strings.TrimSuffix(name, table_ext), 10, 64)
+	if err != nil {
+		return 0, 0
+	}
+
+	return 0, fileNum
+}
+
+// Rebuild merges the salvaged records and newer ones, which win over every
+// table, into fresh tables in layer 1 and writes a manifest listing only
+// them. The old tables are only touched once the manifest is in place, the
+// damaged ones are moved into lostDir and the rest removed. It returns the
+// names of the tables written
+func (s *TableSalvage) Rebuild(compactionDir, lostDir string, newer []sstable.Data, opts Options) ([]string, error) {
+	for _, dir := range []string{s.dataDir, compactionDir} {
+		if err := s.fs.MkdirAll(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	// deeper levels hold older data and level 0 was flushed in file number order
+	slices.SortFunc(s.runs, func(a, b salvagedRun) int {
+		if a.level != b.level {
+			return b.level - a.level
+		}
+		return cmp.Compare(a.fileNum, b.fileNum)
+	})
+
+	runs := make([][]sstable.Data, 0, len(s.runs)+1)
+	for _, run := range s.runs {
+		runs = append(runs, run.data)
+	}
+	runs = append(runs, newer)
+
+	lastSequence := s.LastSequence
+	for _, keyVal := range newer {
+		lastSequence = max(lastSequence, keyVal.Seq)
+	}
+
+	// every record ends up in the only layer so no tombstone has anything left to shadow
+	merged := sstable.DropTombstones(mergeRuns(runs, nil))
+
+	opts.FS = s.fs
+	lsm := &LSMTree{DataDir: s.dataDir, CompactionDir: compactionDir, Options: opts.withDefaults(), fs: s.fs}
+	version := manifest.NewVersion()
+	version.NextFileNum = s.maxFileNum + 1
+	version.LastSequence = lastSequence
+
+	written := []LSMTreeNode{}
+	for _, data := range splitTables(merged, lsm.Options.TargetFileSize) {
+		fileNum := version.NextFileNum
+		version.NextFileNum += 1
+
+		node, err := lsm.writeTable(data, 1, fileNum, filepath.Join(s.dataDir, fmt.Sprintf("%06d%s", fileNum, table_ext)))
+		if err != nil {
+			lsm.removeTableFiles(written)
+			return nil, err
+		}
+		written = append(written, node)
+		version.Levels[1] = append(version.Levels[1], fileMeta(1, node))
+	}
+
+	if s.ManifestErr != nil {
+		err := s.moveManifests(lostDir)
+		if err != nil {
+			lsm.removeTableFiles(written)
+			return nil, err
+		}
+	}
+
+	versions, err := manifest.Create(s.fs, s.dataDir, version)
+	if err != nil {
+		lsm.removeTableFiles(written)
+		return nil, err
+	}
+
+	err = versions.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range s.Damaged {
+		_, err = MoveToLost(s.fs, filepath.Join(s.dataDir, name), lostDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = removeStrayFiles(s.fs, s.dataDir, compactionDir, version.LiveFiles())
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(written))
+	for _, node := range written {
+		names = append(names, filepath.Base(node.Table.FilePath))
+	}
+
+	return names, nil
+}
+
+// moveManifests keeps the manifests that could not be read around in lostDir
+// instead of letting the new manifest remove them
+func (s *TableSalvage) moveManifests(lostDir string) error {
+	names, err := s.fs.List(s.dataDir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, ok := manifest.ParseManifestName(name); !ok {
+			continue
+		}
+
+		_, err = MoveToLost(s.fs, filepath.Join(s.dataDir, name), lostDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MoveToLost moves the file into lostDir, adding a suffix to its name when
+// an earlier repair already left a file with that name there. It returns the
+// new path
+func MoveToLost(fs vfs.FS, path, lostDir string) (string, error) {
+	err := fs.MkdirAll(lostDir)
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(path)
+	target := filepath.Join(lostDir, name)
+	for i := 1; ; i += 1 {
+		exists, err := vfs.Exists(fs, target)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			break
+		}
+		target = filepath.Join(lostDir, fmt.Sprintf("%s.%d", name, i))
+	}
+
+	err = fs.Rename(path, target)
+	if err != nil {
+		return "", err
+	}
+
+	return target, fs.Sync(lostDir)
+}
@@ -0,0 +1,70 @@
+package lsmtree
+
+import (
+	"slices"
+	"sync"
+)
+
+// snapshotList counts the live snapshots reading at each sequence number,
+// compaction keeps every version one of them can still read
+type snapshotList struct {
+	mu   sync.Mutex
+	refs map[uint64]int
+}
+
+// AcquireSnapshot keeps the versions visible at seq around until the
+// snapshot is released again
+func (lsm *LSMTree) AcquireSnapshot(seq uint64) {
+	lsm.snapshots.mu.Lock()
+	defer lsm.snapshots.mu.Unlock()
+
+	if lsm.snapshots.refs == nil {
+		lsm.snapshots.refs = map[uint64]int{}
+	}
+	lsm.snapshots.refs[seq] += 1
+}
+
+func (lsm *LSMTree) ReleaseSnapshot(seq uint64) {
+	lsm.snapshots.mu.Lock()
+	defer lsm.snapshots.mu.Unlock()
+
+	lsm.snapshots.refs[seq] -= 1
+	if lsm.snapshots.refs[seq] <= 0 {
+		delete(lsm.snapshots.refs, seq)
+	}
+}
+
+// Snapshots returns the sequence numbers of the live snapshots in ascending order
+func (lsm *LSMTree) Snapshots() []uint64 {
+	lsm.snapshots.mu.Lock()
+	defer lsm.snapshots.mu.Unlock()
+
+	seqs := make([]uint64, 0, len(lsm.snapshots.refs))
+	for seq := range lsm.snapshots.refs {
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+
+	return seqs
+}
+
+// NewestSnapshot returns the sequence number of the newest live snapshot, 0
+// when there is none
+func (lsm *LSMTree) NewestSnapshot() uint64 {
+	lsm.snapshots.mu.Lock()
+	defer lsm.snapshots.mu.Unlock()
+
+	newest := uint64(0)
+	for seq := range lsm.snapshots.refs {
+		newest = max(newest, seq)
+	}
+
+	return newest
+}
+
+// readBySnapshot reports whether a snapshot reads the version of a key
+// written at seq rather than the next newer version written at newer
+func readBySnapshot(seq, newer uint64, snapshots []uint64) bool {
+	i, _ := slices.BinarySearch(snapshots, seq)
+	return i < len(snapshots) && snapshots[i] < newer
+}
@@ -0,0 +1,397 @@
+package manifest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	vfs "stinky-db/db/VFS"
+	wal "stinky-db/db/WAL"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	current_file      = "CURRENT"
+	manifest_prefix   = "MANIFEST-"
+	max_manifest_size = 4 << 20
+)
+
+var (
+	ErrInvalidCurrent = errors.New("CURRENT does not point at a manifest")
+	ErrClosed         = errors.New("version set is closed")
+)
+
+// FileMeta describes a live SSTable, Name is the file inside the data dir
+type FileMeta struct {
+	Num      uint64 `json:"num"`
+	Name     string `json:"name"`
+	Level    int    `json:"level"`
+	StartKey string `json:"start_key"`
+	EndKey   string `json:"end_key"`
+	Size     int64  `json:"size"`
+}
+
+type DeletedFile struct {
+	Level int    `json:"level"`
+	Num   uint64 `json:"num"`
+}
+
+// VersionEdit is a single record of the manifest, it takes the live set of
+// tables from one version to the next
+type VersionEdit struct {
+	Added        []FileMeta    `json:"added,omitempty"`
+	Removed      []DeletedFile `json:"removed,omitempty"`
+	NextFileNum  uint64        `json:"next_file_num,omitempty"`
+	LastSequence uint64        `json:"last_sequence,omitempty"`
+}
+
+// Version is the set of live tables per level, level 0 is kept in the order
+// its tables were added, oldest first
+type Version struct {
+	Levels       map[int][]FileMeta
+	NextFileNum  uint64
+	LastSequence uint64
+}
+
+func NewVersion() Version {
+	return Version{Levels: map[int][]FileMeta{}, NextFileNum: 1}
+}
+
+func (v *Version) apply(edit VersionEdit) {
+	for _, removed := range edit.Removed {
+		v.Levels[removed.Level] = slices.DeleteFunc(v.Levels[removed.Level], func(file FileMeta) bool {
+			return file.Num == removed.Num
+		})
+		if len(v.Levels[removed.Level]) == 0 {
+			delete(v.Levels, removed.Level)
+		}
+	}
+
+	for _, added := range edit.Added {
+		v.Levels[added.Level] = append(v.Levels[added.Level], added)
+		v.NextFileNum = max(v.NextFileNum, added.Num+1)
+	}
+
+	v.NextFileNum = max(v.NextFileNum, edit.NextFileNum)
+	v.LastSequence = max(v.LastSequence, edit.LastSequence)
+}
+
+// snapshot is the edit that builds the version from an empty one
+func (v *Version) snapshot() VersionEdit {
+	edit := VersionEdit{NextFileNum: v.NextFileNum, LastSequence: v.LastSequence}
+	for _, level := range v.LevelNums() {
+		edit.Added = append(edit.Added, v.Levels[level]...)
+	}
+
+	return edit
+}
+
+func (v *Version) clone() Version {
+	levels := make(map[int][]FileMeta, len(v.Levels))
+	for level, files := range v.Levels {
+		levels[level] = slices.Clone(files)
+	}
+
+	return Version{Levels: levels, NextFileNum: v.NextFileNum, LastSequence: v.LastSequence}
+}
+
+func (v *Version) LevelNums() []int {
+	levels := make([]int, 0, len(v.Levels))
+	for level := range v.Levels {
+		levels = append(levels, level)
+	}
+	slices.Sort(levels)
+
+	return levels
+}
+
+// LiveFiles returns the names of every table the version references
+func (v *Version) LiveFiles() map[string]bool {
+	live := map[string]bool{}
+	for _, files := range v.Levels {
+		for _, file := range files {
+			live[file.Name] = true
+		}
+	}
+
+	return live
+}
+
+// VersionSet appends version edits to the current manifest. The manifest
+// is a log of edits framed like WAL records, CURRENT names the manifest in
+// use and is only ever replaced by a rename
+type VersionSet struct {
+	fs          vfs.FS
+	dir         string
+	version     Version
+	manifestNum uint64
+	file        vfs.File
+	writer      *wal.Writer
+	size        int64
+	mu          sync.Mutex
+	closed      bool
+}
+
+// Exists reports whether dir holds a CURRENT file
+func Exists(fs vfs.FS, dir string) (bool, error) {
+	return vfs.Exists(fs, filepath.Join(dir, current_file))
+}
+
+// Create starts a new manifest in dir holding base, it is used to set up a
+// fresh database or to move one that predates the manifest over to it
+func Create(fs vfs.FS, dir string, base Version) (*VersionSet, error) {
+	if base.Levels == nil {
+		base.Levels = map[int][]FileMeta{}
+	}
+
+	vs := &VersionSet{fs: fs, dir: dir, version: base}
+	err := vs.rotate()
+	if err != nil {
+		return nil, err
+	}
+
+	return vs, nil
+}
+
+// Open recovers the version CURRENT points at and continues in a new
+// manifest. A torn or corrupt edit at the end of the manifest was never
+// committed and is dropped
+func Open(fs vfs.FS, dir string) (*VersionSet, error) {
+	version, err := Load(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return Create(fs, dir, version)
+}
+
+// Load reads the version CURRENT points at without writing anything
+func Load(fs vfs.FS, dir string) (Version, error) {
+	name, err := vfs.ReadFile(fs, filepath.Join(dir, current_file))
+	if err != nil {
+		return Version{}, err
+	}
+
+	manifestName := strings.TrimSpace(string(name))
+	if _, ok := ParseManifestName(manifestName); !ok {
+		return Version{}, fmt.Errorf("%w: %q", ErrInvalidCurrent, manifestName)
+	}
+
+	return readManifest(fs, filepath.Join(dir, manifestName))
+}
+
+func readManifest(fs vfs.FS, path string) (Version, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return Version{}, err
+	}
+	defer file.Close()
+
+	version := NewVersion()
+	buffered := bufio.NewReader(file)
+	reader := wal.NewReader(buffered)
+	for records := 0; ; records += 1 {
+		record, err := reader.ReadRecord()
+		if err == io.EOF || errors.Is(err, wal.ErrTornRecord) {
+			return version, nil
+		}
+
+		// a corrupt last edit is garbage a crash left behind while it was
+		// appended, like a torn one it was never committed. The snapshot the
+		// manifest starts with was synced before CURRENT pointed at it, so
+		// it being corrupt is not
+		if errors.Is(err, wal.ErrCorruptRecord) && records > 0 {
+			if _, peekErr := buffered.Peek(1); peekErr == io.EOF {
+				return version, nil
+			}
+		}
+		if err != nil {
+			return Version{}, fmt.Errorf("%s at offset %d: %w", path, reader.Offset(), err)
+		}
+
+		edit := VersionEdit{}
+		err = json.Unmarshal(record, &edit)
+		if err != nil {
+			return Version{}, fmt.Errorf("%s at offset %d: %w", path, reader.Offset(), err)
+		}
+		version.apply(edit)
+	}
+}
+
+// rotate writes the whole version into a new manifest and points CURRENT at
+// it, the old manifest is only removed once CURRENT has moved on
+func (vs *VersionSet) rotate() error {
+	num := vs.version.NextFileNum
+	vs.version.NextFileNum += 1
+	name := fmt.Sprintf("%s%06d", manifest_prefix, num)
+
+	file, err := vs.fs.Create(filepath.Join(vs.dir, name))
+	if err != nil {
+		return err
+	}
+
+	writer := wal.NewWriter(file)
+	size, err := writeEdit(writer, file, vs.version.snapshot())
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = setCurrent(vs.fs, vs.dir, name)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if vs.file != nil {
+		vs.file.Close()
+	}
+
+	vs.file = file
+	vs.writer = writer
+	vs.size = size
+	vs.manifestNum = num
+
+	return removeOldManifests(vs.fs, vs.dir, num)
+}
+
+func writeEdit(writer *wal.Writer, file vfs.File, edit VersionEdit) (int64, error) {
+	payload, err := json.Marshal(edit)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := writer.WriteRecord(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(n), file.Sync()
+}
+
+func setCurrent(fs vfs.FS, dir, manifestName string) error {
+	tmp := filepath.Join(dir, current_file+".tmp")
+	err := vfs.WriteFile(fs, tmp, []byte(manifestName+"\n"))
+	if err != nil {
+		return err
+	}
+
+	err = fs.Rename(tmp, filepath.Join(dir, current_file))
+	if err != nil {
+		return err
+	}
+
+	return fs.Sync(dir)
+}
+
+// removeOldManifests removes every manifest other than the one in use
+func removeOldManifests(fs vfs.FS, dir string, current uint64) error {
+	names, err := fs.List(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		num, ok := ParseManifestName(name)
+		if !ok || num == current {
+			continue
+		}
+
+		err = fs.Remove(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseManifestName returns the number of a manifest file
+func ParseManifestName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, manifest_prefix) {
+		return 0, false
+	}
+
+	num, err := strconv.ParseUint(strings.TrimPrefix(name, manifest_prefix), 10, 64)
+	return num, err == nil
+}
+
+// IsManifestFile reports whether name is a manifest or the CURRENT pointer
+func IsManifestFile(name string) bool {
+	_, ok := ParseManifestName(name)
+	return ok || name == current_file || name == current_file+".tmp"
+}
+
+// NewFileNum hands out the number for a new file, numbers that end up in no
+// committed edit are simply skipped
+func (vs *VersionSet) NewFileNum() uint64 {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	num := vs.version.NextFileNum
+	vs.version.NextFileNum += 1
+
+	return num
+}
+
+// LogAndApply makes the edit durable in the manifest before applying it to
+// the current version
+func (vs *VersionSet) LogAndApply(edit VersionEdit) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if vs.closed {
+		return ErrClosed
+	}
+
+	edit.NextFileNum = max(edit.NextFileNum, vs.version.NextFileNum)
+	if vs.size >= max_manifest_size {
+		next := vs.version.clone()
+		next.apply(edit)
+
+		prev := vs.version
+		vs.version = next
+		err := vs.rotate()
+		if err != nil {
+			vs.version = prev
+		}
+		return err
+	}
+
+	n, err := writeEdit(vs.writer, vs.file, edit)
+	if err != nil {
+		// the manifest may end in part of this edit now, the next edit starts a new one
+		vs.size = max_manifest_size
+		return err
+	}
+	vs.size += n
+	vs.version.apply(edit)
+
+	return nil
+}
+
+// Current returns a copy of the current version
+func (vs *VersionSet) Current() Version {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	return vs.version.clone()
+}
+
+func (vs *VersionSet) Close() error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if vs.closed {
+		return nil
+	}
+	vs.closed = true
+
+	return vs.file.Close()
+}
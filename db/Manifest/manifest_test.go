@@ -0,0 +1,288 @@
+package manifest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	vfs "stinky-db/db/VFS"
+	wal "stinky-db/db/WAL"
+	"strings"
+	"testing"
+)
+
+func table(num uint64, level int, start, end string) FileMeta {
+	return FileMeta{Num: num, Name: start + end, Level: level, StartKey: start, EndKey: end}
+}
+
+func TestLogAndApplySurvivesReopen(t *testing.T) {
+	fs := vfs.NewMem()
+	dir := "data"
+	err := fs.MkdirAll(dir)
+	if err != nil {
+		t.Fatalf("could not make dir: %+v\n", err)
+	}
+
+	vs, err := Create(fs, dir, NewVersion())
+	if err != nil {
+		t.Fatalf("could not create version set: %+v\n", err)
+	}
+
+	first, second := vs.NewFileNum(), vs.NewFileNum()
+	edits := []VersionEdit{
+		{Added: []FileMeta{table(first, 0, "a", "c")}},
+		{Added: []FileMeta{table(second, 0, "b", "d")}},
+		{
+			Removed:      []DeletedFile{{Level: 0, Num: second}},
+			Added:        []FileMeta{table(vs.NewFileNum(), 1, "b", "d")},
+			LastSequence: 42,
+		},
+	}
+	for _, edit := range edits {
+		err = vs.LogAndApply(edit)
+		if err != nil {
+			t.Fatalf("could not log edit: %+v\n", err)
+		}
+	}
+	nextFileNum := vs.Current().NextFileNum
+	vs.Close()
+
+	vs, err = Open(fs, dir)
+	if err != nil {
+		t.Fatalf("could not reopen version set: %+v\n", err)
+	}
+	defer vs.Close()
+
+	version := vs.Current()
+	if len(version.Levels[0]) != 1 || version.Levels[0][0].StartKey != "a" {
+		t.Errorf("expected only a-c in level 0, got %+v", version.Levels[0])
+	}
+
+	if len(version.Levels[1]) != 1 || version.Levels[1][0].StartKey != "b" {
+		t.Errorf("expected b-d in level 1, got %+v", version.Levels[1])
+	}
+
+	if version.LastSequence != 42 {
+		t.Errorf("expected last sequence 42, got %d", version.LastSequence)
+	}
+
+	if version.NextFileNum < nextFileNum {
+		t.Errorf("expected file numbers to keep growing from %d, got %d", nextFileNum, version.NextFileNum)
+	}
+}
+
+func TestOpenPointsCurrentAtNewManifest(t *testing.T) {
+	dir := t.TempDir()
+	vs, err := Create(vfs.Default, dir, NewVersion())
+	if err != nil {
+		t.Fatalf("could not create version set: %+v\n", err)
+	}
+	vs.Close()
+
+	vs, err = Open(vfs.Default, dir)
+	if err != nil {
+		t.Fatalf("could not reopen version set: %+v\n", err)
+	}
+	defer vs.Close()
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("could not read dir: %+v\n", err)
+	}
+
+	manifests := []string{}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), manifest_prefix) {
+			manifests = append(manifests, file.Name())
+		}
+	}
+
+	current, err := os.ReadFile(filepath.Join(dir, current_file))
+	if err != nil {
+		t.Fatalf("could not read CURRENT: %+v\n", err)
+	}
+
+	if len(manifests) != 1 || strings.TrimSpace(string(current)) != manifests[0] {
+		t.Errorf("expected CURRENT to name the only manifest, got %q and %v", current, manifests)
+	}
+}
+
+func currentManifest(t *testing.T, dir string) string {
+	t.Helper()
+
+	current, err := os.ReadFile(filepath.Join(dir, current_file))
+	if err != nil {
+		t.Fatalf("could not read CURRENT: %+v\n", err)
+	}
+
+	return filepath.Join(dir, strings.TrimSpace(string(current)))
+}
+
+func TestTornEditIsDropped(t *testing.T) {
+	dir := t.TempDir()
+	vs, err := Create(vfs.Default, dir, NewVersion())
+	if err != nil {
+		t.Fatalf("could not create version set: %+v\n", err)
+	}
+
+	for _, edit := range []VersionEdit{
+		{Added: []FileMeta{table(vs.NewFileNum(), 0, "a", "b")}},
+		{Added: []FileMeta{table(vs.NewFileNum(), 0, "c", "d")}},
+	} {
+		err = vs.LogAndApply(edit)
+		if err != nil {
+			t.Fatalf("could not log edit: %+v\n", err)
+		}
+	}
+	vs.Close()
+
+	path := currentManifest(t, dir)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("could not stat manifest: %+v\n", err)
+	}
+
+	err = os.Truncate(path, info.Size()-3)
+	if err != nil {
+		t.Fatalf("could not truncate manifest: %+v\n", err)
+	}
+
+	vs, err = Open(vfs.Default, dir)
+	if err != nil {
+		t.Fatalf("could not reopen version set: %+v\n", err)
+	}
+	defer vs.Close()
+
+	level0 := vs.Current().Levels[0]
+	if len(level0) != 1 || level0[0].StartKey != "a" {
+		t.Errorf("expected only the first edit to survive, got %+v", level0)
+	}
+}
+
+func TestCorruptLastEditIsDropped(t *testing.T) {
+	dir := t.TempDir()
+	vs, err := Create(vfs.Default, dir, NewVersion())
+	if err != nil {
+		t.Fatalf("could not create version set: %+v\n", err)
+	}
+
+	for _, edit := range []VersionEdit{
+		{Added: []FileMeta{table(vs.NewFileNum(), 0, "a", "b")}},
+		{Added: []FileMeta{table(vs.NewFileNum(), 0, "c", "d")}},
+	} {
+		err = vs.LogAndApply(edit)
+		if err != nil {
+			t.Fatalf("could not log edit: %+v\n", err)
+		}
+	}
+	vs.Close()
+
+	path := currentManifest(t, dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read manifest: %+v\n", err)
+	}
+
+	// flip a byte of the final edit, its length is intact but not its checksum
+	data[len(data)-2] ^= 0xff
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatalf("could not write manifest: %+v\n", err)
+	}
+
+	vs, err = Open(vfs.Default, dir)
+	if err != nil {
+		t.Fatalf("could not reopen version set: %+v\n", err)
+	}
+
+	level0 := vs.Current().Levels[0]
+	if len(level0) != 1 || level0[0].StartKey != "a" {
+		t.Errorf("expected only the first edit to survive, got %+v", level0)
+	}
+
+	// the dropped edit is gone from the new manifest, logging goes on after it
+	err = vs.LogAndApply(VersionEdit{Added: []FileMeta{table(vs.NewFileNum(), 0, "e", "f")}})
+	if err != nil {
+		t.Fatalf("could not log edit: %+v\n", err)
+	}
+	vs.Close()
+
+	vs, err = Open(vfs.Default, dir)
+	if err != nil {
+		t.Fatalf("could not reopen version set: %+v\n", err)
+	}
+	defer vs.Close()
+
+	level0 = vs.Current().Levels[0]
+	if len(level0) != 2 {
+		t.Errorf("expected the edits before and after the dropped one, got %+v", level0)
+	}
+}
+
+func TestCorruptEditFollowedByEditsIsReported(t *testing.T) {
+	dir := t.TempDir()
+	vs, err := Create(vfs.Default, dir, NewVersion())
+	if err != nil {
+		t.Fatalf("could not create version set: %+v\n", err)
+	}
+
+	err = vs.LogAndApply(VersionEdit{Added: []FileMeta{table(vs.NewFileNum(), 0, "a", "b")}})
+	if err != nil {
+		t.Fatalf("could not log edit: %+v\n", err)
+	}
+	size := vs.size
+	err = vs.LogAndApply(VersionEdit{Added: []FileMeta{table(vs.NewFileNum(), 0, "c", "d")}})
+	if err != nil {
+		t.Fatalf("could not log edit: %+v\n", err)
+	}
+	vs.Close()
+
+	path := currentManifest(t, dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read manifest: %+v\n", err)
+	}
+
+	// flip the last byte of the first edit, the second one still follows it
+	data[size-1] ^= 0xff
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatalf("could not write manifest: %+v\n", err)
+	}
+
+	_, err = Open(vfs.Default, dir)
+	if !errors.Is(err, wal.ErrCorruptRecord) {
+		t.Errorf("expected corrupt record error, got %+v", err)
+	}
+}
+
+func TestCorruptEditIsReported(t *testing.T) {
+	dir := t.TempDir()
+	vs, err := Create(vfs.Default, dir, NewVersion())
+	if err != nil {
+		t.Fatalf("could not create version set: %+v\n", err)
+	}
+
+	err = vs.LogAndApply(VersionEdit{Added: []FileMeta{table(vs.NewFileNum(), 0, "a", "b")}})
+	if err != nil {
+		t.Fatalf("could not log edit: %+v\n", err)
+	}
+	vs.Close()
+
+	path := currentManifest(t, dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read manifest: %+v\n", err)
+	}
+
+	// flip a byte of the snapshot edit, the first record
+	data[10] ^= 0xff
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatalf("could not write manifest: %+v\n", err)
+	}
+
+	_, err = Open(vfs.Default, dir)
+	if !errors.Is(err, wal.ErrCorruptRecord) {
+		t.Errorf("expected corrupt record error, got %+v", err)
+	}
+}
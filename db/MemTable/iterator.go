@@ -0,0 +1,183 @@
+package memtable
+
+import "strings"
+
+// TreeIterator walks the tree in key order through the parent pointers, the
+// versions of a key come newest first. The tree must not change while it is
+// in use, see MemTable.NewIterator
+type TreeIterator struct {
+	tree *RBTree
+	node *Node
+	// pastEnd tells the two ways of not being on a node apart
+	pastEnd bool
+}
+
+func (t *RBTree) NewIterator() *TreeIterator {
+	return &TreeIterator{tree: t}
+}
+
+func leftmost(node *Node) *Node {
+	for node != nil && node.Left != nil {
+		node = node.Left
+	}
+
+	return node
+}
+
+func rightmost(node *Node) *Node {
+	for node != nil && node.Right != nil {
+		node = node.Right
+	}
+
+	return node
+}
+
+func successor(node *Node) *Node {
+	if node.Right != nil {
+		return leftmost(node.Right)
+	}
+
+	for node.Parent != nil && node == node.Parent.Right {
+		node = node.Parent
+	}
+
+	return node.Parent
+}
+
+func predecessor(node *Node) *Node {
+	if node.Left != nil {
+		return rightmost(node.Left)
+	}
+
+	for node.Parent != nil && node == node.Parent.Left {
+		node = node.Parent
+	}
+
+	return node.Parent
+}
+
+func (it *TreeIterator) Seek(key string) bool {
+	it.node = nil
+	curr := it.tree.Root
+	for curr != nil {
+		if strings.Compare(curr.Key, key) != -1 {
+			it.node = curr
+			curr = curr.Left
+		} else {
+			curr = curr.Right
+		}
+	}
+	it.pastEnd = it.node == nil
+
+	return it.Valid()
+}
+
+func (it *TreeIterator) First() bool {
+	it.node = leftmost(it.tree.Root)
+	it.pastEnd = it.node == nil
+	return it.Valid()
+}
+
+func (it *TreeIterator) Last() bool {
+	it.node = rightmost(it.tree.Root)
+	it.pastEnd = false
+	return it.Valid()
+}
+
+func (it *TreeIterator) Next() bool {
+	if it.node == nil {
+		if it.pastEnd {
+			return false
+		}
+		return it.First()
+	}
+
+	it.node = successor(it.node)
+	it.pastEnd = it.node == nil
+
+	return it.Valid()
+}
+
+func (it *TreeIterator) Prev() bool {
+	if it.node == nil {
+		if it.pastEnd {
+			return it.Last()
+		}
+		return false
+	}
+
+	it.node = predecessor(it.node)
+	it.pastEnd = false
+
+	return it.Valid()
+}
+
+func (it *TreeIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *TreeIterator) Key() string {
+	return it.node.Key
+}
+
+func (it *TreeIterator) Value() string {
+	return it.node.Value
+}
+
+func (it *TreeIterator) Tombstone() bool {
+	return it.node.Tombstone
+}
+
+func (it *TreeIterator) Seq() uint64 {
+	return it.node.Seq
+}
+
+func (it *TreeIterator) Err() error {
+	return nil
+}
+
+func (it *TreeIterator) Close() error {
+	return nil
+}
+
+// Clone copies the tree, writes to the copy leave iterators over the
+// original untouched
+func (t *RBTree) Clone() *RBTree {
+	return &RBTree{Root: cloneNode(t.Root, nil), Size: t.Size, MaxSize: t.MaxSize, LastSeq: t.LastSeq}
+}
+
+func cloneNode(node *Node, parent *Node) *Node {
+	if node == nil {
+		return nil
+	}
+
+	clone := *node
+	clone.Parent = parent
+	clone.Left = cloneNode(node.Left, &clone)
+	clone.Right = cloneNode(node.Right, &clone)
+
+	return &clone
+}
+
+// NewIterator iterates over the tree as it is now without copying it. The
+// tree is marked shared instead, the next write copies it and goes on in
+// the copy, so opening iterators costs nothing and writes only pay for a
+// copy once after any number of them
+func (m *MemTable) NewIterator() *TreeIterator {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.shared = true
+	return m.Tree.NewIterator()
+}
+
+// writable returns the tree to write to, copying it first when iterators
+// may be reading it. It must be called with m.mu held
+func (m *MemTable) writable() *RBTree {
+	if m.shared {
+		m.Tree = m.Tree.Clone()
+		m.shared = false
+	}
+
+	return m.Tree
+}
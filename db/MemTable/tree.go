@@ -1,7 +1,9 @@
 package memtable
 
 import (
+	"cmp"
 	"errors"
+	"math"
 	"strings"
 	"sync"
 )
@@ -10,7 +12,7 @@ type Color bool
 
 const (
 	red, black Color = true, false
-	MAX_SIZE = 5_000_000
+	MAX_SIZE         = 5_000_000
 )
 
 var (
@@ -18,23 +20,30 @@ var (
 )
 
 type Node struct {
-	Key    string
-	Value  string
-	Color  Color
-	Left   *Node
-	Right  *Node
-	Parent *Node
+	Key       string
+	Value     string
+	Seq       uint64
+	Tombstone bool
+	Color     Color
+	Left      *Node
+	Right     *Node
+	Parent    *Node
 }
 
 type RBTree struct {
 	Root    *Node
 	Size    int64
 	MaxSize int64
+	// LastSeq is the highest sequence number inserted into the tree
+	LastSeq uint64
 }
 
 type MemTable struct {
 	Tree *RBTree
 	mu   sync.Mutex
+	// shared is set while iterators may be reading Tree, the next write
+	// then copies the tree first and leaves them the old one
+	shared bool
 }
 
 func NewRBTree(maxSize int64) *RBTree {
@@ -63,30 +72,79 @@ func (t *RBTree) GetMaxSize() int64 {
 	return t.MaxSize
 }
 
+// AtMaxSize reports whether the tree is full, overwrites in place can take
+// it past MaxSize
 func (t *RBTree) AtMaxSize() bool {
-	return t.Size == t.MaxSize
+	return t.Size >= t.MaxSize
 }
 
 func (t *RBTree) Insert(key, value string) error {
+	return t.insert(key, value, 0, 0, false)
+}
+
+// InsertWithSeq inserts the value as the version of the key written at seq.
+// pinned is the sequence number of the newest live snapshot, 0 when there is
+// none, the previous version of the key is only kept when a snapshot reads it
+func (t *RBTree) InsertWithSeq(key, value string, seq, pinned uint64) error {
+	return t.insert(key, value, seq, pinned, false)
+}
+
+// Delete records a tombstone for the key so that the deletion shadows any
+// older value the key has further down the LSM tree
+func (t *RBTree) Delete(key string) error {
+	return t.insert(key, "", 0, 0, true)
+}
+
+func (t *RBTree) DeleteWithSeq(key string, seq, pinned uint64) error {
+	return t.insert(key, "", seq, pinned, true)
+}
+
+// compareVersion orders the tree by key and the versions of a key newest first
+func compareVersion(key string, seq uint64, node *Node) int {
+	compared := strings.Compare(key, node.Key)
+	if compared != KEY_EQUAL_NODE {
+		return compared
+	}
+
+	return cmp.Compare(node.Seq, seq)
+}
+
+func (t *RBTree) insert(key, value string, seq, pinned uint64, tombstone bool) error {
 	if t.Root == nil {
-		t.Root = &Node{Key: key, Value: value, Color: black}
+		t.Root = &Node{Key: key, Value: value, Seq: seq, Tombstone: tombstone, Color: black}
 		t.Size += int64(len(key) + len(value))
+		t.LastSeq = max(t.LastSeq, seq)
+		return nil
+	}
+
+	// no snapshot can read a version newer than pinned, it is overwritten in
+	// place. That adds no node so it is never refused for capacity
+	newest := t.seek(key, math.MaxUint64)
+	if newest != nil && newest.Key == key && newest.Seq <= seq && (newest.Seq == seq || newest.Seq > pinned) {
+		t.LastSeq = max(t.LastSeq, seq)
+		t.Size -= int64(len(newest.Value))
+		t.Size += int64(len(value))
+
+		newest.Value = value
+		newest.Seq = seq
+		newest.Tombstone = tombstone
 		return nil
 	}
 
-	if int64(len(key) + len(value)) + t.Size >= t.MaxSize {
+	if int64(len(key)+len(value))+t.Size > t.MaxSize {
 		return AtMaxCapErr
 	}
+	t.LastSeq = max(t.LastSeq, seq)
 
 	node := t.Root
 	var inserted *Node
 
 	running := true
 	for running {
-		switch strings.Compare(key, node.Key) {
+		switch compareVersion(key, seq, node) {
 		case KEY_LESS_NODE:
 			if node.Left == nil {
-				node.Left = &Node{Key: key, Value: value, Color: red, Parent: node}
+				node.Left = &Node{Key: key, Value: value, Seq: seq, Tombstone: tombstone, Color: red, Parent: node}
 				t.Size += int64(len(key) + len(value))
 				inserted = node.Left
 				running = false
@@ -95,7 +153,7 @@ func (t *RBTree) Insert(key, value string) error {
 			}
 		case KEY_GREATER_NODE:
 			if node.Right == nil {
-				node.Right = &Node{Key: key, Value: value, Color: red, Parent: node}
+				node.Right = &Node{Key: key, Value: value, Seq: seq, Tombstone: tombstone, Color: red, Parent: node}
 				t.Size += int64(len(key) + len(value))
 				inserted = node.Right
 				running = false
@@ -107,6 +165,7 @@ func (t *RBTree) Insert(key, value string) error {
 			t.Size += int64(len(value))
 
 			node.Value = value
+			node.Tombstone = tombstone
 			inserted = node
 			running = false
 		}
@@ -116,21 +175,48 @@ func (t *RBTree) Insert(key, value string) error {
 	return nil
 }
 
-type Found bool
-
-func (t *RBTree) Get(key string) (string, Found) {
+// seek returns the first node that is not ordered before the version, which
+// is the newest version of the key no newer than seq if the key has one
+func (t *RBTree) seek(key string, seq uint64) *Node {
+	var found *Node
 	node := t.Root
 	for node != nil {
-		switch strings.Compare(key, node.Key) {
-		case KEY_LESS_NODE:
+		if compareVersion(key, seq, node) != KEY_GREATER_NODE {
+			found = node
 			node = node.Left
-		case KEY_GREATER_NODE:
+		} else {
 			node = node.Right
-		case KEY_EQUAL_NODE:
-			return node.Value, true
 		}
 	}
-	return "", false
+
+	return found
+}
+
+type Found bool
+
+// Get only finds live keys, a key with a tombstone is reported as not found
+func (t *RBTree) Get(key string) (string, Found) {
+	value, found, tombstone := t.Lookup(key)
+	if tombstone {
+		return "", false
+	}
+
+	return value, found
+}
+
+// Lookup also reports tombstones so readers know to stop looking further down
+func (t *RBTree) Lookup(key string) (string, Found, bool) {
+	return t.LookupAt(key, math.MaxUint64)
+}
+
+// LookupAt finds the newest version of the key written at or before seq
+func (t *RBTree) LookupAt(key string, seq uint64) (string, Found, bool) {
+	node := t.seek(key, seq)
+	if node == nil || node.Key != key {
+		return "", false, false
+	}
+
+	return node.Value, true, node.Tombstone
 }
 
 func (t *RBTree) checkRotate(node *Node) {
@@ -286,6 +372,7 @@ func (m *MemTable) SwapTree() *RBTree {
 
 	currTree := m.Tree
 	m.Tree = NewRBTree(currTree.MaxSize)
+	m.shared = false
 
 	return currTree
 }
@@ -301,9 +388,10 @@ func MemTableFromCache(cache map[string]string, maxSize int64) *MemTable {
 	return &table
 }
 
-func NewMemTable() *MemTable {
+func NewMemTable(maxSize int64) *MemTable {
 	return &MemTable{
-		mu: sync.Mutex{},
+		Tree: NewRBTree(maxSize),
+		mu:   sync.Mutex{},
 	}
 }
 
@@ -311,14 +399,57 @@ func (m *MemTable) InsertCache(cache map[string]string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	tree := m.writable()
 	for key, value := range cache {
-		m.Tree.Insert(key, value)
+		tree.Insert(key, value)
 	}
 }
 
+func (m *MemTable) Insert(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.writable().Insert(key, value)
+}
+
+func (m *MemTable) InsertWithSeq(key, value string, seq, pinned uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.writable().InsertWithSeq(key, value, seq, pinned)
+}
+
+func (m *MemTable) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.writable().Delete(key)
+}
+
+func (m *MemTable) DeleteWithSeq(key string, seq, pinned uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.writable().DeleteWithSeq(key, seq, pinned)
+}
+
 func (m *MemTable) Get(key string) (string, Found) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	return m.Tree.Get(key)
 }
+
+func (m *MemTable) Lookup(key string) (string, Found, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.Tree.Lookup(key)
+}
+
+func (m *MemTable) LookupAt(key string, seq uint64) (string, Found, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.Tree.LookupAt(key, seq)
+}
@@ -148,3 +148,210 @@ func TestGetMaxCapacityErrorOnMaxCapacity(t *testing.T) {
 		t.Errorf("expected max capacity error, got %+v", err)
 	}
 }
+
+func TestAtMaxSizeOnceFull(t *testing.T) {
+	tree := NewRBTree(16)
+	tree.Insert("key", "value")
+	if tree.AtMaxSize() {
+		t.Fatalf("expected room left at %d of %d bytes", tree.Size, tree.MaxSize)
+	}
+
+	err := tree.Insert("k2", "val_ab")
+	if err != nil {
+		t.Fatalf("expected the tree to fill up exactly, got %+v", err)
+	}
+
+	if !tree.AtMaxSize() {
+		t.Errorf("expected the tree to be full at %d of %d bytes", tree.Size, tree.MaxSize)
+	}
+}
+
+func TestOverwritesAreNotRefusedWhenFull(t *testing.T) {
+	tree := NewRBTree(16)
+	tree.Insert("key", "value")
+	tree.Insert("k2", "val_ab")
+
+	err := tree.Insert("key", "other")
+	if err != nil {
+		t.Fatalf("expected an overwrite of the same size to go through, got %+v", err)
+	}
+
+	err = tree.Delete("k2")
+	if err != nil {
+		t.Fatalf("expected a tombstone over an existing key to go through, got %+v", err)
+	}
+
+	err = tree.Insert("k3", "value_long")
+	if !errors.Is(err, AtMaxCapErr) {
+		t.Errorf("expected a new key to be refused, got %+v", err)
+	}
+
+	value, _ := tree.Get("key")
+	if value != "other" {
+		t.Errorf("expected the overwritten value, got %s", value)
+	}
+}
+
+func TestDeleteRecordsTombstone(t *testing.T) {
+	tree := NewRBTree(0)
+	tree.Insert("key", "value")
+	tree.Insert("key2", "value2")
+
+	err := tree.Delete("key")
+	if err != nil {
+		t.Fatalf("could not delete: %+v", err)
+	}
+
+	err = tree.Delete("key3")
+	if err != nil {
+		t.Fatalf("could not delete missing key: %+v", err)
+	}
+
+	_, found := tree.Get("key")
+	if found {
+		t.Errorf("expected deleted key not to be found")
+	}
+
+	_, found, tombstone := tree.Lookup("key3")
+	if !bool(found) || !tombstone {
+		t.Errorf("expected a tombstone for a key that was never inserted, got found %v tombstone %v", found, tombstone)
+	}
+
+	wantedSize := int64(len("key") + len("key2") + len("value2") + len("key3"))
+	if tree.Size != wantedSize {
+		t.Errorf("expected size %d, got %d", wantedSize, tree.Size)
+	}
+
+	tree.Insert("key", "again")
+	value, found, tombstone := tree.Lookup("key")
+	if !bool(found) || tombstone || value != "again" {
+		t.Errorf("expected reinserted key to be live, got %s found %v tombstone %v", value, found, tombstone)
+	}
+}
+
+func TestTreeIterator(t *testing.T) {
+	tree := NewRBTree(0)
+	for _, key := range []string{"d", "b", "f", "a", "c", "e", "g"} {
+		tree.Insert(key, "val_"+key)
+	}
+	tree.Delete("c")
+
+	keys := []string{}
+	it := tree.NewIterator()
+	for it.Next() {
+		keys = append(keys, it.Key())
+		if it.Key() == "c" && !it.Tombstone() {
+			t.Errorf("expected c to be a tombstone")
+		}
+	}
+
+	if !slices.Equal(keys, []string{"a", "b", "c", "d", "e", "f", "g"}) {
+		t.Errorf("expected keys in order, got %v", keys)
+	}
+
+	if !it.Prev() || it.Key() != "g" {
+		t.Errorf("expected prev past the end to land on the last key")
+	}
+
+	if !it.Seek("bb") || it.Key() != "c" {
+		t.Errorf("expected seek to land on the next key c")
+	}
+
+	if !it.Prev() || it.Key() != "b" || it.Value() != "val_b" {
+		t.Errorf("expected prev to go back to b")
+	}
+
+	if it.Seek("h") {
+		t.Errorf("expected seek past the last key to be invalid")
+	}
+}
+
+func TestMemTableIteratorIsACopy(t *testing.T) {
+	table := NewMemTable(0)
+	table.Insert("a", "val")
+
+	it := table.NewIterator()
+	table.Insert("b", "val")
+
+	if !it.First() || it.Next() {
+		t.Errorf("expected the iterator to only see the write made before it")
+	}
+}
+
+func TestMemTableIteratorsShareTheTreeUntilAWrite(t *testing.T) {
+	table := NewMemTable(0)
+	table.Insert("a", "old")
+	tree := table.Tree
+
+	iterators := []*TreeIterator{}
+	for i := 0; i < 10; i += 1 {
+		iterators = append(iterators, table.NewIterator())
+	}
+	if table.Tree != tree {
+		t.Fatalf("expected opening iterators not to copy the tree")
+	}
+
+	// an overwrite in place would change the node the iterators are reading
+	table.Insert("a", "new")
+	copied := table.Tree
+	if copied == tree {
+		t.Fatalf("expected the first write after the iterators to copy the tree")
+	}
+
+	table.Insert("b", "val")
+	if table.Tree != copied {
+		t.Errorf("expected only one copy for any number of iterators")
+	}
+
+	for _, it := range iterators {
+		if !it.First() || it.Value() != "old" || it.Next() {
+			t.Errorf("expected the iterator to only see a = old")
+		}
+	}
+
+	value, _ := table.Get("a")
+	if value != "new" {
+		t.Errorf("expected the write to go to the copy, got %s", value)
+	}
+}
+
+func TestKeepsVersionsSnapshotsRead(t *testing.T) {
+	tree := NewRBTree(0)
+	tree.InsertWithSeq("key", "v1", 1, 0)
+	// no snapshot reads v1 so it is overwritten
+	tree.InsertWithSeq("key", "v2", 2, 0)
+	// a snapshot at 3 still reads v2
+	tree.InsertWithSeq("key", "v4", 4, 3)
+	// v4 is newer than the snapshot so the tombstone replaces it
+	tree.DeleteWithSeq("key", 5, 3)
+	tree.InsertWithSeq("other", "o", 6, 3)
+
+	cases := []struct {
+		seq       uint64
+		value     string
+		found     bool
+		tombstone bool
+	}{
+		{seq: 1, found: false},
+		{seq: 3, value: "v2", found: true},
+		{seq: 4, value: "v2", found: true},
+		{seq: 9, found: true, tombstone: true},
+	}
+
+	for _, c := range cases {
+		value, found, tombstone := tree.LookupAt("key", c.seq)
+		if value != c.value || bool(found) != c.found || tombstone != c.tombstone {
+			t.Errorf("expected %s found %v tombstone %v at %d, got %s %v %v", c.value, c.found, c.tombstone, c.seq, value, found, tombstone)
+		}
+	}
+
+	seqs := []uint64{}
+	it := tree.NewIterator()
+	for it.Next() {
+		seqs = append(seqs, it.Seq())
+	}
+
+	if !slices.Equal(seqs, []uint64{5, 2, 6}) {
+		t.Errorf("expected the versions of a key newest first, got %v", seqs)
+	}
+}
@@ -0,0 +1,400 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	stinky "stinky-db/db"
+	iterator "stinky-db/db/Iterator"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	default_scan_count = 10
+	// flush_batch_size is how many deletes FLUSHALL logs per batch
+	flush_batch_size = 1_000
+)
+
+type command struct {
+	// arity counts the command name too, a negative arity is the minimum
+	arity   int
+	handler func(s *Server, w *Writer, args []string)
+}
+
+var commands = map[string]command{
+	"PING":     {arity: -1, handler: (*Server).ping},
+	"GET":      {arity: 2, handler: (*Server).get},
+	"SET":      {arity: -3, handler: (*Server).set},
+	"DEL":      {arity: -2, handler: (*Server).del},
+	"EXISTS":   {arity: -2, handler: (*Server).exists},
+	"MGET":     {arity: -2, handler: (*Server).mget},
+	"MSET":     {arity: -3, handler: (*Server).mset},
+	"SCAN":     {arity: -2, handler: (*Server).scan},
+	"INFO":     {arity: -1, handler: (*Server).info},
+	"FLUSHALL": {arity: -1, handler: (*Server).flushAll},
+	// redis-cli asks for the command docs when it connects, an empty reply is enough
+	"COMMAND": {arity: -1, handler: func(s *Server, w *Writer, args []string) { w.Array(0) }},
+}
+
+// dispatch runs the command and reports whether the connection should be closed
+func (s *Server) dispatch(w *Writer, args []string) bool {
+	name := strings.ToUpper(args[0])
+	if name == "QUIT" {
+		w.SimpleString("OK")
+		return true
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		w.Error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+
+	cmd.handler(s, w, args)
+	return false
+}
+
+func replyErr(w *Writer, err error) {
+	w.Error("ERR " + err.Error())
+}
+
+func (s *Server) ping(w *Writer, args []string) {
+	switch len(args) {
+	case 1:
+		w.SimpleString("PONG")
+	case 2:
+		w.Bulk(args[1])
+	default:
+		w.Error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *Server) get(w *Writer, args []string) {
+	val, err := s.store.Get(args[1])
+	if errors.Is(err, stinky.ErrNotFound) {
+		w.Null()
+		return
+	}
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+
+	w.Bulk(val)
+}
+
+func (s *Server) set(w *Writer, args []string) {
+	if len(args) != 3 {
+		w.Error("ERR syntax error")
+		return
+	}
+
+	err := s.store.Put(args[1], args[2])
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+
+	w.SimpleString("OK")
+}
+
+// del replies with how many of the keys existed. The keys are looked up and
+// deleted in one transaction, it is retried when another writer touches
+// one of them in between so the count always matches what was deleted
+func (s *Server) del(w *Writer, args []string) {
+	for {
+		deleted, err := s.deleteExisting(args[1:])
+		if errors.Is(err, stinky.ErrConflict) {
+			continue
+		}
+		if err != nil {
+			replyErr(w, err)
+			return
+		}
+
+		w.Integer(deleted)
+		return
+	}
+}
+
+func (s *Server) deleteExisting(keys []string) (int64, error) {
+	txn, err := s.store.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := int64(0)
+	for _, key := range keys {
+		_, err := txn.Get(key)
+		if errors.Is(err, stinky.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			txn.Rollback()
+			return 0, err
+		}
+
+		// later mentions of the key see it deleted and are not counted again
+		txn.Delete(key)
+		deleted += 1
+	}
+
+	return deleted, txn.Commit()
+}
+
+// exists counts a key once for every time it is named, like redis does
+func (s *Server) exists(w *Writer, args []string) {
+	count := int64(0)
+	for _, key := range args[1:] {
+		_, err := s.store.Get(key)
+		if errors.Is(err, stinky.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			replyErr(w, err)
+			return
+		}
+		count += 1
+	}
+
+	w.Integer(count)
+}
+
+// mget reads every key from one snapshot
+func (s *Server) mget(w *Writer, args []string) {
+	snap, err := s.store.NewSnapshot()
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	defer snap.Release()
+
+	values := make([]*string, 0, len(args)-1)
+	for _, key := range args[1:] {
+		val, err := snap.Get(key)
+		if errors.Is(err, stinky.ErrNotFound) {
+			values = append(values, nil)
+			continue
+		}
+		if err != nil {
+			replyErr(w, err)
+			return
+		}
+		values = append(values, &val)
+	}
+
+	w.Array(len(values))
+	for _, val := range values {
+		if val == nil {
+			w.Null()
+		} else {
+			w.Bulk(*val)
+		}
+	}
+}
+
+func (s *Server) mset(w *Writer, args []string) {
+	if len(args)%2 != 1 {
+		w.Error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+
+	batch := stinky.NewWriteBatch()
+	for i := 1; i < len(args); i += 2 {
+		batch.Put(args[i], args[i+1])
+	}
+
+	err := s.store.Write(batch)
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+
+	w.SimpleString("OK")
+}
+
+// scan walks the keys in order, COUNT is how many keys are looked at per
+// call and MATCH filters them afterwards like redis does
+func (s *Server) scan(w *Writer, args []string) {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		w.Error("ERR invalid cursor")
+		return
+	}
+
+	pattern := "*"
+	count := default_scan_count
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.Error("ERR syntax error")
+			return
+		}
+
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				w.Error("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			w.Error("ERR syntax error")
+			return
+		}
+	}
+
+	start := ""
+	if cursor != 0 {
+		var ok bool
+		start, ok = s.cursors.load(cursor)
+		if !ok {
+			w.Error("ERR invalid cursor")
+			return
+		}
+	}
+
+	end := ""
+	if prefix := literalPrefix(pattern); prefix != "" {
+		start = max(start, prefix)
+		end = iterator.PrefixEnd(prefix)
+	}
+
+	it, err := s.store.Scan(start, end)
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	defer it.Close()
+
+	keys := []string{}
+	for examined := 0; examined < count && it.Next(); examined += 1 {
+		if matchGlob(pattern, it.Key()) {
+			keys = append(keys, it.Key())
+		}
+	}
+
+	next := uint64(0)
+	if it.Next() {
+		next = s.cursors.save(it.Key())
+	}
+
+	if err := it.Err(); err != nil {
+		replyErr(w, err)
+		return
+	}
+
+	w.Array(2)
+	w.Bulk(strconv.FormatUint(next, 10))
+	w.Array(len(keys))
+	for _, key := range keys {
+		w.Bulk(key)
+	}
+}
+
+func (s *Server) info(w *Writer, args []string) {
+	stats := s.store.Stats()
+	bloom, readCache := stats.Bloom, stats.ReadCache
+	sections := []struct {
+		name  string
+		lines []string
+	}{
+		{name: "Server", lines: []string{
+			"redis_mode:standalone",
+			fmt.Sprintf("uptime_in_seconds:%d", int64(time.Since(s.started).Seconds())),
+		}},
+		{name: "Clients", lines: []string{
+			fmt.Sprintf("connected_clients:%d", s.clients.Load()),
+			fmt.Sprintf("maxclients:%d", s.opts.MaxClients),
+		}},
+		{name: "Stats", lines: []string{
+			fmt.Sprintf("total_connections_received:%d", s.connections.Load()),
+			fmt.Sprintf("total_commands_processed:%d", s.commands.Load()),
+			fmt.Sprintf("rejected_connections:%d", s.rejected.Load()),
+			fmt.Sprintf("bloom_checks:%d", bloom.Checks),
+			fmt.Sprintf("bloom_negatives:%d", bloom.Negatives),
+			fmt.Sprintf("bloom_false_positives:%d", bloom.FalsePositives),
+			fmt.Sprintf("read_cache_hits:%d", readCache.Hits),
+			fmt.Sprintf("read_cache_misses:%d", readCache.Misses),
+			fmt.Sprintf("read_cache_evictions:%d", readCache.Evictions),
+			fmt.Sprintf("read_cache_bytes:%d", readCache.Bytes),
+		}},
+	}
+
+	wanted := map[string]bool{}
+	for _, arg := range args[1:] {
+		wanted[strings.ToLower(arg)] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["everything"] || wanted["default"]
+
+	out := strings.Builder{}
+	for _, section := range sections {
+		if !all && !wanted[strings.ToLower(section.name)] {
+			continue
+		}
+
+		if out.Len() > 0 {
+			out.WriteString("\r\n")
+		}
+		out.WriteString("# " + section.name + "\r\n")
+		for _, line := range section.lines {
+			out.WriteString(line + "\r\n")
+		}
+	}
+
+	w.Bulk(out.String())
+}
+
+// flushAll deletes every key in batches, ASYNC and SYNC are accepted and
+// both delete before replying
+func (s *Server) flushAll(w *Writer, args []string) {
+	for _, arg := range args[1:] {
+		mode := strings.ToUpper(arg)
+		if mode != "ASYNC" && mode != "SYNC" {
+			w.Error("ERR syntax error")
+			return
+		}
+	}
+
+	it, err := s.store.NewIterator()
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+	defer it.Close()
+
+	batch := stinky.NewWriteBatch()
+	for it.Next() {
+		batch.Delete(it.Key())
+		if batch.Len() < flush_batch_size {
+			continue
+		}
+
+		err = s.store.Write(batch)
+		if err != nil {
+			replyErr(w, err)
+			return
+		}
+		batch.Reset()
+	}
+
+	if err := it.Err(); err != nil {
+		replyErr(w, err)
+		return
+	}
+
+	err = s.store.Write(batch)
+	if err != nil {
+		replyErr(w, err)
+		return
+	}
+
+	w.SimpleString("OK")
+}
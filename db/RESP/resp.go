@@ -0,0 +1,185 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// max_bulk_len matches the biggest record the write-ahead log takes
+	max_bulk_len   = 64 << 20
+	max_array_len  = 1 << 20
+	max_inline_len = 64 << 10
+)
+
+var (
+	ErrProtocol = errors.New("protocol error")
+)
+
+// Reader reads the commands clients send, either as an array of bulk strings
+// or as an inline command of space separated words like telnet sends
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Buffered is how many bytes of pipelined commands are already read
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// ReadCommand returns the words of the next command, an empty inline line
+// gives an empty command
+func (r *Reader) ReadCommand() ([]string, error) {
+	prefix, err := r.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix[0] != '*' {
+		line, err := r.readLine(max_inline_len)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+
+	header, err := r.readLine(max_inline_len)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := parseLength(header[1:], max_array_len)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i += 1 {
+		arg, err := r.readBulk()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+func (r *Reader) readBulk() (string, error) {
+	header, err := r.readLine(max_inline_len)
+	if err != nil {
+		return "", err
+	}
+
+	if len(header) == 0 || header[0] != '$' {
+		return "", fmt.Errorf("%w: expected '$', got '%.1s'", ErrProtocol, header)
+	}
+
+	length, err := parseLength(header[1:], max_bulk_len)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, length+2)
+	_, err = io.ReadFull(r.r, buf)
+	if err != nil {
+		return "", err
+	}
+
+	if buf[length] != '\r' || buf[length+1] != '\n' {
+		return "", fmt.Errorf("%w: bulk string is not terminated by CRLF", ErrProtocol)
+	}
+
+	return string(buf[:length]), nil
+}
+
+// readLine reads up to the next CRLF, a lone LF is accepted as well
+func (r *Reader) readLine(limit int) (string, error) {
+	line := []byte{}
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return "", fmt.Errorf("%w: line is too long", ErrProtocol)
+		}
+
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	return string(line), nil
+}
+
+func parseLength(s string, limit int) (int, error) {
+	length, err := strconv.Atoi(s)
+	if err != nil || length < 0 {
+		return 0, fmt.Errorf("%w: invalid length '%s'", ErrProtocol, s)
+	}
+
+	if length > limit {
+		return 0, fmt.Errorf("%w: length %d is over the limit of %d", ErrProtocol, length, limit)
+	}
+
+	return length, nil
+}
+
+// Writer buffers replies, they are only sent once Flush is called so the
+// replies to pipelined commands go out together
+type Writer struct {
+	w *bufio.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+func (w *Writer) SimpleString(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+// Error sends msg as an error reply, by convention it starts with an upper
+// case error code such as ERR
+func (w *Writer) Error(msg string) {
+	w.w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+}
+
+func (w *Writer) Integer(n int64) {
+	w.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *Writer) Bulk(s string) {
+	w.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// Null sends the null bulk string that stands for a missing key
+func (w *Writer) Null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+// Array starts an array reply, the n elements have to be written after it
+func (w *Writer) Array(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
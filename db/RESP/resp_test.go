@@ -0,0 +1,106 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadsArraysAndInlineCommands(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$5\r\nx\r\ny \r\n" + "PING  hello\r\n" + "\r\n" + "*0\r\n"
+	reader := NewReader(strings.NewReader(input))
+
+	expected := [][]string{
+		{"SET", "a", "x\r\ny "},
+		{"PING", "hello"},
+		{},
+		{},
+	}
+	for i, want := range expected {
+		args, err := reader.ReadCommand()
+		if err != nil {
+			t.Fatalf("could not read command %d: %+v\n", i, err)
+		}
+
+		if !slices.Equal(args, want) {
+			t.Errorf("expected %q, got %q", want, args)
+		}
+	}
+
+	_, err := reader.ReadCommand()
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF, got %+v", err)
+	}
+}
+
+func TestRejectsMalformedCommands(t *testing.T) {
+	for _, input := range []string{
+		"*2\r\n$3\r\nGET\r\n:1\r\n",
+		"*1\r\n$3\r\nGETX\r\n",
+		"*-5\r\n",
+		"*1\r\n$99999999999\r\n",
+		"*x\r\n",
+	} {
+		_, err := NewReader(strings.NewReader(input)).ReadCommand()
+		if !errors.Is(err, ErrProtocol) {
+			t.Errorf("expected protocol error for %q, got %+v", input, err)
+		}
+	}
+}
+
+func TestWritesReplies(t *testing.T) {
+	buf := bytes.Buffer{}
+	writer := NewWriter(&buf)
+	writer.SimpleString("OK")
+	writer.Error("ERR bad")
+	writer.Integer(-3)
+	writer.Array(2)
+	writer.Bulk("val")
+	writer.Null()
+
+	err := writer.Flush()
+	if err != nil {
+		t.Fatalf("could not flush: %+v\n", err)
+	}
+
+	expected := "+OK\r\n-ERR bad\r\n:-3\r\n*2\r\n$3\r\nval\r\n$-1\r\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+	}
+
+	for _, c := range cases {
+		if matchGlob(c.pattern, c.s) != c.match {
+			t.Errorf("expected matchGlob(%q, %q) to be %t", c.pattern, c.s, c.match)
+		}
+	}
+
+	for pattern, prefix := range map[string]string{"user:*": "user:", "a?c": "a", `a\*b*`: "a", "*": ""} {
+		if literalPrefix(pattern) != prefix {
+			t.Errorf("expected prefix %q for %q, got %q", prefix, pattern, literalPrefix(pattern))
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package resp
+
+import (
+	"sync"
+	"time"
+)
+
+// cursorTable hands out the numeric cursors SCAN replies with, each one
+// remembers the key the next call carries on from. Cursors are forgotten
+// once they are older than ttl, or oldest first once max of them are held
+// so a client can not grow the table without bound. The table is shared
+// by every connection since clients with a pool of connections carry a
+// cursor from one of them to the next
+type cursorTable struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	max  int
+	now  func() time.Time
+	next uint64
+	keys map[uint64]string
+	// order holds the cursors oldest first, with the time they were handed out
+	order []savedCursor
+}
+
+type savedCursor struct {
+	cursor uint64
+	saved  time.Time
+}
+
+func newCursorTable(ttl time.Duration, max int) *cursorTable {
+	return &cursorTable{ttl: ttl, max: max, now: time.Now, next: 1, keys: map[uint64]string{}}
+}
+
+func (c *cursorTable) save(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.expire(now)
+
+	cursor := c.next
+	c.next += 1
+	c.keys[cursor] = key
+	c.order = append(c.order, savedCursor{cursor: cursor, saved: now})
+
+	if len(c.order) > c.max {
+		delete(c.keys, c.order[0].cursor)
+		c.order = c.order[1:]
+	}
+
+	return cursor
+}
+
+func (c *cursorTable) load(cursor uint64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(c.now())
+	key, ok := c.keys[cursor]
+	return key, ok
+}
+
+// expire forgets the cursors handed out more than ttl ago
+func (c *cursorTable) expire(now time.Time) {
+	expired := 0
+	for expired < len(c.order) && now.Sub(c.order[expired].saved) > c.ttl {
+		delete(c.keys, c.order[expired].cursor)
+		expired += 1
+	}
+	c.order = c.order[expired:]
+}
+
+// size is how many cursors are remembered
+func (c *cursorTable) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.keys)
+}
+
+// literalPrefix is the part of a MATCH pattern before its first wildcard,
+// only keys with it can match so the scan can be limited to them
+func literalPrefix(pattern string) string {
+	for i := 0; i < len(pattern); i += 1 {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+
+	return pattern
+}
+
+// matchGlob follows the patterns of redis MATCH, * and ? match any run of
+// characters and any single one, [...] matches a set or range of characters
+// and is negated by a leading ^, a \ escapes the character after it
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i += 1 {
+				if matchGlob(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			matched, rest := matchClass(pattern[1:], s[0])
+			if !matched {
+				return false
+			}
+			pattern = rest
+			s = s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			pattern = pattern[1:]
+			s = s[1:]
+		}
+	}
+
+	return len(s) == 0
+}
+
+// matchClass matches c against the set that pattern starts with and returns
+// the pattern after the closing ]
+func matchClass(pattern string, c byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			low, high := min(pattern[0], pattern[2]), max(pattern[0], pattern[2])
+			matched = matched || (c >= low && c <= high)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+
+	return matched != negate, pattern
+}
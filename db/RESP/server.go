@@ -0,0 +1,210 @@
+package resp
+
+import (
+	"errors"
+	"net"
+	stinky "stinky-db/db"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_CLIENTS = 10_000
+	// cursor_ttl is how long a SCAN cursor is remembered after it was handed out
+	cursor_ttl = 10 * time.Minute
+	// max_cursors is how many SCAN cursors are remembered at most, the oldest
+	// are forgotten first. It is far above what clients paging through the
+	// keyspace at once need and bounds what a client looping SCAN 0 can take
+	max_cursors = 100_000
+)
+
+var (
+	ErrServerClosed = errors.New("server is closed")
+)
+
+type Options struct {
+	// MaxClients is how many connections are served at once, further ones
+	// get an error reply and are closed
+	MaxClients int
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxClients <= 0 {
+		o.MaxClients = DEFAULT_MAX_CLIENTS
+	}
+
+	return o
+}
+
+// Server speaks RESP2 over TCP in front of a store. Commands on a connection
+// are run one after the other and their replies are flushed once no more
+// pipelined commands are waiting
+type Server struct {
+	store   *stinky.DB
+	opts    Options
+	cursors *cursorTable
+	started time.Time
+
+	clients     atomic.Int64
+	connections atomic.Int64
+	rejected    atomic.Int64
+	commands    atomic.Int64
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewServer(store *stinky.DB, opts Options) *Server {
+	return &Server{
+		store:   store,
+		opts:    opts.withDefaults(),
+		cursors: newCursorTable(cursor_ttl, max_cursors),
+		started: time.Now(),
+		conns:   map[net.Conn]struct{}{},
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve accepts connections until Close is called, it then returns ErrServerClosed
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.connections.Add(1)
+		if s.clients.Load() >= int64(s.opts.MaxClients) {
+			s.rejected.Add(1)
+			writer := NewWriter(conn)
+			writer.Error("ERR max number of clients reached")
+			writer.Flush()
+			conn.Close()
+			continue
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		s.clients.Add(1)
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer s.clients.Add(-1)
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	reader := NewReader(conn)
+	writer := NewWriter(conn)
+	for {
+		args, err := reader.ReadCommand()
+		if errors.Is(err, ErrProtocol) {
+			writer.Error("ERR " + err.Error())
+			writer.Flush()
+			return
+		}
+		if err != nil {
+			// the client hung up or the server is closing
+			return
+		}
+
+		quit := false
+		if len(args) > 0 {
+			s.commands.Add(1)
+			quit = s.dispatch(writer, args)
+		}
+
+		if reader.Buffered() == 0 || quit {
+			err = writer.Flush()
+			if err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// Close stops accepting connections, closes the open ones and waits for
+// their commands to finish. The store is left open
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+
+	err := error(nil)
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return err
+}
+
+// Addr is the address the server listens on, nil before Serve is called
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Addr()
+}
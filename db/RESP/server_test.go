@@ -0,0 +1,351 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	stinky "stinky-db/db"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, opts Options) string {
+	store, err := stinky.Open(t.TempDir(), stinky.Options{})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %+v\n", err)
+	}
+
+	server := NewServer(store, opts)
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		server.Close()
+		store.Close()
+	})
+
+	return listener.Addr().String()
+}
+
+type client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not dial: %+v\n", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &client{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *client) send(t *testing.T, commands ...[]string) {
+	buf := NewWriter(c.conn)
+	for _, args := range commands {
+		buf.Array(len(args))
+		for _, arg := range args {
+			buf.Bulk(arg)
+		}
+	}
+
+	err := buf.Flush()
+	if err != nil {
+		t.Fatalf("could not send: %+v\n", err)
+	}
+}
+
+// reply reads one reply, errors and simple strings come back with their type
+// byte, nulls as nil and arrays as []any
+func (c *client) reply(t *testing.T) any {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("could not read reply: %+v\n", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	switch line[0] {
+	case '+', '-', ':':
+		return line
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(c.reader, buf)
+		if err != nil {
+			t.Fatalf("could not read bulk: %+v\n", err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := []any{}
+		for i := 0; i < n; i += 1 {
+			items = append(items, c.reply(t))
+		}
+		return items
+	}
+
+	t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func TestPipelinedCommands(t *testing.T) {
+	addr := startServer(t, Options{})
+	c := dial(t, addr)
+
+	c.send(t,
+		[]string{"SET", "a", "1"},
+		[]string{"set", "b", "2"},
+		[]string{"MSET", "c", "3", "d", "4"},
+		[]string{"GET", "a"},
+		[]string{"MGET", "a", "x", "c"},
+		[]string{"EXISTS", "a", "b", "x", "a"},
+		[]string{"DEL", "a", "x", "a"},
+		[]string{"GET", "a"},
+		[]string{"PING"},
+		[]string{"PING", "hi"},
+		[]string{"INCR", "a"},
+		[]string{"GET"},
+		[]string{"SET", "a", "1", "NX"},
+	)
+
+	expected := []any{
+		"+OK",
+		"+OK",
+		"+OK",
+		"1",
+		[]any{"1", nil, "3"},
+		":3",
+		":1",
+		nil,
+		"+PONG",
+		"hi",
+		"-ERR unknown command 'INCR'",
+		"-ERR wrong number of arguments for 'get' command",
+		"-ERR syntax error",
+	}
+	for i, want := range expected {
+		got := c.reply(t)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("reply %d: expected %v, got %v", i, want, got)
+		}
+	}
+}
+
+func TestConcurrentDeletesCountEveryKeyOnce(t *testing.T) {
+	addr := startServer(t, Options{})
+	clients := []*client{}
+	for i := 0; i < 8; i += 1 {
+		clients = append(clients, dial(t, addr))
+	}
+
+	keys := 200
+	for round := 0; round < 10; round += 1 {
+		for i := 0; i < keys; i += 1 {
+			clients[0].send(t, []string{"SET", fmt.Sprintf("key_%d", i), "v"})
+			clients[0].reply(t)
+		}
+
+		// every client deletes every key, the replies have to add up to
+		// the number of keys no matter how the deletes interleave
+		for _, c := range clients {
+			commands := [][]string{}
+			for i := 0; i < keys; i += 1 {
+				commands = append(commands, []string{"DEL", fmt.Sprintf("key_%d", i), fmt.Sprintf("key_%d", (i+1)%keys)})
+			}
+			c.send(t, commands...)
+		}
+
+		deleted := 0
+		for _, c := range clients {
+			for i := 0; i < keys; i += 1 {
+				reply := c.reply(t).(string)
+				n, err := strconv.Atoi(strings.TrimPrefix(reply, ":"))
+				if err != nil {
+					t.Fatalf("unexpected DEL reply %q", reply)
+				}
+				deleted += n
+			}
+		}
+
+		if deleted != keys {
+			t.Fatalf("round %d: expected %d keys to be deleted, the replies count %d", round, keys, deleted)
+		}
+	}
+}
+
+func TestScanWalksMatchingKeys(t *testing.T) {
+	addr := startServer(t, Options{})
+	c := dial(t, addr)
+
+	expected := []string{}
+	for i := 0; i < 25; i += 1 {
+		key := fmt.Sprintf("user:%02d", i)
+		expected = append(expected, key)
+		c.send(t, []string{"SET", key, "v"}, []string{"SET", fmt.Sprintf("other:%02d", i), "v"})
+		c.reply(t)
+		c.reply(t)
+	}
+
+	keys := []string{}
+	cursor := "0"
+	for calls := 0; ; calls += 1 {
+		if calls > 10 {
+			t.Fatalf("scan did not finish")
+		}
+
+		c.send(t, []string{"SCAN", cursor, "MATCH", "user:*", "COUNT", "7"})
+		reply, ok := c.reply(t).([]any)
+		if !ok || len(reply) != 2 {
+			t.Fatalf("unexpected scan reply %v", reply)
+		}
+
+		for _, key := range reply[1].([]any) {
+			keys = append(keys, key.(string))
+		}
+
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if !slices.Equal(keys, expected) {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+
+	c.send(t, []string{"FLUSHALL"}, []string{"SCAN", "0"})
+	if reply := c.reply(t); reply != "+OK" {
+		t.Fatalf("could not flush: %v", reply)
+	}
+
+	reply := c.reply(t)
+	if fmt.Sprint(reply) != fmt.Sprint([]any{"0", []any{}}) {
+		t.Errorf("expected an empty store after FLUSHALL, got %v", reply)
+	}
+}
+
+func TestInterleavedScansKeepTheirCursors(t *testing.T) {
+	addr := startServer(t, Options{})
+	clients := []*client{dial(t, addr), dial(t, addr)}
+
+	for i := 0; i < 10; i += 1 {
+		clients[0].send(t, []string{"SET", fmt.Sprintf("key_%d", i), "v"})
+		clients[0].reply(t)
+	}
+
+	// every scan is started before any of them carries on, far more than
+	// any fixed number of cursors a table could hold
+	scans := 1_100
+	cursors := make([]string, scans)
+	seen := make([]int, scans)
+	for i := range cursors {
+		c := clients[i%2]
+		c.send(t, []string{"SCAN", "0", "COUNT", "3"})
+		reply := c.reply(t).([]any)
+		cursors[i] = reply[0].(string)
+		seen[i] += len(reply[1].([]any))
+	}
+
+	for round := 0; round < 10; round += 1 {
+		for i, cursor := range cursors {
+			if cursor == "0" {
+				continue
+			}
+
+			// carry on through the other connection, like a pooled client
+			c := clients[(i+1)%2]
+			c.send(t, []string{"SCAN", cursor, "COUNT", "3"})
+			reply, ok := c.reply(t).([]any)
+			if !ok {
+				t.Fatalf("scan %d: cursor %s was lost", i, cursor)
+			}
+			cursors[i] = reply[0].(string)
+			seen[i] += len(reply[1].([]any))
+		}
+	}
+
+	for i := range cursors {
+		if cursors[i] != "0" || seen[i] != 10 {
+			t.Fatalf("scan %d: expected every key once, got %d with cursor %s", i, seen[i], cursors[i])
+		}
+	}
+}
+
+func TestCursorsExpire(t *testing.T) {
+	now := time.Now()
+	cursors := newCursorTable(time.Minute, 10)
+	cursors.now = func() time.Time { return now }
+
+	first := cursors.save("a")
+	now = now.Add(30 * time.Second)
+	second := cursors.save("b")
+
+	now = now.Add(31 * time.Second)
+	if _, ok := cursors.load(first); ok {
+		t.Errorf("expected the first cursor to have expired")
+	}
+	if key, ok := cursors.load(second); !ok || key != "b" {
+		t.Errorf("expected the second cursor to resume at b, got %q %v", key, ok)
+	}
+
+	now = now.Add(time.Minute)
+	cursors.save("c")
+	if cursors.size() != 1 {
+		t.Errorf("expected expired cursors to be forgotten, %d are left", cursors.size())
+	}
+}
+
+func TestCursorsAreCapped(t *testing.T) {
+	cursors := newCursorTable(time.Hour, 3)
+
+	saved := []uint64{}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		saved = append(saved, cursors.save(key))
+	}
+
+	if cursors.size() != 3 {
+		t.Errorf("expected 3 cursors to be remembered, got %d", cursors.size())
+	}
+	if _, ok := cursors.load(saved[0]); ok {
+		t.Errorf("expected the oldest cursor to be forgotten")
+	}
+	for i, key := range []string{"b", "c", "d"} {
+		if got, ok := cursors.load(saved[i+1]); !ok || got != key {
+			t.Errorf("expected cursor %d to resume at %s, got %q %v", saved[i+1], key, got, ok)
+		}
+	}
+}
+
+func TestRejectsClientsOverTheLimit(t *testing.T) {
+	addr := startServer(t, Options{MaxClients: 1})
+
+	first := dial(t, addr)
+	first.send(t, []string{"PING"})
+	if reply := first.reply(t); reply != "+PONG" {
+		t.Fatalf("expected PONG, got %v", reply)
+	}
+
+	second := dial(t, addr)
+	reply := second.reply(t)
+	if reply != "-ERR max number of clients reached" {
+		t.Errorf("expected the second client to be rejected, got %v", reply)
+	}
+
+	first.send(t, []string{"INFO", "stats"})
+	info, _ := first.reply(t).(string)
+	if !strings.Contains(info, "rejected_connections:1\r\n") {
+		t.Errorf("expected the rejection in INFO, got %q", info)
+	}
+}
@@ -0,0 +1,231 @@
+package sstable
+
+import (
+	"container/list"
+	vfs "stinky-db/db/VFS"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DEFAULT_BLOCK_CACHE_SIZE = 8 << 20
+	// decoded_record_overhead is roughly what a decoded record costs on top
+	// of its key and value
+	decoded_record_overhead = 48
+)
+
+// SharedBlockCache is the block cache of every table that was not given one
+var SharedBlockCache = NewBlockCache(DEFAULT_BLOCK_CACHE_SIZE)
+
+// nextFileID hands out the ids block caches tell tables apart by, paths do
+// not work for that as tables are renamed once they are written
+var nextFileID atomic.Uint64
+
+type blockKey struct {
+	fileID uint64
+	offset int
+}
+
+type cachedBlock struct {
+	key     blockKey
+	records []Data
+	size    int64
+}
+
+// BlockCache holds the decoded data blocks of tables up to a byte budget and
+// evicts the least recently used block once it is over it. The records it
+// hands out are shared between readers and must not be modified
+type BlockCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	order    *list.List
+	// files holds the cached blocks of every table by their offset
+	files map[uint64]map[int]*list.Element
+}
+
+// NewBlockCache creates a cache holding up to capacity bytes of decoded
+// blocks, a capacity of 0 or less caches nothing
+func NewBlockCache(capacity int64) *BlockCache {
+	return &BlockCache{
+		capacity: capacity,
+		order:    list.New(),
+		files:    map[uint64]map[int]*list.Element{},
+	}
+}
+
+// SetCapacity changes the byte budget, blocks are evicted right away if the
+// cache is over the new one
+func (c *BlockCache) SetCapacity(capacity int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = capacity
+	c.evict()
+}
+
+func (c *BlockCache) get(key blockKey) ([]Data, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.files[key.fileID][key.offset]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cachedBlock).records, true
+}
+
+func (c *BlockCache) set(key blockKey, records []Data, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if size > c.capacity {
+		return
+	}
+
+	blocks, ok := c.files[key.fileID]
+	if !ok {
+		blocks = map[int]*list.Element{}
+		c.files[key.fileID] = blocks
+	}
+
+	if elem, ok := blocks[key.offset]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	blocks[key.offset] = c.order.PushFront(&cachedBlock{key: key, records: records, size: size})
+	c.size += size
+	c.evict()
+}
+
+func (c *BlockCache) evict() {
+	for c.size > max(c.capacity, 0) {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *BlockCache) remove(elem *list.Element) {
+	block := c.order.Remove(elem).(*cachedBlock)
+	c.size -= block.size
+
+	blocks := c.files[block.key.fileID]
+	delete(blocks, block.key.offset)
+	if len(blocks) == 0 {
+		delete(c.files, block.key.fileID)
+	}
+}
+
+// evictFile drops every block of the table
+func (c *BlockCache) evictFile(fileID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, elem := range c.files[fileID] {
+		c.remove(elem)
+	}
+}
+
+// fileUsage is how many blocks of the table are cached and their size
+func (c *BlockCache) fileUsage(fileID uint64) (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := int64(0)
+	for _, elem := range c.files[fileID] {
+		size += elem.Value.(*cachedBlock).size
+	}
+
+	return len(c.files[fileID]), size
+}
+
+// Size is how many bytes of blocks the cache holds
+func (c *BlockCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// BlockCacheStats describes how a table used the block cache
+type BlockCacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	// Blocks and Bytes are what the cache holds of the table right now
+	Blocks int   `json:"blocks"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// tableBlocks is the block cache state of a table, it is shared by the
+// copies of a Table so they count into the same stats
+type tableBlocks struct {
+	id      uint64
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+	evicted atomic.Bool
+}
+
+func newTableBlocks() *tableBlocks {
+	return &tableBlocks{id: nextFileID.Add(1)}
+}
+
+func (t *Table) blockCache() *BlockCache {
+	if t.BlockCache == nil {
+		return SharedBlockCache
+	}
+
+	return t.BlockCache
+}
+
+// cachedReadBlock returns the records of a data block from the block cache,
+// reading and caching them on a miss. open is only called on a miss
+func (t *Table) cachedReadBlock(open func() (vfs.File, error), handle BlockHandle) ([]Data, error) {
+	key := blockKey{fileID: t.blocks.id, offset: handle.Offset}
+	if records, ok := t.blockCache().get(key); ok {
+		t.blocks.hits.Add(1)
+		return records, nil
+	}
+	t.blocks.misses.Add(1)
+
+	file, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := t.readBlock(file, handle)
+	if err != nil {
+		return nil, err
+	}
+
+	// a removed table can still be read by open iterators, its blocks are not cached again
+	if !t.blocks.evicted.Load() {
+		size := int64(0)
+		for _, keyVal := range records {
+			size += int64(len(keyVal.Key) + len(keyVal.Value) + decoded_record_overhead)
+		}
+		t.blockCache().set(key, records, size)
+	}
+
+	return records, nil
+}
+
+// EvictBlocks drops the cached blocks of the table, it is called once the
+// table has been removed
+func (t *Table) EvictBlocks() {
+	t.blocks.evicted.Store(true)
+	t.blockCache().evictFile(t.blocks.id)
+}
+
+// BlockCacheStats reports the block cache hits and misses of the table and
+// what the cache holds of it
+func (t *Table) BlockCacheStats() BlockCacheStats {
+	stats := BlockCacheStats{
+		Hits:   t.blocks.hits.Load(),
+		Misses: t.blocks.misses.Load(),
+	}
+	stats.Blocks, stats.Bytes = t.blockCache().fileUsage(t.blocks.id)
+
+	return stats
+}
@@ -0,0 +1,134 @@
+package sstable
+
+import (
+	"fmt"
+	vfs "stinky-db/db/VFS"
+	"testing"
+)
+
+func writeCachedTable(t *testing.T, fs vfs.FS, cache *BlockCache, records int) *Table {
+	data := []Data{}
+	for i := 0; i < records; i += 1 {
+		data = append(data, Data{Key: fmt.Sprintf("key_%04d", i), Value: fmt.Sprintf("val_%d", i), Seq: uint64(i + 1)})
+	}
+
+	table := GenerateFromSorted(data, "table.sst")
+	table.FS = fs
+	table.BlockCache = cache
+	err := table.WriteToFile()
+	if err != nil {
+		t.Fatalf("could not write data: %+v\n", err)
+	}
+
+	return &table
+}
+
+func TestPointReadsHitTheBlockCache(t *testing.T) {
+	fs := vfs.NewMem()
+	cache := NewBlockCache(1 << 20)
+	table := writeCachedTable(t, fs, cache, 1000)
+
+	for i := 0; i < 2; i += 1 {
+		val, err := table.Get("key_0500")
+		if err != nil || val != "val_500" {
+			t.Fatalf("expected val_500, got %s %+v", val, err)
+		}
+	}
+
+	stats := table.BlockCacheStats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Blocks != 1 || stats.Bytes == 0 {
+		t.Errorf("expected one miss followed by a hit, got %+v", stats)
+	}
+
+	// a cached block is served without the file
+	err := fs.Remove("table.sst")
+	if err != nil {
+		t.Fatalf("could not remove table: %+v\n", err)
+	}
+
+	val, err := table.Get("key_0500")
+	if err != nil || val != "val_500" {
+		t.Errorf("expected val_500 from the cache, got %s %+v", val, err)
+	}
+}
+
+func TestIteratorsShareTheBlockCache(t *testing.T) {
+	cache := NewBlockCache(1 << 20)
+	table := writeCachedTable(t, vfs.NewMem(), cache, 1000)
+
+	for round := 0; round < 2; round += 1 {
+		it, err := table.NewIterator()
+		if err != nil {
+			t.Fatalf("could not open iterator: %+v\n", err)
+		}
+
+		count := 0
+		for it.Next() {
+			count += 1
+		}
+		it.Close()
+
+		if it.Err() != nil || count != 1000 {
+			t.Fatalf("expected 1000 records, got %d %+v", count, it.Err())
+		}
+	}
+
+	stats := table.BlockCacheStats()
+	if stats.Misses != uint64(len(table.Blocks)) || stats.Hits != uint64(len(table.Blocks)) {
+		t.Errorf("expected every block to be read once and then hit, got %+v over %d blocks", stats, len(table.Blocks))
+	}
+}
+
+func TestBlockCacheStaysWithinItsBudget(t *testing.T) {
+	cache := NewBlockCache(8 << 10)
+	table := writeCachedTable(t, vfs.NewMem(), cache, 5000)
+
+	for i := 0; i < 5000; i += 100 {
+		_, err := table.Get(fmt.Sprintf("key_%04d", i))
+		if err != nil {
+			t.Fatalf("could not get key_%04d: %+v\n", i, err)
+		}
+	}
+
+	if cache.Size() > 8<<10 {
+		t.Errorf("expected at most %d bytes cached, got %d", 8<<10, cache.Size())
+	}
+
+	cache.SetCapacity(0)
+	if cache.Size() != 0 || table.BlockCacheStats().Blocks != 0 {
+		t.Errorf("expected shrinking the cache to empty it, got %d bytes", cache.Size())
+	}
+}
+
+func TestEvictBlocksDropsTheTable(t *testing.T) {
+	cache := NewBlockCache(1 << 20)
+	fs := vfs.NewMem()
+	table := writeCachedTable(t, fs, cache, 1000)
+
+	it, err := table.NewIterator()
+	if err != nil {
+		t.Fatalf("could not open iterator: %+v\n", err)
+	}
+	defer it.Close()
+
+	for _, key := range []string{"key_0001", "key_0999"} {
+		_, err := table.Get(key)
+		if err != nil {
+			t.Fatalf("could not get %s: %+v\n", key, err)
+		}
+	}
+
+	table.EvictBlocks()
+	if cache.Size() != 0 {
+		t.Errorf("expected the blocks of the table to be evicted, %d bytes are left", cache.Size())
+	}
+
+	// iterators still read a removed table but do not bring its blocks back
+	count := 0
+	for it.Next() {
+		count += 1
+	}
+	if count != 1000 || cache.Size() != 0 {
+		t.Errorf("expected 1000 records and nothing cached, got %d records and %d bytes", count, cache.Size())
+	}
+}
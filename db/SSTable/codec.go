@@ -0,0 +1,360 @@
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Codec is how a block is compressed, it is recorded in the trailer of
+// every block from format_compressed on
+type Codec uint8
+
+const (
+	CodecNone Codec = iota
+	// CodecSnappy is the snappy block format, fast with a moderate ratio
+	CodecSnappy
+	// CodecFlate is DEFLATE at its best compression from compress/flate. It
+	// stands in for zstd, which the standard library does not have, and
+	// like it trades speed for a better ratio on cold levels
+	CodecFlate
+)
+
+const (
+	// min_compression_gain is the share of a block compression has to save
+	// for the block to be stored compressed, 12.5% like leveldb
+	min_compression_gain = 8
+	// max_decoded_size bounds the size a compressed block can claim to
+	// expand to. A block holds block_size bytes and at most one record past
+	// that, records are bounded by the WAL to 64 MiB, so real blocks stay
+	// well below it. Bigger blocks are never compressed
+	max_decoded_size = 128 << 20
+
+	snappy_hash_bits   = 14
+	snappy_min_length  = 17
+	snappy_max_offset  = 1<<16 - 1
+	snappy_tag_literal = 0
+	snappy_tag_copy1   = 1
+	snappy_tag_copy2   = 2
+	snappy_tag_copy4   = 3
+)
+
+var (
+	errBadCompressedBlock = errors.New("bad compressed block")
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecSnappy:
+		return "snappy"
+	case CodecFlate:
+		return "flate"
+	default:
+		return fmt.Sprintf("codec(%d)", uint8(c))
+	}
+}
+
+// ParseCodec is the inverse of Codec.String
+func ParseCodec(name string) (Codec, error) {
+	for _, codec := range []Codec{CodecNone, CodecSnappy, CodecFlate} {
+		if codec.String() == name {
+			return codec, nil
+		}
+	}
+
+	return CodecNone, fmt.Errorf("unknown codec %q", name)
+}
+
+// compress returns the block compressed with the codec, blocks that do not
+// get small enough are kept as they are and CodecNone is returned
+func compress(block []byte, codec Codec) ([]byte, Codec) {
+	if len(block) > max_decoded_size {
+		return block, CodecNone
+	}
+
+	var compressed []byte
+	switch codec {
+	case CodecSnappy:
+		compressed = snappyEncode(block)
+	case CodecFlate:
+		compressed = flateEncode(block)
+	default:
+		return block, CodecNone
+	}
+
+	if len(compressed) > len(block)-len(block)/min_compression_gain {
+		return block, CodecNone
+	}
+
+	return compressed, codec
+}
+
+func decompress(block []byte, codec Codec) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return block, nil
+	case CodecSnappy:
+		return snappyDecode(block)
+	case CodecFlate:
+		return flateDecode(block)
+	default:
+		return nil, fmt.Errorf("%w: unknown codec %d", InvalidFileErr, codec)
+	}
+}
+
+// decodedLen reads the uncompressed length both codecs start with
+func decodedLen(block []byte) (int, []byte, error) {
+	length, n := binary.Uvarint(block)
+	if n <= 0 || length > max_decoded_size {
+		return 0, nil, errBadCompressedBlock
+	}
+
+	return int(length), block[n:], nil
+}
+
+// flateEncode writes the uncompressed length followed by the DEFLATE stream
+func flateEncode(block []byte) []byte {
+	buf := bytes.NewBuffer(binary.AppendUvarint(nil, uint64(len(block))))
+	writer, _ := flate.NewWriter(buf, flate.BestCompression)
+	writer.Write(block)
+	writer.Close()
+
+	return buf.Bytes()
+}
+
+func flateDecode(block []byte) ([]byte, error) {
+	length, stream, err := decodedLen(block)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := make([]byte, length)
+	reader := flate.NewReader(bytes.NewReader(stream))
+	defer reader.Close()
+
+	_, err = io.ReadFull(reader, decoded)
+	if err != nil {
+		return nil, errBadCompressedBlock
+	}
+
+	// anything past the length the block claims means it is damaged
+	n, _ := reader.Read(make([]byte, 1))
+	if n > 0 {
+		return nil, errBadCompressedBlock
+	}
+
+	return decoded, nil
+}
+
+// snappyEncode compresses the block in the snappy block format, the
+// uncompressed length followed by literals and back references. Matches
+// are found through a hash table of the last position of every 4 bytes
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	if len(src) < snappy_min_length {
+		return appendLiteral(dst, src)
+	}
+
+	table := make([]int, 1<<snappy_hash_bits)
+	literal := 0
+	for pos := 0; pos+4 <= len(src); {
+		word := binary.LittleEndian.Uint32(src[pos:])
+		hash := (word * 0x1e35a7bd) >> (32 - snappy_hash_bits)
+		candidate := table[hash] - 1
+		table[hash] = pos + 1
+
+		if candidate < 0 || pos-candidate > snappy_max_offset || binary.LittleEndian.Uint32(src[candidate:]) != word {
+			pos += 1
+			continue
+		}
+
+		length := 4
+		for pos+length < len(src) && src[candidate+length] == src[pos+length] {
+			length += 1
+		}
+
+		dst = appendLiteral(dst, src[literal:pos])
+		dst = appendCopy(dst, pos-candidate, length)
+		pos += length
+		literal = pos
+	}
+
+	return appendLiteral(dst, src[literal:])
+}
+
+func appendLiteral(dst []byte, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+
+	n := len(literal) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappy_tag_literal)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappy_tag_literal, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappy_tag_literal, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappy_tag_literal, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappy_tag_literal, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+
+	return append(dst, literal...)
+}
+
+// appendCopy splits a match into copies of at most 64 bytes, the last one
+// is kept at 4 bytes or more so it can use the short form
+func appendCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = appendCopy2(dst, offset, 64)
+		length -= 64
+	}
+
+	if length > 64 {
+		dst = appendCopy2(dst, offset, 60)
+		length -= 60
+	}
+
+	if length >= 12 || offset >= 2048 {
+		return appendCopy2(dst, offset, length)
+	}
+
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappy_tag_copy1, byte(offset))
+}
+
+func appendCopy2(dst []byte, offset, length int) []byte {
+	return append(dst, byte(length-1)<<2|snappy_tag_copy2, byte(offset), byte(offset>>8))
+}
+
+func snappyDecode(src []byte) ([]byte, error) {
+	length, src, err := decodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		tag := src[0]
+		offset, n := 0, 0
+
+		switch tag & 3 {
+		case snappy_tag_literal:
+			n = int(tag >> 2)
+			extra := 0
+			if n >= 60 {
+				extra = n - 59
+				if len(src) < 1+extra {
+					return nil, errBadCompressedBlock
+				}
+
+				n = 0
+				for i := extra; i > 0; i -= 1 {
+					n = n<<8 | int(src[i])
+				}
+			}
+			n += 1
+
+			src = src[1+extra:]
+			if n > len(src) || len(dst)+n > length {
+				return nil, errBadCompressedBlock
+			}
+			dst = append(dst, src[:n]...)
+			src = src[n:]
+			continue
+
+		case snappy_tag_copy1:
+			if len(src) < 2 {
+				return nil, errBadCompressedBlock
+			}
+			n = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+
+		case snappy_tag_copy2:
+			if len(src) < 3 {
+				return nil, errBadCompressedBlock
+			}
+			n = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+
+		case snappy_tag_copy4:
+			if len(src) < 5 {
+				return nil, errBadCompressedBlock
+			}
+			n = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+
+		if offset <= 0 || offset > len(dst) || len(dst)+n > length {
+			return nil, errBadCompressedBlock
+		}
+
+		// copies can overlap what they write, so they go a byte at a time
+		start := len(dst) - offset
+		for i := 0; i < n; i += 1 {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if len(dst) != length {
+		return nil, errBadCompressedBlock
+	}
+
+	return dst, nil
+}
+
+// CompressionStats describes how the data blocks of a table are stored
+type CompressionStats struct {
+	// Blocks counts the data blocks stored with each codec
+	Blocks map[Codec]int
+	// StoredBytes is what the data blocks take up in the file and RawBytes
+	// what they take up uncompressed, trailers left out
+	StoredBytes int64
+	RawBytes    int64
+}
+
+// Ratio is how many times smaller compression made the data blocks
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+// CompressionStats reads every data block to tell how well it compressed,
+// tables in the JSON format have no blocks to report
+func (t *Table) CompressionStats() (CompressionStats, error) {
+	stats := CompressionStats{Blocks: map[Codec]int{}}
+	if t.FileIndex.Version < format_binary {
+		return stats, nil
+	}
+
+	file, release, err := t.open()
+	if err != nil {
+		return stats, err
+	}
+	defer release()
+
+	for _, handle := range t.Blocks {
+		block, codec, err := t.readStoredSection(file, handle.Offset, handle.Len)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Blocks[codec] += 1
+		stats.StoredBytes += int64(handle.Len)
+		stats.RawBytes += int64(len(block))
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,201 @@
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func codecInputs() [][]byte {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	records := []byte{}
+	for i := 0; i < 500; i += 1 {
+		records = append(records, fmt.Sprintf("key_%04d:val_%d;", i, i%7)...)
+	}
+
+	return [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("short block"),
+		bytes.Repeat([]byte("a"), 10000),
+		bytes.Repeat([]byte("abcdefgh"), 3000),
+		random,
+		records,
+	}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{CodecSnappy, CodecFlate} {
+		for i, input := range codecInputs() {
+			var encoded []byte
+			if codec == CodecSnappy {
+				encoded = snappyEncode(input)
+			} else {
+				encoded = flateEncode(input)
+			}
+
+			decoded, err := decompress(encoded, codec)
+			if err != nil || !bytes.Equal(decoded, input) {
+				t.Errorf("%s: input %d did not round trip: %+v", codec, i, err)
+			}
+		}
+	}
+}
+
+func TestCompressKeepsBlocksThatDoNotShrink(t *testing.T) {
+	inputs := codecInputs()
+
+	_, codec := compress(inputs[5], CodecSnappy)
+	if codec != CodecNone {
+		t.Errorf("expected random bytes to be stored uncompressed, got %s", codec)
+	}
+
+	compressed, codec := compress(inputs[6], CodecSnappy)
+	if codec != CodecSnappy || len(compressed) >= len(inputs[6]) {
+		t.Errorf("expected records to compress, got %s with %d of %d bytes", codec, len(compressed), len(inputs[6]))
+	}
+}
+
+func TestCorruptCompressedBlocksAreRejected(t *testing.T) {
+	input := codecInputs()[6]
+	for _, codec := range []Codec{CodecSnappy, CodecFlate} {
+		compressed, _ := compress(input, codec)
+
+		truncated := compressed[:len(compressed)/2]
+		_, err := decompress(truncated, codec)
+		if err == nil {
+			t.Errorf("%s: expected a truncated block to be rejected", codec)
+		}
+
+		// a block claiming to expand past max_decoded_size is not allocated
+		huge := append([]byte{0xff, 0xff, 0xff, 0xff, 0x0f}, compressed[1:]...)
+		_, err = decompress(huge, codec)
+		if err == nil {
+			t.Errorf("%s: expected an oversized length to be rejected", codec)
+		}
+	}
+
+	_, err := decompress([]byte{1, 2, 3}, Codec(9))
+	if !errors.Is(err, InvalidFileErr) {
+		t.Errorf("expected an unknown codec to be rejected, got %+v", err)
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	for _, codec := range []Codec{CodecNone, CodecSnappy, CodecFlate} {
+		parsed, err := ParseCodec(codec.String())
+		if err != nil || parsed != codec {
+			t.Errorf("expected %s, got %s %+v", codec, parsed, err)
+		}
+	}
+
+	_, err := ParseCodec("zip")
+	if err == nil {
+		t.Errorf("expected an unknown codec name to be rejected")
+	}
+}
+
+func TestCompressedTableRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{CodecSnappy, CodecFlate} {
+		path := t.TempDir() + "/table.sst"
+		data := []Data{}
+		for i := 0; i < 2000; i += 1 {
+			data = append(data, Data{Key: fmt.Sprintf("key_%04d", i), Value: fmt.Sprintf("val_%d", i%10), Seq: uint64(i + 1)})
+		}
+
+		table := GenerateFromSorted(data, path)
+		table.Options.Codec = codec
+		table.BlockCache = NewBlockCache(0)
+		err := table.WriteToFile()
+		if err != nil {
+			t.Fatalf("%s: could not write table: %+v\n", codec, err)
+		}
+
+		restored, err := GenerateFromDisk(path)
+		if err != nil {
+			t.Fatalf("%s: could not restore table: %+v\n", codec, err)
+		}
+		restored.BlockCache = NewBlockCache(0)
+
+		val, err := restored.Get("key_1234")
+		if err != nil || val != "val_4" {
+			t.Errorf("%s: expected val_4, got %s %+v", codec, val, err)
+		}
+
+		elements, err := restored.GetAllElements()
+		if err != nil || len(elements) != len(data) {
+			t.Errorf("%s: expected %d records, got %d %+v", codec, len(data), len(elements), err)
+		}
+
+		stats, err := restored.CompressionStats()
+		if err != nil || stats.Blocks[codec] != len(restored.Blocks) || stats.Ratio() <= 1 {
+			t.Errorf("%s: expected every block to be compressed, got %+v %+v", codec, stats, err)
+		}
+	}
+}
+
+func TestHighlyCompressibleValuesRoundTrip(t *testing.T) {
+	value := strings.Repeat("a", 4<<20)
+	for _, codec := range []Codec{CodecSnappy, CodecFlate} {
+		path := t.TempDir() + "/table.sst"
+		table := GenerateFromSorted([]Data{{Key: "a", Value: value, Seq: 1}, {Key: "b", Value: "val", Seq: 2}}, path)
+		table.Options.Codec = codec
+		table.BlockCache = NewBlockCache(0)
+		err := table.WriteToFile()
+		if err != nil {
+			t.Fatalf("%s: could not write table: %+v\n", codec, err)
+		}
+
+		restored, err := GenerateFromDisk(path)
+		if err != nil {
+			t.Fatalf("%s: could not restore table: %+v\n", codec, err)
+		}
+		restored.BlockCache = NewBlockCache(0)
+
+		val, err := restored.Get("a")
+		if err != nil || val != value {
+			t.Errorf("%s: expected the value back, got %d bytes %+v", codec, len(val), err)
+		}
+
+		stats, err := restored.CompressionStats()
+		if err != nil || stats.Blocks[codec] == 0 {
+			t.Errorf("%s: expected the value to be stored compressed, got %+v %+v", codec, stats, err)
+		}
+	}
+}
+
+func TestCorruptCompressedTableIsReported(t *testing.T) {
+	path := t.TempDir() + "/table.sst"
+	data := []Data{}
+	for i := 0; i < 2000; i += 1 {
+		data = append(data, Data{Key: fmt.Sprintf("key_%04d", i), Value: "val", Seq: uint64(i + 1)})
+	}
+
+	table := GenerateFromSorted(data, path)
+	table.Options.Codec = CodecSnappy
+	table.BlockCache = NewBlockCache(0)
+	err := table.WriteToFile()
+	if err != nil {
+		t.Fatalf("could not write table: %+v\n", err)
+	}
+
+	handle := table.Blocks[1]
+	flipByte(t, path, handle.Offset+3)
+
+	_, err = table.Get(handle.LastKey)
+	corruption := &ErrCorruption{}
+	if !errors.As(err, &corruption) || corruption.Offset != int64(handle.Offset) {
+		t.Errorf("expected corruption at %d, got %+v", handle.Offset, err)
+	}
+
+	_, err = os.Stat(path)
+	if err != nil {
+		t.Fatalf("expected the table to stay on disk: %+v\n", err)
+	}
+}
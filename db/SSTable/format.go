@@ -0,0 +1,462 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	vfs "stinky-db/db/VFS"
+)
+
+// A binary table is laid out as
+//
+//	data blocks | index block | meta block | bloom filter | footer
+//
+// Records in a data block are a uvarint key length, the key, a uvarint value
+// length, the value, a flags byte and the uvarint sequence number, before
+// format_sequenced the last field was the varint written time in unix nanos.
+// The index block has one entry per data block holding its last key, offset
+// and length, the meta block holds the first and last key of the table and
+// the footer is fixed size so it can be read without scanning the file.
+// From format_checksummed on every block is followed by the crc32c of its
+// bytes and the footer carries a checksum of its own. From format_compressed
+// on the checksum is preceded by the codec the block is compressed with and
+// covers the codec as well, block handles point at the compressed bytes
+const (
+	// format_json is the original layout of JSON records and a $$ separated JSON file index
+	format_json        = 1
+	format_binary      = 2
+	format_checksummed = 3
+	format_sequenced   = 4
+	format_compressed  = 5
+
+	table_magic = uint64(0x53544e4b59534254) // STNKYSBT
+	// the version and magic sit at the very end of every footer so the
+	// footer size can be told from them
+	footer_tail_size   = 4 + 8
+	footer_size_v2     = 6*8 + footer_tail_size
+	footer_size        = 6*8 + 4 + footer_tail_size
+	block_trailer_size = 4
+	// codec_trailer_size is the trailer of format_compressed, the codec and the checksum
+	codec_trailer_size = 1 + block_trailer_size
+	block_size         = 4 << 10
+
+	flag_delete = 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// BlockHandle points at a data block, LastKey is the biggest key in it
+type BlockHandle struct {
+	LastKey string
+	Offset  int
+	Len     int
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readString(buf []byte) (string, []byte, bool) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < length {
+		return "", nil, false
+	}
+
+	return string(buf[n : n+int(length)]), buf[n+int(length):], true
+}
+
+func readUvarint(buf []byte) (uint64, []byte, bool) {
+	val, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, nil, false
+	}
+
+	return val, buf[n:], true
+}
+
+func appendRecord(buf []byte, keyVal Data) []byte {
+	buf = appendString(buf, keyVal.Key)
+	buf = appendString(buf, keyVal.Value)
+
+	flags := byte(0)
+	if keyVal.Delete {
+		flags |= flag_delete
+	}
+	buf = append(buf, flags)
+
+	return binary.AppendUvarint(buf, keyVal.Seq)
+}
+
+// decodeBlock reads the records of a block written in the given format version
+func decodeBlock(block []byte, version int) ([]Data, error) {
+	data := []Data{}
+	for len(block) > 0 {
+		keyVal, rest, err := decodeRecord(block, version)
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, keyVal)
+		block = rest
+	}
+
+	return data, nil
+}
+
+// decodeRecord reads the record at the start of buf and returns the bytes after it
+func decodeRecord(buf []byte, version int) (Data, []byte, error) {
+	keyVal := Data{}
+	ok := false
+
+	keyVal.Key, buf, ok = readString(buf)
+	if !ok {
+		return keyVal, nil, fmt.Errorf("%w: bad record key", InvalidFileErr)
+	}
+
+	keyVal.Value, buf, ok = readString(buf)
+	if !ok || len(buf) == 0 {
+		return keyVal, nil, fmt.Errorf("%w: bad record value", InvalidFileErr)
+	}
+
+	keyVal.Delete = buf[0]&flag_delete != 0
+	buf = buf[1:]
+
+	// the written time of older formats does not order anything, those records keep Seq 0
+	n := 0
+	if version >= format_sequenced {
+		keyVal.Seq, n = binary.Uvarint(buf)
+	} else {
+		_, n = binary.Varint(buf)
+	}
+	if n <= 0 {
+		return keyVal, nil, fmt.Errorf("%w: bad record sequence", InvalidFileErr)
+	}
+
+	return keyVal, buf[n:], nil
+}
+
+func encodeIndex(handles []BlockHandle) []byte {
+	buf := []byte{}
+	for _, handle := range handles {
+		buf = appendString(buf, handle.LastKey)
+		buf = binary.AppendUvarint(buf, uint64(handle.Offset))
+		buf = binary.AppendUvarint(buf, uint64(handle.Len))
+	}
+
+	return buf
+}
+
+func decodeIndex(buf []byte) ([]BlockHandle, error) {
+	handles := []BlockHandle{}
+	for len(buf) > 0 {
+		handle := BlockHandle{}
+		offset, length := uint64(0), uint64(0)
+		ok := false
+
+		handle.LastKey, buf, ok = readString(buf)
+		if ok {
+			offset, buf, ok = readUvarint(buf)
+		}
+		if ok {
+			length, buf, ok = readUvarint(buf)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: bad index entry", InvalidFileErr)
+		}
+
+		handle.Offset = int(offset)
+		handle.Len = int(length)
+		handles = append(handles, handle)
+	}
+
+	return handles, nil
+}
+
+func encodeMeta(minMax MinMax) []byte {
+	buf := appendString(nil, minMax.StartKey)
+	return appendString(buf, minMax.EndKey)
+}
+
+func decodeMeta(buf []byte) (MinMax, error) {
+	minMax := MinMax{}
+	ok := false
+
+	minMax.StartKey, buf, ok = readString(buf)
+	if ok {
+		minMax.EndKey, _, ok = readString(buf)
+	}
+	if !ok {
+		return minMax, fmt.Errorf("%w: bad meta block", InvalidFileErr)
+	}
+
+	return minMax, nil
+}
+
+func encodeFooter(fileIdx FileIndex) []byte {
+	buf := make([]byte, 0, footer_size)
+	for _, field := range []int{
+		fileIdx.IndexStart, fileIdx.IndexLen,
+		fileIdx.MetaStart, fileIdx.MetaLen,
+		fileIdx.BloomStart, fileIdx.BloomLen,
+	} {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(field))
+	}
+
+	buf = binary.LittleEndian.AppendUint32(buf, 0)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(fileIdx.Version))
+	buf = binary.LittleEndian.AppendUint64(buf, table_magic)
+	binary.LittleEndian.PutUint32(buf[6*8:], footerChecksum(buf))
+
+	return buf
+}
+
+// footerChecksum covers every byte of the footer apart from the checksum itself
+func footerChecksum(footer []byte) uint32 {
+	crc := crc32.Checksum(footer[:6*8], crcTable)
+	return crc32.Update(crc, crcTable, footer[6*8+4:])
+}
+
+// footerVersion reads the format version out of the last bytes of a file,
+// it reports false when they are not the end of a binary footer which is
+// the case for tables written in the JSON format
+func footerVersion(tail []byte) (int, bool) {
+	if len(tail) != footer_tail_size || binary.LittleEndian.Uint64(tail[4:]) != table_magic {
+		return 0, false
+	}
+
+	return int(binary.LittleEndian.Uint32(tail)), true
+}
+
+func footerSize(version int) int {
+	if version == format_binary {
+		return footer_size_v2
+	}
+
+	return footer_size
+}
+
+func decodeFooter(buf []byte, version int) (FileIndex, bool) {
+	if version >= format_checksummed && footerChecksum(buf) != binary.LittleEndian.Uint32(buf[6*8:]) {
+		return FileIndex{}, false
+	}
+
+	fields := make([]int, 6)
+	for i := range fields {
+		fields[i] = int(binary.LittleEndian.Uint64(buf[i*8:]))
+	}
+
+	return FileIndex{
+		DataStart:  0,
+		DataLen:    fields[0],
+		IndexStart: fields[0],
+		IndexLen:   fields[1],
+		MetaStart:  fields[2],
+		MetaLen:    fields[3],
+		BloomStart: fields[4],
+		BloomLen:   fields[5],
+		Version:    version,
+	}, true
+}
+
+func appendBlock(buf []byte, block []byte) []byte {
+	buf = append(buf, block...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(block, crcTable))
+}
+
+// appendCompressedBlock compresses the block with the codec if that makes it
+// small enough and returns how many bytes it takes up before its trailer
+func appendCompressedBlock(buf []byte, block []byte, codec Codec) ([]byte, int) {
+	stored, codec := compress(block, codec)
+	buf = append(buf, stored...)
+	buf = append(buf, byte(codec))
+	crc := crc32.Checksum(buf[len(buf)-len(stored)-1:], crcTable)
+
+	return binary.LittleEndian.AppendUint32(buf, crc), len(stored)
+}
+
+// encodeBinary lays the sorted records out in blocks and returns the whole
+// file along with the index of its data blocks
+func (t *Table) encodeBinary(bloomBytes []byte) ([]byte, []BlockHandle) {
+	buf := []byte{}
+	handles := []BlockHandle{}
+	block := []byte{}
+	for i, keyVal := range t.Data {
+		block = appendRecord(block, keyVal)
+		if len(block) < block_size && i != len(t.Data)-1 {
+			continue
+		}
+
+		offset := len(buf)
+		stored := 0
+		buf, stored = appendCompressedBlock(buf, block, t.Options.Codec)
+		handles = append(handles, BlockHandle{LastKey: keyVal.Key, Offset: offset, Len: stored})
+		block = block[:0]
+	}
+
+	fileIdx := FileIndex{
+		DataStart: 0,
+		DataLen:   len(buf),
+		MinMax: MinMax{
+			StartKey: t.Data[0].Key,
+			EndKey:   t.Data[len(t.Data)-1].Key,
+		},
+		Version: format_compressed,
+	}
+
+	index := encodeIndex(handles)
+	fileIdx.IndexStart = len(buf)
+	fileIdx.IndexLen = len(index)
+	buf, _ = appendCompressedBlock(buf, index, CodecNone)
+
+	meta := encodeMeta(fileIdx.MinMax)
+	fileIdx.MetaStart = len(buf)
+	fileIdx.MetaLen = len(meta)
+	buf, _ = appendCompressedBlock(buf, meta, CodecNone)
+
+	if len(bloomBytes) > 0 {
+		fileIdx.BloomStart = len(buf)
+		fileIdx.BloomLen = len(bloomBytes)
+		buf, _ = appendCompressedBlock(buf, bloomBytes, CodecNone)
+	}
+
+	t.FileIndex = fileIdx
+
+	return append(buf, encodeFooter(fileIdx)...), handles
+}
+
+// Checksummed reports whether the blocks of the table carry checksums
+func (t *Table) Checksummed() bool {
+	return t.FileIndex.Version >= format_checksummed
+}
+
+// readSection reads length bytes at offset and verifies the checksum that
+// follows them in checksummed tables. The bytes of a mapped table point into
+// the mapping and are only valid while the file is held
+func (t *Table) readSection(file vfs.File, offset, length int) ([]byte, error) {
+	section, _, err := t.readStoredSection(file, offset, length)
+	return section, err
+}
+
+func (t *Table) trailerSize() int {
+	switch {
+	case t.FileIndex.Version >= format_compressed:
+		return codec_trailer_size
+	case t.Checksummed():
+		return block_trailer_size
+	default:
+		return 0
+	}
+}
+
+// readStoredSection is readSection that also returns the codec the section
+// was stored with, the returned bytes are decompressed
+func (t *Table) readStoredSection(file vfs.File, offset, length int) ([]byte, Codec, error) {
+	trailer := t.trailerSize()
+	if offset < 0 || length < 0 || offset+length+trailer > t.fileSize {
+		return nil, CodecNone, t.corruption(offset, "section is out of bounds")
+	}
+
+	// mapped tables hand out their bytes without a copy
+	buf, mapped := []byte(nil), false
+	if file, ok := file.(*mappedFile); ok {
+		buf, mapped = file.section(offset, length+trailer)
+	}
+
+	if !mapped {
+		buf = make([]byte, length+trailer)
+		_, err := file.ReadAt(buf, int64(offset))
+		if errors.Is(err, io.EOF) {
+			return nil, CodecNone, t.corruption(offset, "section is cut short")
+		}
+		if err != nil {
+			return nil, CodecNone, err
+		}
+	}
+
+	if trailer == 0 {
+		return buf, CodecNone, nil
+	}
+
+	// the checksum of a compressed table covers the codec byte in front of it
+	checked := length + trailer - block_trailer_size
+	if crc32.Checksum(buf[:checked], crcTable) != binary.LittleEndian.Uint32(buf[checked:]) {
+		return nil, CodecNone, t.corruption(offset, "checksum mismatch")
+	}
+
+	codec := CodecNone
+	if trailer == codec_trailer_size {
+		codec = Codec(buf[length])
+	}
+
+	section, err := decompress(buf[:length], codec)
+	if err != nil {
+		return nil, codec, t.corruption(offset, err.Error())
+	}
+
+	return section, codec, nil
+}
+
+// openBinary loads the index, meta block and bloom filter of a binary table
+func (t *Table) openBinary(file vfs.File, fileIdx FileIndex) error {
+	if fileIdx.Version < format_binary || fileIdx.Version > format_compressed {
+		return fmt.Errorf("%w: unknown format version %d", InvalidFileErr, fileIdx.Version)
+	}
+	t.FileIndex = fileIdx
+
+	indexBytes, err := t.readSection(file, fileIdx.IndexStart, fileIdx.IndexLen)
+	if err != nil {
+		return err
+	}
+
+	t.Blocks, err = decodeIndex(indexBytes)
+	if err != nil {
+		return t.corruption(fileIdx.IndexStart, err.Error())
+	}
+
+	for _, handle := range t.Blocks {
+		if handle.Offset+handle.Len > fileIdx.DataLen {
+			return t.corruption(fileIdx.IndexStart, "index points past the data blocks")
+		}
+	}
+
+	metaBytes, err := t.readSection(file, fileIdx.MetaStart, fileIdx.MetaLen)
+	if err != nil {
+		return err
+	}
+
+	t.FileIndex.MinMax, err = decodeMeta(metaBytes)
+	if err != nil {
+		return t.corruption(fileIdx.MetaStart, err.Error())
+	}
+
+	return t.loadBloom(file)
+}
+
+func (t *Table) readBlock(file vfs.File, handle BlockHandle) ([]Data, error) {
+	block, err := t.readSection(file, handle.Offset, handle.Len)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := decodeBlock(block, t.FileIndex.Version)
+	if err != nil {
+		return nil, t.corruption(handle.Offset, err.Error())
+	}
+
+	return data, nil
+}
+func (t *Table) readAllBinary(file vfs.File) ([]Data, error) {
+	data := []Data{}
+	for _, handle := range t.Blocks {
+		records, err := t.readBlock(file, handle)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, records...)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,188 @@
+package sstable
+
+import (
+	"sort"
+	vfs "stinky-db/db/VFS"
+	"strings"
+)
+
+// TableIterator walks a table a block at a time, the index tells it which
+// block to load for a Seek. Tables in the JSON format are read as one block
+type TableIterator struct {
+	table   *Table
+	file    vfs.File
+	release func()
+	// block is the loaded block, -1 before the first one and numBlocks()
+	// after the last one
+	block   int
+	records []Data
+	pos     int
+	err     error
+}
+
+// NewIterator holds on to the file until Close so the table can be iterated
+// even after compaction removed it
+func (t *Table) NewIterator() (*TableIterator, error) {
+	file, release, err := t.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return &TableIterator{table: t, file: file, release: release, block: -1}, nil
+}
+
+func (it *TableIterator) openFile() (vfs.File, error) {
+	return it.file, nil
+}
+
+func (it *TableIterator) numBlocks() int {
+	return it.table.NumBlocks()
+}
+
+func (it *TableIterator) load(block int) bool {
+	if block < 0 || block >= it.numBlocks() {
+		it.block = min(max(block, -1), it.numBlocks())
+		it.records = nil
+		return false
+	}
+
+	var records []Data
+	var err error
+	if it.table.FileIndex.Version < format_binary {
+		records, err = it.table.readAllJSON(it.file)
+	} else {
+		records, err = it.table.cachedReadBlock(it.openFile, it.table.Blocks[block])
+	}
+
+	if err != nil {
+		it.err = err
+		it.block = it.numBlocks()
+		it.records = nil
+		return false
+	}
+
+	it.block = block
+	it.records = records
+
+	return true
+}
+
+func (it *TableIterator) Seek(key string) bool {
+	block := 0
+	if it.table.FileIndex.Version >= format_binary {
+		block = sort.Search(len(it.table.Blocks), func(i int) bool {
+			return strings.Compare(it.table.Blocks[i].LastKey, key) != -1
+		})
+	}
+
+	if !it.load(block) {
+		return false
+	}
+
+	it.pos = sort.Search(len(it.records), func(i int) bool {
+		return strings.Compare(it.records[i].Key, key) != -1
+	})
+	if it.pos == len(it.records) {
+		return it.first(block + 1)
+	}
+
+	return true
+}
+
+func (it *TableIterator) first(block int) bool {
+	for it.load(block) {
+		if len(it.records) > 0 {
+			it.pos = 0
+			return true
+		}
+		block += 1
+	}
+
+	return false
+}
+
+func (it *TableIterator) last(block int) bool {
+	for it.load(block) {
+		if len(it.records) > 0 {
+			it.pos = len(it.records) - 1
+			return true
+		}
+		block -= 1
+	}
+
+	return false
+}
+
+func (it *TableIterator) First() bool {
+	return it.first(0)
+}
+
+func (it *TableIterator) Last() bool {
+	return it.last(it.numBlocks() - 1)
+}
+
+func (it *TableIterator) Next() bool {
+	if it.block < 0 {
+		return it.First()
+	}
+
+	if !it.Valid() {
+		return false
+	}
+
+	it.pos += 1
+	if it.pos < len(it.records) {
+		return true
+	}
+
+	return it.first(it.block + 1)
+}
+
+func (it *TableIterator) Prev() bool {
+	if it.block >= it.numBlocks() {
+		if it.err != nil {
+			return false
+		}
+		return it.Last()
+	}
+
+	if !it.Valid() {
+		return false
+	}
+
+	it.pos -= 1
+	if it.pos >= 0 {
+		return true
+	}
+
+	return it.last(it.block - 1)
+}
+
+func (it *TableIterator) Valid() bool {
+	return it.block >= 0 && it.block < it.numBlocks() && it.pos >= 0 && it.pos < len(it.records)
+}
+
+func (it *TableIterator) Key() string {
+	return it.records[it.pos].Key
+}
+
+func (it *TableIterator) Value() string {
+	return it.records[it.pos].Value
+}
+
+func (it *TableIterator) Tombstone() bool {
+	return it.records[it.pos].Delete
+}
+
+func (it *TableIterator) Seq() uint64 {
+	return it.records[it.pos].Seq
+}
+
+func (it *TableIterator) Err() error {
+	return it.err
+}
+
+func (it *TableIterator) Close() error {
+	it.release()
+	return nil
+}
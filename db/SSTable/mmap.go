@@ -0,0 +1,36 @@
+package sstable
+
+import (
+	"io"
+	vfs "stinky-db/db/VFS"
+)
+
+// mappedFile serves reads of a table out of its memory mapping, it is only
+// valid while the table cache holds the mapping for the reader
+type mappedFile struct {
+	vfs.File
+	data []byte
+}
+
+func (f *mappedFile) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 || offset >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(buf, f.data[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// section returns the mapped bytes at offset without copying them, they must
+// not be held on to once the file is released
+func (f *mappedFile) section(offset, length int) ([]byte, bool) {
+	if offset < 0 || length < 0 || offset+length > len(f.data) {
+		return nil, false
+	}
+
+	return f.data[offset : offset+length], true
+}
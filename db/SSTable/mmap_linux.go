@@ -0,0 +1,28 @@
+package sstable
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+// mmap maps the whole file read only, it reports false for files it can not
+// map such as the ones of an in memory FS
+func mmap(file any, size int) ([]byte, bool) {
+	osFile, ok := file.(*os.File)
+	if !ok || size <= 0 {
+		return nil, false
+	}
+
+	data, err := syscall.Mmap(int(osFile.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, false
+	}
+
+	return data, true
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
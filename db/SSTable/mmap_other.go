@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sstable
+
+const mmapSupported = false
+
+// mmap is only supported on linux, elsewhere tables are read with ReadAt
+func mmap(file any, size int) ([]byte, bool) {
+	return nil, false
+}
+
+func munmap(data []byte) error {
+	return nil
+}
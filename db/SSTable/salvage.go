@@ -0,0 +1,134 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	vfs "stinky-db/db/VFS"
+)
+
+// implausible_seq is a sequence number no database gets to, a block whose
+// records decode to one was written with the time of format_checksummed in
+// place of the sequence number
+const implausible_seq = uint64(1) << 56
+
+// Salvage reads every record of the table at path in fs that can still be trusted
+// and describes what could not be read in lost. Blocks that fail their
+// checksum are skipped. When the table can not be opened at all, say its
+// footer was never written, the records are read from the start of the file
+// and every block that is followed by a matching checksum is kept. The
+// returned error is only set when the file can not be read
+func Salvage(fs vfs.FS, path string) ([]Data, []string, error) {
+	table, openErr := GenerateFromFS(fs, path)
+	if openErr == nil {
+		data := []Data{}
+		lost := []string{}
+		for i := 0; i < table.NumBlocks(); i += 1 {
+			records, err := table.ReadBlock(i)
+			if err != nil {
+				lost = append(lost, fmt.Sprintf("block %d: %v", i, err))
+				continue
+			}
+			data = append(data, records...)
+		}
+
+		return data, lost, nil
+	}
+
+	buf, err := vfs.ReadFile(fs, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lost := []string{fmt.Sprintf("could not open the table: %v", openErr)}
+	if len(buf) > 0 && buf[0] == '{' {
+		return salvageJSON(buf), lost, nil
+	}
+
+	data := scanBlocks(buf, format_compressed)
+	if len(data) == 0 {
+		data = scanBlocks(buf, format_sequenced)
+	}
+	for _, keyVal := range data {
+		if keyVal.Seq >= implausible_seq {
+			data = scanBlocks(buf, format_checksummed)
+			break
+		}
+	}
+
+	return data, lost, nil
+}
+
+// scanBlocks walks the records from the start of a binary table without its
+// index. A block ends where the bytes after a record are the checksum of the
+// block so far, and the data blocks end with the first one shorter than
+// block_size since only the last data block can be. Compressed blocks can not
+// be walked record by record, from format_compressed on only the blocks
+// stored uncompressed are found
+func scanBlocks(buf []byte, version int) []Data {
+	trailer, codecByte := block_trailer_size, 0
+	if version >= format_compressed {
+		trailer, codecByte = codec_trailer_size, 1
+	}
+
+	data := []Data{}
+	blockStart := 0
+	pos := 0
+	for pos < len(buf) {
+		_, rest, err := decodeRecord(buf[pos:], version)
+		if err != nil {
+			break
+		}
+		pos = len(buf) - len(rest)
+
+		if pos+trailer > len(buf) {
+			break
+		}
+		if codecByte > 0 && Codec(buf[pos]) != CodecNone {
+			continue
+		}
+		checked := pos + codecByte
+		if crc32.Checksum(buf[blockStart:checked], crcTable) != binary.LittleEndian.Uint32(buf[checked:]) {
+			continue
+		}
+
+		records, err := decodeBlock(buf[blockStart:pos], version)
+		if err != nil {
+			break
+		}
+		data = append(data, records...)
+
+		if pos-blockStart < block_size {
+			break
+		}
+		pos += trailer
+		blockStart = pos
+	}
+
+	return data
+}
+
+// salvageJSON decodes the records of a table in the JSON format one after
+// the other until one can not be decoded
+func salvageJSON(buf []byte) []Data {
+	data := []Data{}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	for decoder.More() {
+		record := struct {
+			Key    *string `json:"key"`
+			Value  string  `json:"value"`
+			Delete bool    `json:"delete"`
+		}{}
+
+		err := decoder.Decode(&record)
+		if err != nil || record.Key == nil {
+			break
+		}
+
+		data = append(data, Data{Key: *record.Key, Value: record.Value, Delete: record.Delete})
+	}
+
+	return data
+}
@@ -1,36 +1,121 @@
 package sstable
 
 import (
+	"bytes"
 	"encoding/json"
-	"os"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
 	"sort"
+	bloom "stinky-db/db/Bloom"
 	memtable "stinky-db/db/MemTable"
+	vfs "stinky-db/db/VFS"
 	"stinky-db/db/util"
 	"strings"
 	"sync"
-	"time"
 )
 
 const (
 	sparseIdxSize = 4
+	// footerScanSize is how much of the end of a JSON table is searched for the file index
+	footerScanSize = 4096
 )
 
 var fileIdxSeparator = []byte{"$"[0], "$"[0]}
 
+var (
+	KeyNotFoundErr = errors.New("key not found in table")
+	KeyDeletedErr  = errors.New("key has been deleted")
+	InvalidFileErr = errors.New("file is not an sstable")
+)
+
+// ErrCorruption is returned when bytes read back from a table do not match
+// what was written, Offset is where the damaged block or record starts
+type ErrCorruption struct {
+	Path   string
+	Offset int64
+	Reason string
+}
+
+func (e *ErrCorruption) Error() string {
+	return fmt.Sprintf("sstable %s is corrupt at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
+
+func (t *Table) corruption(offset int, reason string) error {
+	return &ErrCorruption{Path: t.FilePath, Offset: int64(offset), Reason: reason}
+}
+
+// Data is a single record, Seq is the sequence number the DB gave the write
+// and orders versions of a key. Tables in the JSON format predate sequence
+// numbers so their records all have Seq 0
 type Data struct {
-	Key     string    `json:"key"`
-	Value   string    `json:"value"`
-	Written time.Time `json:"written"`
-	Delete  bool      `json:"delete"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Seq    uint64 `json:"seq,omitempty"`
+	Delete bool   `json:"delete"`
+}
+
+func (d Data) value() (string, error) {
+	if d.Delete {
+		return "", KeyDeletedErr
+	}
+
+	return d.Value, nil
+}
+
+// DropTombstones removes the tombstones that are the oldest version of their
+// key, only safe once nothing older than the table is left underneath it.
+// Data holds the versions of a key newest first
+func DropTombstones(data []Data) []Data {
+	live := make([]Data, 0, len(data))
+	for i, keyVal := range data {
+		oldest := i == len(data)-1 || data[i+1].Key != keyVal.Key
+		if !keyVal.Delete || !oldest {
+			live = append(live, keyVal)
+		}
+	}
+
+	return live
+}
+
+type WriteOptions struct {
+	// BloomBitsPerKey sizes the bloom filter written with the table, 0 uses
+	// bloom.DEFAULT_BITS_PER_KEY and a negative value writes no filter
+	BloomBitsPerKey int
+	// Codec compresses the data blocks, blocks it does not shrink enough
+	// are stored uncompressed
+	Codec Codec
 }
 
 type Table struct {
 	Data        []Data                 `json:"data"`
 	SparseIndex map[string]SparseIndex `json:"sparse_index"`
 	FileIndex   FileIndex              `json:"file_index"`
-	FilePath    string
-	Size        int64
-	mu          *sync.Mutex
+	// Blocks indexes the data blocks of a binary table, SparseIndex is only
+	// used by tables in the JSON format
+	Blocks   []BlockHandle
+	FilePath string
+	// FS holds the file, nil is vfs.Default
+	FS vfs.FS
+	// BlockCache holds the decoded blocks of the table, nil is SharedBlockCache
+	BlockCache *BlockCache
+	// TableCache keeps the file open between reads, nil opens it for every read
+	TableCache *TableCache
+	Size       int64
+	fileSize   int
+	Options    WriteOptions
+	Bloom      *bloom.Filter
+	blocks     *tableBlocks
+	mu         *sync.Mutex
+}
+
+func (t *Table) fs() vfs.FS {
+	if t.FS == nil {
+		return vfs.Default
+	}
+
+	return t.FS
 }
 
 func (t *Table) Len() int {
@@ -43,6 +128,9 @@ func (t *Table) Swap(i, j int) {
 
 func (t *Table) Less(i, j int) bool {
 	compared := strings.Compare(t.Data[i].Key, t.Data[j].Key)
+	if compared == 0 {
+		return t.Data[i].Seq > t.Data[j].Seq
+	}
 	return compared == -1
 }
 
@@ -61,78 +149,54 @@ type SparseIndex struct {
 }
 
 type FileIndex struct {
-	//Version    int `json:"version"`
+	// Version is the format of the file, JSON tables were written without it
+	Version    int    `json:"version,omitempty"`
 	DataStart  int    `json:"data_start"`
 	DataLen    int    `json:"data_len"`
 	IndexStart int    `json:"index_start"`
 	IndexLen   int    `json:"index_len"`
+	BloomStart int    `json:"bloom_start,omitempty"`
+	BloomLen   int    `json:"bloom_len,omitempty"`
+	MetaStart  int    `json:"meta_start,omitempty"`
+	MetaLen    int    `json:"meta_len,omitempty"`
 	MinMax     MinMax `json:"min_max"`
 }
 
+// WriteToFile writes the table in the binary format, the records are
+// dropped from memory once they are on disk
 func (t *Table) WriteToFile() error {
-	fileSparseIndex := map[string]SparseIndex{}
-	writeData := []byte{}
-	for i, keyVal := range t.Data {
-		bytes, err := json.Marshal(keyVal)
-		if err != nil {
-			return err
-		}
-		if i%sparseIdxSize == 0 {
-			sparseIdx := SparseIndex{
-				Len:   len(bytes),
-				Start: len(writeData),
-			}
-
-			fileSparseIndex[keyVal.Key] = sparseIdx
+	bloomBytes := []byte{}
+	if t.Options.BloomBitsPerKey >= 0 {
+		t.Bloom = bloom.New(len(t.Data), t.Options.BloomBitsPerKey)
+		for _, keyVal := range t.Data {
+			t.Bloom.Add(keyVal.Key)
 		}
-		writeData = append(writeData, bytes...)
+		bloomBytes = t.Bloom.Encode()
 	}
-	t.SparseIndex = fileSparseIndex
 
-	fileSparseBytes, err := json.Marshal(fileSparseIndex)
-	if err != nil {
-		return err
-	}
+	fileBytes, blocks := t.encodeBinary(bloomBytes)
+	t.Blocks = blocks
+	t.SparseIndex = nil
+	t.Size = int64(t.FileIndex.DataLen)
+	t.fileSize = len(fileBytes)
 
-	fileIdx := FileIndex{
-		DataStart:  0,
-		DataLen:    len(writeData),
-		IndexStart: len(writeData),
-		IndexLen:   len(fileSparseBytes),
-		MinMax: MinMax{
-			StartKey: t.Data[0].Key,
-			EndKey:   t.Data[len(t.Data)-1].Key,
-		},
-	}
-	t.FileIndex = fileIdx
-
-	fileIdxBytes, err := json.Marshal(fileIdx)
+	file, err := t.fs().Create(t.FilePath)
 	if err != nil {
 		return err
 	}
-
-	file, err := os.Create(t.FilePath)
 	defer file.Close()
-	if err != nil {
-		return err
-	}
 
-	_, err = file.Write(writeData)
+	_, err = file.Write(fileBytes)
 	if err != nil {
 		return err
 	}
 
-	_, err = file.Write(fileSparseBytes)
-	if err != nil {
-		return nil
-	}
-
-	_, err = file.Write(fileIdxSeparator)
+	err = file.Sync()
 	if err != nil {
 		return err
 	}
 
-	_, err = file.Write(fileIdxBytes)
+	err = t.fs().Sync(filepath.Dir(t.FilePath))
 	if err != nil {
 		return err
 	}
@@ -142,7 +206,7 @@ func (t *Table) WriteToFile() error {
 	return nil
 }
 
-func (t *Table) writeData(data []byte, file *os.File) error {
+func (t *Table) writeData(data []byte, file vfs.File) error {
 	_, err := file.Write(data)
 	if err != nil {
 		return err
@@ -154,20 +218,19 @@ func (t *Table) writeData(data []byte, file *os.File) error {
 func newTable(filePath string) Table {
 	return Table{
 		FilePath: filePath,
+		blocks:   newTableBlocks(),
 		mu:       &sync.Mutex{},
 	}
 }
 
 func GenerateFromTree(mem *memtable.RBTree, filePath string) (Table, error) {
-	table := newTable(filePath)
-	orderedNodes := mem.Nodes()
-	data := []Data{}
-	for _, node := range orderedNodes {
-		kv := Data{Key: node.Key, Value: node.Value, Written: time.Now()}
-		data = append(data, kv)
-	}
+	return GenerateFromTreeWithOptions(mem, filePath, WriteOptions{})
+}
 
-	table.Data = data
+func GenerateFromTreeWithOptions(mem *memtable.RBTree, filePath string, opts WriteOptions) (Table, error) {
+	table := newTable(filePath)
+	table.Options = opts
+	table.Data = TreeData(mem)
 	if err := table.WriteToFile(); err != nil {
 		return table, err
 	}
@@ -175,7 +238,27 @@ func GenerateFromTree(mem *memtable.RBTree, filePath string) (Table, error) {
 	return table, nil
 }
 
-// GenerateFromData does not write the SSTable to disk, this is used for compaction operations
+// TreeData lists the records of the tree in the order tables keep them
+func TreeData(mem *memtable.RBTree) []Data {
+	data := []Data{}
+	for _, node := range mem.Nodes() {
+		data = append(data, Data{Key: node.Key, Value: node.Value, Seq: node.Seq, Delete: node.Tombstone})
+	}
+
+	return data
+}
+
+// GenerateFromSorted keeps every record, data has to be sorted by key with
+// the versions of a key newest first. The table is not written to disk
+func GenerateFromSorted(data []Data, filePath string) Table {
+	table := newTable(filePath)
+	table.Data = data
+
+	return table
+}
+
+// GenerateFromData only keeps the newest version of every key, it does not
+// write the SSTable to disk
 func GenerateFromData(data []Data, filePath string) Table {
 	table := newTable(filePath)
 	table.Data = data
@@ -186,13 +269,10 @@ func GenerateFromData(data []Data, filePath string) Table {
 			return false
 		}
 
-		firstIsNewer := first.Written.Unix() > second.Written.Unix()
+		firstIsNewer := first.Seq > second.Seq
 		if firstIsNewer {
 			second.Value = first.Value
-			second.Written = first.Written
-		}
-
-		if second.Delete {
+			second.Seq = first.Seq
 			second.Delete = first.Delete
 		}
 
@@ -205,101 +285,95 @@ func GenerateFromData(data []Data, filePath string) Table {
 }
 
 func (t *Table) GetAllElements() ([]Data, error) {
-	var data []Data
-	file, err := os.Open(t.FilePath)
+	file, release, err := t.open()
 	if err != nil {
-		return data, err
+		return nil, err
 	}
+	defer release()
 
-	bytesToRead := make([]byte, t.FileIndex.DataLen)
-	_, err = file.ReadAt(bytesToRead, int64(t.FileIndex.DataStart))
-	if err != nil {
-		return data, err
+	if t.FileIndex.Version >= format_binary {
+		return t.readAllBinary(file)
 	}
 
-	numOfLBraces := 0
-	numOfRBraces := 0
-	currReading := []byte{}
-	for idx := 0; idx < len(bytesToRead); idx += 1 {
-		if bytesToRead[idx] == '{' {
-			numOfLBraces += 1
-		}
+	return t.readAllJSON(file)
+}
 
-		if bytesToRead[idx] == '}' {
-			numOfRBraces += 1
-		}
+// NumBlocks is how many data blocks the table has, a table in the JSON
+// format is read as a single block
+func (t *Table) NumBlocks() int {
+	if t.FileIndex.Version < format_binary {
+		return 1
+	}
 
-		currReading = append(currReading, bytesToRead[idx])
+	return len(t.Blocks)
+}
 
-		if numOfRBraces == numOfLBraces {
-			numOfLBraces = 0
-			numOfRBraces = 0
+// ReadBlock reads the records of the i-th data block, verifying its checksum
+// if the table has them
+func (t *Table) ReadBlock(i int) ([]Data, error) {
+	if i < 0 || i >= t.NumBlocks() {
+		return nil, fmt.Errorf("block %d is out of range, the table has %d", i, t.NumBlocks())
+	}
 
-			keyVal := Data{}
-			err := json.Unmarshal(currReading, &keyVal)
-			if err != nil {
-				return data, err
-			}
+	file, release, err := t.open()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-			data = append(data, keyVal)
-			currReading = []byte{}
-		}
+	if t.FileIndex.Version < format_binary {
+		return t.readAllJSON(file)
 	}
 
-	return data, nil
+	return t.readBlock(file, t.Blocks[i])
 }
 
 func (t *Table) ReadIntoMem() error {
-	var data []Data
-	file, err := os.Open(t.FilePath)
+	data, err := t.GetAllElements()
 	if err != nil {
 		return err
 	}
 
-	bytesToRead := make([]byte, t.FileIndex.DataLen)
-	_, err = file.ReadAt(bytesToRead, int64(t.FileIndex.DataStart))
+	t.Data = data
+
+	return nil
+}
+
+// readAllJSON decodes the records of a table in the JSON format one after the other
+func (t *Table) readAllJSON(file vfs.File) ([]Data, error) {
+	bytesToRead, err := t.readSection(file, t.FileIndex.DataStart, t.FileIndex.DataLen)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	numOfLBraces := 0
-	numOfRBraces := 0
-	currReading := []byte{}
-	for idx := 0; idx < len(bytesToRead); idx += 1 {
-		if bytesToRead[idx] == '{' {
-			numOfLBraces += 1
-		}
-
-		if bytesToRead[idx] == '}' {
-			numOfRBraces += 1
+	data := []Data{}
+	decoder := json.NewDecoder(bytes.NewReader(bytesToRead))
+	for decoder.More() {
+		keyVal := Data{}
+		offset := t.FileIndex.DataStart + int(decoder.InputOffset())
+		err := decoder.Decode(&keyVal)
+		if err != nil {
+			return nil, t.corruption(offset, err.Error())
 		}
 
-		currReading = append(currReading, bytesToRead[idx])
-
-		if numOfRBraces == numOfLBraces {
-			numOfLBraces = 0
-			numOfRBraces = 0
-
-			keyVal := Data{}
-			err := json.Unmarshal(currReading, &keyVal)
-			if err != nil {
-				return err
-			}
-
-			data = append(data, keyVal)
-			currReading = []byte{}
-		}
+		data = append(data, keyVal)
 	}
 
-	t.Data = data
-
-	return nil
+	return data, nil
 }
 
+// GenerateFromDisk loads the index of a table, tables in the binary format
+// end in a fixed size footer and anything else is read as the JSON format
 func GenerateFromDisk(filepath string) (Table, error) {
+	return GenerateFromFS(vfs.Default, filepath)
+}
+
+// GenerateFromFS is GenerateFromDisk for a table kept in fs
+func GenerateFromFS(fs vfs.FS, filepath string) (Table, error) {
 	table := newTable(filepath)
+	table.FS = fs
 
-	file, err := os.Open(filepath)
+	file, err := table.fs().Open(filepath)
 	if err != nil {
 		return table, err
 	}
@@ -311,131 +385,228 @@ func GenerateFromDisk(filepath string) (Table, error) {
 	}
 
 	fileSize := fileStats.Size()
-	bytesToReadForIndex := make([]byte, 150) // fileindex is always smaller than 150 bytes
-	_, err = file.ReadAt(bytesToReadForIndex, fileSize-150)
+	table.fileSize = int(fileSize)
+	if fileSize >= footer_tail_size {
+		tail := make([]byte, footer_tail_size)
+		_, err = file.ReadAt(tail, fileSize-footer_tail_size)
+		if err != nil {
+			return table, err
+		}
+
+		if version, ok := footerVersion(tail); ok {
+			err = table.openFooter(file, version)
+			table.Size = int64(table.FileIndex.DataLen)
+			return table, err
+		}
+	}
+
+	err = table.openJSON(file, fileSize)
+	table.Size = int64(table.FileIndex.DataLen)
+
+	return table, err
+}
+
+func (t *Table) openFooter(file vfs.File, version int) error {
+	size := footerSize(version)
+	if t.fileSize < size {
+		return t.corruption(0, "file is smaller than its footer")
+	}
+
+	footerBytes := make([]byte, size)
+	_, err := file.ReadAt(footerBytes, int64(t.fileSize-size))
 	if err != nil {
-		return table, err
+		return err
 	}
 
-	indexBytes := []byte{}
-	allowedToRead := false
-	for index := 0; index < len(bytesToReadForIndex); index += 1 {
-		currRune := bytesToReadForIndex[index]
-		nextRune := "0"[0]
-		if index+1 != len(bytesToReadForIndex) {
-			nextRune = bytesToReadForIndex[index+1]
-		}
-		if currRune == '$' && nextRune == '$' {
-			allowedToRead = true
-		}
+	fileIndex, ok := decodeFooter(footerBytes, version)
+	if !ok {
+		return t.corruption(t.fileSize-size, "footer checksum mismatch")
+	}
 
-		if !allowedToRead || currRune == '$' {
-			continue
-		} else {
-			indexBytes = append(indexBytes, currRune)
-		}
+	return t.openBinary(file, fileIndex)
+}
+
+func (t *Table) openJSON(file vfs.File, fileSize int64) error {
+	scanSize := min(fileSize, footerScanSize)
+	bytesToReadForIndex := make([]byte, scanSize)
+	_, err := file.ReadAt(bytesToReadForIndex, fileSize-scanSize)
+	if err != nil {
+		return err
+	}
+
+	// the bloom filter sits right before the separator and can contain it,
+	// the last separator is the one in front of the file index
+	separatorAt := bytes.LastIndex(bytesToReadForIndex, fileIdxSeparator)
+	if separatorAt == -1 {
+		return InvalidFileErr
 	}
+	indexBytes := bytesToReadForIndex[separatorAt+len(fileIdxSeparator):]
 
 	fileIndex := FileIndex{}
 	err = json.Unmarshal(indexBytes, &fileIndex)
 	if err != nil {
-		return table, err
+		return t.corruption(int(fileSize-scanSize)+separatorAt, err.Error())
 	}
 
-	sparseIndexBytes := make([]byte, fileIndex.IndexLen)
-	_, err = file.ReadAt(sparseIndexBytes, int64(fileIndex.IndexStart))
+	if fileIndex.Version == 0 {
+		fileIndex.Version = format_json
+	}
+	if fileIndex.Version != format_json {
+		return fmt.Errorf("%w: unknown format version %d", InvalidFileErr, fileIndex.Version)
+	}
+
+	t.FileIndex = fileIndex
+	sparseIndexBytes, err := t.readSection(file, fileIndex.IndexStart, fileIndex.IndexLen)
 	if err != nil {
-		return table, err
+		return err
 	}
 
 	sparseIdx := map[string]SparseIndex{}
 	err = json.Unmarshal(sparseIndexBytes, &sparseIdx)
 	if err != nil {
-		return table, err
+		return t.corruption(fileIndex.IndexStart, err.Error())
 	}
 
-	table.FileIndex = fileIndex
-	table.SparseIndex = sparseIdx
+	t.FileIndex = fileIndex
+	t.SparseIndex = sparseIdx
 
-	table.Size = int64(fileIndex.DataLen)
+	return t.loadBloom(file)
+}
 
-	return table, nil
+func (t *Table) loadBloom(file vfs.File) error {
+	if t.FileIndex.BloomLen == 0 {
+		return nil
+	}
+
+	bloomBytes, err := t.readSection(file, t.FileIndex.BloomStart, t.FileIndex.BloomLen)
+	if err != nil {
+		return err
+	}
+
+	t.Bloom, err = bloom.Decode(bloomBytes)
+	if err != nil {
+		return t.corruption(t.FileIndex.BloomStart, err.Error())
+	}
+
+	return nil
 }
 
 func (t *Table) Get(key string) (string, error) {
-	return t.readFromDisk(key)
+	return t.GetAt(key, math.MaxUint64)
 }
 
-func (t *Table) readFromDisk(key string) (string, error) {
-	file, err := os.Open(t.FilePath)
-	if err != nil {
-		return "", err
+// GetAt returns the newest version of the key written at or before seq
+func (t *Table) GetAt(key string, seq uint64) (string, error) {
+	if !t.InRange(key) {
+		return "", KeyNotFoundErr
 	}
-	defer file.Close()
 
+	return t.readFromDisk(key, seq)
+}
+
+func (t *Table) InRange(key string) bool {
+	minMax := t.FileIndex.MinMax
+	return strings.Compare(key, minMax.StartKey) != -1 && strings.Compare(key, minMax.EndKey) != 1
+}
+
+func (t *Table) readFromDisk(key string, seq uint64) (string, error) {
+	// JSON tables hold a single version of every key written before sequence numbers
+	if t.FileIndex.Version < format_binary {
+		file, release, err := t.open()
+		if err != nil {
+			return "", err
+		}
+		defer release()
+
+		return t.readFromJSON(file, key)
+	}
+
+	// the file is only opened once a block is not in the block cache
+	var file vfs.File
+	release := func() {}
+	defer func() { release() }()
+	open := func() (vfs.File, error) {
+		if file != nil {
+			return file, nil
+		}
+
+		var err error
+		file, release, err = t.open()
+		if err != nil {
+			release = func() {}
+		}
+		return file, err
+	}
+
+	// the first block whose last key is not smaller than the key holds its
+	// newest version, older ones can carry on into the blocks after it
+	i := sort.Search(len(t.Blocks), func(i int) bool {
+		return strings.Compare(t.Blocks[i].LastKey, key) != -1
+	})
+	for ; i < len(t.Blocks); i += 1 {
+		records, err := t.cachedReadBlock(open, t.Blocks[i])
+		if err != nil {
+			return "", err
+		}
+
+		for _, keyVal := range records {
+			if keyVal.Key == key && keyVal.Seq <= seq {
+				return keyVal.value()
+			}
+			if keyVal.Key > key {
+				return "", KeyNotFoundErr
+			}
+		}
+	}
+
+	return "", KeyNotFoundErr
+}
+
+func (t *Table) readFromJSON(file vfs.File, key string) (string, error) {
 	if index, ok := t.SparseIndex[key]; ok {
 		data := Data{}
-		bytes := make([]byte, index.Len)
-		_, err = file.ReadAt(bytes, int64(index.Start))
-
-		err = json.Unmarshal(bytes, &data)
+		record, err := t.readSection(file, index.Start, index.Len)
 		if err != nil {
 			return "", err
 		}
 
-		return data.Value, nil
+		err = json.Unmarshal(record, &data)
+		if err != nil {
+			return "", t.corruption(index.Start, err.Error())
+		}
+
+		return data.value()
 	}
 
 	startKeyIdx := 0
-	finalKeyIdx := 0
+	finalKeyIdx := t.FileIndex.DataLen
 	for idxKey, val := range t.SparseIndex {
 		smallerOrBigger := strings.Compare(idxKey, key)
 		if smallerOrBigger == 1 {
-			finalKeyIdx = val.Start
+			finalKeyIdx = min(finalKeyIdx, val.Start)
 		} else {
-			startKeyIdx = val.Start + val.Len
+			startKeyIdx = max(startKeyIdx, val.Start+val.Len)
 		}
 	}
-	if finalKeyIdx == 0 {
-		finalKeyIdx = t.FileIndex.DataLen - 1
-	}
 
-	bytesToParse := make([]byte, finalKeyIdx-startKeyIdx+1)
-	_, err = file.ReadAt(bytesToParse, int64(startKeyIdx))
+	bytesToParse, err := t.readSection(file, startKeyIdx, finalKeyIdx-startKeyIdx)
 	if err != nil {
 		return "", err
 	}
 
-	lenToParse := len(bytesToParse)
-	numOfLBraces := 0
-	numOfRBraces := 0
-	objRead := []byte{}
-	for idx := 0; idx < lenToParse; idx += 1 {
-		if bytesToParse[idx] == '{' {
-			numOfLBraces += 1
-		}
-
-		if bytesToParse[idx] == '}' {
-			numOfRBraces += 1
+	decoder := json.NewDecoder(bytes.NewReader(bytesToParse))
+	for decoder.More() {
+		data := Data{}
+		offset := startKeyIdx + int(decoder.InputOffset())
+		err := decoder.Decode(&data)
+		if err != nil {
+			return "", t.corruption(offset, err.Error())
 		}
-		objRead = append(objRead, bytesToParse[idx])
 
-		if numOfRBraces == numOfLBraces {
-			data := Data{}
-			err := json.Unmarshal(objRead, &data)
-			if err != nil {
-				return "", err
-			}
-
-			if data.Key == key {
-				return data.Value, nil
-			} else {
-				numOfLBraces = 0
-				numOfRBraces = 0
-				objRead = []byte{}
-			}
+		if data.Key == key {
+			return data.value()
 		}
 	}
 
-	return "", nil
+	return "", KeyNotFoundErr
 }
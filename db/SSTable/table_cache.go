@@ -0,0 +1,229 @@
+package sstable
+
+import (
+	"container/list"
+	"os"
+	vfs "stinky-db/db/VFS"
+	"sync"
+)
+
+const (
+	DEFAULT_MAX_OPEN_TABLES = 500
+)
+
+// openTable is the file of a table held open by a table cache, refs counts
+// the readers using it right now
+type openTable struct {
+	id   uint64
+	file vfs.File
+	// mapping is the memory mapping of the file, nil when it is read with ReadAt
+	mapping []byte
+	fs      vfs.FS
+	path    string
+	refs    int
+	// removed tables are deleted once the last reader releases them
+	removed bool
+}
+
+// TableCache keeps the files of tables open so reads do not have to open
+// them every time. Up to capacity files are kept open, past that the least
+// recently used file no reader is using is closed. Files are reference
+// counted, a table removed while readers still use its file is only
+// deleted once the last of them is done
+type TableCache struct {
+	mu       sync.Mutex
+	capacity int
+	mmap     bool
+	// order holds every open file, most recently used first
+	order *list.List
+	files map[uint64]*list.Element
+}
+
+type TableCacheOptions struct {
+	// MaxOpenTables is how many files are kept open, 0 or less uses
+	// DEFAULT_MAX_OPEN_TABLES
+	MaxOpenTables int
+	// Mmap maps the files into memory and serves reads straight out of the
+	// mapping, files that can not be mapped are read with ReadAt. It is only
+	// supported on linux
+	Mmap bool
+}
+
+// NewTableCache creates a cache holding up to capacity files open, a
+// capacity of 0 or less uses DEFAULT_MAX_OPEN_TABLES
+func NewTableCache(capacity int) *TableCache {
+	return NewTableCacheWithOptions(TableCacheOptions{MaxOpenTables: capacity})
+}
+
+func NewTableCacheWithOptions(opts TableCacheOptions) *TableCache {
+	if opts.MaxOpenTables <= 0 {
+		opts.MaxOpenTables = DEFAULT_MAX_OPEN_TABLES
+	}
+
+	return &TableCache{
+		capacity: opts.MaxOpenTables,
+		mmap:     opts.Mmap,
+		order:    list.New(),
+		files:    map[uint64]*list.Element{},
+	}
+}
+
+// acquire returns the open file of the table, the returned func has to be
+// called once the reader is done with it
+func (c *TableCache) acquire(t *Table) (vfs.File, func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.files[t.blocks.id]
+	if !ok {
+		file, err := t.fs().Open(t.FilePath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		open := &openTable{id: t.blocks.id, file: file, fs: t.fs(), path: t.FilePath}
+		if c.mmap {
+			if mapping, ok := mmap(file, t.fileSize); ok {
+				open.mapping = mapping
+				open.file = &mappedFile{File: file, data: mapping}
+			}
+		}
+
+		elem = c.order.PushFront(open)
+		c.files[t.blocks.id] = elem
+	}
+
+	c.order.MoveToFront(elem)
+	open := elem.Value.(*openTable)
+	open.refs += 1
+	c.evict()
+
+	released := false
+	return open.file, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		// releasing twice would let another reader's file be closed underneath it
+		if released {
+			return
+		}
+		released = true
+
+		open.refs -= 1
+		if open.refs == 0 && open.removed {
+			c.close(elem)
+			open.fs.Remove(open.path)
+			return
+		}
+		c.evict()
+	}, nil
+}
+
+// evict closes the least recently used files that no reader is using until
+// the cache is within its capacity
+func (c *TableCache) evict() {
+	for elem := c.order.Back(); elem != nil && c.order.Len() > c.capacity; {
+		prev := elem.Prev()
+		if elem.Value.(*openTable).refs == 0 {
+			c.close(elem)
+		}
+		elem = prev
+	}
+}
+
+// close unmaps and closes the file, it must only be called once no reader
+// is using it
+func (c *TableCache) close(elem *list.Element) {
+	open := c.order.Remove(elem).(*openTable)
+	delete(c.files, open.id)
+	if open.mapping != nil {
+		munmap(open.mapping)
+	}
+	open.file.Close()
+}
+
+// remove deletes the file of the table, or marks it to be deleted once the
+// readers using it are done
+func (c *TableCache) remove(t *Table) error {
+	c.mu.Lock()
+	elem, ok := c.files[t.blocks.id]
+	if ok {
+		open := elem.Value.(*openTable)
+		if open.refs > 0 {
+			open.removed = true
+			c.mu.Unlock()
+			return nil
+		}
+		c.close(elem)
+	}
+	c.mu.Unlock()
+
+	return t.fs().Remove(t.FilePath)
+}
+
+// Close closes every file no reader is using, the others are closed as
+// soon as their readers release them
+func (c *TableCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = 0
+	c.evict()
+}
+
+// Mapped is how many of the open files are memory mapped
+func (c *TableCache) Mapped() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mapped := 0
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		if elem.Value.(*openTable).mapping != nil {
+			mapped += 1
+		}
+	}
+
+	return mapped
+}
+
+// Len is how many files the cache holds open
+func (c *TableCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// open returns the file of the table and a func to call once done with it,
+// tables without a table cache open the file every time
+func (t *Table) open() (vfs.File, func(), error) {
+	if t.TableCache != nil {
+		return t.TableCache.acquire(t)
+	}
+
+	file, err := t.fs().Open(t.FilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return file, func() { file.Close() }, nil
+}
+
+// Remove deletes the file of the table and evicts its cached blocks. With
+// a table cache readers still using the file keep it until they are done
+func (t *Table) Remove() error {
+	t.EvictBlocks()
+
+	var err error
+	if t.TableCache != nil {
+		err = t.TableCache.remove(t)
+	} else {
+		err = t.fs().Remove(t.FilePath)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package sstable
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	vfs "stinky-db/db/VFS"
+	"testing"
+)
+
+func writeTables(t *testing.T, fs vfs.FS, cache *TableCache, num int) []*Table {
+	tables := []*Table{}
+	for i := 0; i < num; i += 1 {
+		table := GenerateFromSorted([]Data{{Key: "key", Value: fmt.Sprintf("val_%d", i), Seq: 1}}, fmt.Sprintf("%d.sst", i))
+		table.FS = fs
+		table.TableCache = cache
+		// keep the reads on the file instead of the block cache
+		table.BlockCache = NewBlockCache(0)
+		err := table.WriteToFile()
+		if err != nil {
+			t.Fatalf("could not write table: %+v\n", err)
+		}
+		tables = append(tables, &table)
+	}
+
+	return tables
+}
+
+func TestTableCacheClosesLeastRecentlyUsedFiles(t *testing.T) {
+	cache := NewTableCache(2)
+	tables := writeTables(t, vfs.NewMem(), cache, 4)
+
+	for round := 0; round < 3; round += 1 {
+		for i, table := range tables {
+			val, err := table.Get("key")
+			if err != nil || val != fmt.Sprintf("val_%d", i) {
+				t.Fatalf("expected val_%d, got %s %+v", i, val, err)
+			}
+
+			if cache.Len() > 2 {
+				t.Fatalf("expected at most 2 open files, got %d", cache.Len())
+			}
+		}
+	}
+
+	cache.Close()
+	if cache.Len() != 0 {
+		t.Errorf("expected every file to be closed, %d are open", cache.Len())
+	}
+}
+
+func TestTableCacheKeepsFilesOpenPastItsCapacityWhileInUse(t *testing.T) {
+	cache := NewTableCache(1)
+	tables := writeTables(t, vfs.NewMem(), cache, 3)
+
+	iterators := []*TableIterator{}
+	for _, table := range tables {
+		it, err := table.NewIterator()
+		if err != nil {
+			t.Fatalf("could not open iterator: %+v\n", err)
+		}
+		iterators = append(iterators, it)
+	}
+
+	if cache.Len() != 3 {
+		t.Fatalf("expected the files in use to stay open, got %d", cache.Len())
+	}
+
+	for i, it := range iterators {
+		if !it.First() || it.Value() != fmt.Sprintf("val_%d", i) {
+			t.Errorf("expected val_%d, got %+v", i, it.Err())
+		}
+		it.Close()
+	}
+
+	if cache.Len() != 1 {
+		t.Errorf("expected the cache to shrink back to 1 file, got %d", cache.Len())
+	}
+}
+
+func TestRemovedTableIsDeletedOnceReleased(t *testing.T) {
+	fs := vfs.NewMem()
+	cache := NewTableCache(10)
+	table := writeTables(t, fs, cache, 1)[0]
+
+	it, err := table.NewIterator()
+	if err != nil {
+		t.Fatalf("could not open iterator: %+v\n", err)
+	}
+
+	err = table.Remove()
+	if err != nil {
+		t.Fatalf("could not remove table: %+v\n", err)
+	}
+
+	_, err = fs.Stat(table.FilePath)
+	if err != nil {
+		t.Fatalf("expected the file to stay while the iterator reads it, got %+v", err)
+	}
+
+	if !it.First() || it.Value() != "val_0" {
+		t.Errorf("expected the iterator to still read the table, got %+v", it.Err())
+	}
+
+	it.Close()
+	it.Close()
+
+	_, err = fs.Stat(table.FilePath)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the file to be deleted once released, got %+v", err)
+	}
+	if cache.Len() != 0 {
+		t.Errorf("expected the file to be closed, %d are open", cache.Len())
+	}
+}
+
+func TestMappedTables(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported on this platform")
+	}
+
+	dir := t.TempDir()
+	cache := NewTableCacheWithOptions(TableCacheOptions{MaxOpenTables: 2, Mmap: true})
+	tables := []*Table{}
+	for i := 0; i < 3; i += 1 {
+		data := []Data{}
+		for j := 0; j < 1000; j += 1 {
+			data = append(data, Data{Key: fmt.Sprintf("key_%04d", j), Value: fmt.Sprintf("val_%d_%d", i, j), Seq: uint64(j + 1)})
+		}
+
+		table := GenerateFromSorted(data, fmt.Sprintf("%s/%d.sst", dir, i))
+		table.TableCache = cache
+		table.BlockCache = NewBlockCache(0)
+		err := table.WriteToFile()
+		if err != nil {
+			t.Fatalf("could not write table: %+v\n", err)
+		}
+		tables = append(tables, &table)
+	}
+
+	it, err := tables[0].NewIterator()
+	if err != nil {
+		t.Fatalf("could not open iterator: %+v\n", err)
+	}
+
+	for i, table := range tables {
+		val, err := table.Get("key_0500")
+		if err != nil || val != fmt.Sprintf("val_%d_500", i) {
+			t.Errorf("expected val_%d_500, got %s %+v", i, val, err)
+		}
+	}
+
+	if cache.Mapped() == 0 {
+		t.Fatalf("expected the tables to be mapped")
+	}
+
+	// the mapping of a removed table stays until the iterator is done with it
+	err = tables[0].Remove()
+	if err != nil {
+		t.Fatalf("could not remove table: %+v\n", err)
+	}
+
+	count := 0
+	for it.Next() {
+		if it.Value() != fmt.Sprintf("val_0_%d", count) {
+			t.Fatalf("expected val_0_%d, got %s", count, it.Value())
+		}
+		count += 1
+	}
+	if count != 1000 || it.Err() != nil {
+		t.Errorf("expected 1000 records, got %d %+v", count, it.Err())
+	}
+	it.Close()
+
+	_, err = os.Stat(tables[0].FilePath)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the table to be deleted once released, got %+v", err)
+	}
+
+	cache.Close()
+	if cache.Len() != 0 || cache.Mapped() != 0 {
+		t.Errorf("expected every file to be unmapped and closed, %d are open", cache.Len())
+	}
+}
+
+func TestMappedCorruptionIsReported(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported on this platform")
+	}
+
+	path := t.TempDir() + "/table.sst"
+	table := GenerateFromSorted([]Data{{Key: "a", Value: "val", Seq: 1}}, path)
+	err := table.WriteToFile()
+	if err != nil {
+		t.Fatalf("could not write table: %+v\n", err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read table: %+v\n", err)
+	}
+	contents[0] ^= 0xff
+	err = os.WriteFile(path, contents, 0o644)
+	if err != nil {
+		t.Fatalf("could not corrupt table: %+v\n", err)
+	}
+
+	table.TableCache = NewTableCacheWithOptions(TableCacheOptions{Mmap: true})
+	table.BlockCache = NewBlockCache(0)
+	_, err = table.Get("a")
+
+	var corruption *ErrCorruption
+	if !errors.As(err, &corruption) || corruption.Offset != 0 {
+		t.Errorf("expected corruption at offset 0, got %+v", err)
+	}
+}
@@ -1,11 +1,15 @@
 package sstable
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
 	memtable "stinky-db/db/MemTable"
+	vfs "stinky-db/db/VFS"
 	"testing"
-	"time"
 )
 
 func TestWriteTableToFile(t *testing.T) {
@@ -71,6 +75,7 @@ func TestReadFromDisk(t *testing.T) {
 func TestRestoreTableFromDisk(t *testing.T) {
 	filepath := "./my_test_file"
 	wantedFileIndx := FileIndex{
+		Version:    format_json,
 		DataStart:  0,
 		DataLen:    476,
 		IndexStart: 476,
@@ -144,38 +149,32 @@ func TestGetAllElements(t *testing.T) {
 }
 
 func TestGenerateFromData(t *testing.T) {
-	location, err := time.LoadLocation("")
-	if err != nil {
-		t.Errorf("invalid location data: %s\n", err.Error())
-		return
-	}
-
-	repeatDate := time.Date(2024, time.January, 1, 1, 1, 1, 1, location)
-	febDate := time.Date(2024, time.February, 1, 1, 1, 1, 1, location)
-	marDate := time.Date(2024, time.March, 1, 1, 1, 1, 1, location)
-	aprDate := time.Date(2024, time.April, 1, 1, 1, 1, 1, location)
+	repeatSeq := uint64(1)
+	febSeq := uint64(2)
+	marSeq := uint64(3)
+	aprSeq := uint64(4)
 
 	dataToInsert := []Data{
-		{Key: "1", Value: "xxx", Written: aprDate},
-		{Key: "5", Value: "e", Written: repeatDate},
-		{Key: "1", Value: "x", Written: repeatDate},
-		{Key: "2", Value: "b", Written: repeatDate},
-		{Key: "3", Value: "c", Written: repeatDate},
-		{Key: "4", Value: "d", Written: repeatDate},
-		{Key: "1", Value: "yyy", Written: marDate},
-		{Key: "6", Value: "f", Written: repeatDate},
-		{Key: "7", Value: "g", Written: repeatDate},
-		{Key: "1", Value: "xyz", Written: febDate},
+		{Key: "1", Value: "xxx", Seq: aprSeq},
+		{Key: "5", Value: "e", Seq: repeatSeq},
+		{Key: "1", Value: "x", Seq: repeatSeq},
+		{Key: "2", Value: "b", Seq: repeatSeq},
+		{Key: "3", Value: "c", Seq: repeatSeq},
+		{Key: "4", Value: "d", Seq: repeatSeq},
+		{Key: "1", Value: "yyy", Seq: marSeq},
+		{Key: "6", Value: "f", Seq: repeatSeq},
+		{Key: "7", Value: "g", Seq: repeatSeq},
+		{Key: "1", Value: "xyz", Seq: febSeq},
 	}
 
 	expectedData := []Data{
-		{Key: "1", Value: "xxx", Written: aprDate},
-		{Key: "2", Value: "b", Written: repeatDate},
-		{Key: "3", Value: "c", Written: repeatDate},
-		{Key: "4", Value: "d", Written: repeatDate},
-		{Key: "5", Value: "e", Written: repeatDate},
-		{Key: "6", Value: "f", Written: repeatDate},
-		{Key: "7", Value: "g", Written: repeatDate},
+		{Key: "1", Value: "xxx", Seq: aprSeq},
+		{Key: "2", Value: "b", Seq: repeatSeq},
+		{Key: "3", Value: "c", Seq: repeatSeq},
+		{Key: "4", Value: "d", Seq: repeatSeq},
+		{Key: "5", Value: "e", Seq: repeatSeq},
+		{Key: "6", Value: "f", Seq: repeatSeq},
+		{Key: "7", Value: "g", Seq: repeatSeq},
 	}
 
 	table := GenerateFromData(dataToInsert, "")
@@ -190,3 +189,630 @@ func TestGenerateFromData(t *testing.T) {
 		}
 	}
 }
+
+func TestTombstonesArePersisted(t *testing.T) {
+	defer os.Remove("./myfile")
+
+	tree := memtable.NewRBTree(0)
+	tree.Insert("1", "a")
+	tree.Insert("2", "b")
+	tree.Delete("3")
+	tree.Insert("4", "d")
+	tree.Insert("5", "e")
+	tree.Delete("6")
+
+	written, err := GenerateFromTree(tree, "./myfile")
+	if err != nil {
+		t.Fatalf("could not write data: %s", err.Error())
+	}
+
+	table, err := GenerateFromDisk(written.FilePath)
+	if err != nil {
+		t.Fatalf("could not read table: %s", err.Error())
+	}
+
+	for _, key := range []string{"3", "6"} {
+		_, err = table.Get(key)
+		if !errors.Is(err, KeyDeletedErr) {
+			t.Errorf("expected %s to be deleted, got %+v", key, err)
+		}
+	}
+
+	_, err = table.Get("9")
+	if !errors.Is(err, KeyNotFoundErr) {
+		t.Errorf("expected missing key error, got %+v", err)
+	}
+
+	val, err := table.Get("4")
+	if err != nil || val != "d" {
+		t.Errorf("expected d, got %s %+v", val, err)
+	}
+}
+
+func TestGenerateFromDataKeepsNewestTombstone(t *testing.T) {
+	older := uint64(1)
+	newer := uint64(2)
+
+	table := GenerateFromData([]Data{
+		{Key: "1", Value: "a", Seq: older},
+		{Key: "1", Seq: newer, Delete: true},
+		{Key: "2", Seq: older, Delete: true},
+		{Key: "2", Value: "b", Seq: newer},
+	}, "")
+
+	expected := []Data{
+		{Key: "1", Seq: newer, Delete: true},
+		{Key: "2", Value: "b", Seq: newer},
+	}
+
+	if !reflect.DeepEqual(table.Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, table.Data)
+	}
+
+	live := DropTombstones(table.Data)
+	if len(live) != 1 || live[0].Key != "2" {
+		t.Errorf("expected only key 2 to survive, got %+v", live)
+	}
+}
+
+func TestBloomFilterIsPersisted(t *testing.T) {
+	defer os.Remove("./myfile")
+
+	tree := memtable.NewRBTree(0)
+	for i := 0; i < 50; i += 1 {
+		tree.Insert(fmt.Sprintf("key_%02d", i), "val")
+	}
+
+	written, err := GenerateFromTree(tree, "./myfile")
+	if err != nil {
+		t.Fatalf("could not write data: %s", err.Error())
+	}
+
+	if written.Bloom == nil || written.FileIndex.BloomLen == 0 {
+		t.Fatalf("expected a bloom filter to be written with the table")
+	}
+
+	table, err := GenerateFromDisk(written.FilePath)
+	if err != nil {
+		t.Fatalf("could not read table: %s", err.Error())
+	}
+
+	if table.Bloom == nil {
+		t.Fatalf("expected the bloom filter to be loaded from disk")
+	}
+
+	for i := 0; i < 50; i += 1 {
+		key := fmt.Sprintf("key_%02d", i)
+		if !table.Bloom.MayContain(key) {
+			t.Errorf("loaded bloom filter is missing %s", key)
+		}
+
+		val, err := table.Get(key)
+		if err != nil || val != "val" {
+			t.Errorf("expected val for %s, got %s %+v", key, val, err)
+		}
+	}
+}
+
+func TestWriteWithoutBloomFilter(t *testing.T) {
+	defer os.Remove("./myfile")
+
+	tree := memtable.NewRBTree(0)
+	tree.Insert("1", "a")
+
+	_, err := GenerateFromTreeWithOptions(tree, "./myfile", WriteOptions{BloomBitsPerKey: -1})
+	if err != nil {
+		t.Fatalf("could not write data: %s", err.Error())
+	}
+
+	table, err := GenerateFromDisk("./myfile")
+	if err != nil {
+		t.Fatalf("could not read table: %s", err.Error())
+	}
+
+	if table.Bloom != nil {
+		t.Errorf("expected no bloom filter")
+	}
+}
+
+func TestReadsLegacyJSONTable(t *testing.T) {
+	table, err := GenerateFromDisk("./my_test_file")
+	if err != nil {
+		t.Fatalf("could not generate table from disk: %+v\n", err)
+	}
+
+	for key, want := range map[string]string{"1": "x", "2": "b", "5": "e", "7": "g"} {
+		val, err := table.Get(key)
+		if err != nil || val != want {
+			t.Errorf("expected %s for %s, got %s %+v", want, key, val, err)
+		}
+	}
+
+	elements, err := table.GetAllElements()
+	if err != nil {
+		t.Fatalf("could not get all elements: %+v\n", err)
+	}
+
+	if len(elements) != 7 {
+		t.Errorf("expected 7 elements, got %d", len(elements))
+	}
+}
+
+func TestBinaryFormatRoundTrip(t *testing.T) {
+	defer os.Remove("./myfile")
+
+	// values with braces and separators broke the JSON reader
+	tree := memtable.NewRBTree(0)
+	expected := map[string]string{}
+	for i := 0; i < 2000; i += 1 {
+		key := fmt.Sprintf("key_%04d", i)
+		val := fmt.Sprintf("{\"nested\": {\"i\": %d}}$$", i)
+		tree.Insert(key, val)
+		expected[key] = val
+	}
+	tree.Delete("key_0100")
+	delete(expected, "key_0100")
+
+	_, err := GenerateFromTree(tree, "./myfile")
+	if err != nil {
+		t.Fatalf("could not write data: %+v\n", err)
+	}
+
+	table, err := GenerateFromDisk("./myfile")
+	if err != nil {
+		t.Fatalf("could not generate table from disk: %+v\n", err)
+	}
+
+	if table.FileIndex.Version != format_compressed {
+		t.Errorf("expected binary format version, got %d", table.FileIndex.Version)
+	}
+
+	if len(table.Blocks) < 2 {
+		t.Errorf("expected the records to span several blocks, got %d", len(table.Blocks))
+	}
+
+	if table.FileIndex.MinMax != (MinMax{StartKey: "key_0000", EndKey: "key_1999"}) {
+		t.Errorf("unexpected key range %+v", table.FileIndex.MinMax)
+	}
+
+	for key, want := range expected {
+		val, err := table.Get(key)
+		if err != nil || val != want {
+			t.Fatalf("expected %s for %s, got %s %+v", want, key, val, err)
+		}
+	}
+
+	_, err = table.Get("key_0100")
+	if !errors.Is(err, KeyDeletedErr) {
+		t.Errorf("expected key_0100 to be deleted, got %+v", err)
+	}
+
+	_, err = table.Get("key_0100a")
+	if !errors.Is(err, KeyNotFoundErr) {
+		t.Errorf("expected key_0100a to be missing, got %+v", err)
+	}
+
+	elements, err := table.GetAllElements()
+	if err != nil {
+		t.Fatalf("could not get all elements: %+v\n", err)
+	}
+
+	if len(elements) != 2000 {
+		t.Errorf("expected 2000 elements, got %d", len(elements))
+	}
+}
+
+func writeCorruptibleTable(t *testing.T, path string) Table {
+	t.Helper()
+
+	tree := memtable.NewRBTree(0)
+	for i := 0; i < 1000; i += 1 {
+		tree.Insert(fmt.Sprintf("key_%04d", i), fmt.Sprintf("val_%d", i))
+	}
+
+	table, err := GenerateFromTree(tree, path)
+	if err != nil {
+		t.Fatalf("could not write data: %+v\n", err)
+	}
+
+	return table
+}
+
+func flipByte(t *testing.T, path string, offset int) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read table: %+v\n", err)
+	}
+
+	data[offset] ^= 0xff
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatalf("could not write table: %+v\n", err)
+	}
+}
+
+func TestCorruptBlockIsReported(t *testing.T) {
+	defer os.Remove("./myfile")
+
+	table := writeCorruptibleTable(t, "./myfile")
+	handle := table.Blocks[1]
+	flipByte(t, "./myfile", handle.Offset+3)
+
+	_, err := table.Get(handle.LastKey)
+	corruption := &ErrCorruption{}
+	if !errors.As(err, &corruption) {
+		t.Fatalf("expected a corruption error, got %+v", err)
+	}
+
+	if corruption.Path != "./myfile" || corruption.Offset != int64(handle.Offset) {
+		t.Errorf("expected corruption in ./myfile at %d, got %+v", handle.Offset, corruption)
+	}
+
+	_, err = table.Get(table.Blocks[0].LastKey)
+	if err != nil {
+		t.Errorf("expected the untouched block to still be readable, got %+v", err)
+	}
+
+	_, err = table.GetAllElements()
+	if !errors.As(err, &corruption) {
+		t.Errorf("expected GetAllElements to report the corruption, got %+v", err)
+	}
+
+	err = table.ReadIntoMem()
+	if !errors.As(err, &corruption) {
+		t.Errorf("expected ReadIntoMem to report the corruption, got %+v", err)
+	}
+}
+
+func TestCorruptIndexAndFooterAreReported(t *testing.T) {
+	defer os.Remove("./myfile")
+
+	table := writeCorruptibleTable(t, "./myfile")
+	flipByte(t, "./myfile", table.FileIndex.IndexStart+1)
+
+	_, err := GenerateFromDisk("./myfile")
+	corruption := &ErrCorruption{}
+	if !errors.As(err, &corruption) || corruption.Offset != int64(table.FileIndex.IndexStart) {
+		t.Errorf("expected corruption at the index block, got %+v", err)
+	}
+
+	table = writeCorruptibleTable(t, "./myfile")
+	info, err := os.Stat("./myfile")
+	if err != nil {
+		t.Fatalf("could not stat table: %+v\n", err)
+	}
+	flipByte(t, "./myfile", int(info.Size())-footer_size+2)
+
+	_, err = GenerateFromDisk("./myfile")
+	if !errors.As(err, &corruption) || corruption.Offset != info.Size()-footer_size {
+		t.Errorf("expected corruption at the footer, got %+v", err)
+	}
+}
+
+func TestTableIterator(t *testing.T) {
+	defer os.Remove("./myfile")
+
+	tree := memtable.NewRBTree(0)
+	for i := 0; i < 1000; i += 2 {
+		tree.Insert(fmt.Sprintf("key_%04d", i), fmt.Sprintf("val_%d", i))
+	}
+	tree.Delete("key_0500")
+
+	table, err := GenerateFromTree(tree, "./myfile")
+	if err != nil {
+		t.Fatalf("could not write data: %+v\n", err)
+	}
+
+	it, err := table.NewIterator()
+	if err != nil {
+		t.Fatalf("could not make iterator: %+v\n", err)
+	}
+	defer it.Close()
+
+	count := 0
+	prev := ""
+	for it.Next() {
+		if it.Key() <= prev {
+			t.Fatalf("expected keys in order, got %s after %s", it.Key(), prev)
+		}
+		if it.Key() == "key_0500" && !it.Tombstone() {
+			t.Errorf("expected key_0500 to be a tombstone")
+		}
+		prev = it.Key()
+		count += 1
+	}
+
+	if count != 500 || it.Err() != nil {
+		t.Errorf("expected 500 records, got %d %+v", count, it.Err())
+	}
+
+	backwards := 0
+	for ok := it.Last(); ok; ok = it.Prev() {
+		backwards += 1
+	}
+	if backwards != 500 {
+		t.Errorf("expected 500 records backwards, got %d", backwards)
+	}
+
+	if !it.Seek("key_0501") || it.Key() != "key_0502" {
+		t.Errorf("expected seek to land on key_0502")
+	}
+
+	if !it.Prev() || it.Key() != "key_0500" {
+		t.Errorf("expected prev to go back to key_0500")
+	}
+
+	if it.Seek("key_9999") || !it.Prev() || it.Key() != "key_0998" {
+		t.Errorf("expected prev past the end to land on the last key")
+	}
+}
+
+func TestTableIteratorOverJSONTable(t *testing.T) {
+	table, err := GenerateFromDisk("./my_test_file")
+	if err != nil {
+		t.Fatalf("could not generate table from disk: %+v\n", err)
+	}
+
+	it, err := table.NewIterator()
+	if err != nil {
+		t.Fatalf("could not make iterator: %+v\n", err)
+	}
+	defer it.Close()
+
+	if !it.Seek("3") || it.Key() != "3" || it.Value() != "c" {
+		t.Errorf("expected seek to find 3=c")
+	}
+}
+
+func TestSequenceNumbersRoundTrip(t *testing.T) {
+	defer os.Remove("./myfile")
+
+	tree := memtable.NewRBTree(0)
+	tree.InsertWithSeq("1", "a", 7, 0)
+	tree.DeleteWithSeq("2", 9, 0)
+	tree.InsertWithSeq("3", "c", 8, 0)
+
+	_, err := GenerateFromTree(tree, "./myfile")
+	if err != nil {
+		t.Fatalf("could not write data: %+v\n", err)
+	}
+
+	table, err := GenerateFromDisk("./myfile")
+	if err != nil {
+		t.Fatalf("could not generate table from disk: %+v\n", err)
+	}
+
+	elements, err := table.GetAllElements()
+	if err != nil {
+		t.Fatalf("could not get all elements: %+v\n", err)
+	}
+
+	expected := []Data{
+		{Key: "1", Value: "a", Seq: 7},
+		{Key: "2", Seq: 9, Delete: true},
+		{Key: "3", Value: "c", Seq: 8},
+	}
+	if !reflect.DeepEqual(elements, expected) {
+		t.Errorf("expected %+v, got %+v", expected, elements)
+	}
+}
+
+func TestOlderFormatsSkipWrittenTime(t *testing.T) {
+	// before format_sequenced the records ended in the varint written time
+	block := appendString(nil, "1")
+	block = appendString(block, "a")
+	block = append(block, 0)
+	block = binary.AppendVarint(block, 1704070861000000001)
+	block = appendString(block, "2")
+	block = appendString(block, "")
+	block = append(block, flag_delete)
+	block = binary.AppendVarint(block, 0)
+
+	data, err := decodeBlock(block, format_checksummed)
+	if err != nil {
+		t.Fatalf("could not decode block: %+v\n", err)
+	}
+
+	expected := []Data{{Key: "1", Value: "a"}, {Key: "2", Delete: true}}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, data)
+	}
+}
+
+func TestGetAtReadsVersionsAcrossBlocks(t *testing.T) {
+	defer os.Remove("./myfile")
+
+	// enough versions of "b" to fill several blocks, newest first
+	data := []Data{{Key: "a", Value: "a", Seq: 1}}
+	for seq := 1000; seq > 0; seq -= 2 {
+		data = append(data, Data{Key: "b", Value: fmt.Sprintf("val_%04d", seq), Seq: uint64(seq)})
+	}
+	data = append(data, Data{Key: "c", Seq: 5, Delete: true}, Data{Key: "c", Value: "c", Seq: 3})
+
+	table := GenerateFromSorted(data, "./myfile")
+	err := table.WriteToFile()
+	if err != nil {
+		t.Fatalf("could not write data: %+v\n", err)
+	}
+
+	if len(table.Blocks) < 2 {
+		t.Fatalf("expected the versions to span several blocks, got %d", len(table.Blocks))
+	}
+
+	cases := map[uint64]string{1000: "val_1000", 999: "val_0998", 500: "val_0500", 3: "val_0002"}
+	for seq, want := range cases {
+		val, err := table.GetAt("b", seq)
+		if err != nil || val != want {
+			t.Errorf("expected %s at %d, got %s %+v", want, seq, val, err)
+		}
+	}
+
+	_, err = table.GetAt("b", 1)
+	if !errors.Is(err, KeyNotFoundErr) {
+		t.Errorf("expected no version of b at 1, got %+v", err)
+	}
+
+	val, err := table.GetAt("c", 4)
+	if err != nil || val != "c" {
+		t.Errorf("expected c at 4, got %s %+v", val, err)
+	}
+
+	_, err = table.GetAt("c", 5)
+	if !errors.Is(err, KeyDeletedErr) {
+		t.Errorf("expected c to be deleted at 5, got %+v", err)
+	}
+
+	val, err = table.Get("b")
+	if err != nil || val != "val_1000" {
+		t.Errorf("expected the newest version of b, got %s %+v", val, err)
+	}
+}
+
+func TestSalvageKeepsTrustedBlocks(t *testing.T) {
+	dir := t.TempDir()
+	data := []Data{}
+	for i := 0; i < 1000; i += 1 {
+		data = append(data, Data{Key: fmt.Sprintf("key_%04d", i), Value: "val", Seq: uint64(i + 1)})
+	}
+
+	table := GenerateFromSorted(data, dir+"/table.sst")
+	err := table.WriteToFile()
+	if err != nil {
+		t.Fatalf("could not write data: %+v\n", err)
+	}
+	if len(table.Blocks) < 4 {
+		t.Fatalf("expected several blocks, got %d", len(table.Blocks))
+	}
+
+	buf, err := os.ReadFile(table.FilePath)
+	if err != nil {
+		t.Fatalf("could not read table: %+v\n", err)
+	}
+
+	// a table cut short in its fourth block keeps the three before it
+	third := table.Blocks[2]
+	cut := third.Offset + third.Len + block_trailer_size + 100
+	err = os.WriteFile(dir+"/cut.sst", buf[:cut], 0o644)
+	if err != nil {
+		t.Fatalf("could not write table: %+v\n", err)
+	}
+
+	salvaged, lost, err := Salvage(vfs.Default, dir+"/cut.sst")
+	if err != nil {
+		t.Fatalf("could not salvage: %+v\n", err)
+	}
+	if len(lost) == 0 {
+		t.Errorf("expected the missing footer to be reported")
+	}
+
+	table, _ = GenerateFromDisk(table.FilePath)
+	expected := 0
+	for i := 0; i < 3; i += 1 {
+		records, _ := table.ReadBlock(i)
+		expected += len(records)
+	}
+	if !reflect.DeepEqual(salvaged, data[:expected]) {
+		t.Errorf("expected the first %d records, got %d", expected, len(salvaged))
+	}
+
+	// a block failing its checksum is skipped and the rest is read through the index
+	second := table.Blocks[1]
+	buf[second.Offset+10] ^= 0xff
+	err = os.WriteFile(dir+"/corrupt.sst", buf, 0o644)
+	if err != nil {
+		t.Fatalf("could not write table: %+v\n", err)
+	}
+
+	salvaged, lost, err = Salvage(vfs.Default, dir+"/corrupt.sst")
+	if err != nil {
+		t.Fatalf("could not salvage: %+v\n", err)
+	}
+
+	records, _ := table.ReadBlock(1)
+	if len(lost) != 1 || len(salvaged) != len(data)-len(records) {
+		t.Errorf("expected only block 1 to be lost, got %d records and %v", len(salvaged), lost)
+	}
+
+	// the same works for tables that were written without sequence numbers
+	legacy := []Data{}
+	buf = []byte{}
+	for i := 0; i < 10; i += 1 {
+		legacy = append(legacy, Data{Key: fmt.Sprintf("key_%d", i), Value: "val"})
+		buf = appendString(buf, legacy[i].Key)
+		buf = appendString(buf, legacy[i].Value)
+		buf = append(buf, 0)
+		buf = binary.AppendVarint(buf, 1712491807714104000)
+	}
+	buf = appendBlock(nil, buf)
+	err = os.WriteFile(dir+"/legacy.sst", buf, 0o644)
+	if err != nil {
+		t.Fatalf("could not write table: %+v\n", err)
+	}
+
+	salvaged, _, err = Salvage(vfs.Default, dir+"/legacy.sst")
+	if err != nil || !reflect.DeepEqual(salvaged, legacy) {
+		t.Errorf("expected the records of the checksummed format, got %+v %+v", salvaged, err)
+	}
+}
+
+func TestSalvageJSONTable(t *testing.T) {
+	buf, err := os.ReadFile("./my_test_file")
+	if err != nil {
+		t.Fatalf("could not read table: %+v\n", err)
+	}
+
+	path := t.TempDir() + "/layer_0_1"
+	second := bytes.Index(buf[1:], []byte(`{"key"`)) + 1
+	third := bytes.Index(buf[second+1:], []byte(`{"key"`)) + second + 1
+	err = os.WriteFile(path, buf[:third+10], 0o644)
+	if err != nil {
+		t.Fatalf("could not write table: %+v\n", err)
+	}
+
+	salvaged, lost, err := Salvage(vfs.Default, path)
+	if err != nil {
+		t.Fatalf("could not salvage: %+v\n", err)
+	}
+
+	expected := []Data{{Key: "1", Value: "x"}, {Key: "2", Value: "b"}}
+	if !reflect.DeepEqual(salvaged, expected) || len(lost) == 0 {
+		t.Errorf("expected %+v, got %+v %v", expected, salvaged, lost)
+	}
+}
+
+func TestTableInMemFS(t *testing.T) {
+	fs := vfs.NewMem()
+	data := []Data{}
+	for i := 0; i < 1000; i += 1 {
+		data = append(data, Data{Key: fmt.Sprintf("key_%04d", i), Value: fmt.Sprintf("val_%d", i), Seq: uint64(i + 1)})
+	}
+
+	table := GenerateFromSorted(data, "table.sst")
+	table.FS = fs
+	err := table.WriteToFile()
+	if err != nil {
+		t.Fatalf("could not write data: %+v\n", err)
+	}
+
+	_, err = os.Stat("table.sst")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected nothing to be written to disk, got %+v", err)
+	}
+
+	opened, err := GenerateFromFS(fs, "table.sst")
+	if err != nil {
+		t.Fatalf("could not open table: %+v\n", err)
+	}
+
+	val, err := opened.Get("key_0500")
+	if err != nil || val != "val_500" {
+		t.Errorf("expected val_500, got %s %+v", val, err)
+	}
+
+	all, err := opened.GetAllElements()
+	if err != nil || !reflect.DeepEqual(all, data) {
+		t.Errorf("expected every record back, got %d records %+v", len(all), err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package vfs
+
+import (
+	"os"
+)
+
+// lockFile fails where there is no flock, going on without the lock would
+// let two processes open the same database and corrupt it
+func lockFile(file *os.File) error {
+	return ErrLockUnsupported
+}
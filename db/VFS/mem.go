@@ -0,0 +1,383 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS keeps every file in memory, for tests and databases that do not need
+// to outlive the process. Everything written is durable right away
+type MemFS struct {
+	mu sync.Mutex
+	// nodes holds every file and directory by its cleaned path
+	nodes map[string]*memNode
+	locks map[string]bool
+}
+
+type memNode struct {
+	name    string
+	dir     bool
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func NewMem() *MemFS {
+	return &MemFS{
+		nodes: map[string]*memNode{},
+		locks: map[string]bool{},
+	}
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// parentExists must be called with mem.mu held, the current and root
+// directories always exist
+func (mem *MemFS) parentExists(name string) bool {
+	parent := filepath.Dir(name)
+	if parent == "." || parent == "/" {
+		return true
+	}
+
+	node, ok := mem.nodes[parent]
+	return ok && node.dir
+}
+
+func (mem *MemFS) Open(name string) (File, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	node, ok := mem.nodes[filepath.Clean(name)]
+	if !ok {
+		return nil, pathErr("open", name, os.ErrNotExist)
+	}
+
+	return &memFile{node: node}, nil
+}
+
+func (mem *MemFS) Create(name string) (File, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if !mem.parentExists(name) {
+		return nil, pathErr("create", name, os.ErrNotExist)
+	}
+
+	node, ok := mem.nodes[name]
+	if ok && node.dir {
+		return nil, pathErr("create", name, errors.New("is a directory"))
+	}
+	if !ok {
+		node = &memNode{name: filepath.Base(name)}
+		mem.nodes[name] = node
+	}
+
+	node.mu.Lock()
+	node.data = nil
+	node.modTime = time.Now()
+	node.mu.Unlock()
+
+	return &memFile{node: node, writable: true}, nil
+}
+
+func (mem *MemFS) Rename(oldname, newname string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	oldname = filepath.Clean(oldname)
+	newname = filepath.Clean(newname)
+	node, ok := mem.nodes[oldname]
+	if !ok {
+		return pathErr("rename", oldname, os.ErrNotExist)
+	}
+	if node.dir {
+		return pathErr("rename", oldname, errors.New("renaming directories is not supported"))
+	}
+	if !mem.parentExists(newname) {
+		return pathErr("rename", newname, os.ErrNotExist)
+	}
+	if existing, ok := mem.nodes[newname]; ok && existing.dir {
+		return pathErr("rename", newname, errors.New("is a directory"))
+	}
+
+	delete(mem.nodes, oldname)
+	node.mu.Lock()
+	node.name = filepath.Base(newname)
+	node.mu.Unlock()
+	mem.nodes[newname] = node
+
+	return nil
+}
+
+func (mem *MemFS) Remove(name string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := mem.nodes[name]
+	if !ok {
+		return pathErr("remove", name, os.ErrNotExist)
+	}
+	if node.dir && len(mem.children(name)) > 0 {
+		return pathErr("remove", name, errors.New("directory not empty"))
+	}
+
+	delete(mem.nodes, name)
+	return nil
+}
+
+// children must be called with mem.mu held
+func (mem *MemFS) children(dir string) []string {
+	prefix := dir + string(filepath.Separator)
+	if dir == "/" {
+		prefix = dir
+	}
+
+	names := []string{}
+	for path := range mem.nodes {
+		if dir == "." && filepath.Dir(path) == "." {
+			names = append(names, path)
+		} else if strings.HasPrefix(path, prefix) && !strings.ContainsRune(path[len(prefix):], filepath.Separator) {
+			names = append(names, path[len(prefix):])
+		}
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+func (mem *MemFS) List(dir string) ([]string, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	if dir != "." && dir != "/" {
+		node, ok := mem.nodes[dir]
+		if !ok {
+			return nil, pathErr("open", dir, os.ErrNotExist)
+		}
+		if !node.dir {
+			return nil, pathErr("readdirent", dir, errors.New("not a directory"))
+		}
+	}
+
+	return mem.children(dir), nil
+}
+
+func (mem *MemFS) Stat(name string) (fs.FileInfo, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if name == "." || name == "/" {
+		return &memNode{name: name, dir: true}, nil
+	}
+
+	node, ok := mem.nodes[name]
+	if !ok {
+		return nil, pathErr("stat", name, os.ErrNotExist)
+	}
+
+	return node.info(), nil
+}
+
+func (mem *MemFS) MkdirAll(dir string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	for path := dir; path != "." && path != "/"; path = filepath.Dir(path) {
+		node, ok := mem.nodes[path]
+		if ok && !node.dir {
+			return pathErr("mkdir", path, errors.New("not a directory"))
+		}
+		if !ok {
+			mem.nodes[path] = &memNode{name: filepath.Base(path), dir: true, modTime: time.Now()}
+		}
+	}
+
+	return nil
+}
+
+func (mem *MemFS) Sync(dir string) error {
+	_, err := mem.Stat(dir)
+	return err
+}
+
+func (mem *MemFS) Lock(name string) (io.Closer, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if mem.locks[name] {
+		return nil, ErrLocked
+	}
+	if !mem.parentExists(name) {
+		return nil, pathErr("open", name, os.ErrNotExist)
+	}
+	if _, ok := mem.nodes[name]; !ok {
+		mem.nodes[name] = &memNode{name: filepath.Base(name), modTime: time.Now()}
+	}
+	mem.locks[name] = true
+
+	return &memLock{mem: mem, name: name}, nil
+}
+
+type memLock struct {
+	mem  *MemFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.mem.mu.Lock()
+		delete(l.mem.locks, l.name)
+		l.mem.mu.Unlock()
+	})
+
+	return nil
+}
+
+// info copies what Stat reports so later writes do not change it
+func (node *memNode) info() *memNode {
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+
+	return &memNode{name: node.name, dir: node.dir, data: node.data, modTime: node.modTime}
+}
+
+func (node *memNode) Name() string       { return node.name }
+func (node *memNode) Size() int64        { return int64(len(node.data)) }
+func (node *memNode) ModTime() time.Time { return node.modTime }
+func (node *memNode) IsDir() bool        { return node.dir }
+func (node *memNode) Sys() any           { return nil }
+
+func (node *memNode) Mode() fs.FileMode {
+	if node.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+// memFile reads and writes the node it was opened on, a file that was
+// renamed or removed while open keeps its contents like it would on disk
+type memFile struct {
+	node     *memNode
+	writable bool
+	offset   int64
+	closed   bool
+}
+
+func (f *memFile) Read(buf []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	n, err := f.ReadAt(buf, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *memFile) ReadAt(buf []byte, offset int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if offset < 0 {
+		return 0, pathErr("readat", f.node.name, errors.New("negative offset"))
+	}
+
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+
+	if offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(buf, f.node.data[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *memFile) Write(buf []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.writable {
+		return 0, pathErr("write", f.node.name, errors.New("file is opened for reading"))
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	f.node.data = append(f.node.data, buf...)
+	f.node.modTime = time.Now()
+
+	return len(buf), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if !f.writable {
+		return pathErr("truncate", f.node.name, errors.New("file is opened for reading"))
+	}
+	if size < 0 {
+		return pathErr("truncate", f.node.name, errors.New("negative size"))
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+
+	return f.node.info(), nil
+}
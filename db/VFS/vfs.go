@@ -0,0 +1,166 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"slices"
+)
+
+var (
+	ErrLocked = errors.New("file is locked by someone else")
+	// ErrLockUnsupported is returned by Lock of the OS filesystem on
+	// platforms without flock
+	ErrLockUnsupported = errors.New("file locking is not supported on " + runtime.GOOS)
+)
+
+// File is an open file. Files from Open are read, files from Create written
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	// Sync makes everything written to the file durable
+	Sync() error
+	Stat() (fs.FileInfo, error)
+	// Truncate cuts the file down to size bytes, it does not move the
+	// offset writes continue at
+	Truncate(size int64) error
+}
+
+// FS is everything the database does with files, paths are joined with
+// filepath.Join. Errors for missing files match os.ErrNotExist
+type FS interface {
+	// Open opens an existing file for reading
+	Open(name string) (File, error)
+	// Create creates a file for writing, truncating it if it exists
+	Create(name string) (File, error)
+	// Rename replaces newname with oldname, it is atomic on both
+	// implementations
+	Rename(oldname, newname string) error
+	// Remove removes a file or an empty directory
+	Remove(name string) error
+	// List returns the names of the entries of a directory sorted
+	List(dir string) ([]string, error)
+	Stat(name string) (fs.FileInfo, error)
+	MkdirAll(dir string) error
+	// Sync makes the creation, renaming and removal of the entries of a
+	// directory durable
+	Sync(dir string) error
+	// Lock takes an exclusive lock on name, creating it if needed, and fails
+	// with ErrLocked while someone else holds it. Closing releases the lock
+	Lock(name string) (io.Closer, error)
+}
+
+// Default uses the files of the operating system
+var Default FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Create(name string) (File, error) {
+	return os.Create(name)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) List(dir string) ([]string, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	names, err := file.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+
+	return names, nil
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0o755)
+}
+
+func (osFS) Sync(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Exists reports whether name exists
+func Exists(fs FS, name string) (bool, error) {
+	_, err := fs.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// ReadFile reads the whole file
+func ReadFile(fs FS, name string) ([]byte, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// WriteFile writes the file and syncs it, the directory it is in is not synced
+func WriteFile(fs FS, name string, data []byte) error {
+	file, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
@@ -0,0 +1,172 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// forEachFS runs the test against the disk and memory, both have to behave the same
+func forEachFS(t *testing.T, test func(t *testing.T, fs FS, dir string)) {
+	t.Run("os", func(t *testing.T) {
+		test(t, Default, t.TempDir())
+	})
+	t.Run("mem", func(t *testing.T) {
+		test(t, NewMem(), "/tmp/db")
+	})
+}
+
+func TestCreateReadRename(t *testing.T) {
+	forEachFS(t, func(t *testing.T, fs FS, dir string) {
+		err := fs.MkdirAll(filepath.Join(dir, "data"))
+		if err != nil {
+			t.Fatalf("could not make dir: %+v\n", err)
+		}
+
+		path := filepath.Join(dir, "data", "a.tmp")
+		err = WriteFile(fs, path, []byte("hello world"))
+		if err != nil {
+			t.Fatalf("could not write file: %+v\n", err)
+		}
+
+		err = fs.Rename(path, filepath.Join(dir, "data", "a"))
+		if err != nil {
+			t.Fatalf("could not rename: %+v\n", err)
+		}
+
+		file, err := fs.Open(filepath.Join(dir, "data", "a"))
+		if err != nil {
+			t.Fatalf("could not open: %+v\n", err)
+		}
+		defer file.Close()
+
+		buf := make([]byte, 5)
+		n, err := file.ReadAt(buf, 6)
+		if err != nil || string(buf[:n]) != "world" {
+			t.Errorf("expected world, got %q %+v", buf[:n], err)
+		}
+
+		n, err = file.ReadAt(buf, 8)
+		if err != io.EOF || string(buf[:n]) != "rld" {
+			t.Errorf("expected rld and EOF, got %q %+v", buf[:n], err)
+		}
+
+		stat, err := file.Stat()
+		if err != nil || stat.Size() != 11 {
+			t.Errorf("expected 11 bytes, got %+v %+v", stat, err)
+		}
+
+		all, err := io.ReadAll(file)
+		if err != nil || string(all) != "hello world" {
+			t.Errorf("expected hello world, got %q %+v", all, err)
+		}
+
+		_, err = fs.Open(path)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the old name to be gone, got %+v", err)
+		}
+	})
+}
+
+func TestListAndRemove(t *testing.T) {
+	forEachFS(t, func(t *testing.T, fs FS, dir string) {
+		err := fs.MkdirAll(filepath.Join(dir, "sub", "deeper"))
+		if err != nil {
+			t.Fatalf("could not make dir: %+v\n", err)
+		}
+
+		for _, name := range []string{"b", "a", "sub/c"} {
+			err = WriteFile(fs, filepath.Join(dir, name), nil)
+			if err != nil {
+				t.Fatalf("could not write %s: %+v\n", name, err)
+			}
+		}
+
+		names, err := fs.List(dir)
+		if err != nil || !reflect.DeepEqual(names, []string{"a", "b", "sub"}) {
+			t.Errorf("expected a, b and sub, got %v %+v", names, err)
+		}
+
+		err = fs.Remove(filepath.Join(dir, "sub"))
+		if err == nil {
+			t.Errorf("expected a directory with files in it to stay")
+		}
+
+		err = fs.Remove(filepath.Join(dir, "a"))
+		if err != nil {
+			t.Fatalf("could not remove: %+v\n", err)
+		}
+
+		exists, err := Exists(fs, filepath.Join(dir, "a"))
+		if err != nil || exists {
+			t.Errorf("expected a to be removed, got %t %+v", exists, err)
+		}
+
+		_, err = fs.List(filepath.Join(dir, "missing"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected listing a missing dir to fail, got %+v", err)
+		}
+
+		_, err = fs.Create(filepath.Join(dir, "missing", "file"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected creating a file in a missing dir to fail, got %+v", err)
+		}
+	})
+}
+
+func TestLock(t *testing.T) {
+	forEachFS(t, func(t *testing.T, fs FS, dir string) {
+		err := fs.MkdirAll(dir)
+		if err != nil {
+			t.Fatalf("could not make dir: %+v\n", err)
+		}
+
+		lock, err := fs.Lock(filepath.Join(dir, "LOCK"))
+		if err != nil {
+			t.Fatalf("could not lock: %+v\n", err)
+		}
+
+		_, err = fs.Lock(filepath.Join(dir, "LOCK"))
+		if !errors.Is(err, ErrLocked) {
+			t.Errorf("expected the second lock to fail, got %+v", err)
+		}
+
+		err = lock.Close()
+		if err != nil {
+			t.Fatalf("could not unlock: %+v\n", err)
+		}
+
+		lock, err = fs.Lock(filepath.Join(dir, "LOCK"))
+		if err != nil {
+			t.Fatalf("could not lock again: %+v\n", err)
+		}
+		lock.Close()
+	})
+}
+
+func TestMemFilesOutliveRemoval(t *testing.T) {
+	fs := NewMem()
+	err := WriteFile(fs, "table", []byte("records"))
+	if err != nil {
+		t.Fatalf("could not write file: %+v\n", err)
+	}
+
+	file, err := fs.Open("table")
+	if err != nil {
+		t.Fatalf("could not open: %+v\n", err)
+	}
+	defer file.Close()
+
+	err = fs.Remove("table")
+	if err != nil {
+		t.Fatalf("could not remove: %+v\n", err)
+	}
+
+	all, err := io.ReadAll(file)
+	if err != nil || string(all) != "records" {
+		t.Errorf("expected the open file to keep its contents, got %q %+v", all, err)
+	}
+}
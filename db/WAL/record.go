@@ -0,0 +1,94 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	header_size     = 8
+	max_record_size = 64 << 20
+)
+
+var (
+	ErrCorruptRecord  = errors.New("corrupt log record")
+	ErrTornRecord     = errors.New("torn log record")
+	ErrRecordTooLarge = errors.New("log record is too large")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Writer frames records as a little endian uint32 length and a crc32c
+// checksum of the payload followed by the payload itself
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) WriteRecord(payload []byte) (int, error) {
+	buf := make([]byte, header_size+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[header_size:], payload)
+
+	return w.w.Write(buf)
+}
+
+type Reader struct {
+	r      io.Reader
+	offset int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Offset is the position right after the last record that was read successfully
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// ReadRecord returns io.EOF once every record has been read, ErrTornRecord
+// when the input ends in the middle of a record and ErrCorruptRecord when a
+// record does not match its checksum
+func (r *Reader) ReadRecord() ([]byte, error) {
+	header := make([]byte, header_size)
+	n, err := io.ReadFull(r.r, header)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrTornRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	if length > max_record_size {
+		return nil, ErrCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r.r, payload)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrTornRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, ErrCorruptRecord
+	}
+
+	r.offset += int64(n) + int64(length)
+
+	return payload, nil
+}
@@ -0,0 +1,465 @@
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	vfs "stinky-db/db/VFS"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs the segment for every record before WaitDurable
+	// returns, the fsync runs in WaitDurable so the writer does not hold
+	// its own locks through it
+	SyncAlways SyncMode = iota
+	// SyncGroup lets writers that wait at the same time share a single fsync
+	SyncGroup
+	// SyncPeriodic fsyncs the segment every SyncInterval, records written in
+	// between can be lost on a crash
+	SyncPeriodic
+)
+
+const (
+	segment_suffix        = ".log"
+	DEFAULT_SEGMENT_SIZE  = 16 << 20
+	DEFAULT_SYNC_INTERVAL = 100 * time.Millisecond
+)
+
+var (
+	ErrClosed = errors.New("log is closed")
+	// ErrFailed is returned by every write once a record could not be cut
+	// off the log after a failed write, or an fsync failed. What the log
+	// holds past the last durable record is unknown from then on
+	ErrFailed = errors.New("log has failed")
+)
+
+type Options struct {
+	SyncMode     SyncMode
+	SyncInterval time.Duration
+	// SegmentSize is the size in bytes after which writes move on to a new segment
+	SegmentSize int64
+	// FS holds the segments, nil is vfs.Default
+	FS vfs.FS
+}
+
+// Ticket identifies a written record so the writer can wait for it to become durable
+type Ticket struct {
+	Segment uint64
+	n       uint64
+}
+
+type Log struct {
+	dir         string
+	opts        Options
+	mu          sync.Mutex
+	cond        *sync.Cond
+	fs          vfs.FS
+	file        vfs.File
+	segment     uint64
+	segmentSize int64
+	recovered   []uint64
+	written     uint64
+	synced      uint64
+	syncing     bool
+	// failed is set once the log can not take writes any more, see ErrFailed
+	failed error
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func (o Options) withDefaults() Options {
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = DEFAULT_SEGMENT_SIZE
+	}
+
+	if o.SyncInterval <= 0 {
+		o.SyncInterval = DEFAULT_SYNC_INTERVAL
+	}
+
+	if o.FS == nil {
+		o.FS = vfs.Default
+	}
+
+	return o
+}
+
+// SegmentName is the file name of a segment inside the log dir
+func SegmentName(segment uint64) string {
+	return fmt.Sprintf("%06d%s", segment, segment_suffix)
+}
+
+// ListSegments returns the ids of the segments stored in dir in ascending order
+func ListSegments(fs vfs.FS, dir string) ([]uint64, error) {
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []uint64{}
+	for _, name := range names {
+		if !strings.HasSuffix(name, segment_suffix) {
+			continue
+		}
+
+		segment, err := strconv.ParseUint(strings.TrimSuffix(name, segment_suffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	slices.Sort(segments)
+
+	return segments, nil
+}
+
+// Open starts a new segment in dir, segments left over from earlier runs are
+// kept untouched until they are replayed and removed
+func Open(dir string, opts Options) (*Log, error) {
+	opts = opts.withDefaults()
+	err := opts.FS.MkdirAll(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := ListSegments(opts.FS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:       dir,
+		opts:      opts,
+		fs:        opts.FS,
+		recovered: segments,
+		done:      make(chan struct{}),
+	}
+	l.cond = sync.NewCond(&l.mu)
+
+	next := uint64(1)
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+
+	err = l.openSegment(next)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.opts.SyncMode == SyncPeriodic {
+		l.wg.Add(1)
+		go l.syncPeriodically()
+	}
+
+	return l, nil
+}
+
+func (l *Log) openSegment(segment uint64) error {
+	file, err := l.fs.Create(filepath.Join(l.dir, SegmentName(segment)))
+	if err != nil {
+		return err
+	}
+
+	err = l.fs.Sync(l.dir)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.segment = segment
+	l.segmentSize = 0
+
+	return nil
+}
+
+// Segment is the id of the segment currently written to
+func (l *Log) Segment() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.segment
+}
+
+// Replay calls fn for every record in the segments that existed when the log
+// was opened, in the order they were written. A torn record at the end of a
+// segment is what a crash mid-write leaves behind so it ends that segment
+// without an error
+func (l *Log) Replay(fn func(segment uint64, record []byte) error) error {
+	for _, segment := range l.recovered {
+		err := l.replaySegment(segment, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *Log) replaySegment(segment uint64, fn func(segment uint64, record []byte) error) error {
+	file, err := l.fs.Open(filepath.Join(l.dir, SegmentName(segment)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReader(file)
+	reader := NewReader(buffered)
+	for {
+		record, err := reader.ReadRecord()
+		if err == io.EOF || errors.Is(err, ErrTornRecord) {
+			return nil
+		}
+
+		if errors.Is(err, ErrCorruptRecord) {
+			if _, peekErr := buffered.Peek(1); peekErr == io.EOF {
+				return nil
+			}
+
+			return fmt.Errorf("%w: segment %d at offset %d", err, segment, reader.Offset())
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(segment, record)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Write appends the record to the current segment, the returned ticket has
+// to be passed to WaitDurable to know once it is durable. A record that
+// fails to be written is cut off the segment again and writing continues
+// in a new one, so no later record follows its torn bytes
+func (l *Log) Write(record []byte) (Ticket, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return Ticket{}, ErrClosed
+	}
+
+	if l.failed != nil {
+		return Ticket{}, l.failed
+	}
+
+	// the reader would take a bigger record for a corrupt one
+	if len(record) > max_record_size {
+		return Ticket{}, ErrRecordTooLarge
+	}
+
+	if l.segmentSize > 0 && l.segmentSize+int64(len(record)+header_size) > l.opts.SegmentSize {
+		err := l.rotate()
+		if err != nil {
+			l.fail(err)
+			return Ticket{}, err
+		}
+	}
+
+	start := l.segmentSize
+	n, err := NewWriter(l.file).WriteRecord(record)
+	l.segmentSize += int64(n)
+	if err != nil {
+		l.discard(start, err)
+		return Ticket{}, err
+	}
+
+	l.written += 1
+
+	return Ticket{Segment: l.segment, n: l.written}, nil
+}
+
+// discard cuts the segment back to offset, where the record that failed to
+// be written starts, and moves on to a new segment since the file offset
+// stays past it. The log fails when that does not work either. It must be
+// called with l.mu held
+func (l *Log) discard(offset int64, cause error) {
+	err := l.file.Truncate(offset)
+	if err == nil {
+		err = l.rotate()
+	}
+
+	if err != nil {
+		l.fail(errors.Join(cause, err))
+	}
+}
+
+// fail must be called with l.mu held
+func (l *Log) fail(err error) {
+	if l.failed == nil {
+		l.failed = fmt.Errorf("%w: %w", ErrFailed, err)
+	}
+	l.cond.Broadcast()
+}
+
+// WaitDurable blocks until the record behind the ticket has been fsynced,
+// the first waiter syncs on behalf of everyone that wrote before it. In
+// SyncPeriodic mode it returns right away
+func (l *Log) WaitDurable(ticket Ticket) error {
+	if l.opts.SyncMode == SyncPeriodic {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.waitForSync(ticket.n)
+}
+
+// Append writes the record and waits for it to become durable
+func (l *Log) Append(record []byte) (uint64, error) {
+	ticket, err := l.Write(record)
+	if err != nil {
+		return 0, err
+	}
+
+	return ticket.Segment, l.WaitDurable(ticket)
+}
+
+// waitForSync must be called with l.mu held
+func (l *Log) waitForSync(target uint64) error {
+	for l.synced < target {
+		if l.failed != nil {
+			return l.failed
+		}
+
+		if l.syncing {
+			l.cond.Wait()
+			continue
+		}
+
+		l.syncing = true
+		upTo := l.written
+		file := l.file
+		l.mu.Unlock()
+
+		err := file.Sync()
+
+		l.mu.Lock()
+		l.syncing = false
+		if err != nil {
+			l.fail(err)
+		} else if upTo > l.synced {
+			l.synced = upTo
+		}
+		l.cond.Broadcast()
+	}
+
+	return nil
+}
+
+func (l *Log) syncPeriodically() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if !l.closed {
+				l.waitForSync(l.written)
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Rotate closes the current segment and starts a new one, returning the id
+// of the new segment
+func (l *Log) Rotate() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	err := l.rotate()
+	return l.segment, err
+}
+
+func (l *Log) rotate() error {
+	err := l.closeSegment()
+	if err != nil {
+		return err
+	}
+
+	return l.openSegment(l.segment + 1)
+}
+
+// closeSegment must be called with l.mu held
+func (l *Log) closeSegment() error {
+	for l.syncing {
+		l.cond.Wait()
+	}
+
+	err := l.file.Sync()
+	if err != nil {
+		return err
+	}
+	l.synced = l.written
+	l.cond.Broadcast()
+
+	return l.file.Close()
+}
+
+// RemoveBefore deletes every segment older than the given one, the segment
+// being written to is never removed
+func (l *Log) RemoveBefore(segment uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	segments, err := ListSegments(l.fs, l.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, existing := range segments {
+		if existing >= segment || (!l.closed && existing == l.segment) {
+			continue
+		}
+
+		err = l.fs.Remove(filepath.Join(l.dir, SegmentName(existing)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return l.fs.Sync(l.dir)
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	err := l.closeSegment()
+	l.mu.Unlock()
+
+	l.wg.Wait()
+
+	return err
+}
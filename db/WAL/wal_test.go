@@ -0,0 +1,200 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	vfs "stinky-db/db/VFS"
+	"sync"
+	"testing"
+)
+
+func replayAll(t *testing.T, dir string) []string {
+	log, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not reopen log: %+v\n", err)
+	}
+	defer log.Close()
+
+	records := []string{}
+	err = log.Replay(func(segment uint64, record []byte) error {
+		records = append(records, string(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not replay log: %+v\n", err)
+	}
+
+	return records
+}
+
+func TestAppendAndReplay(t *testing.T) {
+	for _, mode := range []SyncMode{SyncAlways, SyncGroup, SyncPeriodic} {
+		dir := t.TempDir()
+		log, err := Open(dir, Options{SyncMode: mode})
+		if err != nil {
+			t.Fatalf("could not open log: %+v\n", err)
+		}
+
+		expected := []string{}
+		for i := 0; i < 10; i += 1 {
+			record := fmt.Sprintf("record_%d", i)
+			_, err = log.Append([]byte(record))
+			if err != nil {
+				t.Fatalf("could not append record: %+v\n", err)
+			}
+			expected = append(expected, record)
+		}
+
+		err = log.Close()
+		if err != nil {
+			t.Fatalf("could not close log: %+v\n", err)
+		}
+
+		records := replayAll(t, dir)
+		if !slices.Equal(records, expected) {
+			t.Errorf("mode %d: expected %v, got %v", mode, expected, records)
+		}
+	}
+}
+
+func TestGroupCommitConcurrentWriters(t *testing.T) {
+	dir := t.TempDir()
+	log, err := Open(dir, Options{SyncMode: SyncGroup})
+	if err != nil {
+		t.Fatalf("could not open log: %+v\n", err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i += 1 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := log.Append([]byte(fmt.Sprintf("record_%d", i)))
+			if err != nil {
+				t.Errorf("could not append record: %+v\n", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	log.Close()
+
+	records := replayAll(t, dir)
+	if len(records) != 50 {
+		t.Errorf("expected 50 records, got %d", len(records))
+	}
+}
+
+func TestRotateAndRemoveBefore(t *testing.T) {
+	fs := vfs.NewMem()
+	dir := "wal"
+	log, err := Open(dir, Options{SegmentSize: 64, FS: fs})
+	if err != nil {
+		t.Fatalf("could not open log: %+v\n", err)
+	}
+	defer log.Close()
+
+	for i := 0; i < 20; i += 1 {
+		_, err = log.Append([]byte(fmt.Sprintf("record_%d", i)))
+		if err != nil {
+			t.Fatalf("could not append record: %+v\n", err)
+		}
+	}
+
+	segments, err := ListSegments(fs, dir)
+	if err != nil {
+		t.Fatalf("could not list segments: %+v\n", err)
+	}
+	if len(segments) < 2 {
+		t.Fatalf("expected writes to rotate into several segments, got %v", segments)
+	}
+
+	current := log.Segment()
+	err = log.RemoveBefore(current + 1)
+	if err != nil {
+		t.Fatalf("could not remove segments: %+v\n", err)
+	}
+
+	segments, err = ListSegments(fs, dir)
+	if err != nil {
+		t.Fatalf("could not list segments: %+v\n", err)
+	}
+	if !slices.Equal(segments, []uint64{current}) {
+		t.Errorf("expected only the current segment %d to be left, got %v", current, segments)
+	}
+}
+
+func TestReplayToleratesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	log, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not open log: %+v\n", err)
+	}
+
+	for _, record := range []string{"first", "second"} {
+		_, err = log.Append([]byte(record))
+		if err != nil {
+			t.Fatalf("could not append record: %+v\n", err)
+		}
+	}
+	segment := log.Segment()
+	log.Close()
+
+	path := filepath.Join(dir, SegmentName(segment))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("could not stat segment: %+v\n", err)
+	}
+
+	err = os.Truncate(path, info.Size()-3)
+	if err != nil {
+		t.Fatalf("could not truncate segment: %+v\n", err)
+	}
+
+	records := replayAll(t, dir)
+	if !slices.Equal(records, []string{"first"}) {
+		t.Errorf("expected only the first record to survive, got %v", records)
+	}
+}
+
+func TestReplayReportsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	log, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not open log: %+v\n", err)
+	}
+
+	for _, record := range []string{"first", "second"} {
+		_, err = log.Append([]byte(record))
+		if err != nil {
+			t.Fatalf("could not append record: %+v\n", err)
+		}
+	}
+	segment := log.Segment()
+	log.Close()
+
+	path := filepath.Join(dir, SegmentName(segment))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read segment: %+v\n", err)
+	}
+
+	data[header_size] ^= 0xff
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatalf("could not write segment: %+v\n", err)
+	}
+
+	log, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not reopen log: %+v\n", err)
+	}
+	defer log.Close()
+
+	err = log.Replay(func(segment uint64, record []byte) error { return nil })
+	if !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected corrupt record error, got %+v", err)
+	}
+}
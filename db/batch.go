@@ -0,0 +1,35 @@
+package db
+
+// WriteBatch collects puts and deletes that DB.Write logs as a single record
+// and applies in one go, readers see either all of them or none
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	kind  byte
+	key   string
+	value string
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key, value string) {
+	b.ops = append(b.ops, batchOp{kind: record_put, key: key, value: value})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{kind: record_delete, key: key})
+}
+
+// Len is the number of writes in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so it can be reused
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
@@ -0,0 +1,540 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"math"
+	bloom "stinky-db/db/Bloom"
+	cache "stinky-db/db/Cache"
+	lsmtree "stinky-db/db/LSMTree"
+	memtable "stinky-db/db/MemTable"
+	sstable "stinky-db/db/SSTable"
+	vfs "stinky-db/db/VFS"
+	wal "stinky-db/db/WAL"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_CACHE_SIZE           = 1_000
+	DEFAULT_READ_CACHE_SIZE      = 8 << 20
+	DEFAULT_MAX_IMMUTABLE_TABLES = 2
+	write_slowdown               = time.Millisecond
+	data_dir                     = "/data"
+	compaction_dir               = "/compaction"
+	wal_dir                      = "/wal"
+	lock_file                    = "/LOCK"
+)
+
+var (
+	ErrNotFound      = errors.New("key not found")
+	ErrClosed        = errors.New("database is closed")
+	ErrEntryTooLarge = errors.New("entry is larger than the memtable")
+	ErrLocked        = errors.New("database is in use by someone else")
+)
+
+type Options struct {
+	// CacheSize is the number of keys the cache holds before they are moved into the memtable
+	CacheSize int
+	// ReadCacheSize is the size in bytes of the cache in front of the
+	// SSTables, a negative value disables it
+	ReadCacheSize int64
+	// ReadCachePolicy picks how the read cache chooses what to evict
+	ReadCachePolicy cache.Policy
+	// MemTableSize is the size in bytes the memtable can grow to before it is flushed into the LSM tree
+	MemTableSize int64
+	// WAL configures how the write-ahead log syncs and rotates its segments
+	WAL wal.Options
+	// BloomBitsPerKey sizes the bloom filter of every SSTable, a negative value disables them
+	BloomBitsPerKey int
+	// MaxImmutableMemTables is how many full memtables can wait for their
+	// flush before writers are stalled
+	MaxImmutableMemTables int
+	// Level0MaxTables, Level0SlowdownTables, Level0StopTables, TargetFileSize,
+	// Layer1MaxBytes and CompactionWorkers tune compaction, see lsmtree.Options
+	Level0MaxTables      int
+	Level0SlowdownTables int
+	Level0StopTables     int
+	TargetFileSize       int64
+	Layer1MaxBytes       int64
+	CompactionWorkers    int
+	// BlockCache holds the decoded blocks of the SSTables, nil shares
+	// sstable.SharedBlockCache with every other database of the process
+	BlockCache *sstable.BlockCache
+	// MaxOpenTables is how many SSTable files are kept open between reads,
+	// the least recently used ones are closed past it
+	MaxOpenTables int
+	// Mmap serves reads of the SSTables out of memory mappings of their
+	// files instead of a read syscall each, it is only supported on linux
+	// and for the files of vfs.Default
+	Mmap bool
+	// Compression picks the codec of the SSTable data blocks per level, see
+	// lsmtree.Options
+	Compression []sstable.Codec
+	// FS holds every file of the database, nil is vfs.Default. It replaces
+	// the FS of the WAL options
+	FS vfs.FS
+}
+
+type Stats struct {
+	// Sequence is the sequence number of the last write
+	Sequence  uint64
+	Bloom     bloom.StatsSnapshot
+	ReadCache cache.ReadStats
+}
+
+type DB struct {
+	dir  string
+	opts Options
+	// lock keeps other processes from opening the database while it is open
+	lock  io.Closer
+	cache *cache.Cache
+	// readCache holds the newest values read from the SSTables, nil when it
+	// is disabled. Every write invalidates the keys it touches
+	readCache *cache.ReadCache
+	mem       *memtable.MemTable
+	// imm holds full memtables waiting for the flush worker, oldest first
+	imm []immutableMemTable
+	lsm *lsmtree.LSMTree
+	wal *wal.Log
+	// cacheSegment and memSegment are the oldest WAL segments holding writes
+	// that still only live in the cache and the memtable, 0 when they are empty
+	cacheSegment uint64
+	memSegment   uint64
+	// seq is the sequence number of the last write, every write gets the
+	// next one so newer versions of a key always have a higher number
+	seq uint64
+	mu  sync.RWMutex
+	// cond is signalled whenever the immutable memtables change
+	cond *sync.Cond
+	// txns counts the open transactions by the sequence number they read at,
+	// while there are any written holds the last sequence number each key was
+	// written at so commits can find conflicts
+	txns      map[uint64]int
+	written   map[string]uint64
+	bgErr     error
+	stopFlush bool
+	flushWg   sync.WaitGroup
+	closed    bool
+}
+
+func (o Options) withDefaults() Options {
+	if o.CacheSize <= 0 {
+		o.CacheSize = DEFAULT_CACHE_SIZE
+	}
+
+	if o.ReadCacheSize == 0 {
+		o.ReadCacheSize = DEFAULT_READ_CACHE_SIZE
+	}
+
+	if o.MemTableSize <= 0 {
+		o.MemTableSize = memtable.MAX_SIZE
+	}
+
+	if o.MaxImmutableMemTables <= 0 {
+		o.MaxImmutableMemTables = DEFAULT_MAX_IMMUTABLE_TABLES
+	}
+
+	if o.FS == nil {
+		o.FS = vfs.Default
+	}
+	o.WAL.FS = o.FS
+
+	return o
+}
+
+// Open opens the database stored in dir, creating it if it does not exist
+// yet. It fails with ErrLocked while someone else has it open
+func Open(dir string, opts Options) (*DB, error) {
+	opts = opts.withDefaults()
+
+	lock, err := lockDir(opts.FS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	lsm, err := lsmtree.NewTreeWithOptions(dir+data_dir, dir+compaction_dir, lsmtree.Options{
+		BloomBitsPerKey:      opts.BloomBitsPerKey,
+		Level0MaxTables:      opts.Level0MaxTables,
+		Level0SlowdownTables: opts.Level0SlowdownTables,
+		Level0StopTables:     opts.Level0StopTables,
+		TargetFileSize:       opts.TargetFileSize,
+		Layer1MaxBytes:       opts.Layer1MaxBytes,
+		CompactionWorkers:    opts.CompactionWorkers,
+		FS:                   opts.FS,
+		BlockCache:           opts.BlockCache,
+		MaxOpenTables:        opts.MaxOpenTables,
+		Mmap:                 opts.Mmap,
+		Compression:          opts.Compression,
+	})
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	log, err := wal.Open(dir+wal_dir, opts.WAL)
+	if err != nil {
+		lsm.Close()
+		lock.Close()
+		return nil, err
+	}
+
+	db := &DB{
+		dir:     dir,
+		opts:    opts,
+		lock:    lock,
+		cache:   cache.NewCache(opts.CacheSize),
+		mem:     memtable.NewMemTable(opts.MemTableSize),
+		lsm:     lsm,
+		wal:     log,
+		seq:     lsm.LastSequence(),
+		txns:    map[uint64]int{},
+		written: map[string]uint64{},
+	}
+	db.cond = sync.NewCond(&db.mu)
+	if opts.ReadCacheSize > 0 {
+		db.readCache = cache.NewReadCache(cache.ReadOptions{MaxBytes: opts.ReadCacheSize, Policy: opts.ReadCachePolicy})
+	}
+
+	db.flushWg.Add(1)
+	go db.flushWorker()
+
+	db.mu.Lock()
+	err = log.Replay(db.replayRecord)
+	db.mu.Unlock()
+
+	if err != nil {
+		db.stopBackgroundWork()
+		log.Close()
+		lock.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// lockDir creates dir and takes the lock file in it
+func lockDir(fs vfs.FS, dir string) (io.Closer, error) {
+	err := fs.MkdirAll(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := fs.Lock(dir + lock_file)
+	if errors.Is(err, vfs.ErrLocked) {
+		return nil, ErrLocked
+	}
+
+	return lock, err
+}
+
+func (db *DB) replayRecord(segment uint64, record []byte) error {
+	seq, ops, err := decodeRecord(record)
+	if err != nil {
+		return err
+	}
+
+	if seq == 0 {
+		seq = db.seq + 1
+	}
+	db.seq = max(db.seq, seq+uint64(len(ops))-1)
+
+	return db.apply(segment, seq, ops)
+}
+
+func (db *DB) Put(key, value string) error {
+	return db.write([]batchOp{{kind: record_put, key: key, value: value}}, nil)
+}
+
+// Delete writes a tombstone for the key which hides any older value the key
+// has in the memtable or on disk
+func (db *DB) Delete(key string) error {
+	return db.write([]batchOp{{kind: record_delete, key: key}}, nil)
+}
+
+// Write applies every put and delete of the batch atomically, a crash either
+// keeps all of them or none
+func (db *DB) Write(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	return db.write(batch.ops, nil)
+}
+
+// write logs the entries as one record before applying them, the caller only
+// gets an answer once the log reports the record as durable. The fsync that
+// makes it durable runs after db.mu is released so reads and other writers
+// are not held up by it. Records are logged and applied in seq order under
+// db.mu, a failed fsync fails the log so no later write is acknowledged
+// after one that was not. validate is run with db.mu held right before the
+// record is logged and can veto the write
+func (db *DB) write(ops []batchOp, validate func() error) error {
+	for _, op := range ops {
+		if int64(len(op.key)+len(op.value)) >= db.opts.MemTableSize {
+			return ErrEntryTooLarge
+		}
+	}
+
+	// give compaction a chance to catch up before level 0 gets so big that flushes stop
+	if db.lsm.Level0Len() >= db.lsm.Options.Level0SlowdownTables {
+		time.Sleep(write_slowdown)
+	}
+
+	db.mu.Lock()
+	err := db.waitForRoom()
+	if err == nil && validate != nil {
+		err = validate()
+	}
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+
+	seq := db.seq + 1
+	record := encodeBatch(seq, ops)
+	if len(ops) == 1 {
+		record = encodeRecord(ops[0].kind, seq, ops[0].key, ops[0].value)
+	}
+
+	ticket, err := db.wal.Write(record)
+	if err == nil {
+		db.seq = seq + uint64(len(ops)) - 1
+		db.trackWrites(seq, ops)
+		err = db.apply(ticket.Segment, seq, ops)
+	}
+	db.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return db.wal.WaitDurable(ticket)
+}
+
+// apply moves the writes into the cache, the first one is given seq and the
+// ones after it the numbers that follow
+func (db *DB) apply(segment uint64, seq uint64, ops []batchOp) error {
+	if db.cacheSegment == 0 {
+		db.cacheSegment = segment
+	}
+
+	pinned := db.lsm.NewestSnapshot()
+	for i, op := range ops {
+		if db.readCache != nil {
+			db.readCache.Invalidate(op.key)
+		}
+
+		if op.kind == record_delete {
+			db.cache.DeleteWithSeq(op.key, seq+uint64(i), pinned)
+		} else {
+			db.cache.SetWithSeq(op.key, op.value, seq+uint64(i), pinned)
+		}
+	}
+
+	if db.cache.IsAtMaxSize() {
+		return db.drainCache()
+	}
+
+	return nil
+}
+
+func (db *DB) Get(key string) (string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return "", ErrClosed
+	}
+
+	return db.get(key, db.seq)
+}
+
+// get returns the newest version of the key written at or before seq, it
+// must be called with db.mu held
+func (db *DB) get(key string, seq uint64) (string, error) {
+	if entry, ok := db.cache.LookupAt(key, seq); ok {
+		if entry.Tombstone {
+			return "", ErrNotFound
+		}
+		return entry.Value, nil
+	}
+
+	if val, found, tombstone := db.mem.LookupAt(key, seq); found {
+		if tombstone {
+			return "", ErrNotFound
+		}
+		return val, nil
+	}
+
+	for i := len(db.imm) - 1; i >= 0; i -= 1 {
+		if val, found, tombstone := db.imm[i].tree.LookupAt(key, seq); found {
+			if tombstone {
+				return "", ErrNotFound
+			}
+			return val, nil
+		}
+	}
+
+	// the read cache only holds the newest versions, older reads go to the tables
+	useReadCache := db.readCache != nil && seq == db.seq
+	if useReadCache {
+		if val, ok := db.readCache.Get(key); ok {
+			return val, nil
+		}
+	}
+
+	val, err := db.lsm.GetAt(key, seq)
+	if errors.Is(err, sstable.KeyNotFoundErr) || errors.Is(err, sstable.KeyDeletedErr) {
+		return "", ErrNotFound
+	}
+
+	if err == nil && useReadCache {
+		db.readCache.Set(key, val)
+	}
+
+	return val, err
+}
+
+func (db *DB) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stats := Stats{
+		Sequence: db.seq,
+		Bloom:    db.lsm.BloomStats.Snapshot(),
+	}
+	if db.readCache != nil {
+		stats.ReadCache = db.readCache.Stats()
+	}
+
+	return stats
+}
+
+// MaxEntrySize is the size a key and value together have to stay below,
+// bigger entries are rejected with ErrEntryTooLarge
+func (db *DB) MaxEntrySize() int64 {
+	return db.opts.MemTableSize
+}
+
+// Err reports why the database no longer takes writes, it is nil while the
+// database is open and background work has not failed
+func (db *DB) Err() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	return db.bgErr
+}
+
+// WaitForCompactions blocks until every full memtable has been flushed and
+// no compaction is left to run
+func (db *DB) WaitForCompactions() error {
+	db.mu.Lock()
+	for len(db.imm) > 0 && db.bgErr == nil {
+		db.cond.Wait()
+	}
+	err := db.bgErr
+	db.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return db.lsm.WaitForCompactions()
+}
+
+// Compact flushes the memtables and merges every table down into the
+// deepest layer, only the versions that snapshots still read are kept
+func (db *DB) Compact() error {
+	err := db.Flush()
+	if err != nil {
+		return err
+	}
+
+	return db.lsm.CompactAll()
+}
+
+// Levels lists the live tables of every level of the LSM tree
+func (db *DB) Levels() []lsmtree.LevelInfo {
+	return db.lsm.Levels()
+}
+
+// Close moves everything still held in memory onto disk, the database can
+// not be used after it has been closed
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+
+	err := db.drainCache()
+	if err == nil {
+		err = db.flushMemTable()
+	}
+	db.mu.Unlock()
+
+	bgErr := db.stopBackgroundWork()
+	if err == nil {
+		err = bgErr
+	}
+
+	defer db.lock.Close()
+
+	closeErr := db.wal.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	// everything the log held is on disk now
+	return db.wal.RemoveBefore(math.MaxUint64)
+}
+
+func (db *DB) drainCache() error {
+	pinned := db.lsm.NewestSnapshot()
+	for key, versions := range db.cache.Swap() {
+		for _, entry := range versions {
+			if db.memSegment == 0 {
+				db.memSegment = db.cacheSegment
+			}
+
+			err := db.insertIntoMemTable(key, entry, pinned)
+			if errors.Is(err, memtable.AtMaxCapErr) {
+				err = db.flushMemTable()
+				if err != nil {
+					return err
+				}
+
+				db.memSegment = db.cacheSegment
+				err = db.insertIntoMemTable(key, entry, pinned)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+	db.cacheSegment = 0
+
+	if db.mem.Tree.AtMaxSize() {
+		return db.flushMemTable()
+	}
+
+	return nil
+}
+
+func (db *DB) insertIntoMemTable(key string, entry cache.Entry, pinned uint64) error {
+	if entry.Tombstone {
+		return db.mem.DeleteWithSeq(key, entry.Seq, pinned)
+	}
+
+	return db.mem.InsertWithSeq(key, entry.Value, entry.Seq, pinned)
+}
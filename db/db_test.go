@@ -0,0 +1,1477 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	cache "stinky-db/db/Cache"
+	sstable "stinky-db/db/SSTable"
+	vfs "stinky-db/db/VFS"
+	wal "stinky-db/db/WAL"
+	"sync"
+	"testing"
+)
+
+// crash stops the database like a crash would, the log is closed as it is
+// and the lock released without anything being flushed
+func crash(db *DB) {
+	db.wal.Close()
+	db.lock.Close()
+}
+
+func TestPutGetDelete(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	err = db.Put("a", "val")
+	if err != nil {
+		t.Fatalf("could not put: %+v\n", err)
+	}
+
+	val, err := db.Get("a")
+	if err != nil {
+		t.Fatalf("could not get: %+v\n", err)
+	}
+
+	if val != "val" {
+		t.Errorf("expected val, got %s", val)
+	}
+
+	err = db.Delete("a")
+	if err != nil {
+		t.Fatalf("could not delete: %+v\n", err)
+	}
+
+	_, err = db.Get("a")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected not found error, got %+v", err)
+	}
+
+	_, err = db.Get("b")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected not found error, got %+v", err)
+	}
+}
+
+func TestReadsThroughFlushes(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{CacheSize: 4, MemTableSize: 128, TargetFileSize: 512, Layer1MaxBytes: 1024})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i += 1 {
+		err = db.Put(fmt.Sprintf("key_%03d", i), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatalf("could not put %d: %+v\n", i, err)
+		}
+	}
+
+	err = db.Put("key_010", "overwritten")
+	if err != nil {
+		t.Fatalf("could not overwrite: %+v\n", err)
+	}
+
+	err = db.Delete("key_020")
+	if err != nil {
+		t.Fatalf("could not delete: %+v\n", err)
+	}
+
+	err = db.WaitForCompactions()
+	if err != nil {
+		t.Fatalf("could not wait for compactions: %+v\n", err)
+	}
+
+	if db.lsm.Level0Len() == 0 && len(db.lsm.Layers) == 0 {
+		t.Fatalf("expected memtables to have been flushed into the lsm tree")
+	}
+
+	for i := 0; i < 100; i += 1 {
+		key := fmt.Sprintf("key_%03d", i)
+		val, err := db.Get(key)
+		switch i {
+		case 10:
+			if val != "overwritten" {
+				t.Errorf("expected overwritten value for %s, got %s", key, val)
+			}
+		case 20:
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected %s to be deleted, got %s %+v", key, val, err)
+			}
+		default:
+			if err != nil || val != fmt.Sprintf("val_%d", i) {
+				t.Errorf("expected val_%d for %s, got %s %+v", i, key, val, err)
+			}
+		}
+	}
+}
+
+func TestReopenKeepsData(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+
+	err = db.Put("a", "val")
+	if err != nil {
+		t.Fatalf("could not put: %+v\n", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("could not close db: %+v\n", err)
+	}
+
+	_, err = db.Get("a")
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("expected closed error, got %+v", err)
+	}
+
+	db, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not reopen db: %+v\n", err)
+	}
+	defer db.Close()
+
+	val, err := db.Get("a")
+	if err != nil || val != "val" {
+		t.Errorf("expected val after reopen, got %s %+v", val, err)
+	}
+}
+
+func TestEntrySizes(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{MemTableSize: 16})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	err = db.Put("a", "")
+	if err != nil {
+		t.Errorf("expected empty values to be accepted, got %+v", err)
+	}
+
+	val, err := db.Get("a")
+	if err != nil || val != "" {
+		t.Errorf("expected an empty value, got %s %+v", val, err)
+	}
+
+	err = db.Put("a", "a value that is way too large")
+	if !errors.Is(err, ErrEntryTooLarge) {
+		t.Errorf("expected entry too large error, got %+v", err)
+	}
+}
+
+func TestRecoversUnflushedWritesFromLog(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{CacheSize: 4, MemTableSize: 256, WAL: wal.Options{SyncMode: wal.SyncGroup}})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+
+	for i := 0; i < 30; i += 1 {
+		err = db.Put(fmt.Sprintf("key_%03d", i), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatalf("could not put %d: %+v\n", i, err)
+		}
+	}
+
+	err = db.Delete("key_005")
+	if err != nil {
+		t.Fatalf("could not delete: %+v\n", err)
+	}
+
+	// simulate a crash, nothing held in the cache or memtable gets flushed
+	crash(db)
+
+	db, err = Open(dir, Options{CacheSize: 4, MemTableSize: 256})
+	if err != nil {
+		t.Fatalf("could not reopen db: %+v\n", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 30; i += 1 {
+		key := fmt.Sprintf("key_%03d", i)
+		val, err := db.Get(key)
+		if i == 5 {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected %s to stay deleted, got %s %+v", key, val, err)
+			}
+			continue
+		}
+
+		if err != nil || val != fmt.Sprintf("val_%d", i) {
+			t.Errorf("expected val_%d for %s, got %s %+v", i, key, val, err)
+		}
+	}
+}
+
+func TestDeleteShadowsFlushedValues(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{CacheSize: 2, MemTableSize: 64})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+
+	err = db.Put("a", "val")
+	if err != nil {
+		t.Fatalf("could not put: %+v\n", err)
+	}
+
+	for i := 0; i < 10; i += 1 {
+		err = db.Put(fmt.Sprintf("filler_%d", i), "val")
+		if err != nil {
+			t.Fatalf("could not put filler: %+v\n", err)
+		}
+	}
+
+	err = db.WaitForCompactions()
+	if err != nil {
+		t.Fatalf("could not wait for compactions: %+v\n", err)
+	}
+
+	val, err := db.lsm.Get("a")
+	if err != nil || val != "val" {
+		t.Fatalf("expected a to have been flushed to disk, got %s %+v", val, err)
+	}
+
+	err = db.Delete("a")
+	if err != nil {
+		t.Fatalf("could not delete: %+v\n", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("could not close db: %+v\n", err)
+	}
+
+	db, err = Open(dir, Options{CacheSize: 2, MemTableSize: 64})
+	if err != nil {
+		t.Fatalf("could not reopen db: %+v\n", err)
+	}
+	defer db.Close()
+
+	_, err = db.Get("a")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the tombstone on disk to hide a, got %+v", err)
+	}
+}
+
+func TestReadCacheIsInvalidatedByWrites(t *testing.T) {
+	for _, policy := range []cache.Policy{cache.PolicyLRU, cache.PolicyARC, cache.PolicyTinyLFU} {
+		db, err := Open(t.TempDir(), Options{ReadCachePolicy: policy})
+		if err != nil {
+			t.Fatalf("could not open db: %+v\n", err)
+		}
+
+		err = db.Put("a", "old")
+		if err != nil {
+			t.Fatalf("could not put: %+v\n", err)
+		}
+
+		err = db.Flush()
+		if err != nil {
+			t.Fatalf("could not flush: %+v\n", err)
+		}
+
+		snapshot, err := db.NewSnapshot()
+		if err != nil {
+			t.Fatalf("could not take snapshot: %+v\n", err)
+		}
+
+		for i := 0; i < 2; i += 1 {
+			val, err := db.Get("a")
+			if err != nil || val != "old" {
+				t.Fatalf("expected old, got %s %+v", val, err)
+			}
+		}
+
+		stats := db.Stats().ReadCache
+		if stats.Hits != 1 || stats.Len != 1 {
+			t.Errorf("expected the second read to hit the cache, got %+v", stats)
+		}
+
+		err = db.Put("a", "new")
+		if err == nil {
+			err = db.Flush()
+		}
+		if err != nil {
+			t.Fatalf("could not overwrite a: %+v\n", err)
+		}
+
+		val, err := db.Get("a")
+		if err != nil || val != "new" {
+			t.Errorf("expected new after the overwrite, got %s %+v", val, err)
+		}
+
+		val, err = snapshot.Get("a")
+		if err != nil || val != "old" {
+			t.Errorf("expected the snapshot to read old, got %s %+v", val, err)
+		}
+		snapshot.Release()
+
+		err = db.Delete("a")
+		if err == nil {
+			err = db.Flush()
+		}
+		if err != nil {
+			t.Fatalf("could not delete a: %+v\n", err)
+		}
+
+		_, err = db.Get("a")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected a to be deleted, got %+v", err)
+		}
+
+		err = db.Close()
+		if err != nil {
+			t.Fatalf("could not close db: %+v\n", err)
+		}
+	}
+}
+
+func openFiles(t *testing.T) int {
+	t.Helper()
+
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("can not count open files: %+v", err)
+	}
+
+	return len(fds)
+}
+
+func TestReadsDoNotLeakFileDescriptors(t *testing.T) {
+	// without a block cache every read goes to the files
+	db, err := Open(t.TempDir(), Options{
+		CacheSize:       4,
+		MemTableSize:    256,
+		Level0MaxTables: 100,
+		ReadCacheSize:   -1,
+		BlockCache:      sstable.NewBlockCache(0),
+		MaxOpenTables:   4,
+	})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 200; i += 1 {
+		err = db.Put(fmt.Sprintf("key_%03d", i), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatalf("could not put: %+v\n", err)
+		}
+	}
+
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("could not flush: %+v\n", err)
+	}
+
+	if db.lsm.Level0Len() <= 4 {
+		t.Fatalf("expected more tables than can be kept open, got %d", db.lsm.Level0Len())
+	}
+
+	readAll := func(rounds int) {
+		for round := 0; round < rounds; round += 1 {
+			for i := 0; i < 200; i += 1 {
+				_, err := db.Get(fmt.Sprintf("key_%03d", i))
+				if err != nil {
+					t.Fatalf("could not get: %+v\n", err)
+				}
+			}
+
+			it, err := db.Scan("", "")
+			if err != nil {
+				t.Fatalf("could not scan: %+v\n", err)
+			}
+			for it.Next() {
+			}
+			it.Close()
+		}
+	}
+
+	readAll(1)
+	before := openFiles(t)
+	readAll(20)
+	after := openFiles(t)
+
+	if after > before {
+		t.Errorf("expected no more open files after 4000 reads, went from %d to %d", before, after)
+	}
+	if open := db.lsm.OpenTables(); open > 4 {
+		t.Errorf("expected at most 4 table files to be open, got %d", open)
+	}
+}
+
+func TestMmapReadsThroughCompactions(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{
+		CacheSize:       4,
+		MemTableSize:    256,
+		Level0MaxTables: 2,
+		ReadCacheSize:   -1,
+		BlockCache:      sstable.NewBlockCache(0),
+		Mmap:            true,
+	})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	for round := 0; round < 3; round += 1 {
+		for i := 0; i < 100; i += 1 {
+			err = db.Put(fmt.Sprintf("key_%03d", i), fmt.Sprintf("val_%d_%d", round, i))
+			if err != nil {
+				t.Fatalf("could not put: %+v\n", err)
+			}
+		}
+
+		it, err := db.Scan("", "")
+		if err != nil {
+			t.Fatalf("could not scan: %+v\n", err)
+		}
+
+		// compaction removes the tables the iterator is still reading
+		err = db.Compact()
+		if err != nil {
+			t.Fatalf("could not compact: %+v\n", err)
+		}
+
+		count := 0
+		for it.Next() {
+			if it.Value() != fmt.Sprintf("val_%d_%d", round, count) {
+				t.Fatalf("expected val_%d_%d, got %s", round, count, it.Value())
+			}
+			count += 1
+		}
+		it.Close()
+		if count != 100 {
+			t.Errorf("expected 100 keys, got %d", count)
+		}
+
+		for i := 0; i < 100; i += 1 {
+			val, err := db.Get(fmt.Sprintf("key_%03d", i))
+			if err != nil || val != fmt.Sprintf("val_%d_%d", round, i) {
+				t.Fatalf("expected val_%d_%d, got %s %+v", round, i, val, err)
+			}
+		}
+	}
+}
+
+func TestConcurrentWritesDuringFlushes(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{
+		CacheSize:       8,
+		MemTableSize:    256,
+		Level0MaxTables: 2,
+		TargetFileSize:  512,
+		Layer1MaxBytes:  2048,
+	})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w += 1 {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i += 1 {
+				key := fmt.Sprintf("key_%d_%03d", w, i)
+				err := db.Put(key, fmt.Sprintf("val_%d", i))
+				if err != nil {
+					t.Errorf("could not put %s: %+v\n", key, err)
+					return
+				}
+
+				val, err := db.Get(key)
+				if err != nil || val != fmt.Sprintf("val_%d", i) {
+					t.Errorf("expected to read back %s right after writing it, got %s %+v", key, val, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("could not close db: %+v\n", err)
+	}
+
+	db, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not reopen db: %+v\n", err)
+	}
+	defer db.Close()
+
+	for w := 0; w < 4; w += 1 {
+		for i := 0; i < 100; i += 1 {
+			key := fmt.Sprintf("key_%d_%03d", w, i)
+			val, err := db.Get(key)
+			if err != nil || val != fmt.Sprintf("val_%d", i) {
+				t.Errorf("expected val_%d for %s after reopening, got %s %+v", i, key, val, err)
+			}
+		}
+	}
+}
+
+func TestScanAcrossAllLevels(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{CacheSize: 4, MemTableSize: 128, TargetFileSize: 256, Layer1MaxBytes: 512})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	expected := map[string]string{}
+	for i := 0; i < 60; i += 1 {
+		key := fmt.Sprintf("key_%02d", i)
+		expected[key] = fmt.Sprintf("val_%d", i)
+		err = db.Put(key, expected[key])
+		if err != nil {
+			t.Fatalf("could not put: %+v\n", err)
+		}
+	}
+
+	for i := 0; i < 60; i += 7 {
+		key := fmt.Sprintf("key_%02d", i)
+		delete(expected, key)
+		err = db.Delete(key)
+		if err != nil {
+			t.Fatalf("could not delete: %+v\n", err)
+		}
+	}
+
+	expected["key_10"] = "overwritten"
+	err = db.Put("key_10", "overwritten")
+	if err != nil {
+		t.Fatalf("could not overwrite: %+v\n", err)
+	}
+	err = db.Put("other", "val")
+	if err != nil {
+		t.Fatalf("could not put: %+v\n", err)
+	}
+
+	it, err := db.Scan("key_05", "key_25")
+	if err != nil {
+		t.Fatalf("could not scan: %+v\n", err)
+	}
+	defer it.Close()
+
+	keys := []string{}
+	for it.Next() {
+		if it.Value() != expected[it.Key()] {
+			t.Errorf("expected %s for %s, got %s", expected[it.Key()], it.Key(), it.Value())
+		}
+		keys = append(keys, it.Key())
+	}
+
+	wanted := []string{}
+	for i := 5; i < 25; i += 1 {
+		key := fmt.Sprintf("key_%02d", i)
+		if _, ok := expected[key]; ok {
+			wanted = append(wanted, key)
+		}
+	}
+
+	if !slices.Equal(keys, wanted) {
+		t.Errorf("expected %v, got %v", wanted, keys)
+	}
+
+	prefix, err := db.PrefixScan("key_")
+	if err != nil {
+		t.Fatalf("could not prefix scan: %+v\n", err)
+	}
+	defer prefix.Close()
+
+	count := 0
+	for ok := prefix.Last(); ok; ok = prefix.Prev() {
+		count += 1
+	}
+
+	if count != len(expected) || prefix.Err() != nil {
+		t.Errorf("expected %d keys with the prefix, got %d %+v", len(expected), count, prefix.Err())
+	}
+}
+
+func TestSequenceNumbersSurviveRestarts(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{CacheSize: 4, MemTableSize: 256, Level0MaxTables: 2}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+
+	// every flush holds a version of the same key, compaction has to keep the last one
+	for i := 0; i < 60; i += 1 {
+		err = db.Put("key", fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatalf("could not put %d: %+v\n", i, err)
+		}
+		err = db.Put(fmt.Sprintf("filler_%03d", i), "xxxxxxxxxxxxxxxxxxxx")
+		if err != nil {
+			t.Fatalf("could not put filler %d: %+v\n", i, err)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("could not close db: %+v\n", err)
+	}
+
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("could not reopen db: %+v\n", err)
+	}
+
+	if db.seq != 120 {
+		t.Errorf("expected the last sequence number to be 120 after reopening, got %d", db.seq)
+	}
+
+	err = db.Put("key", "after_reopen")
+	if err != nil {
+		t.Fatalf("could not put: %+v\n", err)
+	}
+
+	// simulate a crash, the last write only lives in the log
+	crash(db)
+
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("could not reopen db: %+v\n", err)
+	}
+	defer db.Close()
+
+	if db.seq != 121 {
+		t.Errorf("expected the last sequence number to be 121 after replay, got %d", db.seq)
+	}
+
+	err = db.WaitForCompactions()
+	if err != nil {
+		t.Fatalf("could not compact: %+v\n", err)
+	}
+
+	val, err := db.Get("key")
+	if err != nil || val != "after_reopen" {
+		t.Errorf("expected after_reopen, got %s %+v", val, err)
+	}
+}
+
+func TestSnapshotReadsPointInTime(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{CacheSize: 4, MemTableSize: 256, TargetFileSize: 256, Layer1MaxBytes: 512, Level0MaxTables: 2})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	before := map[string]string{}
+	for i := 0; i < 40; i += 1 {
+		key := fmt.Sprintf("key_%02d", i)
+		before[key] = fmt.Sprintf("val_%d", i)
+		err = db.Put(key, before[key])
+		if err != nil {
+			t.Fatalf("could not put: %+v\n", err)
+		}
+	}
+
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatalf("could not take snapshot: %+v\n", err)
+	}
+	defer snap.Release()
+
+	// rewrite every key a few times so the old versions get flushed and compacted
+	for round := 0; round < 3; round += 1 {
+		for i := 0; i < 40; i += 1 {
+			key := fmt.Sprintf("key_%02d", i)
+			if i%5 == 0 {
+				err = db.Delete(key)
+			} else {
+				err = db.Put(key, fmt.Sprintf("new_%d_%d", round, i))
+			}
+			if err != nil {
+				t.Fatalf("could not write: %+v\n", err)
+			}
+		}
+	}
+	err = db.Put("key_99", "after")
+	if err != nil {
+		t.Fatalf("could not put: %+v\n", err)
+	}
+
+	err = db.WaitForCompactions()
+	if err != nil {
+		t.Fatalf("could not compact: %+v\n", err)
+	}
+
+	for key, want := range before {
+		val, err := snap.Get(key)
+		if err != nil || val != want {
+			t.Errorf("expected %s for %s in the snapshot, got %s %+v", want, key, val, err)
+		}
+	}
+
+	_, err = snap.Get("key_99")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected key_99 to be missing from the snapshot, got %+v", err)
+	}
+
+	val, err := db.Get("key_01")
+	if err != nil || val != "new_2_1" {
+		t.Errorf("expected new_2_1 outside the snapshot, got %s %+v", val, err)
+	}
+
+	_, err = db.Get("key_05")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected key_05 to be deleted outside the snapshot, got %+v", err)
+	}
+
+	it, err := snap.Scan("", "")
+	if err != nil {
+		t.Fatalf("could not scan snapshot: %+v\n", err)
+	}
+	defer it.Close()
+
+	count := 0
+	for it.Next() {
+		if it.Value() != before[it.Key()] {
+			t.Errorf("expected %s for %s in the snapshot scan, got %s", before[it.Key()], it.Key(), it.Value())
+		}
+		count += 1
+	}
+	if count != len(before) {
+		t.Errorf("expected %d keys in the snapshot scan, got %d", len(before), count)
+	}
+
+	snap.Release()
+	_, err = snap.Get("key_01")
+	if !errors.Is(err, ErrSnapshotReleased) {
+		t.Errorf("expected released snapshot error, got %+v", err)
+	}
+}
+
+func TestWriteBatchIsAtomic(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{CacheSize: 3, MemTableSize: 128})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	batch := NewWriteBatch()
+	batch.Put("a", "100")
+	batch.Put("b", "0")
+	err = db.Write(batch)
+	if err != nil {
+		t.Fatalf("could not write batch: %+v\n", err)
+	}
+
+	// move the balance between a and b, a snapshot must never see half a move
+	stop := make(chan struct{})
+	readerErr := make(chan error, 1)
+	go func() {
+		defer close(readerErr)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			snap, err := db.NewSnapshot()
+			if err != nil {
+				readerErr <- err
+				return
+			}
+			a, errA := snap.Get("a")
+			b, errB := snap.Get("b")
+			snap.Release()
+			if errA != nil || errB != nil {
+				readerErr <- errors.Join(errA, errB)
+				return
+			}
+
+			total := 0
+			for _, val := range []string{a, b} {
+				n := 0
+				fmt.Sscanf(val, "%d", &n)
+				total += n
+			}
+			if total != 100 {
+				readerErr <- fmt.Errorf("saw a=%s b=%s", a, b)
+				return
+			}
+		}
+	}()
+
+	for i := 1; i <= 100; i += 1 {
+		batch.Reset()
+		batch.Put("a", fmt.Sprintf("%d", 100-i))
+		batch.Put(fmt.Sprintf("filler_%03d", i), "xxxxxxxxxxxxxxxxxxxx")
+		batch.Delete(fmt.Sprintf("filler_%03d", i-1))
+		batch.Put("b", fmt.Sprintf("%d", i))
+		err = db.Write(batch)
+		if err != nil {
+			t.Fatalf("could not write batch %d: %+v\n", i, err)
+		}
+	}
+	close(stop)
+
+	if err := <-readerErr; err != nil {
+		t.Errorf("reader saw a partial batch: %+v", err)
+	}
+
+	for key, want := range map[string]string{"a": "0", "b": "100", "filler_100": "xxxxxxxxxxxxxxxxxxxx"} {
+		val, err := db.Get(key)
+		if err != nil || val != want {
+			t.Errorf("expected %s for %s, got %s %+v", want, key, val, err)
+		}
+	}
+
+	_, err = db.Get("filler_099")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected filler_099 to be deleted, got %+v", err)
+	}
+}
+
+func TestTornWriteBatchIsDropped(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+
+	err = db.Put("before", "val")
+	if err != nil {
+		t.Fatalf("could not put: %+v\n", err)
+	}
+
+	batch := NewWriteBatch()
+	for i := 0; i < 10; i += 1 {
+		batch.Put(fmt.Sprintf("key_%d", i), "val")
+	}
+	err = db.Write(batch)
+	if err != nil {
+		t.Fatalf("could not write batch: %+v\n", err)
+	}
+
+	// simulate a crash in the middle of writing the batch record
+	crash(db)
+	segments, err := wal.ListSegments(vfs.Default, dir+wal_dir)
+	if err != nil {
+		t.Fatalf("could not list segments: %+v\n", err)
+	}
+	path := fmt.Sprintf("%s%s/%06d.log", dir, wal_dir, segments[len(segments)-1])
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("could not stat segment: %+v\n", err)
+	}
+	err = os.Truncate(path, stat.Size()-5)
+	if err != nil {
+		t.Fatalf("could not truncate segment: %+v\n", err)
+	}
+
+	db, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not reopen db: %+v\n", err)
+	}
+	defer db.Close()
+
+	val, err := db.Get("before")
+	if err != nil || val != "val" {
+		t.Errorf("expected the write before the batch to survive, got %s %+v", val, err)
+	}
+
+	for i := 0; i < 10; i += 1 {
+		_, err = db.Get(fmt.Sprintf("key_%d", i))
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected key_%d of the torn batch to be missing, got %+v", i, err)
+		}
+	}
+}
+
+func TestTxnCommitsReadModifyWrite(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	err = db.Put("counter", "1")
+	if err != nil {
+		t.Fatalf("could not put: %+v\n", err)
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		t.Fatalf("could not begin: %+v\n", err)
+	}
+
+	val, err := txn.Get("counter")
+	if err != nil || val != "1" {
+		t.Fatalf("expected 1, got %s %+v", val, err)
+	}
+
+	txn.Put("counter", "2")
+	txn.Delete("other")
+
+	// the transaction reads its own writes, nobody else does before Commit
+	val, err = txn.Get("counter")
+	if err != nil || val != "2" {
+		t.Errorf("expected the txn to read its own write, got %s %+v", val, err)
+	}
+
+	val, err = db.Get("counter")
+	if err != nil || val != "1" {
+		t.Errorf("expected the write to stay invisible before commit, got %s %+v", val, err)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("could not commit: %+v\n", err)
+	}
+
+	val, err = db.Get("counter")
+	if err != nil || val != "2" {
+		t.Errorf("expected 2 after commit, got %s %+v", val, err)
+	}
+
+	err = txn.Put("counter", "3")
+	if !errors.Is(err, ErrTxnDone) {
+		t.Errorf("expected done error, got %+v", err)
+	}
+}
+
+func TestTxnConflictsOnReadKeys(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	db.Put("a", "1")
+	db.Put("b", "1")
+
+	first, _ := db.Begin()
+	second, _ := db.Begin()
+
+	first.Get("a")
+	first.Put("a", "first")
+	second.Get("a")
+	second.Get("b")
+	second.Put("b", "second")
+
+	err = first.Commit()
+	if err != nil {
+		t.Fatalf("expected the first commit to succeed: %+v\n", err)
+	}
+
+	err = second.Commit()
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected a conflict on a, got %+v", err)
+	}
+
+	val, err := db.Get("b")
+	if err != nil || val != "1" {
+		t.Errorf("expected the conflicting txn to write nothing, got %s %+v", val, err)
+	}
+
+	// blind writes and writes before the snapshot do not conflict
+	third, _ := db.Begin()
+	db.Put("c", "outside")
+	third.Get("a")
+	third.Put("c", "third")
+
+	err = third.Commit()
+	if err != nil {
+		t.Errorf("expected a commit without conflicts, got %+v", err)
+	}
+
+	rolledBack, _ := db.Begin()
+	rolledBack.Put("a", "never")
+	rolledBack.Rollback()
+
+	val, err = db.Get("a")
+	if err != nil || val != "first" {
+		t.Errorf("expected first after the rollback, got %s %+v", val, err)
+	}
+
+	if len(db.txns) != 0 || len(db.written) != 0 {
+		t.Errorf("expected no tracked writes once every txn is done, got %d txns %d writes", len(db.txns), len(db.written))
+	}
+}
+
+func TestConcurrentTxnIncrements(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{CacheSize: 8, MemTableSize: 512})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	db.Put("counter", "0")
+
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < 4; worker += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i += 1 {
+				for {
+					txn, err := db.Begin()
+					if err != nil {
+						t.Errorf("could not begin: %+v", err)
+						return
+					}
+
+					val, _ := txn.Get("counter")
+					n := 0
+					fmt.Sscanf(val, "%d", &n)
+					txn.Put("counter", fmt.Sprintf("%d", n+1))
+
+					err = txn.Commit()
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrConflict) {
+						t.Errorf("could not commit: %+v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get("counter")
+	if err != nil || val != "100" {
+		t.Errorf("expected 100 increments, got %s %+v", val, err)
+	}
+}
+
+func TestCompactMovesEverythingToTheBottom(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{CacheSize: 4, MemTableSize: 256, TargetFileSize: 512, Layer1MaxBytes: 1024})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 200; i += 1 {
+		err = db.Put(fmt.Sprintf("key_%03d", i%100), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatalf("could not put %d: %+v\n", i, err)
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		err = db.Delete(fmt.Sprintf("key_%03d", i))
+		if err != nil {
+			t.Fatalf("could not delete %d: %+v\n", i, err)
+		}
+	}
+
+	err = db.Compact()
+	if err != nil {
+		t.Fatalf("could not compact: %+v\n", err)
+	}
+
+	levels := db.Levels()
+	if len(levels[0].Tables) != 0 {
+		t.Errorf("expected level 0 to be empty, got %d tables", len(levels[0].Tables))
+	}
+
+	nonEmpty := 0
+	for _, level := range levels[1:] {
+		if len(level.Tables) > 0 {
+			nonEmpty += 1
+		}
+	}
+	if nonEmpty != 1 {
+		t.Errorf("expected every table in one layer, got %+v", levels)
+	}
+
+	for i := 0; i < 100; i += 1 {
+		val, err := db.Get(fmt.Sprintf("key_%03d", i))
+		if i%2 == 0 {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected key_%03d to be deleted, got %s %+v", i, val, err)
+			}
+			continue
+		}
+
+		if err != nil || val != fmt.Sprintf("val_%d", i+100) {
+			t.Errorf("expected val_%d for key_%03d, got %s %+v", i+100, i, val, err)
+		}
+	}
+}
+
+func TestRepairRecoversWhatIsReadable(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+
+	for i := 0; i < 2000; i += 1 {
+		err = db.Put(fmt.Sprintf("key_%04d", i), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatalf("could not put %d: %+v\n", i, err)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("could not close db: %+v\n", err)
+	}
+
+	db, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not reopen db: %+v\n", err)
+	}
+
+	err = db.Put("key_0000", "newer")
+	if err != nil {
+		t.Fatalf("could not put: %+v\n", err)
+	}
+	err = db.Delete("key_0001")
+	if err != nil {
+		t.Fatalf("could not delete: %+v\n", err)
+	}
+
+	// simulate a crash, the last writes only live in the log
+	crash(db)
+	db.stopBackgroundWork()
+
+	// the table loses its second half and footer like after a full disk
+	tables, err := filepath.Glob(dir + data_dir + "/*.sst")
+	if err != nil || len(tables) != 1 {
+		t.Fatalf("expected a single table, got %v %+v", tables, err)
+	}
+	stat, err := os.Stat(tables[0])
+	if err != nil {
+		t.Fatalf("could not stat table: %+v\n", err)
+	}
+	err = os.Truncate(tables[0], stat.Size()/2)
+	if err != nil {
+		t.Fatalf("could not truncate table: %+v\n", err)
+	}
+
+	// a segment with a corrupt record between two good ones keeps the first
+	buf := bytes.Buffer{}
+	segment := wal.NewWriter(&buf)
+	segment.WriteRecord(encodeRecord(record_put, 10_000, "wal_key", "val"))
+	corrupt := buf.Len()
+	segment.WriteRecord(encodeRecord(record_put, 10_001, "corrupt", "val"))
+	buf.Bytes()[corrupt+4] ^= 0xff
+	segment.WriteRecord(encodeRecord(record_put, 10_002, "after", "val"))
+	err = os.WriteFile(dir+wal_dir+"/"+wal.SegmentName(999), buf.Bytes(), 0o644)
+	if err != nil {
+		t.Fatalf("could not write segment: %+v\n", err)
+	}
+
+	_, err = Open(dir, Options{})
+	if err == nil {
+		t.Fatalf("expected the damaged table to keep the db from opening")
+	}
+
+	report, err := Repair(dir)
+	if err != nil {
+		t.Fatalf("could not repair: %+v\n", err)
+	}
+
+	if len(report.DamagedTables) != 1 || len(report.DamagedSegments) != 1 || report.WALRecords != 3 {
+		t.Errorf("expected a damaged table and segment and 3 log records, got %+v", report)
+	}
+	if report.TableRecords == 0 || report.TableRecords >= 2000 {
+		t.Errorf("expected part of the table to be recovered, got %d records", report.TableRecords)
+	}
+
+	lost, err := os.ReadDir(report.LostDir)
+	if err != nil || len(lost) != 2 {
+		t.Errorf("expected the table and segment in the lost dir, got %v %+v", lost, err)
+	}
+
+	db, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("could not open repaired db: %+v\n", err)
+	}
+	defer db.Close()
+
+	expected := map[string]string{"key_0000": "newer", "key_0002": "val_2", "wal_key": "val"}
+	for key, value := range expected {
+		val, err := db.Get(key)
+		if err != nil || val != value {
+			t.Errorf("expected %s for %s, got %s %+v", value, key, val, err)
+		}
+	}
+
+	for _, key := range []string{"key_0001", "key_1999", "corrupt", "after"} {
+		_, err = db.Get(key)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected %s to be missing, got %+v", key, err)
+		}
+	}
+
+	it, err := db.Scan("key_", "key_~")
+	if err != nil {
+		t.Fatalf("could not scan: %+v\n", err)
+	}
+	defer it.Close()
+
+	count := 0
+	for it.Next() {
+		count += 1
+	}
+	if count != report.TableRecords-1 {
+		t.Errorf("expected the %d recovered keys but key_0001, got %d", report.TableRecords, count)
+	}
+}
+
+func TestInMemoryDatabases(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("db", Options{FS: fs, MemTableSize: 1024})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+
+	_, err = Open("db", Options{FS: fs})
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("expected the open database to be locked, got %+v", err)
+	}
+
+	// a second database in the same FS does not share anything with the first
+	other, err := Open("other", Options{FS: fs})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer other.Close()
+
+	for i := 0; i < 200; i += 1 {
+		err = db.Put(fmt.Sprintf("key_%03d", i), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatalf("could not put %d: %+v\n", i, err)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("could not close db: %+v\n", err)
+	}
+
+	_, err = os.Stat("db")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected nothing to be written to disk, got %+v", err)
+	}
+
+	db, err = Open("db", Options{FS: fs})
+	if err != nil {
+		t.Fatalf("could not reopen db: %+v\n", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 200; i += 1 {
+		val, err := db.Get(fmt.Sprintf("key_%03d", i))
+		if err != nil || val != fmt.Sprintf("val_%d", i) {
+			t.Errorf("expected val_%d, got %s %+v", i, val, err)
+		}
+	}
+
+	_, err = other.Get("key_000")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the other database to be empty, got %+v", err)
+	}
+}
+
+// faultyFS fails the writes and syncs of WAL segments on demand, a failed
+// write still gets half of its bytes into the file like a torn write would
+type faultyFS struct {
+	vfs.FS
+	mu         sync.Mutex
+	failWrites int
+	failSyncs  int
+	// blockSyncs, when set, holds every sync until it is closed and
+	// syncing is told about each one first
+	blockSyncs chan struct{}
+	syncing    chan struct{}
+}
+
+type faultyFile struct {
+	vfs.File
+	fs *faultyFS
+}
+
+var errInjected = errors.New("injected failure")
+
+func (f *faultyFS) Create(name string) (vfs.File, error) {
+	file, err := f.FS.Create(name)
+	if err != nil || filepath.Ext(name) != ".log" {
+		return file, err
+	}
+
+	return &faultyFile{File: file, fs: f}, nil
+}
+
+func (f *faultyFS) fail(writes, syncs int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failWrites, f.failSyncs = writes, syncs
+}
+
+func (f *faultyFile) Write(buf []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.fs.failWrites > 0 {
+		f.fs.failWrites -= 1
+		n, _ := f.File.Write(buf[:len(buf)/2])
+		return n, errInjected
+	}
+
+	return f.File.Write(buf)
+}
+
+func (f *faultyFile) Sync() error {
+	f.fs.mu.Lock()
+	block, syncing := f.fs.blockSyncs, f.fs.syncing
+	f.fs.mu.Unlock()
+
+	if block != nil {
+		syncing <- struct{}{}
+		<-block
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.fs.failSyncs > 0 {
+		f.fs.failSyncs -= 1
+		return errInjected
+	}
+
+	return f.File.Sync()
+}
+
+func TestFailedLogWriteDoesNotLoseLaterWrites(t *testing.T) {
+	fs := &faultyFS{FS: vfs.NewMem()}
+	db, err := Open("db", Options{FS: fs})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if key == "c" {
+			fs.fail(1, 0)
+		}
+
+		err = db.Put(key, "val_"+key)
+		if key == "c" {
+			if !errors.Is(err, errInjected) {
+				t.Fatalf("expected the write of c to fail, got %+v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("could not put %s: %+v\n", key, err)
+		}
+	}
+	crash(db)
+
+	db, err = Open("db", Options{FS: fs.FS})
+	if err != nil {
+		t.Fatalf("could not reopen db after a failed write: %+v\n", err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "b", "d"} {
+		val, err := db.Get(key)
+		if err != nil || val != "val_"+key {
+			t.Errorf("expected the acknowledged write of %s to survive, got %s %+v", key, val, err)
+		}
+	}
+
+	_, err = db.Get("c")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the failed write of c to be gone, got %+v", err)
+	}
+
+	// the next write gets a sequence number of its own
+	err = db.Put("e", "val_e")
+	if err != nil {
+		t.Fatalf("could not put e: %+v\n", err)
+	}
+	val, err := db.Get("d")
+	if err != nil || val != "val_d" {
+		t.Errorf("expected d to be untouched by later writes, got %s %+v", val, err)
+	}
+}
+
+func TestFailedLogSyncFailsLaterWrites(t *testing.T) {
+	fs := &faultyFS{FS: vfs.NewMem()}
+	db, err := Open("db", Options{FS: fs})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	err = db.Put("a", "val_a")
+	if err != nil {
+		t.Fatalf("could not put a: %+v\n", err)
+	}
+
+	fs.fail(0, 1)
+	err = db.Put("b", "val_b")
+	if !errors.Is(err, errInjected) {
+		t.Fatalf("expected the write of b to fail, got %+v", err)
+	}
+
+	// nothing is acknowledged after a write whose fate is unknown
+	err = db.Put("c", "val_c")
+	if !errors.Is(err, wal.ErrFailed) {
+		t.Errorf("expected the log to have failed, got %+v", err)
+	}
+}
+
+func TestReadsDoNotWaitForLogSyncs(t *testing.T) {
+	fs := &faultyFS{FS: vfs.NewMem()}
+	db, err := Open("db", Options{FS: fs, WAL: wal.Options{SyncMode: wal.SyncAlways}})
+	if err != nil {
+		t.Fatalf("could not open db: %+v\n", err)
+	}
+	defer db.Close()
+
+	err = db.Put("a", "val_a")
+	if err != nil {
+		t.Fatalf("could not put a: %+v\n", err)
+	}
+
+	block := make(chan struct{})
+	fs.mu.Lock()
+	fs.blockSyncs, fs.syncing = block, make(chan struct{}, 1)
+	fs.mu.Unlock()
+
+	written := make(chan error)
+	go func() {
+		written <- db.Put("b", "val_b")
+	}()
+	<-fs.syncing
+
+	// the put is stuck in its fsync, reads go on meanwhile
+	val, err := db.Get("a")
+	if err != nil || val != "val_a" {
+		t.Errorf("expected val_a while the put syncs, got %s %+v", val, err)
+	}
+
+	fs.mu.Lock()
+	fs.blockSyncs = nil
+	fs.mu.Unlock()
+	close(block)
+
+	err = <-written
+	if err != nil {
+		t.Fatalf("could not put b: %+v\n", err)
+	}
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	memtable "stinky-db/db/MemTable"
+)
+
+type immutableMemTable struct {
+	tree *memtable.RBTree
+	// segment is the oldest WAL segment with writes that are in the tree
+	segment uint64
+}
+
+// waitForRoom stalls a writer while the flush worker is behind, it must be
+// called with db.mu held
+func (db *DB) waitForRoom() error {
+	for len(db.imm) >= db.opts.MaxImmutableMemTables && db.bgErr == nil && !db.closed {
+		db.cond.Wait()
+	}
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	return db.bgErr
+}
+
+// flushMemTable hands the memtable to the flush worker and starts a new one,
+// it must be called with db.mu held
+func (db *DB) flushMemTable() error {
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+
+	tree := db.mem.SwapTree()
+	segment := db.memSegment
+	db.memSegment = 0
+	if tree.Root == nil {
+		return nil
+	}
+
+	db.imm = append(db.imm, immutableMemTable{tree: tree, segment: segment})
+	db.cond.Broadcast()
+
+	return nil
+}
+
+// Flush moves everything held in memory into level 0 tables and returns
+// once they are written
+func (db *DB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	err := db.drainCache()
+	if err == nil {
+		err = db.flushMemTable()
+	}
+	if err != nil {
+		return err
+	}
+
+	for len(db.imm) > 0 && db.bgErr == nil {
+		db.cond.Wait()
+	}
+
+	return db.bgErr
+}
+
+// flushWorker writes the immutable memtables into level 0 in the order they
+// filled up and drops the WAL segments that are no longer needed
+func (db *DB) flushWorker() {
+	defer db.flushWg.Done()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for {
+		for len(db.imm) == 0 && !db.stopFlush {
+			db.cond.Wait()
+		}
+
+		if len(db.imm) == 0 || db.bgErr != nil {
+			return
+		}
+
+		oldest := db.imm[0]
+		db.mu.Unlock()
+		err := db.lsm.InsertMemtable(oldest.tree)
+		db.mu.Lock()
+
+		if err != nil {
+			db.bgErr = err
+			db.cond.Broadcast()
+			return
+		}
+
+		// the table stays readable from imm until it is in level 0
+		db.imm = db.imm[1:]
+		segment := db.oldestUnflushedSegment()
+		db.cond.Broadcast()
+
+		db.mu.Unlock()
+		err = db.wal.RemoveBefore(segment)
+		db.mu.Lock()
+
+		if err != nil {
+			db.bgErr = err
+			db.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// stopBackgroundWork lets the flush worker write out what is left and waits
+// for it and the running compactions to finish
+func (db *DB) stopBackgroundWork() error {
+	db.mu.Lock()
+	db.stopFlush = true
+	db.cond.Broadcast()
+	db.mu.Unlock()
+
+	db.flushWg.Wait()
+	lsmErr := db.lsm.Close()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+
+	return lsmErr
+}
+
+// oldestUnflushedSegment must be called with db.mu held
+func (db *DB) oldestUnflushedSegment() uint64 {
+	oldest := db.wal.Segment()
+	segments := []uint64{db.memSegment, db.cacheSegment}
+	for _, imm := range db.imm {
+		segments = append(segments, imm.segment)
+	}
+
+	for _, segment := range segments {
+		if segment != 0 && segment < oldest {
+			oldest = segment
+		}
+	}
+
+	return oldest
+}
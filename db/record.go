@@ -0,0 +1,148 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// record_put_v1 and record_delete_v1 were logged before writes had
+	// sequence numbers, replay gives them the next free one
+	record_put_v1    byte = 1
+	record_delete_v1 byte = 2
+	record_put       byte = 3
+	record_delete    byte = 4
+	// record_batch holds the writes of a WriteBatch, they get consecutive
+	// sequence numbers starting at the one of the record
+	record_batch byte = 5
+)
+
+var (
+	errBadRecord = errors.New("malformed log record")
+)
+
+// encodeRecord lays a write out as its kind, the uvarint sequence number and
+// the uvarint length prefixed key and value
+func encodeRecord(kind byte, seq uint64, key, value string) []byte {
+	buf := make([]byte, 0, 1+3*binary.MaxVarintLen64+len(key)+len(value))
+	buf = append(buf, kind)
+	buf = binary.AppendUvarint(buf, seq)
+	buf = appendLengthPrefixed(buf, key)
+	buf = appendLengthPrefixed(buf, value)
+
+	return buf
+}
+
+// encodeBatch lays the batch out as record_batch, the uvarint sequence number
+// of its first write and the uvarint count of writes, each of them being
+// its kind and length prefixed key and value
+func encodeBatch(seq uint64, ops []batchOp) []byte {
+	size := 1 + 2*binary.MaxVarintLen64
+	for _, op := range ops {
+		size += 1 + 2*binary.MaxVarintLen64 + len(op.key) + len(op.value)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, record_batch)
+	buf = binary.AppendUvarint(buf, seq)
+	buf = binary.AppendUvarint(buf, uint64(len(ops)))
+	for _, op := range ops {
+		buf = append(buf, op.kind)
+		buf = appendLengthPrefixed(buf, op.key)
+		buf = appendLengthPrefixed(buf, op.value)
+	}
+
+	return buf
+}
+
+// decodeRecord returns the writes in a record and the sequence number of the
+// first one, which is 0 for records logged without one
+func decodeRecord(record []byte) (uint64, []batchOp, error) {
+	if len(record) == 0 {
+		return 0, nil, errBadRecord
+	}
+
+	kind := record[0]
+	rest := record[1:]
+	seq := uint64(0)
+	count := uint64(1)
+	legacy := kind == record_put_v1 || kind == record_delete_v1
+	ok := true
+	switch kind {
+	case record_put_v1:
+		kind = record_put
+	case record_delete_v1:
+		kind = record_delete
+	case record_put, record_delete:
+		seq, rest, ok = readUvarint(rest)
+	case record_batch:
+		seq, rest, ok = readUvarint(rest)
+		if ok {
+			count, rest, ok = readUvarint(rest)
+		}
+	default:
+		return 0, nil, errBadRecord
+	}
+
+	if !ok || (seq == 0 && !legacy) || count == 0 {
+		return 0, nil, errBadRecord
+	}
+
+	ops := []batchOp{}
+	for i := uint64(0); i < count; i += 1 {
+		op := batchOp{kind: kind}
+		if kind == record_batch {
+			if len(rest) == 0 {
+				return 0, nil, errBadRecord
+			}
+			op.kind = rest[0]
+			rest = rest[1:]
+			if op.kind != record_put && op.kind != record_delete {
+				return 0, nil, errBadRecord
+			}
+		}
+
+		var err error
+		op.key, rest, err = readLengthPrefixed(rest)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		op.value, rest, err = readLengthPrefixed(rest)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		ops = append(ops, op)
+	}
+
+	if len(rest) != 0 {
+		return 0, nil, errBadRecord
+	}
+
+	return seq, ops, nil
+}
+
+func appendLengthPrefixed(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readUvarint(buf []byte) (uint64, []byte, bool) {
+	val, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, nil, false
+	}
+
+	return val, buf[n:], true
+}
+
+func readLengthPrefixed(buf []byte) (string, []byte, error) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < length {
+		return "", nil, errBadRecord
+	}
+
+	end := n + int(length)
+	return string(buf[n:end]), buf[end:], nil
+}
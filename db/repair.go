@@ -0,0 +1,177 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	lsmtree "stinky-db/db/LSMTree"
+	sstable "stinky-db/db/SSTable"
+	vfs "stinky-db/db/VFS"
+	wal "stinky-db/db/WAL"
+)
+
+const lost_dir = "/lost"
+
+// RepairReport describes what Repair recovered and what it could not
+type RepairReport struct {
+	// TablesRead and SegmentsRead count the files every record was recovered from
+	TablesRead   int
+	SegmentsRead int
+	// DamagedTables and DamagedSegments name the files records were lost
+	// from, they were moved into the lost dir
+	DamagedTables   []string
+	DamagedSegments []string
+	// Lost describes what could not be read, keyed by file name
+	Lost map[string][]string
+	// TableRecords and WALRecords count the records recovered from each
+	TableRecords int
+	WALRecords   int
+	// TablesWritten names the tables the recovered records were written into
+	TablesWritten []string
+	LostDir       string
+}
+
+// Repair rebuilds a database that can not be opened anymore from whatever is
+// still readable in its tables and WAL segments. The records are written
+// into fresh tables under a new manifest and the WAL is emptied, the files
+// records were lost from are moved into the lost dir next to the data. The
+// database can not be open while it is repaired
+func Repair(dir string) (RepairReport, error) {
+	return RepairWithOptions(dir, Options{})
+}
+
+// RepairWithOptions repairs the database in opts.FS and writes the new tables
+// with the bloom filters and file size of the options
+func RepairWithOptions(dir string, opts Options) (RepairReport, error) {
+	opts = opts.withDefaults()
+	fs := opts.FS
+	report := RepairReport{Lost: map[string][]string{}, LostDir: dir + lost_dir}
+
+	lock, err := lockDir(fs, dir)
+	if err != nil {
+		return report, err
+	}
+	defer lock.Close()
+
+	salvage, err := lsmtree.SalvageTables(fs, dir+data_dir)
+	if err != nil {
+		return report, err
+	}
+
+	report.TablesRead = len(salvage.Intact)
+	report.DamagedTables = salvage.Damaged
+	report.TableRecords = salvage.Records
+	for name, lost := range salvage.Lost {
+		report.Lost[name] = lost
+	}
+	if salvage.ManifestErr != nil {
+		report.Lost["MANIFEST"] = []string{fmt.Sprintf("could not be read, every table was salvaged: %v", salvage.ManifestErr)}
+	}
+
+	segments, err := wal.ListSegments(fs, dir+wal_dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return report, err
+	}
+
+	newer := []sstable.Data{}
+	seq := salvage.LastSequence
+	for _, segment := range segments {
+		name := wal.SegmentName(segment)
+		records, lost, err := salvageSegment(fs, filepath.Join(dir+wal_dir, name))
+		if err != nil {
+			return report, err
+		}
+
+		if lost != "" {
+			report.DamagedSegments = append(report.DamagedSegments, name)
+			report.Lost[name] = []string{lost}
+		} else {
+			report.SegmentsRead += 1
+		}
+
+		for _, record := range records {
+			recordSeq, ops, _ := decodeRecord(record)
+			if recordSeq == 0 {
+				recordSeq = seq + 1
+			}
+			seq = max(seq, recordSeq+uint64(len(ops))-1)
+
+			for i, op := range ops {
+				newer = append(newer, sstable.Data{
+					Key:    op.key,
+					Value:  op.value,
+					Seq:    recordSeq + uint64(i),
+					Delete: op.kind == record_delete,
+				})
+			}
+			report.WALRecords += len(ops)
+		}
+	}
+
+	report.TablesWritten, err = salvage.Rebuild(dir+compaction_dir, report.LostDir, newer, lsmtree.Options{
+		BloomBitsPerKey: opts.BloomBitsPerKey,
+		TargetFileSize:  opts.TargetFileSize,
+		Compression:     opts.Compression,
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// everything the segments held is in the new tables now
+	for _, segment := range segments {
+		name := wal.SegmentName(segment)
+		path := filepath.Join(dir+wal_dir, name)
+		if _, damaged := report.Lost[name]; damaged {
+			_, err = lsmtree.MoveToLost(fs, path, report.LostDir)
+		} else {
+			err = fs.Remove(path)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// salvageSegment reads the records of a WAL segment up to the first one that
+// is corrupt or can not be decoded, lost describes where it stopped. A torn
+// record at the end is a write that was never acknowledged and is not lost
+func salvageSegment(fs vfs.FS, path string) ([][]byte, string, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReader(file)
+	reader := wal.NewReader(buffered)
+	records := [][]byte{}
+	for {
+		offset := reader.Offset()
+		record, err := reader.ReadRecord()
+		if err == io.EOF || errors.Is(err, wal.ErrTornRecord) {
+			return records, "", nil
+		}
+
+		if errors.Is(err, wal.ErrCorruptRecord) {
+			if _, peekErr := buffered.Peek(1); peekErr == io.EOF {
+				return records, "", nil
+			}
+			return records, fmt.Sprintf("%v at offset %d, the rest of the segment was skipped", err, offset), nil
+		}
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		_, _, err = decodeRecord(record)
+		if err != nil {
+			return records, fmt.Sprintf("%v at offset %d, the rest of the segment was skipped", err, offset), nil
+		}
+		records = append(records, record)
+	}
+}
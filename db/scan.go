@@ -0,0 +1,62 @@
+package db
+
+import (
+	iterator "stinky-db/db/Iterator"
+)
+
+// NewIterator iterates over every live key in the database
+func (db *DB) NewIterator() (iterator.Iterator, error) {
+	return db.Scan("", "")
+}
+
+// Scan returns an iterator over the live keys in [start, end), an empty end
+// scans up to the last key. The iterator sees the database as it was when
+// Scan was called and has to be closed once done with
+func (db *DB) Scan(start, end string) (iterator.Iterator, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	return db.scan(start, end, db.seq)
+}
+
+// scan only shows versions written at or before seq, it must be called with
+// db.mu held
+func (db *DB) scan(start, end string, seq uint64) (iterator.Iterator, error) {
+	cached := []iterator.Entry{}
+	for key, versions := range db.cache.Snapshot() {
+		for _, entry := range versions {
+			cached = append(cached, iterator.Entry{Key: key, Value: entry.Value, Seq: entry.Seq, Tombstone: entry.Tombstone})
+		}
+	}
+	iterator.SortEntries(cached)
+
+	// newest first, so the merging iterator resolves every key to its latest write
+	children := []iterator.InternalIterator{
+		iterator.NewSliceIterator(cached),
+		db.mem.NewIterator(),
+	}
+	for i := len(db.imm) - 1; i >= 0; i -= 1 {
+		children = append(children, db.imm[i].tree.NewIterator())
+	}
+
+	tables, err := db.lsm.NewIterators()
+	if err != nil {
+		return nil, err
+	}
+	children = append(children, tables...)
+
+	for i, child := range children {
+		children[i] = iterator.NewSnapshotIterator(child, seq)
+	}
+
+	return iterator.NewBoundedIterator(iterator.NewMergingIterator(children), start, end), nil
+}
+
+// PrefixScan returns an iterator over the live keys starting with prefix
+func (db *DB) PrefixScan(prefix string) (iterator.Iterator, error) {
+	return db.Scan(prefix, iterator.PrefixEnd(prefix))
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"errors"
+	iterator "stinky-db/db/Iterator"
+	"sync/atomic"
+)
+
+var (
+	ErrSnapshotReleased = errors.New("snapshot has been released")
+)
+
+// Snapshot reads the database as it was when the snapshot was taken while
+// writers carry on. Compaction keeps the versions a snapshot reads until it
+// is released, so snapshots should not be held on to for longer than needed
+type Snapshot struct {
+	db       *DB
+	seq      uint64
+	released atomic.Bool
+}
+
+// NewSnapshot pins the current state of the database for reading
+func (db *DB) NewSnapshot() (*Snapshot, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	return db.newSnapshot(), nil
+}
+
+// newSnapshot must be called with db.mu held. A write takes db.mu before it
+// picks its sequence number, so it either made it in before the snapshot or
+// keeps the versions the snapshot reads
+func (db *DB) newSnapshot() *Snapshot {
+	db.lsm.AcquireSnapshot(db.seq)
+	return &Snapshot{db: db, seq: db.seq}
+}
+
+// Seq is the sequence number of the last write the snapshot sees
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+func (s *Snapshot) Get(key string) (string, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	if s.db.closed {
+		return "", ErrClosed
+	}
+
+	if s.released.Load() {
+		return "", ErrSnapshotReleased
+	}
+
+	return s.db.get(key, s.seq)
+}
+
+// NewIterator iterates over every key live in the snapshot
+func (s *Snapshot) NewIterator() (iterator.Iterator, error) {
+	return s.Scan("", "")
+}
+
+// Scan returns an iterator over the keys live in the snapshot in [start, end)
+func (s *Snapshot) Scan(start, end string) (iterator.Iterator, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	if s.db.closed {
+		return nil, ErrClosed
+	}
+
+	if s.released.Load() {
+		return nil, ErrSnapshotReleased
+	}
+
+	return s.db.scan(start, end, s.seq)
+}
+
+func (s *Snapshot) PrefixScan(prefix string) (iterator.Iterator, error) {
+	return s.Scan(prefix, iterator.PrefixEnd(prefix))
+}
+
+// Release lets compaction drop the versions only the snapshot still reads,
+// iterators opened from it stay usable until they are closed
+func (s *Snapshot) Release() {
+	if s.released.Swap(true) {
+		return
+	}
+
+	s.db.lsm.ReleaseSnapshot(s.seq)
+}
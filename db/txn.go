@@ -0,0 +1,183 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+var (
+	ErrConflict = errors.New("transaction conflict")
+	ErrTxnDone  = errors.New("transaction has already been committed or rolled back")
+)
+
+// Txn reads from a snapshot taken by Begin and buffers its writes until
+// Commit. Commit fails with ErrConflict when a key the transaction read was
+// written by someone else after the snapshot, the caller can then retry the
+// whole transaction. A Txn must not be used from several goroutines at once
+type Txn struct {
+	db     *DB
+	snap   *Snapshot
+	batch  *WriteBatch
+	writes map[string]batchOp
+	reads  map[string]struct{}
+	done   bool
+}
+
+func (db *DB) Begin() (*Txn, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	snap := db.newSnapshot()
+	db.txns[snap.seq] += 1
+
+	return &Txn{
+		db:     db,
+		snap:   snap,
+		batch:  NewWriteBatch(),
+		writes: map[string]batchOp{},
+		reads:  map[string]struct{}{},
+	}, nil
+}
+
+// Get sees the writes of the transaction itself on top of its snapshot, the
+// keys read from the snapshot are checked for conflicts on Commit
+func (txn *Txn) Get(key string) (string, error) {
+	if txn.done {
+		return "", ErrTxnDone
+	}
+
+	if op, ok := txn.writes[key]; ok {
+		if op.kind == record_delete {
+			return "", ErrNotFound
+		}
+		return op.value, nil
+	}
+
+	txn.reads[key] = struct{}{}
+
+	return txn.snap.Get(key)
+}
+
+func (txn *Txn) Put(key, value string) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	txn.batch.Put(key, value)
+	txn.writes[key] = batchOp{kind: record_put, key: key, value: value}
+
+	return nil
+}
+
+func (txn *Txn) Delete(key string) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	txn.batch.Delete(key)
+	txn.writes[key] = batchOp{kind: record_delete, key: key}
+
+	return nil
+}
+
+// Commit writes the buffered writes atomically unless one of the keys read
+// has been written since the snapshot, the transaction is over either way
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.finish()
+
+	if txn.batch.Len() == 0 {
+		txn.db.mu.RLock()
+		defer txn.db.mu.RUnlock()
+
+		return txn.validate()
+	}
+
+	return txn.db.write(txn.batch.ops, txn.validate)
+}
+
+// Rollback drops the buffered writes
+func (txn *Txn) Rollback() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.finish()
+
+	return nil
+}
+
+// validate must be called with db.mu held, the keys are checked in order so
+// the same conflict is always reported for the same writes
+func (txn *Txn) validate() error {
+	if txn.db.closed {
+		return ErrClosed
+	}
+
+	keys := make([]string, 0, len(txn.reads))
+	for key := range txn.reads {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		if txn.db.written[key] > txn.snap.seq {
+			return fmt.Errorf("%w: %s was written after the transaction began", ErrConflict, key)
+		}
+	}
+
+	return nil
+}
+
+func (txn *Txn) finish() {
+	txn.done = true
+	txn.snap.Release()
+
+	txn.db.mu.Lock()
+	defer txn.db.mu.Unlock()
+
+	txn.db.txns[txn.snap.seq] -= 1
+	if txn.db.txns[txn.snap.seq] <= 0 {
+		delete(txn.db.txns, txn.snap.seq)
+	}
+	txn.db.pruneWrites()
+}
+
+// trackWrites remembers what the writes starting at seq touched while
+// transactions are open, it must be called with db.mu held
+func (db *DB) trackWrites(seq uint64, ops []batchOp) {
+	if len(db.txns) == 0 {
+		return
+	}
+
+	for i, op := range ops {
+		db.written[op.key] = seq + uint64(i)
+	}
+}
+
+// pruneWrites forgets the writes no open transaction can conflict with, it
+// must be called with db.mu held
+func (db *DB) pruneWrites() {
+	if len(db.txns) == 0 {
+		clear(db.written)
+		return
+	}
+
+	oldest := uint64(math.MaxUint64)
+	for seq := range db.txns {
+		oldest = min(oldest, seq)
+	}
+
+	for key, seq := range db.written {
+		if seq <= oldest {
+			delete(db.written, key)
+		}
+	}
+}
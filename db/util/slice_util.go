@@ -1,12 +1,15 @@
 package util
 
+// CompactFunc replaces runs of elements for which eq is true with the first
+// element of the run. eq gets the candidate first and the element that is
+// kept second, so it can merge the candidate into the kept one
 func CompactFunc[S ~[]E, E any](s S, eq func(*E, *E) bool) S {
 	if len(s) < 2 {
 		return s
 	}
 	i := 1
 	for k := 1; k < len(s); k++ {
-		if !eq(&s[k], &s[k-1]) {
+		if !eq(&s[k], &s[i-1]) {
 			if i != k {
 				s[i] = s[k]
 			}